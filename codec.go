@@ -0,0 +1,630 @@
+package sofia
+
+import (
+   "encoding/hex"
+   "errors"
+   "strconv"
+   "strings"
+)
+
+// childBoxes splits a payload into its child boxes, stopping at the first
+// malformed header.
+func childBoxes(payload []byte) [][]byte {
+   var children [][]byte
+   for len(payload) >= 8 {
+      var header BoxHeader
+      if header.Parse(payload) != nil || header.Size < 8 || header.Size > uint64(len(payload)) {
+         break
+      }
+      size := int(header.Size)
+      children = append(children, payload[:size])
+      payload = payload[size:]
+   }
+   return children
+}
+
+// findChild returns the first child box of the given type.
+func findChild(children [][]byte, boxType string) ([]byte, bool) {
+   for _, child := range children {
+      if len(child) >= 8 && string(child[4:8]) == boxType {
+         return child, true
+      }
+   }
+   return nil, false
+}
+
+// CodecString returns the RFC 6381 codec string for a sample entry format
+// and its child boxes, e.g. "avc1.64001f" or "mp4a.40.2". Formats that are
+// not understood are returned as the bare four-character code.
+func CodecString(format [4]byte, children [][]byte) string {
+   codec := string(format[:])
+   switch codec {
+   case "avc1", "avc2", "avc3", "avc4":
+      if data, ok := findChild(children, "avcC"); ok {
+         var avcC AvcCBox
+         if avcC.Parse(data) == nil {
+            return codec + "." + hex.EncodeToString([]byte{
+               avcC.Profile, avcC.ProfileCompatibility, avcC.Level,
+            })
+         }
+      }
+   case "av01":
+      if data, ok := findChild(children, "av1C"); ok {
+         var av1C Av1CBox
+         if av1C.Parse(data) == nil {
+            return av1C.CodecString()
+         }
+      }
+   case "mp4a":
+      if esds, ok := findChild(children, "esds"); ok && len(esds) > 12 {
+         if suffix, ok := esdsCodec(esds[12:]); ok {
+            return codec + "." + suffix
+         }
+      }
+   }
+   return codec
+}
+
+// readDescriptor reads an MPEG-4 descriptor tag and its variable-length
+// size, returning the descriptor body and the data following it.
+func readDescriptor(data []byte) (byte, []byte, []byte, bool) {
+   if len(data) < 2 {
+      return 0, nil, nil, false
+   }
+   tag := data[0]
+   size := 0
+   i := 1
+   for ; i < len(data) && i <= 4; i++ {
+      size = size<<7 | int(data[i]&0x7F)
+      if data[i]&0x80 == 0 {
+         i++
+         break
+      }
+   }
+   if i+size > len(data) {
+      return 0, nil, nil, false
+   }
+   return tag, data[i : i+size], data[i+size:], true
+}
+
+// esdsCodec returns the "OTI.AOT" suffix of an mp4a codec string from the
+// descriptors of an 'esds' box.
+func esdsCodec(data []byte) (string, bool) {
+   tag, body, _, ok := readDescriptor(data)
+   if !ok || tag != 0x03 || len(body) < 3 { // ES_Descriptor
+      return "", false
+   }
+   flags := body[2]
+   body = body[3:]
+   if flags&0x80 != 0 { // streamDependenceFlag
+      if len(body) < 2 {
+         return "", false
+      }
+      body = body[2:]
+   }
+   if flags&0x40 != 0 { // URL_Flag
+      if len(body) < 1 || len(body) < 1+int(body[0]) {
+         return "", false
+      }
+      body = body[1+int(body[0]):]
+   }
+   if flags&0x20 != 0 { // OCRstreamFlag
+      if len(body) < 2 {
+         return "", false
+      }
+      body = body[2:]
+   }
+   tag, config, _, ok := readDescriptor(body)
+   if !ok || tag != 0x04 || len(config) < 13 { // DecoderConfigDescriptor
+      return "", false
+   }
+   suffix := hex.EncodeToString(config[:1])
+   tag, info, _, ok := readDescriptor(config[13:])
+   if !ok || tag != 0x05 || len(info) < 1 { // DecoderSpecificInfo
+      return suffix, true
+   }
+   // AudioSpecificConfig starts with a 5-bit audioObjectType, escaped to
+   // six more bits when it is 31.
+   objectType := int(info[0] >> 3)
+   if objectType == 31 && len(info) >= 2 {
+      objectType = 32 + (int(info[0]&0x07)<<3 | int(info[1]>>5))
+   }
+   return suffix + "." + strconv.Itoa(objectType), true
+}
+
+// --- AVCC ---
+type AvcCBox struct {
+   Header               BoxHeader
+   ConfigurationVersion byte
+   Profile              byte
+   ProfileCompatibility byte
+   Level                byte
+   LengthSizeMinusOne   byte
+   SPS                  [][]byte
+   PPS                  [][]byte
+}
+
+func (b *AvcCBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 14 { // 8 header + 5 fixed fields + SPS count
+      return errors.New("avcC box too short")
+   }
+   p := parser{data: data, offset: 8}
+   b.ConfigurationVersion = p.Byte()
+   b.Profile = p.Byte()
+   b.ProfileCompatibility = p.Byte()
+   b.Level = p.Byte()
+   b.LengthSizeMinusOne = p.Byte() & 0x03
+
+   spsCount := int(p.Byte() & 0x1F)
+   b.SPS = make([][]byte, 0, spsCount)
+   for i := 0; i < spsCount; i++ {
+      if len(data) < p.offset+2 {
+         return errors.New("avcC truncated while reading SPS length")
+      }
+      length := int(p.Uint16())
+      if len(data) < p.offset+length {
+         return errors.New("avcC truncated while reading SPS")
+      }
+      b.SPS = append(b.SPS, p.Bytes(length))
+   }
+
+   if len(data) < p.offset+1 {
+      return errors.New("avcC truncated while reading PPS count")
+   }
+   ppsCount := int(p.Byte())
+   b.PPS = make([][]byte, 0, ppsCount)
+   for i := 0; i < ppsCount; i++ {
+      if len(data) < p.offset+2 {
+         return errors.New("avcC truncated while reading PPS length")
+      }
+      length := int(p.Uint16())
+      if len(data) < p.offset+length {
+         return errors.New("avcC truncated while reading PPS")
+      }
+      b.PPS = append(b.PPS, p.Bytes(length))
+   }
+   // Profile-specific extensions, if any, are ignored.
+   return nil
+}
+
+// NALLengthSize returns the size in bytes of the NAL unit length prefix
+// used in samples.
+func (b *AvcCBox) NALLengthSize() int {
+   return int(b.LengthSizeMinusOne) + 1
+}
+
+// ToAnnexB converts a sample from length-prefixed NAL units to Annex B
+// start codes, reading lengths of NALLengthSize bytes.
+func (b *AvcCBox) ToAnnexB(sample []byte) ([]byte, error) {
+   return toAnnexB(sample, b.NALLengthSize())
+}
+
+func toAnnexB(sample []byte, lengthSize int) ([]byte, error) {
+   out := make([]byte, 0, len(sample)+16)
+   p := parser{data: sample}
+   for p.offset < len(sample) {
+      if len(sample) < p.offset+lengthSize {
+         return nil, errors.New("sample truncated while reading NAL length")
+      }
+      length := int(p.UintN(lengthSize))
+      if len(sample)-p.offset < length {
+         return nil, errors.New("NAL unit extends past end of sample")
+      }
+      out = append(out, 0, 0, 0, 1)
+      out = append(out, p.Bytes(length)...)
+   }
+   return out, nil
+}
+
+// LooksDecrypted reports whether sample, made of NAL units prefixed with
+// lengths of nalLengthSize bytes, is plausibly clear AVC or HEVC data. Every
+// length must be non-zero and the units must end exactly at the end of the
+// sample, with the forbidden_zero_bit of each NAL header clear. Encrypted or
+// wrongly decrypted data almost never passes. It is meant as an opt-in
+// check on a keyframe after decryption, for example to detect a wrong key.
+func LooksDecrypted(sample []byte, nalLengthSize int) bool {
+   if nalLengthSize < 1 || nalLengthSize > 4 || len(sample) == 0 {
+      return false
+   }
+   p := parser{data: sample}
+   for p.offset < len(sample) {
+      if len(sample) < p.offset+nalLengthSize {
+         return false
+      }
+      length := int(p.UintN(nalLengthSize))
+      if length == 0 || len(sample)-p.offset < length {
+         return false
+      }
+      if sample[p.offset]&0x80 != 0 { // forbidden_zero_bit
+         return false
+      }
+      p.offset += length
+   }
+   return true
+}
+
+// --- HVCC ---
+type HvcCArray struct {
+   Completeness bool
+   NALUnitType  byte
+   NALUnits     [][]byte
+}
+
+type HvcCBox struct {
+   Header                           BoxHeader
+   ConfigurationVersion             byte
+   GeneralProfileSpace              byte
+   GeneralTierFlag                  bool
+   GeneralProfileIDC                byte
+   GeneralProfileCompatibilityFlags uint32
+   GeneralConstraintIndicatorFlags  uint64 // 48 bits
+   GeneralLevelIDC                  byte
+   MinSpatialSegmentationIDC        uint16
+   ParallelismType                  byte
+   ChromaFormatIDC                  byte
+   BitDepthLumaMinus8               byte
+   BitDepthChromaMinus8             byte
+   AvgFrameRate                     uint16
+   ConstantFrameRate                byte
+   NumTemporalLayers                byte
+   TemporalIDNested                 bool
+   LengthSizeMinusOne               byte
+   Arrays                           []HvcCArray
+}
+
+func (b *HvcCBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 31 { // 8 header + 22 fixed fields + numOfArrays
+      return errors.New("hvcC box too short")
+   }
+   p := parser{data: data, offset: 8}
+   b.ConfigurationVersion = p.Byte()
+   profile := p.Byte()
+   b.GeneralProfileSpace = profile >> 6
+   b.GeneralTierFlag = profile&0x20 != 0
+   b.GeneralProfileIDC = profile & 0x1F
+   b.GeneralProfileCompatibilityFlags = p.Uint32()
+   b.GeneralConstraintIndicatorFlags = uint64(p.Uint16())<<32 | uint64(p.Uint32())
+   b.GeneralLevelIDC = p.Byte()
+   b.MinSpatialSegmentationIDC = p.Uint16() & 0x0FFF
+   b.ParallelismType = p.Byte() & 0x03
+   b.ChromaFormatIDC = p.Byte() & 0x03
+   b.BitDepthLumaMinus8 = p.Byte() & 0x07
+   b.BitDepthChromaMinus8 = p.Byte() & 0x07
+   b.AvgFrameRate = p.Uint16()
+   flags := p.Byte()
+   b.ConstantFrameRate = flags >> 6
+   b.NumTemporalLayers = flags >> 3 & 0x07
+   b.TemporalIDNested = flags&0x04 != 0
+   b.LengthSizeMinusOne = flags & 0x03
+
+   numOfArrays := int(p.Byte())
+   b.Arrays = make([]HvcCArray, 0, numOfArrays)
+   for i := 0; i < numOfArrays; i++ {
+      if len(data) < p.offset+3 {
+         return errors.New("hvcC truncated while reading NAL unit array")
+      }
+      var array HvcCArray
+      typeByte := p.Byte()
+      array.Completeness = typeByte&0x80 != 0
+      array.NALUnitType = typeByte & 0x3F
+      numNalus := int(p.Uint16())
+      for j := 0; j < numNalus; j++ {
+         if len(data) < p.offset+2 {
+            return errors.New("hvcC truncated while reading NAL unit length")
+         }
+         length := int(p.Uint16())
+         if len(data) < p.offset+length {
+            return errors.New("hvcC truncated while reading NAL unit")
+         }
+         array.NALUnits = append(array.NALUnits, p.Bytes(length))
+      }
+      b.Arrays = append(b.Arrays, array)
+   }
+   return nil
+}
+
+// NALLengthSize returns the size in bytes of the NAL unit length prefix
+// used in samples.
+func (b *HvcCBox) NALLengthSize() int {
+   return int(b.LengthSizeMinusOne) + 1
+}
+
+// --- BIT READER ---
+
+type bitReader struct {
+   data []byte
+   bit  int
+}
+
+// Bits reads n bits (at most 32) most significant first. Reads past the
+// end yield zero bits and mark the reader as overrun.
+func (r *bitReader) Bits(n int) uint32 {
+   var val uint32
+   for i := 0; i < n; i++ {
+      val <<= 1
+      if r.bit/8 < len(r.data) {
+         val |= uint32(r.data[r.bit/8]>>(7-r.bit%8)) & 1
+      }
+      r.bit++
+   }
+   return val
+}
+
+func (r *bitReader) Flag() bool {
+   return r.Bits(1) == 1
+}
+
+// Overrun reports whether a read went past the end of the data.
+func (r *bitReader) Overrun() bool {
+   return r.bit > len(r.data)*8
+}
+
+// uvlc reads an AV1 variable length unsigned integer.
+func (r *bitReader) uvlc() uint32 {
+   leadingZeros := 0
+   for !r.Flag() {
+      leadingZeros++
+      if leadingZeros >= 32 || r.Overrun() {
+         return 0
+      }
+   }
+   return r.Bits(leadingZeros) + (1 << leadingZeros) - 1
+}
+
+// --- AV1C ---
+
+// Av1ColorConfig holds the color_config fields of an AV1 sequence header.
+type Av1ColorConfig struct {
+   ColorPrimaries          byte
+   TransferCharacteristics byte
+   MatrixCoefficients      byte
+   FullRange               bool
+}
+
+type Av1CBox struct {
+   Header               BoxHeader
+   SeqProfile           byte
+   SeqLevelIdx0         byte
+   SeqTier0             byte
+   HighBitdepth         bool
+   TwelveBit            bool
+   Monochrome           bool
+   ChromaSubsamplingX   byte
+   ChromaSubsamplingY   byte
+   ChromaSamplePosition byte
+   ConfigOBUs           []byte
+   ColorConfig          *Av1ColorConfig // Present if ConfigOBUs has a sequence header
+}
+
+func (b *Av1CBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 12 {
+      return errors.New("av1C box too short")
+   }
+   p := parser{data: data, offset: 8}
+   if p.Byte()&0x80 == 0 {
+      return errors.New("av1C marker bit not set")
+   }
+   val := p.Byte()
+   b.SeqProfile = val >> 5
+   b.SeqLevelIdx0 = val & 0x1F
+   val = p.Byte()
+   b.SeqTier0 = val >> 7
+   b.HighBitdepth = val&0x40 != 0
+   b.TwelveBit = val&0x20 != 0
+   b.Monochrome = val&0x10 != 0
+   b.ChromaSubsamplingX = val >> 3 & 1
+   b.ChromaSubsamplingY = val >> 2 & 1
+   b.ChromaSamplePosition = val & 0x03
+   _ = p.Byte() // initial_presentation_delay
+   b.ConfigOBUs = data[p.offset:b.Header.Size]
+   b.ColorConfig = findAv1ColorConfig(b.ConfigOBUs)
+   return nil
+}
+
+// BitDepth returns the sample bit depth, 8, 10 or 12.
+func (b *Av1CBox) BitDepth() int {
+   switch {
+   case b.HighBitdepth && b.TwelveBit:
+      return 12
+   case b.HighBitdepth:
+      return 10
+   }
+   return 8
+}
+
+// CodecString returns the av01 codec string. The optional color fields are
+// included only when a sequence header OBU is present.
+func (b *Av1CBox) CodecString() string {
+   twoDigits := func(n int) string {
+      if n < 10 {
+         return "0" + strconv.Itoa(n)
+      }
+      return strconv.Itoa(n)
+   }
+   var sb strings.Builder
+   sb.WriteString("av01.")
+   sb.WriteString(strconv.Itoa(int(b.SeqProfile)))
+   sb.WriteByte('.')
+   sb.WriteString(twoDigits(int(b.SeqLevelIdx0)))
+   if b.SeqTier0 == 1 {
+      sb.WriteByte('H')
+   } else {
+      sb.WriteByte('M')
+   }
+   sb.WriteByte('.')
+   sb.WriteString(twoDigits(b.BitDepth()))
+   if color := b.ColorConfig; color != nil {
+      monochrome := 0
+      if b.Monochrome {
+         monochrome = 1
+      }
+      fullRange := 0
+      if color.FullRange {
+         fullRange = 1
+      }
+      sb.WriteByte('.')
+      sb.WriteString(strconv.Itoa(monochrome))
+      sb.WriteByte('.')
+      sb.WriteString(strconv.Itoa(int(b.ChromaSubsamplingX)))
+      sb.WriteString(strconv.Itoa(int(b.ChromaSubsamplingY)))
+      sb.WriteString(strconv.Itoa(int(b.ChromaSamplePosition)))
+      for _, n := range []byte{
+         color.ColorPrimaries, color.TransferCharacteristics, color.MatrixCoefficients,
+      } {
+         sb.WriteByte('.')
+         sb.WriteString(twoDigits(int(n)))
+      }
+      sb.WriteByte('.')
+      sb.WriteString(strconv.Itoa(fullRange))
+   }
+   return sb.String()
+}
+
+// findAv1ColorConfig walks the OBUs and decodes the color_config of the
+// first sequence header, returning nil if there is none or it is truncated.
+func findAv1ColorConfig(obus []byte) *Av1ColorConfig {
+   for len(obus) > 0 {
+      header := obus[0]
+      obuType := header >> 3 & 0x0F
+      offset := 1
+      if header&0x04 != 0 { // obu_extension_flag
+         offset++
+      }
+      size := len(obus) - offset
+      if header&0x02 != 0 { // obu_has_size_field
+         value, n := leb128(obus[offset:])
+         if n == 0 {
+            return nil
+         }
+         offset += n
+         size = int(value)
+      }
+      if size < 0 || offset+size > len(obus) {
+         return nil
+      }
+      if obuType == 1 { // OBU_SEQUENCE_HEADER
+         return parseAv1SequenceHeader(obus[offset : offset+size])
+      }
+      obus = obus[offset+size:]
+   }
+   return nil
+}
+
+// leb128 decodes an unsigned LEB128 value, returning it and the number of
+// bytes read, or 0 bytes if it is truncated.
+func leb128(data []byte) (uint64, int) {
+   var value uint64
+   for i := 0; i < 8 && i < len(data); i++ {
+      value |= uint64(data[i]&0x7F) << (7 * i)
+      if data[i]&0x80 == 0 {
+         return value, i + 1
+      }
+   }
+   return 0, 0
+}
+
+// parseAv1SequenceHeader skips to color_config in a sequence_header_obu
+// (AV1 specification 5.5) and decodes it.
+func parseAv1SequenceHeader(data []byte) *Av1ColorConfig {
+   r := bitReader{data: data}
+   seqProfile := r.Bits(3)
+   _ = r.Bits(1) // still_picture
+   reducedStillPictureHeader := r.Flag()
+   if reducedStillPictureHeader {
+      _ = r.Bits(5) // seq_level_idx[0]
+   } else {
+      decoderModelInfoPresent := false
+      bufferDelayLength := 0
+      if r.Flag() { // timing_info_present_flag
+         _ = r.Bits(32) // num_units_in_display_tick
+         _ = r.Bits(32) // time_scale
+         if r.Flag() {  // equal_picture_interval
+            _ = r.uvlc() // num_ticks_per_picture_minus_1
+         }
+         decoderModelInfoPresent = r.Flag()
+         if decoderModelInfoPresent {
+            bufferDelayLength = int(r.Bits(5)) + 1
+            _ = r.Bits(32) // num_units_in_decoding_tick
+            _ = r.Bits(5)  // buffer_removal_time_length_minus_1
+            _ = r.Bits(5)  // frame_presentation_time_length_minus_1
+         }
+      }
+      initialDisplayDelayPresent := r.Flag()
+      operatingPoints := int(r.Bits(5)) + 1
+      for i := 0; i < operatingPoints; i++ {
+         _ = r.Bits(12) // operating_point_idc
+         if r.Bits(5) > 7 {
+            _ = r.Bits(1) // seq_tier
+         }
+         if decoderModelInfoPresent && r.Flag() {
+            _ = r.Bits(bufferDelayLength) // decoder_buffer_delay
+            _ = r.Bits(bufferDelayLength) // encoder_buffer_delay
+            _ = r.Bits(1)                 // low_delay_mode_flag
+         }
+         if initialDisplayDelayPresent && r.Flag() {
+            _ = r.Bits(4) // initial_display_delay_minus_1
+         }
+      }
+   }
+   frameWidthBits := int(r.Bits(4)) + 1
+   frameHeightBits := int(r.Bits(4)) + 1
+   _ = r.Bits(frameWidthBits)  // max_frame_width_minus_1
+   _ = r.Bits(frameHeightBits) // max_frame_height_minus_1
+   if !reducedStillPictureHeader && r.Flag() { // frame_id_numbers_present_flag
+      _ = r.Bits(4) // delta_frame_id_length_minus_2
+      _ = r.Bits(3) // additional_frame_id_length_minus_1
+   }
+   _ = r.Bits(3) // use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+   if !reducedStillPictureHeader {
+      _ = r.Bits(4) // interintra, masked compound, warped motion, dual filter
+      enableOrderHint := r.Flag()
+      if enableOrderHint {
+         _ = r.Bits(2) // enable_jnt_comp, enable_ref_frame_mvs
+      }
+      forceScreenContentTools := uint32(2)
+      if !r.Flag() { // seq_choose_screen_content_tools
+         forceScreenContentTools = r.Bits(1)
+      }
+      if forceScreenContentTools > 0 && !r.Flag() { // seq_choose_integer_mv
+         _ = r.Bits(1) // seq_force_integer_mv
+      }
+      if enableOrderHint {
+         _ = r.Bits(3) // order_hint_bits_minus_1
+      }
+   }
+   _ = r.Bits(3) // enable_superres, enable_cdef, enable_restoration
+
+   // color_config
+   highBitdepth := r.Flag()
+   if seqProfile == 2 && highBitdepth {
+      _ = r.Bits(1) // twelve_bit
+   }
+   monochrome := false
+   if seqProfile != 1 {
+      monochrome = r.Flag()
+   }
+   color := Av1ColorConfig{ColorPrimaries: 2, TransferCharacteristics: 2, MatrixCoefficients: 2}
+   if r.Flag() { // color_description_present_flag
+      color.ColorPrimaries = byte(r.Bits(8))
+      color.TransferCharacteristics = byte(r.Bits(8))
+      color.MatrixCoefficients = byte(r.Bits(8))
+   }
+   if !monochrome && color.ColorPrimaries == 1 && color.TransferCharacteristics == 13 && color.MatrixCoefficients == 0 {
+      color.FullRange = true // sRGB
+   } else {
+      color.FullRange = r.Flag()
+   }
+   if r.Overrun() {
+      return nil
+   }
+   return &color
+}
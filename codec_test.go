@@ -0,0 +1,218 @@
+package sofia
+
+import (
+   "bytes"
+   "testing"
+)
+
+func TestAvcCBox_ToAnnexB(t *testing.T) {
+   sps := []byte{0x67, 0x64, 0x00, 0x1f}
+   pps := []byte{0x68, 0xeb}
+   // lengthSizeMinusOne = 1, so samples use 2-byte NAL lengths
+   data := buildBox("avcC", []byte{1, 0x64, 0x00, 0x1f, 0xFD, 0xE1, 0, 4}, sps, []byte{1, 0, 2}, pps)
+   var avcC AvcCBox
+   if err := avcC.Parse(data); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if avcC.NALLengthSize() != 2 {
+      t.Fatalf("expected NAL length size 2, got %d", avcC.NALLengthSize())
+   }
+   if len(avcC.SPS) != 1 || !bytes.Equal(avcC.SPS[0], sps) {
+      t.Errorf("SPS mismatch: %x", avcC.SPS)
+   }
+   if len(avcC.PPS) != 1 || !bytes.Equal(avcC.PPS[0], pps) {
+      t.Errorf("PPS mismatch: %x", avcC.PPS)
+   }
+
+   sample := []byte{0, 3, 0x65, 0xAA, 0xBB, 0, 1, 0x06}
+   annexB, err := avcC.ToAnnexB(sample)
+   if err != nil {
+      t.Fatalf("ToAnnexB failed: %v", err)
+   }
+   expected := []byte{0, 0, 0, 1, 0x65, 0xAA, 0xBB, 0, 0, 0, 1, 0x06}
+   if !bytes.Equal(annexB, expected) {
+      t.Errorf("Annex B mismatch\n  Expected: %x\n  Got:      %x", expected, annexB)
+   }
+
+   if _, err := avcC.ToAnnexB([]byte{0, 9, 0x65}); err == nil {
+      t.Error("expected error for NAL unit past end of sample")
+   }
+}
+
+func TestAvcCBox_SampleEntry(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   moov, _ := FindMoov(boxes)
+   entries := moov.Trak[0].Mdia.Minf.Stbl.Stsd.Entries
+   if len(entries) != 1 || entries[0].Visual == nil || entries[0].Visual.AvcC == nil {
+      t.Fatal("expected an avc1 entry with avcC")
+   }
+   avcC := entries[0].Visual.AvcC
+   if avcC.Profile != 0x64 || avcC.Level != 0x1f || avcC.NALLengthSize() != 4 {
+      t.Errorf("unexpected avcC fields %+v", avcC)
+   }
+   if len(avcC.SPS) != 1 || !bytes.Equal(avcC.SPS[0], []byte{0x67, 0x64, 0x00, 0x1f}) {
+      t.Errorf("SPS mismatch: %x", avcC.SPS)
+   }
+
+   // one SPS declared as 9 bytes, with only 4 present
+   truncated := buildBox("avcC", []byte{1, 0x64, 0x00, 0x1f, 0xFF, 0xE1, 0, 9, 0x67, 0x64, 0x00, 0x1f})
+   if err := new(AvcCBox).Parse(truncated); err == nil {
+      t.Error("expected error for truncated SPS")
+   }
+}
+
+func TestHvcCBox_Parse(t *testing.T) {
+   vps, sps, pps := []byte{0x40, 0x01, 0x0C}, []byte{0x42, 0x01, 0x01, 0x01}, []byte{0x44, 0x01}
+   hvcC := buildBox("hvcC",
+      // version, tier 1 and Main 10, compatibility, constraints, level 120
+      []byte{1, 0x22, 0x20, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 120},
+      // min_spatial_segmentation 0, parallelismType 2, 4:2:0, 10 bits, no
+      // average frame rate, then one temporal layer, nested and 4-byte lengths
+      []byte{0xF0, 0x00, 0xFE, 0xFD, 0xFA, 0xFA, 0, 0, 0x0F},
+      []byte{3},
+      []byte{0xA0, 0, 1, 0, 3}, vps,
+      []byte{0xA1, 0, 1, 0, 4}, sps,
+      []byte{0x22, 0, 1, 0, 2}, pps,
+   )
+   entry := make([]byte, 78)
+   stsd := buildBox("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, buildBox("hvc1", entry, hvcC))
+   var box StsdBox
+   if err := box.Parse(stsd); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if len(box.Entries) != 1 || box.Entries[0].Visual == nil || box.Entries[0].Visual.HvcC == nil {
+      t.Fatal("expected an hvc1 entry with hvcC")
+   }
+   b := box.Entries[0].Visual.HvcC
+   if b.GeneralProfileIDC != 2 || !b.GeneralTierFlag || b.GeneralLevelIDC != 120 ||
+      b.GeneralProfileCompatibilityFlags != 0x20000000 || b.GeneralConstraintIndicatorFlags != 0x900000000000 {
+      t.Errorf("unexpected general fields %+v", b)
+   }
+   if b.ParallelismType != 2 || b.ChromaFormatIDC != 1 || b.BitDepthLumaMinus8 != 2 || b.BitDepthChromaMinus8 != 2 {
+      t.Errorf("unexpected format fields %+v", b)
+   }
+   if b.NumTemporalLayers != 1 || !b.TemporalIDNested || b.NALLengthSize() != 4 {
+      t.Errorf("unexpected temporal fields %+v", b)
+   }
+   if len(b.Arrays) != 3 {
+      t.Fatalf("expected 3 NAL unit arrays, got %d", len(b.Arrays))
+   }
+   for i, expected := range []struct {
+      unitType byte
+      complete bool
+      unit     []byte
+   }{{32, true, vps}, {33, true, sps}, {34, false, pps}} {
+      array := b.Arrays[i]
+      if array.NALUnitType != expected.unitType || array.Completeness != expected.complete ||
+         len(array.NALUnits) != 1 || !bytes.Equal(array.NALUnits[0], expected.unit) {
+         t.Errorf("array %d: unexpected %+v", i, array)
+      }
+   }
+
+   // numOfArrays claims 5 arrays with only 3 present
+   truncated := bytes.Clone(hvcC)
+   truncated[30] = 5
+   if err := new(HvcCBox).Parse(truncated); err == nil {
+      t.Error("expected error for truncated NAL unit arrays")
+   }
+}
+
+// bitWriter packs fields most significant bit first.
+type bitWriter struct {
+   data []byte
+   bit  int
+}
+
+func (w *bitWriter) put(n int, val uint32) {
+   for i := n - 1; i >= 0; i-- {
+      if w.bit%8 == 0 {
+         w.data = append(w.data, 0)
+      }
+      w.data[len(w.data)-1] |= byte(val>>i&1) << (7 - w.bit%8)
+      w.bit++
+   }
+}
+
+func TestAv1CBox_CodecString(t *testing.T) {
+   // A 10-bit 4:2:0 1920x1080 sequence header with BT.2020 PQ colour.
+   var w bitWriter
+   w.put(3, 0)     // seq_profile
+   w.put(1, 0)     // still_picture
+   w.put(1, 0)     // reduced_still_picture_header
+   w.put(1, 0)     // timing_info_present_flag
+   w.put(1, 0)     // initial_display_delay_present_flag
+   w.put(5, 0)     // operating_points_cnt_minus_1
+   w.put(12, 0)    // operating_point_idc[0]
+   w.put(5, 8)     // seq_level_idx[0]
+   w.put(1, 0)     // seq_tier[0]
+   w.put(4, 10)    // frame_width_bits_minus_1
+   w.put(4, 10)    // frame_height_bits_minus_1
+   w.put(11, 1919) // max_frame_width_minus_1
+   w.put(11, 1079) // max_frame_height_minus_1
+   w.put(1, 0)     // frame_id_numbers_present_flag
+   w.put(3, 7)     // use_128x128_superblock .. enable_intra_edge_filter
+   w.put(4, 0)     // interintra .. dual filter
+   w.put(1, 1)     // enable_order_hint
+   w.put(2, 0)     // enable_jnt_comp, enable_ref_frame_mvs
+   w.put(1, 1)     // seq_choose_screen_content_tools
+   w.put(1, 1)     // seq_choose_integer_mv
+   w.put(3, 6)     // order_hint_bits_minus_1
+   w.put(3, 3)     // enable_superres, enable_cdef, enable_restoration
+   w.put(1, 1)     // high_bitdepth
+   w.put(1, 0)     // mono_chrome
+   w.put(1, 1)     // color_description_present_flag
+   w.put(8, 9)     // color_primaries
+   w.put(8, 16)    // transfer_characteristics
+   w.put(8, 9)     // matrix_coefficients
+   w.put(1, 0)     // color_range
+   obu := append([]byte{0x0A, byte(len(w.data))}, w.data...)
+
+   // marker/version, profile/level, tier/bitdepth/chroma, delay
+   data := buildBox("av1C", []byte{0x81, 0x08, 0x4C, 0}, obu)
+   var av1C Av1CBox
+   if err := av1C.Parse(data); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if av1C.ColorConfig == nil {
+      t.Fatal("sequence header color config not found")
+   }
+   expected := "av01.0.08M.10.0.110.09.16.09.0"
+   if codec := CodecString([4]byte{'a', 'v', '0', '1'}, [][]byte{data}); codec != expected {
+      t.Errorf("expected %q, got %q", expected, codec)
+   }
+
+   // Without configOBUs only the mandatory fields are available.
+   data = buildBox("av1C", []byte{0x81, 0x08, 0x4C, 0})
+   if err := av1C.Parse(data); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if codec := av1C.CodecString(); codec != "av01.0.08M.10" {
+      t.Errorf("expected %q, got %q", "av01.0.08M.10", codec)
+   }
+}
+
+func TestLooksDecrypted(t *testing.T) {
+   // IDR slice NAL unit followed by a short SEI
+   clear := []byte{0, 0, 0, 5, 0x65, 0x88, 0x84, 0x00, 0x21, 0, 0, 0, 2, 0x06, 0x05}
+   if !LooksDecrypted(clear, 4) {
+      t.Error("expected clear sample to look decrypted")
+   }
+   garbage := []byte{0x9f, 0x3c, 0x71, 0x02, 0xe5, 0x88, 0x84, 0x00, 0x21, 0xd4, 0x17, 0x6b}
+   if LooksDecrypted(garbage, 4) {
+      t.Error("expected random bytes not to look decrypted")
+   }
+   forbidden := []byte{0, 0, 0, 2, 0xE5, 0x88}
+   if LooksDecrypted(forbidden, 4) {
+      t.Error("expected forbidden_zero_bit to be rejected")
+   }
+   short := []byte{0, 0, 0, 9, 0x65, 0x88}
+   if LooksDecrypted(short, 4) {
+      t.Error("expected NAL length past the sample end to be rejected")
+   }
+   if LooksDecrypted(clear, 0) || LooksDecrypted(nil, 4) {
+      t.Error("expected invalid input to be rejected")
+   }
+}
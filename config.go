@@ -1,7 +1,9 @@
 package sofia
 
 import (
+   "encoding/binary"
    "errors"
+   "io"
    "strings"
 )
 
@@ -18,18 +20,40 @@ type StsdBox struct {
    HeaderFields [8]byte // Ver(1)+Flags(3)+EntryCount(4)
    EncChildren  []*EncBox
    RawChildren  [][]byte
+   // Entries are the parsed sample entries in file order. Encode writes
+   // EncChildren and RawChildren, so changes to Entries are not encoded.
+   Entries    []SampleEntry
+   entryTypes [][4]byte
 }
 
+// EntryCount returns the entry_count field of the box.
+func (b *StsdBox) EntryCount() uint32 {
+   return binary.BigEndian.Uint32(b.HeaderFields[4:8])
+}
+
+// EntryTypes returns the four-character code of every sample entry in file
+// order, for example ["encv" "avc1"] for a track that switches from
+// encrypted to clear content.
+func (b *StsdBox) EntryTypes() [][4]byte {
+   return b.entryTypes
+}
+
+// Sinf returns the protection scheme information of the first protected
+// sample entry, with the header of that entry.
 func (b *StsdBox) Sinf() (*SinfBox, *BoxHeader, bool) {
-   for _, enc := range b.EncChildren {
-      if enc.Sinf != nil {
-         return enc.Sinf, &enc.Header, true
+   for _, entry := range b.Entries {
+      if sinf, header := entry.Sinf(); sinf != nil {
+         return sinf, header, true
       }
    }
    return nil, nil, false
 }
 
 func (b *StsdBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *StsdBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
@@ -38,11 +62,11 @@ func (b *StsdBox) Parse(data []byte) error {
    }
    copy(b.HeaderFields[:], data[8:16])
 
-   payload := data[16:b.Header.Size]
+   payload := data[b.Header.HeaderSize+8:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -54,16 +78,24 @@ func (b *StsdBox) Parse(data []byte) error {
       }
 
       content := payload[offset : offset+boxSize]
+      b.entryTypes = append(b.entryTypes, header.Type)
+      var entry SampleEntry
+      if err := entry.parse(content, opts); err != nil {
+         return err
+      }
       switch string(header.Type[:]) {
       case "encv", "enca":
          var enc EncBox
-         if err := enc.Parse(content); err != nil {
+         if err := enc.parse(content, opts); err != nil {
             return err
          }
+         // Share the sinf, so UnprotectAll affects both views.
+         entry.setSinf(enc.Sinf)
          b.EncChildren = append(b.EncChildren, &enc)
       default:
          b.RawChildren = append(b.RawChildren, content)
       }
+      b.Entries = append(b.Entries, entry)
       offset += boxSize
    }
    return nil
@@ -78,20 +110,272 @@ func (b *StsdBox) Encode() []byte {
    for _, child := range b.RawChildren {
       buffer = append(buffer, child...)
    }
-   b.Header.Size = uint32(len(buffer))
+   b.Header.Size = uint64(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *StsdBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 func (b *StsdBox) UnprotectAll() error {
    for _, child := range b.EncChildren {
       if err := child.Unprotect(); err != nil {
          return err
       }
    }
+   for i := range b.Entries {
+      b.Entries[i].unprotect()
+   }
+   return nil
+}
+
+// --- SAMPLE ENTRIES ---
+
+// visualSampleEntries and audioSampleEntries are the sample entry types
+// parsed as VisualSampleEntry and AudioSampleEntry.
+var (
+   visualSampleEntries = map[string]bool{
+      "avc1": true, "avc3": true, "hvc1": true, "hev1": true, "dvh1": true,
+      "dvhe": true, "av01": true, "vp08": true, "vp09": true, "mp4v": true,
+      "encv": true,
+   }
+   audioSampleEntries = map[string]bool{
+      "mp4a": true, "ac-3": true, "ec-3": true, "ac-4": true, "Opus": true,
+      "fLaC": true, "alac": true, "enca": true,
+   }
+)
+
+// SampleEntry is one entry of stsd. Visual or Audio is set for the video
+// and audio entry types the package knows, and neither for others such as
+// wvtt, which are left in StsdBox.RawChildren.
+type SampleEntry struct {
+   Type   [4]byte
+   Visual *VisualSampleEntry
+   Audio  *AudioSampleEntry
+}
+
+func (e *SampleEntry) Parse(data []byte) error {
+   return e.parse(data, nil)
+}
+
+func (e *SampleEntry) parse(data []byte, opts *ParseOptions) error {
+   var header BoxHeader
+   if err := header.Parse(data); err != nil {
+      return err
+   }
+   e.Type = header.Type
+   switch {
+   case visualSampleEntries[string(header.Type[:])]:
+      // Entries too short for their fields are kept raw, as EncBox does.
+      if len(data) >= header.HeaderSize+78 {
+         e.Visual = &VisualSampleEntry{}
+         return e.Visual.parse(data, opts)
+      }
+   case audioSampleEntries[string(header.Type[:])]:
+      if len(data) >= header.HeaderSize+28 {
+         e.Audio = &AudioSampleEntry{}
+         return e.Audio.parse(data, opts)
+      }
+   }
+   return nil
+}
+
+// Sinf returns the protection scheme information of an encv or enca entry
+// and the entry header, or nil if the entry is not protected.
+func (e *SampleEntry) Sinf() (*SinfBox, *BoxHeader) {
+   switch {
+   case e.Visual != nil && e.Visual.Sinf != nil:
+      return e.Visual.Sinf, &e.Visual.Header
+   case e.Audio != nil && e.Audio.Sinf != nil:
+      return e.Audio.Sinf, &e.Audio.Header
+   }
+   return nil, nil
+}
+
+// Format returns the format of the entry, taken from frma for protected
+// entries.
+func (e *SampleEntry) Format() [4]byte {
+   if sinf, _ := e.Sinf(); sinf != nil && sinf.Frma != nil {
+      return sinf.Frma.DataFormat
+   }
+   return e.Type
+}
+
+func (e *SampleEntry) setSinf(sinf *SinfBox) {
+   switch {
+   case e.Visual != nil:
+      e.Visual.Sinf = sinf
+   case e.Audio != nil:
+      e.Audio.Sinf = sinf
+   }
+}
+
+// unprotect mirrors EncBox.Unprotect.
+func (e *SampleEntry) unprotect() {
+   sinf, header := e.Sinf()
+   if sinf == nil || sinf.Frma == nil {
+      return
+   }
+   header.Type = sinf.Frma.DataFormat
+   e.Type = sinf.Frma.DataFormat
+   e.setSinf(nil)
+}
+
+// VisualSampleEntry is a video sample entry such as avc1, hvc1 or encv.
+type VisualSampleEntry struct {
+   Header             BoxHeader
+   DataReferenceIndex uint16
+   Width              uint16
+   Height             uint16
+   HorizResolution    uint32 // 16.16 pixels per inch
+   VertResolution     uint32 // 16.16 pixels per inch
+   FrameCount         uint16
+   CompressorName     string
+   Depth              uint16
+   AvcC               *AvcCBox // avc1, avc3 and encv of H.264
+   HvcC               *HvcCBox // hvc1, hev1 and encv of HEVC
+   Sinf               *SinfBox
+   RawChildren        [][]byte
+}
+
+func (b *VisualSampleEntry) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *VisualSampleEntry) parse(data []byte, opts *ParseOptions) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if uint64(len(data)) < uint64(b.Header.HeaderSize)+78 || b.Header.Size > uint64(len(data)) {
+      return errors.New("visual sample entry too short")
+   }
+   p := parser{data: data, offset: b.Header.HeaderSize + 6}
+   b.DataReferenceIndex = p.Uint16()
+   p.offset += 16 // pre_defined, reserved and pre_defined
+   b.Width = p.Uint16()
+   b.Height = p.Uint16()
+   b.HorizResolution = p.Uint32()
+   b.VertResolution = p.Uint32()
+   p.offset += 4 // reserved
+   b.FrameCount = p.Uint16()
+   // compressorname is a length byte then up to 31 bytes, padded to 32
+   name := p.Bytes(32)
+   b.CompressorName = string(name[1 : 1+min(int(name[0]), 31)])
+   b.Depth = p.Uint16()
+   p.offset += 2 // pre_defined
+
+   payload := data[p.offset:b.Header.Size]
+   offset := 0
+   for offset < len(payload) {
+      var header BoxHeader
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
+         break
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(payload) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(payload) {
+         return errors.New("invalid child box size")
+      }
+
+      content := payload[offset : offset+boxSize]
+      switch string(header.Type[:]) {
+      case "avcC":
+         var avcC AvcCBox
+         if err := avcC.Parse(content); err != nil {
+            return err
+         }
+         b.AvcC = &avcC
+      case "hvcC":
+         var hvcC HvcCBox
+         if err := hvcC.Parse(content); err != nil {
+            return err
+         }
+         b.HvcC = &hvcC
+      case "sinf":
+         var sinf SinfBox
+         if err := sinf.parse(content, opts); err != nil {
+            return err
+         }
+         b.Sinf = &sinf
+      default:
+         b.RawChildren = append(b.RawChildren, content)
+      }
+      offset += boxSize
+   }
+   return nil
+}
+
+// AudioSampleEntry is an audio sample entry such as mp4a or enca.
+type AudioSampleEntry struct {
+   Header             BoxHeader
+   DataReferenceIndex uint16
+   ChannelCount       uint16
+   SampleSize         uint16
+   SampleRate         uint32 // 16.16, the integer part in Hz
+   Sinf               *SinfBox
+   RawChildren        [][]byte
+}
+
+func (b *AudioSampleEntry) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *AudioSampleEntry) parse(data []byte, opts *ParseOptions) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if uint64(len(data)) < uint64(b.Header.HeaderSize)+28 || b.Header.Size > uint64(len(data)) {
+      return errors.New("audio sample entry too short")
+   }
+   p := parser{data: data, offset: b.Header.HeaderSize + 6}
+   b.DataReferenceIndex = p.Uint16()
+   p.offset += 8 // reserved
+   b.ChannelCount = p.Uint16()
+   b.SampleSize = p.Uint16()
+   p.offset += 4 // pre_defined and reserved
+   b.SampleRate = p.Uint32()
+
+   payload := data[p.offset:b.Header.Size]
+   offset := 0
+   for offset < len(payload) {
+      var header BoxHeader
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
+         break
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(payload) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(payload) {
+         return errors.New("invalid child box size")
+      }
+
+      content := payload[offset : offset+boxSize]
+      switch string(header.Type[:]) {
+      case "sinf":
+         var sinf SinfBox
+         if err := sinf.parse(content, opts); err != nil {
+            return err
+         }
+         b.Sinf = &sinf
+      default:
+         b.RawChildren = append(b.RawChildren, content)
+      }
+      offset += boxSize
+   }
    return nil
 }
 
+// Rate returns the integer part of SampleRate in Hz.
+func (b *AudioSampleEntry) Rate() uint32 {
+   return b.SampleRate >> 16
+}
+
 // --- ENC (Encrypted Sample Entry) ---
 type EncBox struct {
    Header      BoxHeader
@@ -101,6 +385,10 @@ type EncBox struct {
 }
 
 func (b *EncBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *EncBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
@@ -119,12 +407,15 @@ func (b *EncBox) Parse(data []byte) error {
       return nil
    }
    b.EntryHeader = data[payloadOffset : payloadOffset+entrySize]
+   if err := b.checkReserved(opts); err != nil {
+      return err
+   }
 
    payload := data[payloadOffset+entrySize : b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -139,7 +430,7 @@ func (b *EncBox) Parse(data []byte) error {
       switch string(header.Type[:]) {
       case "sinf":
          var sinf SinfBox
-         if err := sinf.Parse(content); err != nil {
+         if err := sinf.parse(content, opts); err != nil {
             return err
          }
          b.Sinf = &sinf
@@ -151,17 +442,40 @@ func (b *EncBox) Parse(data []byte) error {
    return nil
 }
 
+// checkReserved validates the reserved fields of the sample entry header in
+// strict mode.
+func (b *EncBox) checkReserved(opts *ParseOptions) error {
+   if err := opts.checkReserved(b.EntryHeader[0:6]); err != nil {
+      return err
+   }
+   if string(b.Header.Type[:]) == "encv" {
+      if err := opts.checkReserved(b.EntryHeader[10:12]); err != nil {
+         return err
+      }
+      return opts.checkReserved(b.EntryHeader[36:40])
+   }
+   if err := opts.checkReserved(b.EntryHeader[8:16]); err != nil {
+      return err
+   }
+   return opts.checkReserved(b.EntryHeader[22:24])
+}
+
 func (b *EncBox) Encode() []byte {
    buffer := make([]byte, 8)
    buffer = append(buffer, b.EntryHeader...)
    for _, child := range b.RawChildren {
       buffer = append(buffer, child...)
    }
-   b.Header.Size = uint32(len(buffer))
+   b.Header.Size = uint64(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *EncBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 func (b *EncBox) Unprotect() error {
    if b.Sinf == nil {
       return nil
@@ -179,20 +493,25 @@ func (b *EncBox) Unprotect() error {
 type SinfBox struct {
    Header      BoxHeader
    Frma        *FrmaBox
+   Schm        *SchmBox
    Schi        *SchiBox
    RawChildren [][]byte
 }
 
 func (b *SinfBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *SinfBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
 
-   payload := data[8:b.Header.Size]
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -211,9 +530,15 @@ func (b *SinfBox) Parse(data []byte) error {
             return err
          }
          b.Frma = &frma
+      case "schm":
+         var schm SchmBox
+         if err := schm.Parse(content); err != nil {
+            return err
+         }
+         b.Schm = &schm
       case "schi":
          var schi SchiBox
-         if err := schi.Parse(content); err != nil {
+         if err := schi.parse(content, opts); err != nil {
             return err
          }
          b.Schi = &schi
@@ -230,18 +555,44 @@ type SchiBox struct {
    Header      BoxHeader
    Tenc        *TencBox
    RawChildren [][]byte
+   children    [][]byte // every child, including tenc, in file order
+}
+
+// Children returns every child box of schi in file order, including tenc
+// and any scheme-specific boxes.
+func (b *SchiBox) Children() [][]byte {
+   return b.children
+}
+
+func (b *SchiBox) Encode() []byte {
+   buffer := make([]byte, 8)
+   for _, child := range b.children {
+      buffer = append(buffer, child...)
+   }
+   b.Header.Size = uint64(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *SchiBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
 }
 
 func (b *SchiBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *SchiBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
 
-   payload := data[8:b.Header.Size]
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -253,10 +604,11 @@ func (b *SchiBox) Parse(data []byte) error {
       }
 
       content := payload[offset : offset+boxSize]
+      b.children = append(b.children, content)
       switch string(header.Type[:]) {
       case "tenc":
          var tenc TencBox
-         if err := tenc.Parse(content); err != nil {
+         if err := tenc.parse(content, opts); err != nil {
             return err
          }
          b.Tenc = &tenc
@@ -269,6 +621,9 @@ func (b *SchiBox) Parse(data []byte) error {
 }
 
 // --- FRMA ---
+
+// FrmaBox holds the original format of a protected sample entry, such as
+// avc1 behind encv, which Unprotect restores.
 type FrmaBox struct {
    Header     BoxHeader
    DataFormat [4]byte
@@ -284,3 +639,35 @@ func (b *FrmaBox) Parse(data []byte) error {
    copy(b.DataFormat[:], data[8:12])
    return nil
 }
+
+// --- SCHM (Scheme Type) ---
+
+// SchmBox names the protection scheme of a sample entry. SchemeType tells
+// AES-CTR schemes (cenc, cens) from AES-CBC ones (cbc1, cbcs).
+type SchmBox struct {
+   Header        BoxHeader
+   Version       byte
+   Flags         uint32
+   SchemeType    [4]byte // e.g. cenc, cens, cbc1, cbcs
+   SchemeVersion uint32
+   SchemeURI     string // Present if Flags&1
+}
+
+func (b *SchmBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 20 { // 8 header + 4 version/flags + 4 type + 4 version
+      return errors.New("schm box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   copy(b.SchemeType[:], p.Bytes(4))
+   b.SchemeVersion = p.Uint32()
+   if b.Flags&0x000001 != 0 {
+      b.SchemeURI = cString(data[p.offset:b.Header.Size])
+   }
+   return nil
+}
@@ -1,50 +1,175 @@
 package sofia
 
 import (
+   "bytes"
    "encoding/binary"
    "errors"
+   "io"
+   "math"
+   "time"
 )
 
+// ParseOptions controls how the parsers treat input that does not follow
+// the specification. The zero value, which Parse and the Parse methods of
+// the boxes use, ignores reserved fields, repairs known packager bugs and
+// reports nothing. A nil *ParseOptions behaves as the zero value.
+type ParseOptions struct {
+   // Strict makes the parsers reject boxes whose reserved fields are not
+   // zero, returning ErrNonZeroReserved, since real files sometimes
+   // violate this. Strict also disables the repair of known packager bugs.
+   Strict bool
+   // Warn, if not nil, is called with a description of every problem that
+   // the parsers repair instead of reporting as an error.
+   Warn func(message string)
+
+   // fieldless counts the samples without fields that the trun and senc
+   // boxes of one parse have declared, see session.
+   fieldless *uint64
+}
+
+// Parse is the package Parse with these options.
+func (o *ParseOptions) Parse(data []byte) ([]Box, error) {
+   return parse(data, o)
+}
+
+func (o *ParseOptions) strict() bool {
+   return o != nil && o.Strict
+}
+
+func (o *ParseOptions) warn(message string) {
+   if o != nil && o.Warn != nil {
+      o.Warn(message)
+   }
+}
+
+// session returns options that share one budget of samples without fields
+// across a parse: o itself if it already belongs to one, else a copy.
+func (o *ParseOptions) session() *ParseOptions {
+   if o != nil && o.fieldless != nil {
+      return o
+   }
+   s := new(ParseOptions)
+   if o != nil {
+      *s = *o
+   }
+   s.fieldless = new(uint64)
+   return s
+}
+
+// takeFieldless charges count samples without fields to the budget of the
+// parse and reports whether it still holds. Options outside a parse bound
+// the single box instead.
+func (o *ParseOptions) takeFieldless(count uint32) bool {
+   if o == nil || o.fieldless == nil {
+      return count <= maxFieldlessSamples
+   }
+   *o.fieldless += uint64(count)
+   return *o.fieldless <= maxFieldlessSamples
+}
+
+var ErrNonZeroReserved = errors.New("non-zero reserved field")
+
+// ErrSizeMismatch is returned by Parse when a box declares a size that
+// extends past the end of the data, as happens with truncated downloads.
+var ErrSizeMismatch = errors.New("box size exceeds remaining data")
+
+// checkReserved returns ErrNonZeroReserved in strict mode if any byte of
+// reserved is not zero.
+func (o *ParseOptions) checkReserved(reserved []byte) error {
+   if !o.strict() {
+      return nil
+   }
+   for _, b := range reserved {
+      if b != 0 {
+         return ErrNonZeroReserved
+      }
+   }
+   return nil
+}
+
 // --- READING HELPER ---
 
+// parser reads big-endian fields from data. A read past the end of data
+// returns zero values and marks the parser as overrun rather than
+// panicking, so box parsers can check Err once after a run of reads.
 type parser struct {
-   data   []byte
-   offset int
+   data    []byte
+   offset  int
+   overrun bool
 }
 
-func (p *parser) Uint16() uint16 {
-   val := binary.BigEndian.Uint16(p.data[p.offset:])
-   p.offset += 2
+// ErrParserOverrun is returned by parser.Err after a read past the end of
+// the data.
+var ErrParserOverrun = errors.New("box truncated while reading field")
+
+// take returns the next n bytes, or nil after marking the parser overrun
+// if fewer remain.
+func (p *parser) take(n int) []byte {
+   if n < 0 || p.offset < 0 || n > len(p.data)-p.offset {
+      p.overrun = true
+      p.offset = len(p.data)
+      return nil
+   }
+   val := p.data[p.offset : p.offset+n]
+   p.offset += n
    return val
 }
 
+// Ok reports whether every read so far fitted in the data.
+func (p *parser) Ok() bool {
+   return !p.overrun
+}
+
+// Err returns ErrParserOverrun if a read ran past the end of the data.
+func (p *parser) Err() error {
+   if p.overrun {
+      return ErrParserOverrun
+   }
+   return nil
+}
+
+func (p *parser) Uint16() uint16 {
+   if val := p.take(2); val != nil {
+      return binary.BigEndian.Uint16(val)
+   }
+   return 0
+}
+
 func (p *parser) Uint32() uint32 {
-   val := binary.BigEndian.Uint32(p.data[p.offset:])
-   p.offset += 4
-   return val
+   if val := p.take(4); val != nil {
+      return binary.BigEndian.Uint32(val)
+   }
+   return 0
 }
 
 func (p *parser) Int32() int32 {
-   val := int32(binary.BigEndian.Uint32(p.data[p.offset:]))
-   p.offset += 4
-   return val
+   return int32(p.Uint32())
 }
 
 func (p *parser) Uint64() uint64 {
-   val := binary.BigEndian.Uint64(p.data[p.offset:])
-   p.offset += 8
-   return val
+   if val := p.take(8); val != nil {
+      return binary.BigEndian.Uint64(val)
+   }
+   return 0
 }
 
 func (p *parser) Bytes(n int) []byte {
-   val := p.data[p.offset : p.offset+n]
-   p.offset += n
-   return val
+   return p.take(n)
 }
 
 func (p *parser) Byte() byte {
-   val := p.data[p.offset]
-   p.offset++
+   if val := p.take(1); val != nil {
+      return val[0]
+   }
+   return 0
+}
+
+// UintN reads a big-endian unsigned integer of n bytes (1-4).
+func (p *parser) UintN(n int) uint32 {
+   var val uint32
+   for _, b := range p.Bytes(n) {
+      val = val<<8 | uint32(b)
+   }
    return val
 }
 
@@ -81,25 +206,70 @@ func (w *writer) PutByte(data byte) {
 }
 
 // --- BoxHeader ---
+
+// BoxHeader is the size and type of a box. Size is the whole box, header
+// included, and HeaderSize is the length of the header itself: 8 bytes,
+// plus 8 when the box uses a 64-bit largesize and 16 for the UserType of a
+// uuid box.
 type BoxHeader struct {
-   Size uint32
-   Type [4]byte
+   Size       uint64
+   Type       [4]byte
+   UserType   [16]byte // uuid boxes only
+   HeaderSize int
 }
 
+// Parse reads the header at the start of data. A 32-bit size of 1 is
+// followed by a 64-bit largesize, a size of 0 means the box extends to the
+// end of data, and a uuid type is followed by the 16-byte UserType. If the
+// box extends past the end of data, Parse fills in the header and returns
+// ErrSizeMismatch.
 func (h *BoxHeader) Parse(data []byte) error {
    if len(data) < 8 {
       return errors.New("not enough data for box header")
    }
    p := parser{data: data}
-   h.Size = p.Uint32()
+   h.Size = uint64(p.Uint32())
    copy(h.Type[:], p.Bytes(4))
+   h.HeaderSize = 8
+   switch h.Size {
+   case 0:
+      h.Size = uint64(len(data))
+   case 1:
+      if len(data) < 16 {
+         return errors.New("not enough data for box largesize")
+      }
+      h.Size = p.Uint64()
+      h.HeaderSize = 16
+      // a size this large cannot be sliced and is never valid
+      if h.Size < 16 || h.Size > math.MaxInt64/2 {
+         return errors.New("invalid box largesize")
+      }
+   }
+   h.UserType = [16]byte{}
+   if h.Type == [4]byte{'u', 'u', 'i', 'd'} {
+      if len(data) < h.HeaderSize+16 {
+         return errors.New("not enough data for uuid user type")
+      }
+      copy(h.UserType[:], p.Bytes(16))
+      h.HeaderSize += 16
+      if h.Size < uint64(h.HeaderSize) {
+         return errors.New("uuid box smaller than its header")
+      }
+   }
+   if h.Size > uint64(len(data)) {
+      return ErrSizeMismatch
+   }
    return nil
 }
 
+// Put writes the size and type to the start of buffer in their 8-byte
+// form, since the boxes the package encodes never need a largesize. The
+// UserType of a uuid box is not written.
 func (h *BoxHeader) Put(buffer []byte) {
    w := writer{buf: buffer}
-   w.PutUint32(h.Size)
+   w.PutUint32(uint32(h.Size))
    w.PutBytes(h.Type[:])
+   h.HeaderSize = 8
 }
 
 // --- Box ---
@@ -109,7 +279,17 @@ type Box struct {
    Mdat *MdatBox
    Sidx *SidxBox
    Pssh *PsshBox
-   Raw  []byte
+   Mfra *MfraBox
+   Prft *PrftBox
+   Ftyp *FtypBox
+   Styp *StypBox
+   Emsg *EmsgBox
+   // Raw holds the bytes of the box as parsed, so Encode writes every box
+   // but the moov back as is. It is nil for the mdats of ParseReader.
+   Raw []byte
+   // Truncated marks a box cut short by the end of the data; Raw holds
+   // the bytes that are present.
+   Truncated bool
 }
 
 func (b *Box) Encode() []byte {
@@ -121,62 +301,373 @@ func (b *Box) Encode() []byte {
    }
 }
 
+// WriteTo writes the encoded box to w.
+func (b *Box) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// writeEncoded writes an encoded box to w, reporting the bytes written as
+// io.WriterTo does.
+func writeEncoded(w io.Writer, data []byte) (int64, error) {
+   n, err := w.Write(data)
+   return int64(n), err
+}
+
+// Serialize writes boxes to w one at a time, so the whole tree is never
+// held in a single slice, and returns the number of bytes written.
+func Serialize(w io.Writer, boxes []Box) (int64, error) {
+   var total int64
+   for i := range boxes {
+      n, err := boxes[i].WriteTo(w)
+      total += n
+      if err != nil {
+         return total, err
+      }
+   }
+   return total, nil
+}
+
+// Parse splits data into top-level boxes. If the last box is truncated, the
+// boxes before it are returned followed by one marked Truncated, together
+// with ErrSizeMismatch.
 func Parse(data []byte) ([]Box, error) {
+   return parse(data, nil)
+}
+
+func parse(data []byte, opts *ParseOptions) ([]Box, error) {
+   opts = opts.session()
    var boxes []Box
    offset := 0
    for offset < len(data) {
       var header BoxHeader
-      if err := header.Parse(data[offset:]); err != nil {
+      if err := header.Parse(data[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
       if boxSize == 0 {
          boxSize = len(data) - offset
       }
-      if boxSize < 8 || offset+boxSize > len(data) {
+      if boxSize < 8 {
          return nil, errors.New("invalid child box size")
       }
+      if offset+boxSize > len(data) {
+         boxes = append(boxes, Box{Raw: data[offset:], Truncated: true})
+         return boxes, ErrSizeMismatch
+      }
 
-      boxData := data[offset : offset+boxSize]
-      var currentBox Box
-      switch string(header.Type[:]) {
-      case "moov":
-         var moov MoovBox
-         if err := moov.Parse(boxData); err != nil {
-            return nil, err
+      currentBox, err := parseBox(data[offset:offset+boxSize], header, opts)
+      if err != nil {
+         return nil, err
+      }
+      boxes = append(boxes, currentBox)
+      offset += boxSize
+   }
+   return boxes, nil
+}
+
+// parseBox parses one top-level box of the given header.
+func parseBox(boxData []byte, header BoxHeader, opts *ParseOptions) (Box, error) {
+   var currentBox Box
+   switch string(header.Type[:]) {
+   case "moov":
+      var moov MoovBox
+      if err := moov.parse(boxData, opts); err != nil {
+         return Box{}, err
+      }
+      currentBox.Moov = &moov
+   case "moof":
+      var moof MoofBox
+      if err := moof.parse(boxData, opts); err != nil {
+         return Box{}, err
+      }
+      currentBox.Moof = &moof
+   case "mdat":
+      var mdat MdatBox
+      if err := mdat.Parse(boxData); err != nil {
+         return Box{}, err
+      }
+      currentBox.Mdat = &mdat
+   case "sidx":
+      var sidx SidxBox
+      if err := sidx.parse(boxData, opts); err != nil {
+         return Box{}, err
+      }
+      currentBox.Sidx = &sidx
+   case "pssh":
+      var pssh PsshBox
+      if err := pssh.Parse(boxData); err != nil {
+         return Box{}, err
+      }
+      currentBox.Pssh = &pssh
+   case "mfra":
+      var mfra MfraBox
+      if err := mfra.Parse(boxData); err != nil {
+         return Box{}, err
+      }
+      currentBox.Mfra = &mfra
+   case "prft":
+      var prft PrftBox
+      if err := prft.Parse(boxData); err != nil {
+         return Box{}, err
+      }
+      currentBox.Prft = &prft
+   case "ftyp", "styp":
+      var brands FtypBox
+      if err := brands.Parse(boxData); err != nil {
+         return Box{}, err
+      }
+      if header.Type[0] == 'f' {
+         currentBox.Ftyp = &brands
+      } else {
+         currentBox.Styp = &brands
+      }
+   case "emsg":
+      var emsg EmsgBox
+      if err := emsg.Parse(boxData); err != nil {
+         return Box{}, err
+      }
+      currentBox.Emsg = &emsg
+   }
+   currentBox.Raw = boxData
+   return currentBox, nil
+}
+
+// containerBoxes are the box types EstimateParseCost and Walk descend into,
+// with the offset of their first child.
+var containerBoxes = map[string]int{
+   "dinf": 8, "edts": 8, "mdia": 8, "mfra": 8, "minf": 8, "moof": 8,
+   "moov": 8, "mvex": 8, "schi": 8, "sinf": 8, "stbl": 8, "traf": 8,
+   "trak": 8, "udta": 8, "stsd": 16,
+}
+
+// EstimateParseCost scans the box headers of data without building any
+// boxes, so that pathological input can be rejected before Parse. It
+// returns the number of boxes, the deepest nesting level (1 for top-level
+// boxes) and the number of samples declared by stsz and trun boxes, or by
+// senc boxes when they declare more than the truns of their traf.
+func EstimateParseCost(data []byte) (int, int, uint64, error) {
+   var boxCount, maxDepth int
+   var sampleCount uint64
+   var scan func(data []byte, depth int) (uint64, uint64, error)
+   // scan returns the trun and senc sample counts found directly in data,
+   // so that each traf can count the larger of the two.
+   scan = func(data []byte, depth int) (uint64, uint64, error) {
+      var trunCount, sencCount uint64
+      for offset := 0; offset+8 <= len(data); {
+         var header BoxHeader
+         if err := header.Parse(data[offset:]); err != nil {
+            return 0, 0, err
          }
-         currentBox.Moov = &moov
-      case "moof":
-         var moof MoofBox
-         if err := moof.Parse(boxData); err != nil {
-            return nil, err
+         if header.Size < 8 {
+            return 0, 0, errors.New("invalid box size")
          }
-         currentBox.Moof = &moof
-      case "mdat":
-         var mdat MdatBox
-         if err := mdat.Parse(boxData); err != nil {
-            return nil, err
+         size := int(header.Size)
+         box := data[offset : offset+size]
+         boxType := string(header.Type[:])
+         // the fields follow the version and flags after the header
+         fields := box[header.HeaderSize:]
+         boxCount++
+         maxDepth = max(maxDepth, depth)
+         switch boxType {
+         case "trun", "senc":
+            if len(fields) >= 8 {
+               count := uint64(binary.BigEndian.Uint32(fields[4:]))
+               if boxType == "trun" {
+                  trunCount += count
+               } else {
+                  sencCount += count
+               }
+            }
+         case "stsz":
+            if len(fields) >= 12 {
+               sampleCount += uint64(binary.BigEndian.Uint32(fields[8:]))
+            }
+         default:
+            // the offsets of containerBoxes assume an 8-byte header
+            start, ok := containerBoxes[boxType]
+            start += header.HeaderSize - 8
+            if ok && len(box) >= start {
+               truns, sencs, err := scan(box[start:], depth+1)
+               if err != nil {
+                  return 0, 0, err
+               }
+               sampleCount += max(truns, sencs)
+            }
          }
-         currentBox.Mdat = &mdat
-      case "sidx":
-         var sidx SidxBox
-         if err := sidx.Parse(boxData); err != nil {
-            return nil, err
+         offset += size
+      }
+      return trunCount, sencCount, nil
+   }
+   trunCount, sencCount, err := scan(data, 1)
+   if err != nil {
+      return 0, 0, 0, err
+   }
+   sampleCount += max(trunCount, sencCount)
+   return boxCount, maxDepth, sampleCount, nil
+}
+
+// sampleEntryBoxes are the sample entries under stsd that Walk descends
+// into, with the offset of their first child past the visual or audio
+// sample entry fields.
+var sampleEntryBoxes = map[string]int{
+   "avc1": 86, "avc3": 86, "encv": 86, "hev1": 86, "hvc1": 86,
+   "enca": 36, "mp4a": 36,
+}
+
+// ErrStopWalk may be returned by a Walk callback to end the traversal, in
+// which case Walk returns nil.
+var ErrStopWalk = errors.New("stop walk")
+
+// maxWalkDepth bounds the nesting Walk follows, so malformed input with
+// containers nested inside each other cannot exhaust the stack.
+const maxWalkDepth = 32
+
+// Walk visits every box of data depth-first, descending into the
+// containers the package knows, including the sample entries of stsd. fn
+// is called with the chain of box types from the top level down to the
+// box, its header and its payload after the header. If fn returns an
+// error the walk stops and Walk returns it, or nil for ErrStopWalk.
+func Walk(data []byte, fn func(path []string, header BoxHeader, payload []byte) error) error {
+   err := walk(data, nil, func(path []string, box []byte, headerSize int) error {
+      var header BoxHeader
+      header.Parse(box)
+      return fn(path, header, box[headerSize:])
+   })
+   if errors.Is(err, ErrStopWalk) {
+      return nil
+   }
+   return err
+}
+
+// walk calls fn with each whole box and the size of its header.
+func walk(data []byte, path []string, fn func(path []string, box []byte, headerSize int) error) error {
+   if len(path) >= maxWalkDepth {
+      return errors.New("boxes nested too deeply")
+   }
+   for offset := 0; offset+8 <= len(data); {
+      var header BoxHeader
+      if err := header.Parse(data[offset:]); err != nil {
+         return err
+      }
+      if header.Size < uint64(header.HeaderSize) {
+         return errors.New("invalid box size")
+      }
+      if header.Size > uint64(len(data)-offset) {
+         return ErrSizeMismatch
+      }
+      size := int(header.Size)
+      box := data[offset : offset+size]
+      boxType := string(header.Type[:])
+      boxPath := append(path[:len(path):len(path)], boxType)
+      if err := fn(boxPath, box, header.HeaderSize); err != nil {
+         return err
+      }
+      start, ok := containerBoxes[boxType]
+      if !ok && len(path) > 0 && path[len(path)-1] == "stsd" {
+         start, ok = sampleEntryBoxes[boxType]
+      }
+      if ok && header.HeaderSize == 8 && len(box) >= start {
+         if err := walk(box[start:], boxPath, fn); err != nil {
+            return err
          }
-         currentBox.Sidx = &sidx
-      case "pssh":
-         var pssh PsshBox
-         if err := pssh.Parse(boxData); err != nil {
-            return nil, err
+      }
+      offset += int(size)
+   }
+   return nil
+}
+
+// --- FTYP and STYP ---
+
+// FtypBox is the file type box of an init segment or progressive file.
+type FtypBox struct {
+   Header           BoxHeader
+   MajorBrand       [4]byte
+   MinorVersion     uint32
+   CompatibleBrands [][4]byte
+}
+
+// StypBox is the segment type box of a media segment, which has the same
+// layout as ftyp.
+type StypBox = FtypBox
+
+func (b *FtypBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 { // 8 header + major_brand + minor_version
+      return errors.New("brand box too short")
+   }
+   p := parser{data: data[:b.Header.Size], offset: 8}
+   copy(b.MajorBrand[:], p.Bytes(4))
+   b.MinorVersion = p.Uint32()
+   for len(p.data)-p.offset >= 4 {
+      b.CompatibleBrands = append(b.CompatibleBrands, [4]byte(p.Bytes(4)))
+   }
+   return nil
+}
+
+// HasCompatibleBrand reports whether brand, such as "cmfc" or "msdh", is
+// listed in the compatible brands.
+func (b *FtypBox) HasCompatibleBrand(brand string) bool {
+   for _, compatible := range b.CompatibleBrands {
+      if string(compatible[:]) == brand {
+         return true
+      }
+   }
+   return false
+}
+
+// findBrandBox returns the offset and size of the first top-level ftyp or
+// styp box.
+func findBrandBox(data []byte) (int, int, error) {
+   offset := 0
+   for _, box := range childBoxes(data) {
+      switch string(box[4:8]) {
+      case "ftyp", "styp":
+         if len(box) < 16 {
+            return 0, 0, errors.New("brand box too short")
          }
-         currentBox.Pssh = &pssh
-      default:
-         currentBox.Raw = boxData
+         return offset, len(box), nil
       }
-      boxes = append(boxes, currentBox)
-      offset += boxSize
+      offset += len(box)
    }
-   return boxes, nil
+   return 0, 0, errors.New("no ftyp or styp found")
+}
+
+// SetMajorBrand returns a copy of data with the major_brand of the first
+// top-level ftyp or styp replaced.
+func SetMajorBrand(data []byte, brand [4]byte) ([]byte, error) {
+   offset, _, err := findBrandBox(data)
+   if err != nil {
+      return nil, err
+   }
+   out := bytes.Clone(data)
+   copy(out[offset+8:], brand[:])
+   return out, nil
+}
+
+// AddCompatibleBrand returns a copy of data with brand appended to the
+// compatible brands of the first top-level ftyp or styp, unless it is
+// already listed. The box grows by four bytes; chunk offsets of a
+// progressive file are not adjusted, so it is meant for init and media
+// segments.
+func AddCompatibleBrand(data []byte, brand [4]byte) ([]byte, error) {
+   offset, size, err := findBrandBox(data)
+   if err != nil {
+      return nil, err
+   }
+   box := data[offset : offset+size]
+   for i := 16; i+4 <= len(box); i += 4 {
+      if [4]byte(box[i:i+4]) == brand {
+         return bytes.Clone(data), nil
+      }
+   }
+   out := make([]byte, 0, len(data)+4)
+   out = append(out, data[:offset+size]...)
+   out = append(out, brand[:]...)
+   out = append(out, data[offset+size:]...)
+   binary.BigEndian.PutUint32(out[offset:], uint32(size+4))
+   return out, nil
 }
 
 // --- Finders ---
@@ -189,6 +680,190 @@ func FindMoov(boxes []Box) (*MoovBox, bool) {
    return nil, false
 }
 
+// FindMoof returns the first moof of boxes.
+func FindMoof(boxes []Box) (*MoofBox, bool) {
+   for _, box := range boxes {
+      if box.Moof != nil {
+         return box.Moof, true
+      }
+   }
+   return nil, false
+}
+
+// FindBoxByType returns every box of type boxType in data, header
+// included, searching nested containers as Walk does. If data is
+// malformed, the boxes found before the error are returned with it.
+func FindBoxByType(data []byte, boxType string) ([][]byte, error) {
+   var boxes [][]byte
+   err := walk(data, nil, func(path []string, box []byte, _ int) error {
+      if path[len(path)-1] == boxType {
+         boxes = append(boxes, box)
+      }
+      return nil
+   })
+   return boxes, err
+}
+
+// FindFirstBoxByType returns the first box of type boxType in data, header
+// included, searching nested containers as Walk does.
+func FindFirstBoxByType(data []byte, boxType string) ([]byte, bool) {
+   var found []byte
+   walk(data, nil, func(path []string, box []byte, _ int) error {
+      if path[len(path)-1] == boxType {
+         found = box
+         return ErrStopWalk
+      }
+      return nil
+   })
+   return found, found != nil
+}
+
+// FindMoovInReader walks the top-level box headers of r, which holds size
+// bytes, and parses the first moov. Only the headers of other boxes are
+// read, so a large mdat placed before a trailing moov is never loaded.
+func FindMoovInReader(r io.ReaderAt, size int64) (*MoovBox, error) {
+   var offset int64
+   var header [16]byte
+   for offset+8 <= size {
+      if n, err := r.ReadAt(header[:8], offset); n < 8 {
+         return nil, err
+      }
+      boxSize := int64(binary.BigEndian.Uint32(header[0:4]))
+      switch boxSize {
+      case 0: // box extends to the end of the file
+         boxSize = size - offset
+      case 1: // 64-bit largesize follows the type
+         if n, err := r.ReadAt(header[8:16], offset+8); n < 8 {
+            return nil, err
+         }
+         boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+      }
+      if boxSize < 8 || boxSize > size-offset {
+         return nil, errors.New("invalid box size")
+      }
+      if string(header[4:8]) == "moov" {
+         data := make([]byte, boxSize)
+         if n, err := r.ReadAt(data, offset); n < len(data) {
+            return nil, err
+         }
+         var moov MoovBox
+         if err := moov.Parse(data); err != nil {
+            return nil, err
+         }
+         return &moov, nil
+      }
+      offset += boxSize
+   }
+   return nil, errors.New("no moov found")
+}
+
+// ParseReaderFunc reads the top-level boxes of r one at a time and calls fn
+// with the header of each and a reader over its payload, so no box has to
+// be held in memory. Whatever fn leaves unread is skipped, by seeking if r
+// is an io.Seeker. A box whose 32-bit size is 0 extends to the end of r
+// and is passed with a header Size of 0. If r ends inside a box,
+// ParseReaderFunc returns ErrSizeMismatch, except when a seek skips past
+// the end.
+func ParseReaderFunc(r io.Reader, fn func(header BoxHeader, body io.Reader) error) error {
+   return readBoxes(r, func(header BoxHeader, _ []byte, body *io.LimitedReader) error {
+      return fn(header, body)
+   })
+}
+
+// readBoxes implements ParseReaderFunc, also passing fn the raw header.
+func readBoxes(r io.Reader, fn func(header BoxHeader, raw []byte, body *io.LimitedReader) error) error {
+   for {
+      raw := make([]byte, 8, 32)
+      if n, err := io.ReadFull(r, raw); err != nil {
+         if n == 0 && err == io.EOF {
+            return nil
+         }
+         return ErrSizeMismatch
+      }
+      size := binary.BigEndian.Uint32(raw)
+      if size == 1 {
+         raw = raw[:16]
+      }
+      if string(raw[4:8]) == "uuid" {
+         raw = raw[:len(raw)+16]
+      }
+      if _, err := io.ReadFull(r, raw[8:]); err != nil {
+         return ErrSizeMismatch
+      }
+      // only the header has been read, so its size cannot be checked yet
+      var header BoxHeader
+      if err := header.Parse(raw); err != nil && err != ErrSizeMismatch {
+         return err
+      }
+      remaining := int64(header.Size) - int64(header.HeaderSize)
+      if size == 0 {
+         header.Size = 0
+         remaining = math.MaxInt64
+      } else if remaining < 0 {
+         return errors.New("invalid box size")
+      }
+      body := &io.LimitedReader{R: r, N: remaining}
+      if err := fn(header, raw, body); err != nil {
+         return err
+      }
+      if size == 0 {
+         _, err := io.Copy(io.Discard, body)
+         return err
+      }
+      if body.N > 0 {
+         if seeker, ok := r.(io.Seeker); ok {
+            // Seeking past the end succeeds, so read the final byte of the
+            // box to find truncation as the copy below does.
+            if _, err := seeker.Seek(body.N-1, io.SeekCurrent); err != nil {
+               return err
+            }
+            if _, err := io.ReadFull(r, make([]byte, 1)); err != nil {
+               return ErrSizeMismatch
+            }
+         } else if _, err := io.Copy(io.Discard, body); err != nil {
+            return err
+         } else if body.N > 0 {
+            return ErrSizeMismatch
+         }
+      }
+   }
+}
+
+// ParseReader is Parse for a stream: it returns the same boxes, except that
+// mdat payloads are skipped rather than read, leaving Mdat with only its
+// header and a nil Payload and the Raw of the box nil. Such boxes encode
+// to nothing, so Serialize drops them; copy mdats from r to write the file
+// back. It suits callers that need only the moov and moof metadata of
+// large files.
+func ParseReader(r io.Reader) ([]Box, error) {
+   var boxes []Box
+   err := readBoxes(r, func(header BoxHeader, raw []byte, body *io.LimitedReader) error {
+      if string(header.Type[:]) == "mdat" {
+         boxes = append(boxes, Box{Mdat: &MdatBox{Header: header}})
+         return nil
+      }
+      payload, err := io.ReadAll(body)
+      if err != nil {
+         return err
+      }
+      boxData := append(raw, payload...)
+      if header.Size != 0 && body.N > 0 {
+         boxes = append(boxes, Box{Raw: boxData, Truncated: true})
+         return ErrSizeMismatch
+      }
+      box, err := parseBox(boxData, header, nil)
+      if err != nil {
+         return err
+      }
+      boxes = append(boxes, box)
+      return nil
+   })
+   if err != nil && err != ErrSizeMismatch {
+      return nil, err
+   }
+   return boxes, err
+}
+
 func FindSidx(boxes []Box) (*SidxBox, bool) {
    for _, box := range boxes {
       if box.Sidx != nil {
@@ -208,11 +883,14 @@ func (b *MdatBox) Parse(data []byte) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
-   b.Payload = data[8:b.Header.Size]
+   b.Payload = data[b.Header.HeaderSize:b.Header.Size]
    return nil
 }
 
 // --- SIDX ---
+
+// SidxReference is one entry of the sidx reference array. ReferenceType is
+// true when the entry points to another sidx rather than to media.
 type SidxReference struct {
    ReferenceType      bool
    ReferencedSize     uint32
@@ -234,6 +912,10 @@ type SidxBox struct {
 }
 
 func (b *SidxBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *SidxBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
@@ -265,7 +947,9 @@ func (b *SidxBox) Parse(data []byte) error {
    if len(data) < p.offset+4 {
       return errors.New("sidx box too short for reference_count")
    }
-   _ = p.Uint16() // reserved
+   if err := opts.checkReserved(p.Bytes(2)); err != nil {
+      return err
+   }
    referenceCount := p.Uint16()
 
    if len(data)-p.offset < int(referenceCount)*12 {
@@ -287,3 +971,52 @@ func (b *SidxBox) Parse(data []byte) error {
    }
    return nil
 }
+
+// --- PRFT (Producer Reference Time) ---
+type PrftBox struct {
+   Header           BoxHeader
+   Version          byte
+   Flags            uint32
+   ReferenceTrackID uint32
+   NTPTimestamp     uint64 // 32.32 seconds since 1900-01-01 UTC
+   MediaTime        uint64 // in the timescale of the reference track
+}
+
+func (b *PrftBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 24 { // 8 header + 4 version/flags + 4 track + 8 NTP
+      return errors.New("prft box too short")
+   }
+
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.ReferenceTrackID = p.Uint32()
+   b.NTPTimestamp = p.Uint64()
+   if b.Version == 0 {
+      if len(data) < p.offset+4 {
+         return errors.New("prft v0 box too short")
+      }
+      b.MediaTime = uint64(p.Uint32())
+   } else {
+      if len(data) < p.offset+8 {
+         return errors.New("prft v1 box too short")
+      }
+      b.MediaTime = p.Uint64()
+   }
+   return nil
+}
+
+// ntpEpoch is the origin of NTP timestamps.
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Time returns NTPTimestamp as a time.Time. Timestamps from NTP era 1,
+// after 2036, are not handled.
+func (b *PrftBox) Time() time.Time {
+   seconds := int64(b.NTPTimestamp >> 32)
+   nanoseconds := int64((b.NTPTimestamp & 0xFFFFFFFF) * 1e9 >> 32)
+   return time.Unix(ntpEpoch.Unix()+seconds, nanoseconds).UTC()
+}
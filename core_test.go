@@ -0,0 +1,613 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "io"
+   "slices"
+   "strings"
+   "testing"
+   "time"
+)
+
+// countingReader records the number of bytes read through it.
+type countingReader struct {
+   *bytes.Reader
+   read int
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+   n, err := r.Reader.ReadAt(p, off)
+   r.read += n
+   return n, err
+}
+
+// countingSeeker records the number of bytes read through it.
+type countingSeeker struct {
+   *bytes.Reader
+   read int
+}
+
+func (r *countingSeeker) Read(p []byte) (int, error) {
+   n, err := r.Reader.Read(p)
+   r.read += n
+   return n, err
+}
+
+func TestFindMoovInReader(t *testing.T) {
+   init := buildInitSegment(false)
+   ftypSize := binary.BigEndian.Uint32(init)
+   ftyp, moov := init[:ftypSize], init[ftypSize:]
+
+   // ftyp, a large mdat using a 64-bit largesize, then a trailing moov.
+   const payloadSize = 1 << 20
+   mdat := make([]byte, 16+payloadSize)
+   binary.BigEndian.PutUint32(mdat, 1)
+   copy(mdat[4:8], "mdat")
+   binary.BigEndian.PutUint64(mdat[8:], uint64(len(mdat)))
+   file := bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+
+   r := &countingReader{Reader: bytes.NewReader(file)}
+   box, err := FindMoovInReader(r, int64(len(file)))
+   if err != nil {
+      t.Fatalf("FindMoovInReader failed: %v", err)
+   }
+   if len(box.Trak) != 1 || box.Trak[0].TrackID() != 1 {
+      t.Errorf("unexpected moov: %+v", box)
+   }
+   if r.read >= payloadSize {
+      t.Errorf("read %d bytes, mdat payload should have been skipped", r.read)
+   }
+
+   if _, err := FindMoovInReader(bytes.NewReader(ftyp), int64(len(ftyp))); err == nil {
+      t.Error("expected error when no moov is present")
+   }
+}
+
+func TestParse_Truncated(t *testing.T) {
+   init := buildInitSegment(false)
+   file := append(bytes.Clone(init), buildBox("mdat", make([]byte, 100))...)
+   cut := file[:len(init)+50] // cut in the middle of the mdat payload
+
+   boxes, err := Parse(cut)
+   if err != ErrSizeMismatch {
+      t.Fatalf("expected ErrSizeMismatch, got %v", err)
+   }
+   if len(boxes) != 3 {
+      t.Fatalf("expected ftyp, moov and a truncated box, got %d boxes", len(boxes))
+   }
+   if _, ok := FindMoov(boxes); !ok {
+      t.Error("'moov' box missing from partial tree")
+   }
+   last := boxes[2]
+   if !last.Truncated || len(last.Raw) != 50 || string(last.Raw[4:8]) != "mdat" {
+      t.Errorf("unexpected truncated box: truncated=%v len=%d", last.Truncated, len(last.Raw))
+   }
+
+   if _, err := Parse(file); err != nil {
+      t.Errorf("Parse of complete file failed: %v", err)
+   }
+}
+
+func TestEstimateParseCost(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // senc declaring more samples than the trun counts towards the cost
+   moof := buildBox("moof", buildBox("traf",
+      buildBox("trun", []byte{0, 0, 0, 0}, u32(3)),
+      buildBox("senc", []byte{0, 0, 0, 0}, u32(1000000)),
+   ))
+   moov := buildBox("moov", buildBox("trak", buildBox("mdia", buildBox("minf", buildBox("stbl",
+      buildBox("stsz", []byte{0, 0, 0, 0}, u32(100), u32(50)),
+   )))))
+   boxes, depth, samples, err := EstimateParseCost(append(moov, moof...))
+   if err != nil {
+      t.Fatalf("EstimateParseCost failed: %v", err)
+   }
+   if boxes != 10 || depth != 6 || samples != 1000050 {
+      t.Errorf("expected 10 boxes, depth 6, 1000050 samples, got %d %d %d", boxes, depth, samples)
+   }
+   if _, _, _, err := EstimateParseCost(moof[:len(moof)-1]); err != ErrSizeMismatch {
+      t.Errorf("expected ErrSizeMismatch, got %v", err)
+   }
+
+   // the same moof with a 64-bit largesize
+   large := binary.BigEndian.AppendUint32(nil, 1)
+   large = append(large, "moof"...)
+   large = binary.BigEndian.AppendUint64(large, uint64(len(moof)+8))
+   large = append(large, moof[8:]...)
+   boxes, depth, samples, err = EstimateParseCost(large)
+   if err != nil {
+      t.Fatalf("EstimateParseCost failed for largesize: %v", err)
+   }
+   if boxes != 4 || depth != 3 || samples != 1000000 {
+      t.Errorf("expected 4 boxes, depth 3, 1000000 samples, got %d %d %d", boxes, depth, samples)
+   }
+}
+
+func TestBrands(t *testing.T) {
+   ftyp := buildBox("ftyp", []byte("iso6"), []byte{0, 0, 0, 0}, []byte("iso6dash"))
+   moov := buildBox("moov")
+   data := append(bytes.Clone(ftyp), moov...)
+
+   out, err := SetMajorBrand(data, [4]byte{'c', 'm', 'f', 'c'})
+   if err != nil {
+      t.Fatalf("SetMajorBrand failed: %v", err)
+   }
+   if string(out[8:12]) != "cmfc" || len(out) != len(data) {
+      t.Errorf("unexpected major brand result %q", out)
+   }
+
+   out, err = AddCompatibleBrand(data, [4]byte{'c', 'm', 'f', 'c'})
+   if err != nil {
+      t.Fatalf("AddCompatibleBrand failed: %v", err)
+   }
+   expected := append(buildBox("ftyp", []byte("iso6"), []byte{0, 0, 0, 0}, []byte("iso6dashcmfc")), moov...)
+   if !bytes.Equal(out, expected) {
+      t.Errorf("compatible brand mismatch\n  Expected: %q\n  Got:      %q", expected, out)
+   }
+   again, err := AddCompatibleBrand(out, [4]byte{'d', 'a', 's', 'h'})
+   if err != nil || !bytes.Equal(again, out) {
+      t.Errorf("expected existing brand to be left alone, got %q %v", again, err)
+   }
+
+   if _, err := SetMajorBrand(moov, [4]byte{'c', 'm', 'f', 'c'}); err == nil {
+      t.Error("expected error without ftyp or styp")
+   }
+}
+
+func TestSerialize(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatal(err)
+   }
+   var expected []byte
+   for i := range boxes {
+      expected = append(expected, boxes[i].Encode()...)
+   }
+   var out bytes.Buffer
+   n, err := Serialize(&out, boxes)
+   if err != nil {
+      t.Fatalf("Serialize failed: %v", err)
+   }
+   if n != int64(len(expected)) || !bytes.Equal(out.Bytes(), expected) {
+      t.Errorf("expected %d encoded bytes, wrote %d", len(expected), n)
+   }
+
+   // every box of a media segment but the moov is written back as parsed
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   references := []byte{0, 0, 0, 100, 0, 0, 1, 0, 0x90, 0, 0, 0}
+   segment := slices.Concat(
+      buildBox("sidx", []byte{0, 0, 0, 0}, u32(1), u32(90000), u32(0), u32(0), []byte{0, 0, 0, 1}, references),
+      buildBox("pssh", []byte{0, 0, 0, 0}, make([]byte, 16), u32(0)),
+      buildEncryptedSegment(t, [][]byte{[]byte("round trip")}),
+   )
+   if boxes, err = Parse(segment); err != nil {
+      t.Fatal(err)
+   }
+   out.Reset()
+   if _, err := Serialize(&out, boxes); err != nil || !bytes.Equal(out.Bytes(), segment) {
+      t.Errorf("segment round trip mismatch: %d bytes in, %d out, %v", len(segment), out.Len(), err)
+   }
+
+   var stsz StszBox
+   if err := stsz.Parse(buildBox("stsz", []byte{0, 0, 0, 0}, []byte{0, 0, 0, 4}, []byte{0, 0, 0, 9})); err != nil {
+      t.Fatal(err)
+   }
+   var box bytes.Buffer
+   var writer io.WriterTo = &stsz
+   if n, err := writer.WriteTo(&box); err != nil || n != 20 || !bytes.Equal(box.Bytes(), stsz.Encode()) {
+      t.Errorf("unexpected WriteTo result %d %v", n, err)
+   }
+}
+
+func TestSidxBox_Parse(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   references := []byte{0, 0, 0, 2}
+   references = append(references, u32(1<<31|1000)...) // references a sidx
+   references = append(references, u32(90000)...)
+   references = append(references, u32(0)...)
+   references = append(references, u32(500)...)
+   references = append(references, u32(45000)...)
+   references = append(references, u32(1<<31|1<<28|7)...) // SAP type 1
+   expected := []SidxReference{
+      {ReferenceType: true, ReferencedSize: 1000, SubsegmentDuration: 90000},
+      {ReferencedSize: 500, SubsegmentDuration: 45000, StartsWithSAP: true, SAPType: 1, SAPDeltaTime: 7},
+   }
+
+   tests := []struct {
+      name        string
+      data        []byte
+      time        uint64
+      firstOffset uint64
+   }{
+      {"version 0", buildBox("sidx", []byte{0, 0, 0, 0}, u32(1), u32(90000), u32(1234), u32(56), references), 1234, 56},
+      {"version 1", buildBox("sidx", []byte{1, 0, 0, 0}, u32(1), u32(90000), u64(1<<40), u64(1<<33), references), 1 << 40, 1 << 33},
+   }
+   for _, test := range tests {
+      var box SidxBox
+      if err := box.Parse(test.data); err != nil {
+         t.Fatalf("%s: Parse failed: %v", test.name, err)
+      }
+      if box.ReferenceID != 1 || box.Timescale != 90000 {
+         t.Errorf("%s: unexpected reference ID %d or timescale %d", test.name, box.ReferenceID, box.Timescale)
+      }
+      if box.EarliestPresentationTime != test.time || box.FirstOffset != test.firstOffset {
+         t.Errorf("%s: expected time %d and offset %d, got %d and %d",
+            test.name, test.time, test.firstOffset, box.EarliestPresentationTime, box.FirstOffset)
+      }
+      if len(box.References) != len(expected) {
+         t.Fatalf("%s: expected %d references, got %d", test.name, len(expected), len(box.References))
+      }
+      for i := range expected {
+         if box.References[i] != expected[i] {
+            t.Errorf("%s reference %d: expected %+v, got %+v", test.name, i, expected[i], box.References[i])
+         }
+      }
+   }
+
+   var box SidxBox
+   short := buildBox("sidx", []byte{0, 0, 0, 0}, u32(1), u32(90000), u32(0), u32(0), []byte{0, 0, 0xFF, 0xFF})
+   if err := box.Parse(short); err == nil {
+      t.Error("expected error for reference count past the box end")
+   }
+   if err := box.Parse(buildBox("sidx", []byte{1, 0, 0, 0}, u32(1), u32(90000), u32(0), u32(0))); err == nil {
+      t.Error("expected error for version 1 with 32-bit fields")
+   }
+}
+
+func TestWalk(t *testing.T) {
+   init, segment, err := BuildTestContent(TestContentOptions{Scheme: "cenc", KID: testKID, Key: testKey})
+   if err != nil {
+      t.Fatal(err)
+   }
+   var paths []string
+   err = Walk(append(init, segment...), func(path []string, header BoxHeader, payload []byte) error {
+      paths = append(paths, strings.Join(path, "/"))
+      if string(header.Type[:]) != path[len(path)-1] {
+         t.Errorf("header type %q does not end path %v", header.Type[:], path)
+      }
+      if header.Size != uint64(len(payload)+header.HeaderSize) {
+         t.Errorf("%v: header size %d does not match payload of %d bytes", path, header.Size, len(payload))
+      }
+      return nil
+   })
+   if err != nil {
+      t.Fatalf("Walk failed: %v", err)
+   }
+   for _, expected := range []string{
+      "ftyp",
+      "moov/trak/mdia/minf/stbl/stsd/encv/sinf/schi/tenc",
+      "moov/mvex/trex",
+      "moof/traf/trun",
+      "mdat",
+   } {
+      if !slices.Contains(paths, expected) {
+         t.Errorf("path %q not visited", expected)
+      }
+   }
+
+   visited := 0
+   err = Walk(init, func(path []string, header BoxHeader, payload []byte) error {
+      visited++
+      return ErrStopWalk
+   })
+   if err != nil || visited != 1 {
+      t.Errorf("expected ErrStopWalk to end the walk after one box, got %d boxes and %v", visited, err)
+   }
+
+   nested := buildBox("free")
+   for range maxWalkDepth {
+      nested = buildBox("moov", nested)
+   }
+   if err := Walk(nested, func([]string, BoxHeader, []byte) error { return nil }); err == nil {
+      t.Error("expected error for boxes nested too deeply")
+   }
+   truncated := buildBox("moov", buildBox("trak", make([]byte, 8)))
+   binary.BigEndian.PutUint32(truncated[8:], 100)
+   if err := Walk(truncated, func([]string, BoxHeader, []byte) error { return nil }); err != ErrSizeMismatch {
+      t.Errorf("expected ErrSizeMismatch for a child past its parent, got %v", err)
+   }
+}
+
+func TestFindBoxByType(t *testing.T) {
+   init, segment, err := BuildTestContent(TestContentOptions{Scheme: "cenc", KID: testKID, Key: testKey})
+   if err != nil {
+      t.Fatal(err)
+   }
+   moof := childBoxes(segment)[0]
+   data := slices.Concat(init, moof, moof, segment)
+
+   truns, err := FindBoxByType(data, "trun")
+   if err != nil {
+      t.Fatalf("FindBoxByType failed: %v", err)
+   }
+   if len(truns) != 3 {
+      t.Fatalf("expected 3 truns, got %d", len(truns))
+   }
+   var trun TrunBox
+   if err := trun.Parse(truns[0]); err != nil || trun.SampleCount != 3 {
+      t.Errorf("expected a parseable trun of 3 samples, got %+v (%v)", trun, err)
+   }
+
+   tenc, ok := FindFirstBoxByType(data, "tenc")
+   if !ok {
+      t.Fatal("tenc not found")
+   }
+   var box TencBox
+   if err := box.Parse(tenc); err != nil || box.DefaultKID != testKID {
+      t.Errorf("unexpected tenc %+v (%v)", box, err)
+   }
+   if _, ok := FindFirstBoxByType(data, "pssh"); ok {
+      t.Error("expected no pssh")
+   }
+
+   // A corrupt size inside the second moof stops the search with an error
+   // after the trun of the first.
+   binary.BigEndian.PutUint32(data[len(init)+len(moof)+8:], 0xFFFF)
+   truns, err = FindBoxByType(data, "trun")
+   if err == nil || len(truns) != 1 {
+      t.Errorf("expected 1 trun and an error, got %d and %v", len(truns), err)
+   }
+}
+
+func TestBoxHeader_Parse(t *testing.T) {
+   large := binary.BigEndian.AppendUint32(nil, 1)
+   large = append(large, "mdat"...)
+   large = binary.BigEndian.AppendUint64(large, 24)
+   large = append(large, "payload!"...)
+   tests := []struct {
+      name       string
+      data       []byte
+      size       uint64
+      headerSize int
+      wantErr    bool
+   }{
+      {"32-bit size", buildBox("free", []byte("abcd")), 12, 8, false},
+      {"largesize", large, 24, 16, false},
+      {"to end of data", append([]byte{0, 0, 0, 0}, "mdat12345"...), 13, 8, false},
+      {"short largesize", large[:12], 0, 0, true},
+      {"largesize below header", binary.BigEndian.AppendUint64([]byte{0, 0, 0, 1, 'm', 'd', 'a', 't'}, 8), 0, 0, true},
+      {"largesize out of range", binary.BigEndian.AppendUint64([]byte{0, 0, 0, 1, 'm', 'd', 'a', 't'}, 1<<63), 0, 0, true},
+   }
+   for _, test := range tests {
+      var header BoxHeader
+      err := header.Parse(test.data)
+      if (err != nil) != test.wantErr {
+         t.Errorf("%s: unexpected error %v", test.name, err)
+         continue
+      }
+      if !test.wantErr && (header.Size != test.size || header.HeaderSize != test.headerSize) {
+         t.Errorf("%s: expected size %d and header %d, got %d and %d",
+            test.name, test.size, test.headerSize, header.Size, header.HeaderSize)
+      }
+   }
+
+   boxes, err := Parse(append(large, buildBox("free")...))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if len(boxes) != 2 || boxes[0].Mdat == nil || string(boxes[0].Mdat.Payload) != "payload!" {
+      t.Errorf("unexpected boxes for a largesize mdat: %+v", boxes)
+   }
+
+   // the box Parse methods reject truncated boxes instead of slicing
+   // past the end of data
+   var header BoxHeader
+   if err := header.Parse(large[:20]); err != ErrSizeMismatch || header.Size != 24 {
+      t.Errorf("expected ErrSizeMismatch with size 24, got %v and %d", err, header.Size)
+   }
+   truncated := buildBox("hdlr", make([]byte, 24))[:20]
+   if err := new(HdlrBox).Parse(truncated); err != ErrSizeMismatch {
+      t.Errorf("hdlr: expected ErrSizeMismatch, got %v", err)
+   }
+   if err := new(TkhdBox).Parse(truncated); err != ErrSizeMismatch {
+      t.Errorf("tkhd: expected ErrSizeMismatch, got %v", err)
+   }
+   if err := new(EmsgBox).Parse(truncated); err != ErrSizeMismatch {
+      t.Errorf("emsg: expected ErrSizeMismatch, got %v", err)
+   }
+}
+
+func TestBoxHeader_UUID(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // a PIFF senc with one sample and no subsamples
+   piff := buildBox("uuid", piffSencUUID[:], []byte{0, 0, 0, 0}, u32(1), make([]byte, 8))
+   var header BoxHeader
+   if err := header.Parse(piff); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if header.UserType != piffSencUUID || header.HeaderSize != 24 || header.Size != uint64(len(piff)) {
+      t.Errorf("unexpected header %+v", header)
+   }
+   if err := header.Parse(piff[:20]); err == nil {
+      t.Error("expected error for a truncated user type")
+   }
+
+   var payload []byte
+   err := Walk(buildBox("traf", piff), func(path []string, header BoxHeader, data []byte) error {
+      if header.Type == [4]byte{'u', 'u', 'i', 'd'} {
+         payload = data
+      }
+      return nil
+   })
+   if err != nil {
+      t.Fatalf("Walk failed: %v", err)
+   }
+   if !bytes.Equal(payload, piff[24:]) {
+      t.Errorf("expected uuid payload after the user type, got %x", payload)
+   }
+}
+
+func TestParseReader(t *testing.T) {
+   init, segment, err := BuildTestContent(TestContentOptions{})
+   if err != nil {
+      t.Fatal(err)
+   }
+   // a large mdat using a 64-bit largesize between the init and the segment
+   const payloadSize = 1 << 20
+   mdat := make([]byte, 16+payloadSize)
+   binary.BigEndian.PutUint32(mdat, 1)
+   copy(mdat[4:8], "mdat")
+   binary.BigEndian.PutUint64(mdat[8:], uint64(len(mdat)))
+   file := slices.Concat(init, mdat, segment)
+
+   seeker := &countingSeeker{Reader: bytes.NewReader(file)}
+   for name, r := range map[string]io.Reader{
+      "seeker": seeker,
+      "stream": io.MultiReader(bytes.NewReader(file)),
+   } {
+      boxes, err := ParseReader(r)
+      if err != nil {
+         t.Fatalf("%s: ParseReader failed: %v", name, err)
+      }
+      if len(boxes) != 5 || boxes[1].Moov == nil || boxes[3].Moof == nil || boxes[4].Mdat == nil {
+         t.Fatalf("%s: unexpected boxes %+v", name, boxes)
+      }
+      if large := boxes[2].Mdat; large == nil || large.Header.Size != uint64(len(mdat)) || large.Payload != nil {
+         t.Errorf("%s: expected a skipped largesize mdat, got %+v", name, boxes[2])
+      }
+      if moof := boxes[3].Moof; len(moof.Traf.Trun) != 1 || moof.Traf.Trun[0].SampleCount != 3 {
+         t.Errorf("%s: unexpected moof %+v", name, moof)
+      }
+   }
+   if seeker.read >= payloadSize {
+      t.Errorf("read %d bytes, mdat payload should have been skipped", seeker.read)
+   }
+
+   boxes, err := ParseReader(io.MultiReader(bytes.NewReader(file[:len(file)-2])))
+   if err != ErrSizeMismatch || len(boxes) != 5 {
+      t.Errorf("expected ErrSizeMismatch after 5 boxes, got %d and %v", len(boxes), err)
+   }
+   // a cut inside the skipped largesize mdat
+   cut := file[:len(init)+payloadSize/2]
+   for name, r := range map[string]io.Reader{
+      "seeker": bytes.NewReader(cut),
+      "stream": io.MultiReader(bytes.NewReader(cut)),
+   } {
+      if boxes, err := ParseReader(r); err != ErrSizeMismatch || len(boxes) != 3 {
+         t.Errorf("%s: expected ErrSizeMismatch after 3 boxes, got %d and %v", name, len(boxes), err)
+      }
+   }
+   var skipped bytes.Buffer
+   if _, err := Serialize(&skipped, boxes[2:3]); err != nil || skipped.Len() != 0 {
+      t.Errorf("expected a skipped mdat to encode to nothing, got %d bytes (%v)", skipped.Len(), err)
+   }
+   boxes, err = ParseReader(bytes.NewReader(init[:len(init)-2]))
+   if err != ErrSizeMismatch || len(boxes) != 2 || !boxes[1].Truncated {
+      t.Errorf("expected a truncated moov and ErrSizeMismatch, got %+v and %v", boxes, err)
+   }
+
+   var types []string
+   err = ParseReaderFunc(bytes.NewReader(file), func(header BoxHeader, body io.Reader) error {
+      types = append(types, string(header.Type[:]))
+      if string(header.Type[:]) == "ftyp" {
+         brand := make([]byte, 4)
+         if _, err := io.ReadFull(body, brand); err != nil || string(brand) != "iso6" {
+            t.Errorf("unexpected ftyp body %q (%v)", brand, err)
+         }
+      }
+      return nil
+   })
+   if err != nil || !slices.Equal(types, []string{"ftyp", "moov", "mdat", "moof", "mdat"}) {
+      t.Errorf("unexpected boxes %v (%v)", types, err)
+   }
+}
+
+func TestFtypBox_Parse(t *testing.T) {
+   styp := buildBox("styp", []byte("msdh"), []byte{0, 0, 0, 0}, []byte("msdhmsixcmfc"))
+   init, _, err := BuildTestContent(TestContentOptions{})
+   if err != nil {
+      t.Fatal(err)
+   }
+   boxes, err := Parse(append(init, styp...))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   ftyp := boxes[0].Ftyp
+   if ftyp == nil || string(ftyp.MajorBrand[:]) != "iso6" || !ftyp.HasCompatibleBrand("dash") {
+      t.Fatalf("unexpected ftyp %+v", ftyp)
+   }
+   last := boxes[len(boxes)-1]
+   if last.Styp == nil || !last.Styp.HasCompatibleBrand("cmfc") || last.Styp.HasCompatibleBrand("iso6") {
+      t.Errorf("unexpected styp %+v", last.Styp)
+   }
+   if len(last.Styp.CompatibleBrands) != 3 || !bytes.Equal(last.Encode(), styp) {
+      t.Error("styp should keep its brands and encode as parsed")
+   }
+}
+
+func TestPrftBox_Parse(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   // 2024-01-01 00:00:00.5 UTC in NTP time
+   const seconds = 3913056000
+   ntp := uint64(seconds)<<32 | 1<<31
+   v0 := buildBox("prft", []byte{0, 0, 0, 0x18}, u32(1), u64(ntp), u32(90000))
+   v1 := buildBox("prft", []byte{1, 0, 0, 0}, u32(2), u64(ntp), u64(1<<40))
+   boxes, err := Parse(append(v0, v1...))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if len(boxes) != 2 || boxes[0].Prft == nil || boxes[1].Prft == nil {
+      t.Fatalf("expected 2 prft boxes, got %+v", boxes)
+   }
+   prft := boxes[0].Prft
+   if prft.ReferenceTrackID != 1 || prft.MediaTime != 90000 || prft.NTPTimestamp != ntp || prft.Flags != 0x18 {
+      t.Errorf("prft v0: unexpected %+v", prft)
+   }
+   expected := time.Date(2024, 1, 1, 0, 0, 0, 500_000_000, time.UTC)
+   if !prft.Time().Equal(expected) {
+      t.Errorf("expected %v, got %v", expected, prft.Time())
+   }
+   if prft := boxes[1].Prft; prft.ReferenceTrackID != 2 || prft.MediaTime != 1<<40 {
+      t.Errorf("prft v1: unexpected %+v", prft)
+   }
+   if err := new(PrftBox).Parse(buildBox("prft", []byte{1, 0, 0, 0}, u32(1), u64(ntp), u32(0))); err == nil {
+      t.Error("expected error for truncated v1 media_time")
+   }
+}
+
+func TestParser_Overrun(t *testing.T) {
+   p := parser{data: []byte{0, 1, 2}}
+   if v := p.Uint16(); v != 1 || !p.Ok() {
+      t.Fatalf("expected 1 within bounds, got %d (ok %v)", v, p.Ok())
+   }
+   if v := p.Uint32(); v != 0 || p.Ok() {
+      t.Errorf("expected a zero overrun read, got %d (ok %v)", v, p.Ok())
+   }
+   if p.Bytes(1) != nil || p.Byte() != 0 || p.Uint64() != 0 {
+      t.Error("reads after an overrun should return zero values")
+   }
+   if !errors.Is(p.Err(), ErrParserOverrun) {
+      t.Errorf("expected ErrParserOverrun, got %v", p.Err())
+   }
+}
+
+func FuzzParse(f *testing.F) {
+   for _, scheme := range []string{"", "cenc", "cbcs"} {
+      init, segment, err := BuildTestContent(TestContentOptions{Scheme: scheme, KID: testKID, Key: testKey})
+      if err != nil {
+         f.Fatal(err)
+      }
+      f.Add(init)
+      f.Add(segment)
+   }
+   _, segment, err := BuildTestContent(TestContentOptions{Scheme: "cbcs", KID: testKID, Key: testKey, SampleGroup: true})
+   if err != nil {
+      f.Fatal(err)
+   }
+   f.Add(segment)
+   f.Add(buildInitSegment(true))
+   f.Fuzz(func(t *testing.T, data []byte) {
+      boxes, _ := Parse(data)
+      for _, box := range boxes {
+         if box.Moov != nil {
+            for _, trak := range box.Moov.Trak {
+               trak.Summary()
+            }
+         }
+      }
+   })
+}
@@ -1,11 +1,45 @@
 package sofia
 
 import (
+   "bytes"
    "crypto/cipher"
    "errors"
+   "io"
+   "strconv"
 )
 
 // --- PSSH ---
+
+// CommonSystemID is the system ID of the W3C common pssh box,
+// 1077efec-c0b2-4d02-ace3-3c1e52e2fb4b, which carries only key IDs and is
+// what browsers use for Clear Key.
+var CommonSystemID = [16]byte{
+   0x10, 0x77, 0xef, 0xec, 0xc0, 0xb2, 0x4d, 0x02,
+   0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b,
+}
+
+// ClearKeySystemID is the DASH-IF system ID of Clear Key,
+// e2719d58-a985-b3c9-781a-b030af78d30e.
+var ClearKeySystemID = [16]byte{
+   0xe2, 0x71, 0x9d, 0x58, 0xa9, 0x85, 0xb3, 0xc9,
+   0x78, 0x1a, 0xb0, 0x30, 0xaf, 0x78, 0xd3, 0x0e,
+}
+
+// SystemName returns a label for a well-known pssh system ID, or "unknown".
+func SystemName(id [16]byte) string {
+   switch id {
+   case WidevineSystemID:
+      return "Widevine"
+   case PlayReadySystemID:
+      return "PlayReady"
+   case CommonSystemID:
+      return "Common"
+   case ClearKeySystemID:
+      return "ClearKey"
+   }
+   return "unknown"
+}
+
 type PsshBox struct {
    Header   BoxHeader
    Version  byte
@@ -34,7 +68,7 @@ func (b *PsshBox) Parse(data []byte) error {
          return errors.New("pssh too short for KID count")
       }
       kidCount := p.Uint32()
-      if len(data) < p.offset+int(kidCount*16) {
+      if uint64(len(data)-p.offset) < uint64(kidCount)*16 {
          return errors.New("pssh too short for KIDs")
       }
       b.KIDs = make([][16]byte, kidCount)
@@ -54,6 +88,40 @@ func (b *PsshBox) Parse(data []byte) error {
    return nil
 }
 
+// Encode returns the pssh box, with the KID array written only for version
+// 1 and later. Version 0 boxes must not carry KIDs.
+func (b *PsshBox) Encode() ([]byte, error) {
+   if b.Version == 0 && len(b.KIDs) > 0 {
+      return nil, errors.New("pssh version 0 cannot carry KIDs")
+   }
+   size := 32 + len(b.Data) // header, version/flags, system ID, data size
+   if b.Version > 0 {
+      size += 4 + len(b.KIDs)*16
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+   w.PutBytes(b.SystemID[:])
+   if b.Version > 0 {
+      w.PutUint32(uint32(len(b.KIDs)))
+      for _, kid := range b.KIDs {
+         w.PutBytes(kid[:])
+      }
+   }
+   w.PutUint32(uint32(len(b.Data)))
+   w.PutBytes(b.Data)
+   if w.offset != size {
+      return nil, errors.New("pssh encoded size mismatch")
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'p', 's', 's', 'h'}
+   b.Header.Put(buffer)
+   return buffer, nil
+}
+
 // --- TENC ---
 // TencBox defines the Track Encryption Box ('tenc'), which contains
 // default encryption parameters for a track.
@@ -62,6 +130,8 @@ type TencBox struct {
    Header                 BoxHeader
    Version                byte
    Flags                  uint32
+   DefaultCryptByteBlock  byte // version 1 only
+   DefaultSkipByteBlock   byte // version 1 only
    DefaultIsProtected     byte
    DefaultPerSampleIVSize byte
    DefaultKID             [16]byte
@@ -70,6 +140,10 @@ type TencBox struct {
 }
 
 func (b *TencBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *TencBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
@@ -81,38 +155,104 @@ func (b *TencBox) Parse(data []byte) error {
    b.Version = byte(versionAndFlags >> 24)
    b.Flags = versionAndFlags & 0x00FFFFFF
 
-   if b.Version == 0 {
-      // Based on the error, the reserved field for this file is 2 bytes.
-      // Payload: reserved(2) + isProtected(1) + perSampleIVSize(1) + KID(16) = 20 bytes.
-      const requiredV0PayloadSize = 20
-      if len(data) < p.offset+requiredV0PayloadSize {
-         return errors.New("tenc v0 box too short for required fields")
-      }
-
-      // Correctly skip the 2 reserved bytes.
-      _ = p.Bytes(2)
-
-      b.DefaultIsProtected = p.Byte()
-      b.DefaultPerSampleIVSize = p.Byte()
-      copy(b.DefaultKID[:], p.Bytes(16))
-
-      if b.DefaultIsProtected == 1 && b.DefaultPerSampleIVSize == 0 {
-         if p.offset < int(b.Header.Size) {
-            if len(data) < p.offset+1 {
-               return errors.New("tenc box truncated before constant IV size")
-            }
-            b.DefaultConstantIVSize = p.Byte()
-            if len(data) < p.offset+int(b.DefaultConstantIVSize) {
-               return errors.New("tenc box truncated, not enough data for constant IV")
-            }
-            b.DefaultConstantIV = p.Bytes(int(b.DefaultConstantIVSize))
+   if b.Version > 1 {
+      // Unknown versions leave the fields as their zero-value.
+      return nil
+   }
+   // Payload: reserved(1) + reserved(1) in v0 or crypt/skip byte blocks in
+   // v1 + isProtected(1) + perSampleIVSize(1) + KID(16) = 20 bytes.
+   const requiredPayloadSize = 20
+   if len(data) < p.offset+requiredPayloadSize {
+      return errors.New("tenc box too short for required fields")
+   }
+   reserved := p.Bytes(2)
+   b.DefaultCryptByteBlock, b.DefaultSkipByteBlock = 0, 0
+   if b.Version == 1 {
+      b.DefaultCryptByteBlock = reserved[1] >> 4
+      b.DefaultSkipByteBlock = reserved[1] & 0x0F
+      reserved = reserved[:1]
+   }
+   if err := opts.checkReserved(reserved); err != nil {
+      return err
+   }
+
+   b.DefaultIsProtected = p.Byte()
+   b.DefaultPerSampleIVSize = p.Byte()
+   copy(b.DefaultKID[:], p.Bytes(16))
+
+   if b.DefaultIsProtected == 1 && b.DefaultPerSampleIVSize == 0 {
+      if p.offset < int(b.Header.Size) {
+         if len(data) < p.offset+1 {
+            return errors.New("tenc box truncated before constant IV size")
+         }
+         b.DefaultConstantIVSize = p.Byte()
+         if len(data) < p.offset+int(b.DefaultConstantIVSize) {
+            return errors.New("tenc box truncated, not enough data for constant IV")
          }
+         b.DefaultConstantIV = p.Bytes(int(b.DefaultConstantIVSize))
       }
    }
-   // For other versions, we do nothing and leave the fields as their zero-value.
    return nil
 }
 
+// Encode returns the tenc box. The two bytes after version and flags are
+// written as Parse reads them: both reserved in version 0, and a reserved
+// byte followed by the crypt and skip byte block nibbles in version 1. The
+// constant IV is written when the track is protected with no per-sample IV.
+func (b *TencBox) Encode() ([]byte, error) {
+   if b.Version > 1 {
+      return nil, errors.New("unsupported tenc version " + strconv.Itoa(int(b.Version)))
+   }
+   constantIV := b.DefaultIsProtected == 1 && b.DefaultPerSampleIVSize == 0
+   size := 32 // header, version/flags, 2 reserved or pattern, 2 fields, KID
+   if constantIV {
+      if len(b.DefaultConstantIV) != 8 && len(b.DefaultConstantIV) != 16 {
+         return nil, errors.New("tenc constant IV must be 8 or 16 bytes")
+      }
+      size += 1 + len(b.DefaultConstantIV)
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags&0x00FFFFFF)
+   w.PutByte(0) // reserved
+   if b.Version == 1 {
+      w.PutByte(b.DefaultCryptByteBlock<<4 | b.DefaultSkipByteBlock&0x0F)
+   } else {
+      w.PutByte(0) // reserved
+   }
+   w.PutByte(b.DefaultIsProtected)
+   w.PutByte(b.DefaultPerSampleIVSize)
+   w.PutBytes(b.DefaultKID[:])
+   if constantIV {
+      b.DefaultConstantIVSize = byte(len(b.DefaultConstantIV))
+      w.PutByte(b.DefaultConstantIVSize)
+      w.PutBytes(b.DefaultConstantIV)
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'t', 'e', 'n', 'c'}
+   b.Header.Put(buffer)
+   return buffer, nil
+}
+
+// ApplyConstantIV gives every sample of senc without a per-sample IV the
+// DefaultConstantIV of the track, for tracks whose DefaultPerSampleIVSize
+// is 0. Each sample starts from the same IV; it is not advanced across
+// samples. Constant IVs are only allowed with the cbcs scheme, so decrypt
+// such samples with DecryptSampleCBCS: with the CTR mode of DecryptSample
+// a shared IV would reuse the key stream.
+func (b *TencBox) ApplyConstantIV(senc *SencBox) {
+   if len(b.DefaultConstantIV) == 0 {
+      return
+   }
+   for i := range senc.Samples {
+      if len(senc.Samples[i].IV) == 0 {
+         senc.Samples[i].IV = b.DefaultConstantIV
+      }
+   }
+}
+
 // --- SENC ---
 type SubsampleInfo struct {
    BytesOfClearData     uint16
@@ -124,43 +264,136 @@ type SampleEncryptionInfo struct {
    Subsamples []SubsampleInfo
 }
 
+// ClearHeaderSize returns the number of clear bytes at the start of the
+// sample, such as an ADTS header left unencrypted. It is zero for
+// full-sample encryption.
+func (s *SampleEncryptionInfo) ClearHeaderSize() int {
+   if len(s.Subsamples) == 0 {
+      return 0
+   }
+   return int(s.Subsamples[0].BytesOfClearData)
+}
+
+// piffSencUUID is the extended type of the PIFF SampleEncryptionBox, the
+// 'uuid' predecessor of 'senc' used by Smooth Streaming.
+var piffSencUUID = [16]byte{0xA2, 0x39, 0x4F, 0x52, 0x5A, 0x9B, 0x4F, 0x14, 0xA2, 0x44, 0x6C, 0x42, 0x7C, 0x64, 0x8D, 0xF4}
+
 type SencBox struct {
-   Header  BoxHeader
-   Flags   uint32
-   Samples []SampleEncryptionInfo
+   Header      BoxHeader
+   Flags       uint32
+   AlgorithmID uint32   // PIFF only, present if Flags&1
+   IVSize      byte     // PIFF only, present if Flags&1
+   KID         [16]byte // PIFF only, present if Flags&1
+   Samples     []SampleEncryptionInfo
+   // lastTruncated records that Parse failed inside the final entry, which
+   // RepairAgainstTrun may be able to drop.
+   lastTruncated bool
 }
 
 func (b *SencBox) Parse(data []byte) error {
+   return b.ParseWithIVSize(data, 8)
+}
+
+// ParseWithIVSize is Parse for a track whose per-sample IV size, which the
+// senc box does not carry, is ivSize: 8 or 16, or 0 when the track uses a
+// constant IV and the samples hold subsample entries only.
+func (b *SencBox) ParseWithIVSize(data []byte, ivSize int) error {
+   return b.parseWithIVSize(data, ivSize, nil)
+}
+
+func (b *SencBox) parseWithIVSize(data []byte, ivSize int, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
    if len(data) < 16 { // 8 byte header, 4 byte flags, 4 byte sample count
       return errors.New("senc too short")
    }
+   if ivSize != 0 && ivSize != 8 && ivSize != 16 {
+      return errors.New("invalid per-sample IV size " + strconv.Itoa(ivSize))
+   }
 
    p := parser{data: data, offset: 8}
    b.Flags = p.Uint32() & 0x00FFFFFF
+   return b.parseSamples(data, p, ivSize, opts)
+}
+
+// ParsePIFF parses a PIFF SampleEncryptionBox, a 'uuid' box with the
+// extended type A2394F52-5A9B-4F14-A244-6C427C648DF4. When Flags&1 is set
+// the box overrides the algorithm, IV size and KID of the track, and the
+// samples are read with that IV size.
+func (b *SencBox) ParsePIFF(data []byte) error {
+   return b.parsePIFF(data, nil)
+}
+
+func (b *SencBox) parsePIFF(data []byte, opts *ParseOptions) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if b.Header.UserType != piffSencUUID {
+      return errors.New("not a PIFF senc box")
+   }
+   if len(data) < b.Header.HeaderSize+8 { // 4 flags, 4 sample count
+      return errors.New("PIFF senc too short")
+   }
+
+   p := parser{data: data, offset: b.Header.HeaderSize}
+   b.Flags = p.Uint32() & 0x00FFFFFF
+   ivSize := 8
+   if b.Flags&0x000001 != 0 {
+      if len(data) < p.offset+24 {
+         return errors.New("PIFF senc too short for override fields")
+      }
+      b.AlgorithmID = p.UintN(3)
+      b.IVSize = p.Byte()
+      copy(b.KID[:], p.Bytes(16))
+      ivSize = int(b.IVSize)
+   }
+   return b.parseSamples(data, p, ivSize, opts)
+}
+
+// parseSamples reads the sample count and entries that follow the flags.
+func (b *SencBox) parseSamples(data []byte, p parser, ivSize int, opts *ParseOptions) error {
+   if len(data) < p.offset+4 {
+      return errors.New("senc too short")
+   }
    sampleCount := p.Uint32()
+   subsamplesPresent := b.Flags&0x000002 != 0
 
+   // every sample but a truncated last one takes at least this many bytes,
+   // so a corrupt count is rejected before it can force a large allocation
+   minSize := ivSize
+   if subsamplesPresent {
+      minSize += 2
+   }
+   if minSize > 0 && sampleCount > 0 && uint64(sampleCount-1)*uint64(minSize) > uint64(len(data)-p.offset) {
+      return errors.New("senc sample count exceeds box size")
+   }
+   if minSize == 0 && !opts.takeFieldless(sampleCount) {
+      return errors.New("senc sample count too large for samples without fields")
+   }
    b.Samples = make([]SampleEncryptionInfo, sampleCount)
-   const ivSize = 8
-   subsamplesPresent := b.Flags&0x000002 != 0
    for i := uint32(0); i < sampleCount; i++ {
-      if len(data) < p.offset+ivSize {
-         return errors.New("senc truncated while reading IV")
+      truncated := func(message string) error {
+         b.lastTruncated = i == sampleCount-1
+         return errors.New(message)
+      }
+      if ivSize > 0 {
+         if len(data) < p.offset+ivSize {
+            return truncated("senc truncated while reading IV")
+         }
+         b.Samples[i].IV = p.Bytes(ivSize)
       }
-      b.Samples[i].IV = p.Bytes(ivSize)
 
       if subsamplesPresent {
          if len(data) < p.offset+2 {
-            return errors.New("senc truncated while reading subsample count")
+            return truncated("senc truncated while reading subsample count")
          }
          subsampleCount := p.Uint16()
+         if len(data)-p.offset < int(subsampleCount)*6 {
+            return truncated("senc truncated while reading subsample")
+         }
          b.Samples[i].Subsamples = make([]SubsampleInfo, subsampleCount)
          for j := uint16(0); j < subsampleCount; j++ {
-            if len(data) < p.offset+6 {
-               return errors.New("senc truncated while reading subsample")
-            }
             clear := p.Uint16()
             prot := p.Uint32()
             b.Samples[i].Subsamples[j] = SubsampleInfo{clear, prot}
@@ -170,33 +403,393 @@ func (b *SencBox) Parse(data []byte) error {
    return nil
 }
 
+// RepairAgainstTrun works around a packager bug that writes a senc sample
+// count one greater than the trun sample count, leaving a truncated final
+// entry. If Parse failed in exactly that way it drops the bogus entry and
+// returns true. TrafBox parsing calls it unless ParseOptions.Strict is set.
+func (b *SencBox) RepairAgainstTrun(sampleCount uint32) bool {
+   if !b.lastTruncated || len(b.Samples) != int(sampleCount)+1 {
+      return false
+   }
+   b.Samples = b.Samples[:sampleCount]
+   b.lastTruncated = false
+   return true
+}
+
+// Encode returns the senc box with every sample IV ivSize bytes long. The
+// subsample tables are written if any sample has subsamples or Flags&2 is
+// already set, in which case samples without subsamples get a
+// subsample_count of 0.
+func (b *SencBox) Encode(ivSize byte) ([]byte, error) {
+   subsamplesPresent := b.Flags&0x000002 != 0
+   size := 16
+   for _, sample := range b.Samples {
+      if len(sample.IV) != int(ivSize) {
+         return nil, errors.New("senc sample IV does not match IV size")
+      }
+      size += len(sample.IV)
+      if len(sample.Subsamples) > 0 {
+         subsamplesPresent = true
+      }
+   }
+   b.Flags &^= 0x000002
+   if subsamplesPresent {
+      b.Flags |= 0x000002
+      for _, sample := range b.Samples {
+         size += 2 + len(sample.Subsamples)*6
+      }
+   }
+
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(b.Flags)
+   w.PutUint32(uint32(len(b.Samples)))
+   for _, sample := range b.Samples {
+      w.PutBytes(sample.IV)
+      if subsamplesPresent {
+         w.PutUint16(uint16(len(sample.Subsamples)))
+         for _, subsample := range sample.Subsamples {
+            w.PutUint16(subsample.BytesOfClearData)
+            w.PutUint32(subsample.BytesOfProtectedData)
+         }
+      }
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'s', 'e', 'n', 'c'}
+   b.Header.Put(buffer)
+   return buffer, nil
+}
+
+// --- Sample Auxiliary Information ---
+
+// parseAuxInfo decodes the CENC auxiliary information of one sample, which
+// is laid out like a senc entry: the IV followed by an optional subsample
+// table.
+func parseAuxInfo(data []byte, ivSize int) (SampleEncryptionInfo, error) {
+   var info SampleEncryptionInfo
+   if len(data) < ivSize {
+      return info, errors.New("aux info too short for IV")
+   }
+   p := parser{data: data}
+   info.IV = p.Bytes(ivSize)
+   if p.offset == len(data) {
+      return info, nil
+   }
+   if len(data) < p.offset+2 {
+      return info, errors.New("aux info truncated while reading subsample count")
+   }
+   subsampleCount := p.Uint16()
+   if len(data)-p.offset < int(subsampleCount)*6 {
+      return info, errors.New("aux info truncated while reading subsamples")
+   }
+   info.Subsamples = make([]SubsampleInfo, subsampleCount)
+   for i := range info.Subsamples {
+      clear := p.Uint16()
+      prot := p.Uint32()
+      info.Subsamples[i] = SubsampleInfo{clear, prot}
+   }
+   return info, nil
+}
+
+// parseVariableAuxInfo is parseAuxInfo for packagings whose IV size varies
+// from sample to sample, as saiz per-sample sizes allow. An entry that does
+// not fit ivSize exactly is read with the other of the 8 and 16 byte IV
+// sizes if that fits instead.
+func parseVariableAuxInfo(data []byte, ivSize int) (SampleEncryptionInfo, error) {
+   info, err := parseAuxInfo(data, ivSize)
+   if auxInfoSize(info) == len(data) || (ivSize != 8 && ivSize != 16) {
+      return info, err
+   }
+   if other, otherErr := parseAuxInfo(data, 24-ivSize); otherErr == nil && auxInfoSize(other) == len(data) {
+      return other, nil
+   }
+   if err == nil {
+      err = errors.New("aux info size does not match its IV and subsamples")
+   }
+   return info, err
+}
+
+// auxInfoSize returns the encoded size of an aux info entry.
+func auxInfoSize(info SampleEncryptionInfo) int {
+   if info.Subsamples == nil {
+      return len(info.IV)
+   }
+   return len(info.IV) + 2 + 6*len(info.Subsamples)
+}
+
+// ParseSampleAuxInfoAt reads the CENC auxiliary information located by saio
+// and sized by saiz directly from r, so the media does not have to be held
+// in memory. Offsets are relative to base. When saio holds more than one
+// offset, each one starts a chunk (a trun in a fragment) whose sample count
+// is given by chunkSampleCounts. Samples whose saiz size fits a 16 byte IV
+// rather than an 8 byte one, or the reverse, are read with that IV size.
+func ParseSampleAuxInfoAt(r io.ReaderAt, saiz *SaizBox, saio *SaioBox, base int64, ivSize int, chunkSampleCounts []uint32) ([]SampleEncryptionInfo, error) {
+   if len(saio.Offsets) == 0 {
+      return nil, errors.New("saio has no offsets")
+   }
+   counts := chunkSampleCounts
+   if len(saio.Offsets) == 1 {
+      counts = []uint32{saiz.SampleCount}
+   }
+   if len(counts) != len(saio.Offsets) {
+      return nil, errors.New("saio entry count does not match chunk count")
+   }
+   infos := make([]SampleEncryptionInfo, 0, saiz.SampleCount)
+   sample := 0
+   for i, count := range counts {
+      total := 0
+      for j := 0; j < int(count); j++ {
+         total += saiz.SampleInfoSize(sample + j)
+      }
+      buffer := make([]byte, total)
+      if n, err := r.ReadAt(buffer, base+int64(saio.Offsets[i])); n < total {
+         return nil, err
+      }
+      for j := 0; j < int(count); j++ {
+         size := saiz.SampleInfoSize(sample)
+         info, err := parseVariableAuxInfo(buffer[:size], ivSize)
+         if err != nil {
+            return nil, err
+         }
+         infos = append(infos, info)
+         buffer = buffer[size:]
+         sample++
+      }
+   }
+   return infos, nil
+}
+
+// ParseAuxInfo reads the CENC auxiliary information of a fragment stored
+// in mdat rather than in a senc box, as located by a single saio offset
+// relative to the start of mdat and sized by saiz. The result has the same
+// shape as SencBox.Samples, so it can be passed to DecryptSample.
+func ParseAuxInfo(mdat []byte, saio *SaioBox, saiz *SaizBox, ivSize int) ([]SampleEncryptionInfo, error) {
+   if len(saio.Offsets) != 1 {
+      return nil, errors.New("saio must hold a single offset, got " + strconv.Itoa(len(saio.Offsets)))
+   }
+   total := uint64(0)
+   for i := 0; i < int(saiz.SampleCount); i++ {
+      total += uint64(saiz.SampleInfoSize(i))
+   }
+   if offset := saio.Offsets[0]; offset > uint64(len(mdat)) || total > uint64(len(mdat))-offset {
+      return nil, errors.New("aux info extends past end of mdat")
+   }
+   return ParseSampleAuxInfoAt(bytes.NewReader(mdat), saiz, saio, 0, ivSize, nil)
+}
+
+// --- Keys ---
+
+// KeyProvider looks up the content key for a key ID.
+type KeyProvider interface {
+   Key(kid [16]byte) ([]byte, bool)
+}
+
+// KeyMap is a KeyProvider backed by a map from key ID to content key.
+type KeyMap map[[16]byte][]byte
+
+func (m KeyMap) Key(kid [16]byte) ([]byte, bool) {
+   key, ok := m[kid]
+   return key, ok
+}
+
+// Decrypter decrypts protected content with the keys of Keys. The package
+// functions DecryptSegment, ClearSegment, DecryptFile and the like use a
+// Decrypter holding only their keys.
+type Decrypter struct {
+   Keys KeyProvider
+   // Init is the moov of the init segment of the content, whose tenc gives
+   // the key ID and IV size of each track when its fragments carry no
+   // seig sample group or tenc of their own. A moov in the content being
+   // decrypted takes precedence.
+   Init *MoovBox
+   // ClampOverruns clamps a subsample that overruns its sample, which only
+   // happens with corrupt encryption metadata, to the end of the sample
+   // with a warning. By default decryption fails with a
+   // *SubsampleOverrunError instead.
+   ClampOverruns bool
+   // Warn, if not nil, is called with a description of every problem that
+   // is repaired instead of reported as an error, while decrypting or
+   // while parsing the content to decrypt.
+   Warn func(message string)
+}
+
+// parseOptions returns the options to parse content to decrypt with.
+func (d *Decrypter) parseOptions() *ParseOptions {
+   return &ParseOptions{Warn: d.Warn, fieldless: new(uint64)}
+}
+
+// overrun handles subsample running past the end of its sample, returning
+// the error to stop decryption with or nil to clamp it.
+func (d *Decrypter) overrun(subsample int) error {
+   err := &SubsampleOverrunError{Subsample: subsample}
+   if !d.ClampOverruns {
+      return err
+   }
+   if d.Warn != nil {
+      d.Warn(err.Error() + "; clamped")
+   }
+   return nil
+}
+
 // --- Logic ---
-func DecryptSample(sample []byte, info *SampleEncryptionInfo, block cipher.Block) {
+
+// IncrementIV returns a copy of iv advanced by blocks AES blocks, treating
+// it as a 128-bit big-endian counter with carry across all bytes. An 8-byte
+// IV is first padded with zeros to 16 bytes, as CTR mode does.
+func IncrementIV(iv []byte, blocks uint64) []byte {
+   counter := make([]byte, 16)
+   copy(counter, iv)
+   for i := 15; i >= 0 && blocks != 0; i-- {
+      sum := uint64(counter[i]) + blocks&0xFF
+      counter[i] = byte(sum)
+      blocks = blocks>>8 + sum>>8
+   }
+   return counter
+}
+
+// NormalizeIV returns the 16 byte IV to start the cipher of a protection
+// scheme with. The AES-CTR schemes cenc and cens take 8 or 16 byte IVs, an
+// 8 byte IV being the upper half of the counter block; the AES-CBC schemes
+// cbc1 and cbcs need exactly 16 bytes, so an 8 byte IV is an error. A
+// constant IV has to be supplied in its place, see TencBox.ApplyConstantIV.
+func NormalizeIV(iv []byte, scheme string) ([]byte, error) {
+   switch scheme {
+   case "cenc", "cens":
+      switch len(iv) {
+      case 8:
+         padded := make([]byte, 16)
+         copy(padded, iv)
+         return padded, nil
+      case 16:
+         return iv, nil
+      }
+   case "cbc1", "cbcs":
+      if len(iv) == 16 {
+         return iv, nil
+      }
+   default:
+      return nil, errors.New("unknown protection scheme " + scheme)
+   }
+   return nil, errors.New(scheme + " does not take a " + strconv.Itoa(len(iv)) + " byte IV")
+}
+
+// SubsampleOverrunError reports a subsample that extends past the end of
+// its sample, which only happens with corrupt encryption metadata.
+type SubsampleOverrunError struct {
+   Sample    int // index of the sample in its fragment or track
+   Subsample int
+}
+
+func (e *SubsampleOverrunError) Error() string {
+   return "subsample " + strconv.Itoa(e.Subsample) + " of sample " +
+      strconv.Itoa(e.Sample) + " extends past the sample end"
+}
+
+// ErrMissingIV is returned by DecryptSample and DecryptSampleCBCS for a
+// sample with no encryption info or an empty IV, and by the segment and
+// file decryption for a protected sample that has neither a per-sample IV
+// nor a constant IV to fall back on. Tracks using a constant IV need
+// TencBox.ApplyConstantIV before DecryptSampleCBCS.
+var ErrMissingIV = errors.New("sample has no encryption info or IV")
+
+// DecryptSample decrypts a sample in place under the cenc scheme: AES-CTR
+// over the whole sample, or over the protected bytes of each subsample with
+// the keystream running across them. A subsample that overruns the sample
+// fails with a *SubsampleOverrunError; see Decrypter.ClampOverruns to
+// clamp it instead.
+func DecryptSample(sample []byte, info *SampleEncryptionInfo, block cipher.Block) error {
+   return new(Decrypter).DecryptSample(sample, info, block)
+}
+
+// DecryptSample is the package DecryptSample, with overrunning subsamples
+// clamped if d.ClampOverruns is set.
+func (d *Decrypter) DecryptSample(sample []byte, info *SampleEncryptionInfo, block cipher.Block) error {
    if info == nil || len(info.IV) == 0 {
-      return
+      return ErrMissingIV
    }
-   iv := info.IV
-   if len(iv) == 8 {
-      paddedIV := make([]byte, 16)
-      copy(paddedIV, iv)
-      iv = paddedIV
+   iv, err := NormalizeIV(info.IV, "cenc")
+   if err != nil {
+      return err
    }
    stream := cipher.NewCTR(block, iv)
    if len(info.Subsamples) == 0 {
       stream.XORKeyStream(sample, sample)
-   } else {
-      sampleOffset := 0
-      for _, subsample := range info.Subsamples {
-         sampleOffset += int(subsample.BytesOfClearData)
-         if subsample.BytesOfProtectedData > 0 {
-            end := sampleOffset + int(subsample.BytesOfProtectedData)
-            if end > len(sample) {
-               end = len(sample)
-            }
-            chunk := sample[sampleOffset:end]
-            stream.XORKeyStream(chunk, chunk)
-            sampleOffset = end
+      return nil
+   }
+   sampleOffset := 0
+   for i, subsample := range info.Subsamples {
+      end := sampleOffset + int(subsample.BytesOfClearData) + int(subsample.BytesOfProtectedData)
+      if end > len(sample) {
+         if err := d.overrun(i); err != nil {
+            return err
+         }
+      }
+      sampleOffset = min(sampleOffset+int(subsample.BytesOfClearData), len(sample))
+      if subsample.BytesOfProtectedData > 0 {
+         end := min(sampleOffset+int(subsample.BytesOfProtectedData), len(sample))
+         chunk := sample[sampleOffset:end]
+         stream.XORKeyStream(chunk, chunk)
+         sampleOffset = end
+      }
+   }
+   return nil
+}
+
+// DecryptSampleCBCS decrypts a sample in place under the cbcs scheme: AES-CBC
+// applied to cryptByteBlock 16-byte blocks out of every cryptByteBlock +
+// skipByteBlock, starting over from the IV at each subsample. Clear
+// subsample bytes, the skipped blocks and any trailing partial block of a
+// protected range are left untouched. A pattern of 0:0 encrypts every
+// whole block. Subsamples overrunning the sample are handled as by
+// DecryptSample.
+func DecryptSampleCBCS(sample []byte, info *SampleEncryptionInfo, block cipher.Block, cryptByteBlock, skipByteBlock byte) error {
+   return new(Decrypter).DecryptSampleCBCS(sample, info, block, cryptByteBlock, skipByteBlock)
+}
+
+// DecryptSampleCBCS is the package DecryptSampleCBCS, with overrunning
+// subsamples clamped if d.ClampOverruns is set.
+func (d *Decrypter) DecryptSampleCBCS(sample []byte, info *SampleEncryptionInfo, block cipher.Block, cryptByteBlock, skipByteBlock byte) error {
+   if info == nil || len(info.IV) == 0 {
+      return ErrMissingIV
+   }
+   iv, err := NormalizeIV(info.IV, "cbcs")
+   if err != nil {
+      return err
+   }
+   if len(info.Subsamples) == 0 {
+      decryptPattern(sample, iv, block, cryptByteBlock, skipByteBlock)
+      return nil
+   }
+   sampleOffset := 0
+   for i, subsample := range info.Subsamples {
+      end := sampleOffset + int(subsample.BytesOfClearData) + int(subsample.BytesOfProtectedData)
+      if end > len(sample) {
+         if err := d.overrun(i); err != nil {
+            return err
          }
       }
+      sampleOffset = min(sampleOffset+int(subsample.BytesOfClearData), len(sample))
+      end = min(sampleOffset+int(subsample.BytesOfProtectedData), len(sample))
+      decryptPattern(sample[sampleOffset:end], iv, block, cryptByteBlock, skipByteBlock)
+      sampleOffset = end
+   }
+   return nil
+}
+
+// decryptPattern decrypts one protected range with AES-CBC, chaining
+// across the encrypted blocks of the pattern.
+func decryptPattern(data, iv []byte, block cipher.Block, cryptByteBlock, skipByteBlock byte) {
+   const blockSize = 16
+   if cryptByteBlock == 0 && skipByteBlock == 0 {
+      cryptByteBlock = 1
+   }
+   mode := cipher.NewCBCDecrypter(block, iv)
+   crypt := int(cryptByteBlock) * blockSize
+   stride := crypt + int(skipByteBlock)*blockSize
+   for offset := 0; offset+blockSize <= len(data); offset += stride {
+      end := offset + min(crypt, (len(data)-offset)/blockSize*blockSize)
+      mode.CryptBlocks(data[offset:end], data[offset:end])
    }
 }
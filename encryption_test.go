@@ -2,9 +2,16 @@ package sofia
 
 import (
    "bytes"
+   "crypto/aes"
+   "crypto/cipher"
+   "encoding/binary"
    "encoding/hex"
+   "errors"
+   "io"
+   "math"
    "os"
    "path/filepath"
+   "slices"
    "testing"
 )
 
@@ -65,3 +72,803 @@ func TestTencBox_Parsing(t *testing.T) {
       t.Logf("OK: DefaultKID parsed correctly as %s", hex.EncodeToString(parsedKID))
    }
 }
+
+func TestSinfBox_Frma(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(true))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   moov, _ := FindMoov(boxes)
+   sinf, _, ok := moov.Trak[0].Mdia.Minf.Stbl.Stsd.Sinf()
+   if !ok {
+      t.Fatal("'sinf' box not found")
+   }
+   if sinf.Frma == nil {
+      t.Fatal("'frma' box not found in 'sinf'")
+   }
+   if format := string(sinf.Frma.DataFormat[:]); format != "avc1" {
+      t.Errorf("expected DataFormat %q, got %q", "avc1", format)
+   }
+}
+
+func TestPsshBox_Encode(t *testing.T) {
+   tests := []PsshBox{
+      {SystemID: WidevineSystemID, Data: []byte{0x12, 0x10}},
+      {Version: 1, SystemID: CommonSystemID, KIDs: [][16]byte{testKID, {1}}},
+   }
+   for _, box := range tests {
+      data, err := box.Encode()
+      if err != nil {
+         t.Fatalf("version %d: Encode failed: %v", box.Version, err)
+      }
+      if int(box.Header.Size) != len(data) {
+         t.Errorf("version %d: header size %d, encoded %d bytes", box.Version, box.Header.Size, len(data))
+      }
+      var parsed PsshBox
+      if err := parsed.Parse(data); err != nil {
+         t.Fatalf("version %d: Parse failed: %v", box.Version, err)
+      }
+      if parsed.Version != box.Version || parsed.SystemID != box.SystemID ||
+         !slices.Equal(parsed.KIDs, box.KIDs) || !bytes.Equal(parsed.Data, box.Data) {
+         t.Errorf("version %d: round trip mismatch %+v", box.Version, parsed)
+      }
+   }
+   bad := PsshBox{KIDs: [][16]byte{testKID}}
+   if _, err := bad.Encode(); err == nil {
+      t.Error("expected error for KIDs in a version 0 box")
+   }
+}
+
+func TestSystemName(t *testing.T) {
+   tests := map[string]string{
+      "edef8ba979d64acea3c827dcd51d21ed": "Widevine",
+      "9a04f07998404286ab92e65be0885f95": "PlayReady",
+      "1077efecc0b24d02ace33c1e52e2fb4b": "Common",
+      "e2719d58a985b3c9781ab030af78d30e": "ClearKey",
+      "94ce86fb07ff4f43adb893d2fa968ca2": "unknown",
+   }
+   for id, expected := range tests {
+      data, _ := hex.DecodeString(id)
+      if name := SystemName([16]byte(data)); name != expected {
+         t.Errorf("%s: expected %q, got %q", id, expected, name)
+      }
+   }
+}
+
+func TestSchmBox_Parse(t *testing.T) {
+   tests := []struct {
+      name    string
+      data    []byte
+      scheme  string
+      uri     string
+      wantErr bool
+   }{
+      {"cenc", buildBox("schm", []byte{0, 0, 0, 0}, []byte("cenc"), []byte{0, 1, 0, 0}), "cenc", "", false},
+      {"cbcs with URI", buildBox("schm", []byte{0, 0, 0, 1}, []byte("cbcs"), []byte{0, 1, 0, 0},
+         []byte("https://example.com/scheme\x00")), "cbcs", "https://example.com/scheme", false},
+      {"no scheme version", buildBox("schm", []byte{0, 0, 0, 0}, []byte("cenc")), "", "", true},
+   }
+   for _, test := range tests {
+      var box SchmBox
+      err := box.Parse(test.data)
+      if (err != nil) != test.wantErr {
+         t.Errorf("%s: unexpected error %v", test.name, err)
+         continue
+      }
+      if test.wantErr {
+         continue
+      }
+      if string(box.SchemeType[:]) != test.scheme || box.SchemeVersion != 0x00010000 || box.SchemeURI != test.uri {
+         t.Errorf("%s: unexpected box %+v", test.name, box)
+      }
+   }
+}
+
+// TestDecryptSample_AllClearSubsamples interleaves subsamples that have no
+// protected bytes with ones that do, and checks that only the protected
+// ranges are touched and that the keystream runs across them contiguously.
+func TestDecryptSample_AllClearSubsamples(t *testing.T) {
+   block, err := aes.NewCipher(make([]byte, 16))
+   if err != nil {
+      t.Fatal(err)
+   }
+   info := &SampleEncryptionInfo{
+      IV: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+      Subsamples: []SubsampleInfo{
+         {BytesOfClearData: 5, BytesOfProtectedData: 16},
+         {BytesOfClearData: 7, BytesOfProtectedData: 0},
+         {BytesOfClearData: 3, BytesOfProtectedData: 20},
+         {BytesOfClearData: 13, BytesOfProtectedData: 0},
+      },
+   }
+   original := make([]byte, 64)
+   for i := range original {
+      original[i] = byte(i)
+   }
+   sample := bytes.Clone(original)
+   DecryptSample(sample, info, block)
+
+   // Build the expected output by running the keystream over the
+   // concatenated protected ranges only.
+   var protected []byte
+   protected = append(protected, original[5:21]...)
+   protected = append(protected, original[31:51]...)
+   iv := make([]byte, 16)
+   copy(iv, info.IV)
+   cipher.NewCTR(block, iv).XORKeyStream(protected, protected)
+   expected := bytes.Clone(original)
+   copy(expected[5:21], protected[:16])
+   copy(expected[31:51], protected[16:])
+
+   if !bytes.Equal(sample, expected) {
+      t.Errorf("decrypted sample mismatch\n  Expected: %x\n  Got:      %x", expected, sample)
+   }
+   for _, clear := range [][2]int{{0, 5}, {21, 31}, {51, 64}} {
+      if !bytes.Equal(sample[clear[0]:clear[1]], original[clear[0]:clear[1]]) {
+         t.Errorf("clear bytes %d-%d were modified", clear[0], clear[1])
+      }
+   }
+}
+
+func TestDecryptSample_ClearHeader(t *testing.T) {
+   block, err := aes.NewCipher(make([]byte, 16))
+   if err != nil {
+      t.Fatal(err)
+   }
+   iv := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+   // A 2 byte clear header followed by an encrypted AAC frame.
+   clear := append([]byte{0xFF, 0xF1}, []byte("raw aac frame payload bytes")...)
+   encrypted := bytes.Clone(clear)
+   padded := make([]byte, 16)
+   copy(padded, iv)
+   cipher.NewCTR(block, padded).XORKeyStream(encrypted[2:], encrypted[2:])
+
+   info := &SampleEncryptionInfo{
+      IV:         iv,
+      Subsamples: []SubsampleInfo{{BytesOfClearData: 2, BytesOfProtectedData: uint32(len(clear) - 2)}},
+   }
+   if size := info.ClearHeaderSize(); size != 2 {
+      t.Errorf("expected clear header size 2, got %d", size)
+   }
+   sample := bytes.Clone(encrypted)
+   DecryptSample(sample, info, block)
+   if !bytes.Equal(sample, clear) {
+      t.Errorf("subsample decrypt mismatch\n  Expected: %x\n  Got:      %x", clear, sample)
+   }
+
+   // The same bytes expressed as full-sample encryption after the header.
+   full := bytes.Clone(encrypted)
+   DecryptSample(full[2:], &SampleEncryptionInfo{IV: iv}, block)
+   if !bytes.Equal(full, sample) {
+      t.Errorf("full-sample decrypt differs from subsample decrypt: %x", full)
+   }
+
+   // A clear count past the end of the sample must not panic.
+   short := &SampleEncryptionInfo{
+      IV:         iv,
+      Subsamples: []SubsampleInfo{{BytesOfClearData: 100, BytesOfProtectedData: 16}},
+   }
+   DecryptSample(bytes.Clone(encrypted), short, block)
+}
+
+func TestDecryptSample_SubsampleOverrun(t *testing.T) {
+   block, err := aes.NewCipher(make([]byte, 16))
+   if err != nil {
+      t.Fatal(err)
+   }
+   info := &SampleEncryptionInfo{
+      IV: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+      Subsamples: []SubsampleInfo{
+         {BytesOfClearData: 2, BytesOfProtectedData: 8},
+         {BytesOfClearData: 2, BytesOfProtectedData: 100},
+      },
+   }
+   original := make([]byte, 32)
+
+   var warnings []string
+   clamp := &Decrypter{ClampOverruns: true, Warn: func(message string) { warnings = append(warnings, message) }}
+   sample := bytes.Clone(original)
+   if err := clamp.DecryptSample(sample, info, block); err != nil {
+      t.Fatalf("clamped decrypt failed: %v", err)
+   }
+   if len(warnings) != 1 {
+      t.Errorf("expected 1 warning, got %q", warnings)
+   }
+   if bytes.Equal(sample[12:], original[12:]) {
+      t.Error("expected the clamped range to be decrypted")
+   }
+
+   sample = bytes.Clone(original)
+   err = DecryptSample(sample, info, block)
+   var overrun *SubsampleOverrunError
+   if !errors.As(err, &overrun) || overrun.Subsample != 1 {
+      t.Fatalf("expected overrun of subsample 1, got %v", err)
+   }
+   if err := overrunSample(err, 7); err.Error() != "subsample 1 of sample 7 extends past the sample end" {
+      t.Errorf("unexpected error %q", err)
+   }
+   if err := DecryptSampleCBCS(bytes.Clone(original), &SampleEncryptionInfo{IV: make([]byte, 16), Subsamples: info.Subsamples}, block, 1, 9); !errors.As(err, &overrun) {
+      t.Errorf("expected DecryptSampleCBCS to report the overrun, got %v", err)
+   }
+}
+
+func TestDecryptSample_MissingIV(t *testing.T) {
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   for _, info := range []*SampleEncryptionInfo{nil, {}, {Subsamples: []SubsampleInfo{{2, 16}}}} {
+      sample := make([]byte, 32)
+      if err := DecryptSample(sample, info, block); err != ErrMissingIV {
+         t.Errorf("%+v: expected ErrMissingIV, got %v", info, err)
+      }
+      if err := DecryptSampleCBCS(sample, info, block, 1, 9); err != ErrMissingIV {
+         t.Errorf("%+v: expected ErrMissingIV from cbcs, got %v", info, err)
+      }
+      if !bytes.Equal(sample, make([]byte, 32)) {
+         t.Errorf("%+v: sample was modified", info)
+      }
+   }
+}
+
+// sparseReader serves data as if it were located at offset within a larger
+// file, without allocating the bytes before it.
+type sparseReader struct {
+   offset int64
+   data   []byte
+}
+
+func (r sparseReader) ReadAt(p []byte, off int64) (int, error) {
+   if off < r.offset || off-r.offset >= int64(len(r.data)) {
+      return 0, io.EOF
+   }
+   n := copy(p, r.data[off-r.offset:])
+   if n < len(p) {
+      return n, io.EOF
+   }
+   return n, nil
+}
+
+func TestParseSampleAuxInfoAt(t *testing.T) {
+   // Two samples: one with an IV only, one with an IV and a subsample.
+   aux := []byte{
+      1, 2, 3, 4, 5, 6, 7, 8,
+      9, 10, 11, 12, 13, 14, 15, 16, 0, 1, 0, 5, 0, 0, 0, 100,
+   }
+   const offset = 0x1_0000_0010 // past 4 GiB, so saio needs version 1
+   saiz := &SaizBox{SampleCount: 2, SampleInfoSizes: []byte{8, 16}}
+   saio := &SaioBox{Version: 1, Offsets: []uint64{offset - 0x10}}
+
+   infos, err := ParseSampleAuxInfoAt(sparseReader{offset, aux}, saiz, saio, 0x10, 8, nil)
+   if err != nil {
+      t.Fatalf("ParseSampleAuxInfoAt failed: %v", err)
+   }
+   if len(infos) != 2 {
+      t.Fatalf("expected 2 samples, got %d", len(infos))
+   }
+   if !bytes.Equal(infos[0].IV, aux[:8]) || len(infos[0].Subsamples) != 0 {
+      t.Errorf("unexpected first sample: %+v", infos[0])
+   }
+   if !bytes.Equal(infos[1].IV, aux[8:16]) || len(infos[1].Subsamples) != 1 ||
+      infos[1].Subsamples[0] != (SubsampleInfo{5, 100}) {
+      t.Errorf("unexpected second sample: %+v", infos[1])
+   }
+
+   saio.Offsets[0] += 8
+   if _, err := ParseSampleAuxInfoAt(sparseReader{offset, aux}, saiz, saio, 0x10, 8, nil); err == nil {
+      t.Error("expected error reading past the aux info region")
+   }
+}
+
+func TestParseAuxInfo(t *testing.T) {
+   aux := []byte{
+      1, 2, 3, 4, 5, 6, 7, 8, 0, 1, 0, 5, 0, 0, 0, 100,
+      9, 10, 11, 12, 13, 14, 15, 16, 0, 0,
+   }
+   mdat := append([]byte("header"), aux...)
+   saiz := &SaizBox{SampleCount: 2, SampleInfoSizes: []byte{16, 10}}
+   saio := &SaioBox{Offsets: []uint64{6}}
+   infos, err := ParseAuxInfo(mdat, saio, saiz, 8)
+   if err != nil {
+      t.Fatalf("ParseAuxInfo failed: %v", err)
+   }
+   var senc SencBox
+   if err := senc.Parse(buildBox("senc", []byte{0, 0, 0, 2}, []byte{0, 0, 0, 2}, aux)); err != nil {
+      t.Fatalf("senc Parse failed: %v", err)
+   }
+   if len(infos) != len(senc.Samples) {
+      t.Fatalf("expected %d samples, got %d", len(senc.Samples), len(infos))
+   }
+   for i := range infos {
+      if !bytes.Equal(infos[i].IV, senc.Samples[i].IV) || !slices.Equal(infos[i].Subsamples, senc.Samples[i].Subsamples) {
+         t.Errorf("sample %d: expected %+v, got %+v", i, senc.Samples[i], infos[i])
+      }
+   }
+
+   for _, offset := range []uint64{7, uint64(len(mdat)) + 1, math.MaxUint64} {
+      saio.Offsets[0] = offset
+      if _, err := ParseAuxInfo(mdat, saio, saiz, 8); err == nil {
+         t.Errorf("offset %d: expected error for aux info past the mdat", offset)
+      }
+   }
+   saio.Offsets = []uint64{6, 22}
+   if _, err := ParseAuxInfo(mdat, saio, saiz, 8); err == nil {
+      t.Error("expected error for a saio with one offset per chunk")
+   }
+}
+
+func TestParseSampleAuxInfoAt_VariableIVSize(t *testing.T) {
+   // IVs alternate between 8 and 16 bytes; the last sample also carries a
+   // subsample after its 16 byte IV.
+   short, long := bytes.Repeat([]byte{0xAA}, 8), bytes.Repeat([]byte{0xBB}, 16)
+   aux := slices.Concat(short, long, short, long, []byte{0, 1, 0, 5, 0, 0, 0, 100})
+   saiz := &SaizBox{SampleCount: 4, SampleInfoSizes: []byte{8, 16, 8, 24}}
+   saio := &SaioBox{Offsets: []uint64{0}}
+   infos, err := ParseSampleAuxInfoAt(bytes.NewReader(aux), saiz, saio, 0, 8, nil)
+   if err != nil {
+      t.Fatalf("ParseSampleAuxInfoAt failed: %v", err)
+   }
+   for i, expected := range [][]byte{short, long, short, long} {
+      if !bytes.Equal(infos[i].IV, expected) {
+         t.Errorf("sample %d: expected IV %x, got %x", i, expected, infos[i].IV)
+      }
+   }
+   if len(infos[3].Subsamples) != 1 || infos[3].Subsamples[0] != (SubsampleInfo{5, 100}) {
+      t.Errorf("unexpected subsamples %+v", infos[3].Subsamples)
+   }
+
+   saiz.SampleInfoSizes = []byte{8, 16, 8, 20}
+   if _, err := ParseSampleAuxInfoAt(bytes.NewReader(aux), saiz, saio, 0, 8, nil); err == nil {
+      t.Error("expected error for aux info fitting neither IV size")
+   }
+}
+
+func TestTencBox_Strict(t *testing.T) {
+   tenc := buildBox("tenc", []byte{0, 0, 0, 0}, []byte{0, 0x19, 1, 8}, testKID[:])
+   var box TencBox
+   if err := box.Parse(tenc); err != nil {
+      t.Fatalf("lenient Parse failed: %v", err)
+   }
+   if box.DefaultCryptByteBlock != 0 || box.DefaultSkipByteBlock != 0 {
+      t.Errorf("expected no pattern for version 0, got %d:%d", box.DefaultCryptByteBlock, box.DefaultSkipByteBlock)
+   }
+
+   strict := &ParseOptions{Strict: true}
+   if err := box.parse(tenc, strict); err != ErrNonZeroReserved {
+      t.Errorf("expected ErrNonZeroReserved, got %v", err)
+   }
+   tenc[13] = 0
+   if err := box.parse(tenc, strict); err != nil {
+      t.Errorf("strict Parse of clean tenc failed: %v", err)
+   }
+
+   // the options reach a tenc nested in the sample entry of a moov
+   init := buildInitSegment(true)
+   init[bytes.Index(init, []byte("tenc"))+8] = 1
+   if _, err := Parse(init); err != nil {
+      t.Errorf("lenient Parse of init segment failed: %v", err)
+   }
+   if _, err := strict.Parse(init); err != ErrNonZeroReserved {
+      t.Errorf("expected ErrNonZeroReserved from the init segment, got %v", err)
+   }
+}
+
+func TestTencBox_Version1(t *testing.T) {
+   // version 1, cbcs pattern 1:9, constant IV of 16 bytes
+   constantIV := bytes.Repeat([]byte{0xAB}, 16)
+   tenc := buildBox("tenc", []byte{1, 0, 0, 0}, []byte{0, 0x19, 1, 0}, testKID[:], []byte{16}, constantIV)
+   strict := &ParseOptions{Strict: true}
+   var box TencBox
+   if err := box.parse(tenc, strict); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if box.DefaultIsProtected != 1 || box.DefaultPerSampleIVSize != 0 || box.DefaultKID != testKID {
+      t.Errorf("unexpected tenc fields: %+v", box)
+   }
+   if box.DefaultCryptByteBlock != 1 || box.DefaultSkipByteBlock != 9 {
+      t.Errorf("expected pattern 1:9, got %d:%d", box.DefaultCryptByteBlock, box.DefaultSkipByteBlock)
+   }
+   if !bytes.Equal(box.DefaultConstantIV, constantIV) {
+      t.Errorf("expected constant IV %x, got %x", constantIV, box.DefaultConstantIV)
+   }
+   tenc[12] = 1
+   if err := box.parse(tenc, strict); err != ErrNonZeroReserved {
+      t.Errorf("expected ErrNonZeroReserved, got %v", err)
+   }
+}
+
+func TestTencBox_Encode(t *testing.T) {
+   constantIV := bytes.Repeat([]byte{0xAB}, 16)
+   tests := map[string][]byte{
+      "version 0": buildBox("tenc", []byte{0, 0, 0, 0}, []byte{0, 0, 1, 8}, testKID[:]),
+      "version 1": buildBox("tenc", []byte{1, 0, 0, 0}, []byte{0, 0x19, 1, 0}, testKID[:], []byte{16}, constantIV),
+      "clear":     buildBox("tenc", []byte{1, 0, 0, 0}, []byte{0, 0, 0, 0}, make([]byte, 16)),
+   }
+   init, _, err := BuildTestContent(TestContentOptions{Scheme: "cbcs", KID: testKID, Key: testKey})
+   if err != nil {
+      t.Fatal(err)
+   }
+   tests["test content"], _ = FindFirstBoxByType(init, "tenc")
+   for name, original := range tests {
+      var box TencBox
+      if err := box.Parse(original); err != nil {
+         t.Fatalf("%s: Parse failed: %v", name, err)
+      }
+      data, err := box.Encode()
+      if err != nil {
+         t.Fatalf("%s: Encode failed: %v", name, err)
+      }
+      if !bytes.Equal(data, original) {
+         t.Errorf("%s: round trip mismatch\n  Expected: %x\n  Got:      %x", name, original, data)
+      }
+   }
+
+   box := TencBox{Version: 2}
+   if _, err := box.Encode(); err == nil {
+      t.Error("expected error for version 2")
+   }
+   box = TencBox{DefaultIsProtected: 1, DefaultConstantIV: []byte{1, 2, 3}}
+   if _, err := box.Encode(); err == nil {
+      t.Error("expected error for a 3 byte constant IV")
+   }
+}
+
+func TestSencBox_EncodeRoundTrip(t *testing.T) {
+   iv := func(n byte) []byte { return []byte{n, n, n, n, n, n, n, n} }
+   tests := []struct {
+      name    string
+      samples []SampleEncryptionInfo
+   }{
+      {"no subsamples", []SampleEncryptionInfo{{IV: iv(1)}, {IV: iv(2)}}},
+      {"subsamples", []SampleEncryptionInfo{
+         {IV: iv(1), Subsamples: []SubsampleInfo{{5, 100}, {3, 0}}},
+         {IV: iv(2)},
+      }},
+   }
+   for _, test := range tests {
+      t.Run(test.name, func(t *testing.T) {
+         senc := SencBox{Samples: test.samples}
+         data, err := senc.Encode(8)
+         if err != nil {
+            t.Fatalf("Encode failed: %v", err)
+         }
+         if int(senc.Header.Size) != len(data) {
+            t.Errorf("header size %d does not match length %d", senc.Header.Size, len(data))
+         }
+         var parsed SencBox
+         if err := parsed.Parse(data); err != nil {
+            t.Fatalf("Parse failed: %v", err)
+         }
+         if len(parsed.Samples) != len(test.samples) {
+            t.Fatalf("expected %d samples, got %d", len(test.samples), len(parsed.Samples))
+         }
+         for i, sample := range parsed.Samples {
+            if !bytes.Equal(sample.IV, test.samples[i].IV) {
+               t.Errorf("sample %d IV mismatch: %x", i, sample.IV)
+            }
+            if len(sample.Subsamples) != len(test.samples[i].Subsamples) {
+               t.Fatalf("sample %d subsample count mismatch", i)
+            }
+            for j := range sample.Subsamples {
+               if sample.Subsamples[j] != test.samples[i].Subsamples[j] {
+                  t.Errorf("sample %d subsample %d mismatch", i, j)
+               }
+            }
+         }
+      })
+   }
+
+   senc := SencBox{Samples: []SampleEncryptionInfo{{IV: iv(1)}}}
+   if _, err := senc.Encode(16); err == nil {
+      t.Error("expected error for IV size mismatch")
+   }
+
+   // A parsed box with 16 byte IVs and the subsample flag set but no
+   // subsamples encodes back to the same bytes.
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   original := buildBox("senc", u32(2), u32(2), bytes.Repeat([]byte{7}, 16), []byte{0, 0},
+      bytes.Repeat([]byte{8}, 16), []byte{0, 0})
+   var parsed SencBox
+   if err := parsed.ParseWithIVSize(original, 16); err != nil {
+      t.Fatalf("ParseWithIVSize failed: %v", err)
+   }
+   data, err := parsed.Encode(16)
+   if err != nil {
+      t.Fatalf("Encode failed: %v", err)
+   }
+   if !bytes.Equal(data, original) {
+      t.Errorf("round trip mismatch\n  Expected: %x\n  Got:      %x", original, data)
+   }
+}
+
+func TestSchiBox_Children(t *testing.T) {
+   kid := [16]byte{0x3c, 0x18, 0x63, 0x99, 0x5f, 0x93, 0xb8, 0x2b, 0xce, 0x88, 0xba, 0xce, 0x3a, 0x1a, 0xa6, 0x7a}
+   tenc := buildBox("tenc", []byte{0, 0, 0, 0}, []byte{0, 0, 1, 8}, kid[:])
+   other := buildBox("xyzw", []byte("scheme specific"))
+   data := buildBox("schi", other, tenc)
+
+   var schi SchiBox
+   if err := schi.Parse(data); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if schi.Tenc == nil || schi.Tenc.DefaultKID != kid {
+      t.Fatalf("tenc not parsed: %+v", schi.Tenc)
+   }
+   children := schi.Children()
+   if len(children) != 2 || !bytes.Equal(children[0], other) || !bytes.Equal(children[1], tenc) {
+      t.Errorf("unexpected children: %x", children)
+   }
+   if encoded := schi.Encode(); !bytes.Equal(encoded, data) {
+      t.Errorf("round trip mismatch\n  Expected: %x\n  Got:      %x", data, encoded)
+   }
+}
+
+func TestSencBox_RepairAgainstTrun(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // senc declares three samples but holds two IVs and a partial third.
+   senc := buildBox("senc", []byte{0, 0, 0, 0}, u32(3),
+      []byte{1, 1, 1, 1, 1, 1, 1, 1}, []byte{2, 2, 2, 2, 2, 2, 2, 2}, []byte{3, 3, 3})
+   traf := buildBox("traf",
+      buildBox("tfhd", []byte{0, 0, 0, 0}, u32(1)),
+      buildBox("trun", []byte{0, 0, 0, 0}, u32(2)),
+      senc,
+   )
+
+   var warnings []string
+   lenient := &ParseOptions{Warn: func(message string) { warnings = append(warnings, message) }}
+   var box TrafBox
+   if err := box.parse(traf, lenient); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if len(box.Senc.Samples) != 2 || box.Senc.Samples[1].IV[0] != 2 {
+      t.Errorf("expected 2 repaired senc samples, got %+v", box.Senc.Samples)
+   }
+   if len(warnings) != 1 {
+      t.Errorf("expected 1 warning, got %q", warnings)
+   }
+
+   // without a known IV size the error waits for the tenc
+   strict := &ParseOptions{Strict: true}
+   box = TrafBox{}
+   if err := box.parse(traf, strict); err != nil {
+      t.Fatalf("strict Parse failed: %v", err)
+   }
+   if _, err := box.sencWithIVSize(8, strict); err == nil {
+      t.Error("expected error in strict mode")
+   }
+}
+
+func TestDecryptSampleCBCS(t *testing.T) {
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   iv := bytes.Repeat([]byte{7}, 16)
+   // 4 clear bytes, then 1:9 pattern over 200 protected bytes: blocks 0
+   // and 10 are encrypted and the trailing 8 bytes are a partial block.
+   clear := make([]byte, 204)
+   for i := range clear {
+      clear[i] = byte(i)
+   }
+   encrypted := bytes.Clone(clear)
+   mode := cipher.NewCBCEncrypter(block, iv)
+   for _, offset := range []int{4, 4 + 160} {
+      mode.CryptBlocks(encrypted[offset:offset+16], encrypted[offset:offset+16])
+   }
+   info := &SampleEncryptionInfo{
+      IV:         iv,
+      Subsamples: []SubsampleInfo{{BytesOfClearData: 4, BytesOfProtectedData: 200}},
+   }
+   sample := bytes.Clone(encrypted)
+   if err := DecryptSampleCBCS(sample, info, block, 1, 9); err != nil {
+      t.Fatalf("DecryptSampleCBCS failed: %v", err)
+   }
+   if !bytes.Equal(sample, clear) {
+      t.Errorf("decrypted sample mismatch\n  Expected: %x\n  Got:      %x", clear, sample)
+   }
+
+   // Each subsample starts over from the IV.
+   twice := append(bytes.Clone(encrypted[:20]), encrypted[:20]...)
+   info.Subsamples = []SubsampleInfo{{4, 16}, {4, 16}}
+   if err := DecryptSampleCBCS(twice, info, block, 1, 9); err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(twice[:20], clear[:20]) || !bytes.Equal(twice[20:], clear[:20]) {
+      t.Errorf("expected both subsamples to decrypt, got %x", twice)
+   }
+
+   info.IV = iv[:8]
+   if err := DecryptSampleCBCS(sample, info, block, 1, 9); err == nil {
+      t.Error("expected error for 8 byte IV")
+   }
+}
+
+func TestSencBox_ParseWithIVSize(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   iv := bytes.Repeat([]byte{9}, 16)
+   senc := buildBox("senc", []byte{0, 0, 0, 0}, u32(2), iv, iv)
+   var box SencBox
+   if err := box.ParseWithIVSize(senc, 16); err != nil {
+      t.Fatalf("ParseWithIVSize failed: %v", err)
+   }
+   if len(box.Samples) != 2 || !bytes.Equal(box.Samples[1].IV, iv) {
+      t.Errorf("expected two 16 byte IVs, got %+v", box.Samples)
+   }
+
+   // constant IV: subsample entries only
+   constant := buildBox("senc", []byte{0, 0, 0, 2}, u32(1), []byte{0, 1, 0, 5}, u32(100))
+   if err := box.ParseWithIVSize(constant, 0); err != nil {
+      t.Fatalf("ParseWithIVSize failed: %v", err)
+   }
+   sample := box.Samples[0]
+   if sample.IV != nil || len(sample.Subsamples) != 1 || sample.Subsamples[0] != (SubsampleInfo{5, 100}) {
+      t.Errorf("unexpected constant IV sample %+v", sample)
+   }
+   if err := box.ParseWithIVSize(senc, 12); err == nil {
+      t.Error("expected error for IV size 12")
+   }
+
+   // The traf takes the IV size from its seig sample group.
+   seig := append([]byte{0, 0, 1, 16}, testKID[:]...)
+   traf := buildBox("traf",
+      buildBox("tfhd", []byte{0, 0, 0, 0}, u32(1)),
+      buildBox("trun", []byte{0, 0, 0, 0}, u32(2)),
+      senc,
+      buildBox("sgpd", []byte{1, 0, 0, 0}, []byte("seig"), u32(20), u32(1), seig),
+   )
+   var trafBox TrafBox
+   if err := trafBox.Parse(traf); err != nil {
+      t.Fatalf("traf Parse failed: %v", err)
+   }
+   if len(trafBox.Senc.Samples) != 2 || !bytes.Equal(trafBox.Senc.Samples[0].IV, iv) {
+      t.Errorf("expected 16 byte IVs from seig, got %+v", trafBox.Senc.Samples)
+   }
+}
+
+func TestTencBox_ApplyConstantIV(t *testing.T) {
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   constantIV := bytes.Repeat([]byte{3}, 16)
+   tenc := TencBox{DefaultIsProtected: 1, DefaultConstantIVSize: 16, DefaultConstantIV: constantIV}
+   clear := bytes.Repeat([]byte("sixteen byte blk"), 2)
+   senc := SencBox{Samples: make([]SampleEncryptionInfo, 2)}
+   tenc.ApplyConstantIV(&senc)
+
+   // Both samples decrypt from the same IV.
+   for i := range senc.Samples {
+      sample := bytes.Clone(clear)
+      cipher.NewCBCEncrypter(block, constantIV).CryptBlocks(sample, sample)
+      if err := DecryptSampleCBCS(sample, &senc.Samples[i], block, 0, 0); err != nil {
+         t.Fatalf("sample %d: %v", i, err)
+      }
+      if !bytes.Equal(sample, clear) {
+         t.Errorf("sample %d: decrypted %q", i, sample)
+      }
+   }
+   if !bytes.Equal(constantIV, bytes.Repeat([]byte{3}, 16)) {
+      t.Error("constant IV was modified")
+   }
+}
+
+func TestNormalizeIV(t *testing.T) {
+   iv8, iv16 := bytes.Repeat([]byte{1}, 8), bytes.Repeat([]byte{2}, 16)
+   padded := append(bytes.Clone(iv8), make([]byte, 8)...)
+   tests := []struct {
+      scheme   string
+      iv       []byte
+      expected []byte // nil for an error
+   }{
+      {"cenc", iv8, padded},
+      {"cenc", iv16, iv16},
+      {"cens", iv8, padded},
+      {"cens", iv16, iv16},
+      {"cbc1", iv8, nil},
+      {"cbc1", iv16, iv16},
+      {"cbcs", iv8, nil},
+      {"cbcs", iv16, iv16},
+      {"cenc", iv16[:12], nil},
+      {"cenc", nil, nil},
+      {"abcd", iv16, nil},
+   }
+   for _, test := range tests {
+      iv, err := NormalizeIV(test.iv, test.scheme)
+      if test.expected == nil {
+         if err == nil {
+            t.Errorf("%s with %d byte IV: expected error", test.scheme, len(test.iv))
+         }
+         continue
+      }
+      if err != nil || !bytes.Equal(iv, test.expected) {
+         t.Errorf("%s with %d byte IV: got %x %v", test.scheme, len(test.iv), iv, err)
+      }
+   }
+}
+
+func TestSencBox_HugeSubsampleCount(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   senc := buildBox("senc", []byte{0, 0, 0, 2}, u32(2), make([]byte, 8), []byte{0xFF, 0xFF}, make([]byte, 6))
+   var box SencBox
+   if err := box.Parse(senc); err == nil {
+      t.Fatal("expected error for subsample count past the box end")
+   }
+   if box.Samples[0].Subsamples != nil {
+      t.Errorf("expected no allocation, got %d subsamples", len(box.Samples[0].Subsamples))
+   }
+}
+
+func FuzzSencBox_Parse(f *testing.F) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   f.Add(buildBox("senc", []byte{0, 0, 0, 2}, u32(1), make([]byte, 8), []byte{0, 1, 0, 4}, u32(16)))
+   f.Add(buildBox("senc", []byte{0, 0, 0, 2}, u32(1), make([]byte, 8), []byte{0xFF, 0xFF}))
+   f.Fuzz(func(t *testing.T, data []byte) {
+      var box SencBox
+      box.Parse(data)
+   })
+}
+
+func TestIncrementIV(t *testing.T) {
+   tests := []struct {
+      iv       string
+      blocks   uint64
+      expected string
+   }{
+      {"00000000000000000000000000000000", 1, "00000000000000000000000000000001"},
+      {"000000000000000000000000000000ff", 1, "00000000000000000000000000000100"},
+      {"0000000000000000ffffffffffffffff", 1, "00000000000000010000000000000000"},
+      {"00000000000000000000000000fffff0", 0x20, "00000000000000000000000001000010"},
+      {"ffffffffffffffffffffffffffffffff", 2, "00000000000000000000000000000001"},
+      {"0102030405060708", 0xFFFFFFFFFFFFFFFF, "0102030405060708ffffffffffffffff"},
+      {"00000000000000000000000000000001", 0xFFFFFFFFFFFFFFFF, "00000000000000010000000000000000"},
+   }
+   for _, test := range tests {
+      iv, _ := hex.DecodeString(test.iv)
+      original := bytes.Clone(iv)
+      got := hex.EncodeToString(IncrementIV(iv, test.blocks))
+      if got != test.expected {
+         t.Errorf("IncrementIV(%s, %d) = %s, expected %s", test.iv, test.blocks, got, test.expected)
+      }
+      if !bytes.Equal(iv, original) {
+         t.Errorf("IncrementIV modified its input %s", test.iv)
+      }
+   }
+}
+
+func TestSencBox_PIFF(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   kid := [16]byte{0x3c, 0x18, 0x63, 0x99, 0x5f, 0x93, 0xb8, 0x2b, 0xce, 0x88, 0xba, 0xce, 0x3a, 0x1a, 0xa6, 0x7a}
+   iv := bytes.Repeat([]byte{0xAB}, 16)
+   // Smooth Streaming layout: override flag with AES-CTR (algorithm 1) and
+   // 16 byte IVs, plus subsample encryption.
+   piff := buildBox("uuid", piffSencUUID[:], []byte{0, 0, 0, 0x03},
+      []byte{0, 0, 1, 16}, kid[:], u32(1), iv, []byte{0, 1, 0, 5}, u32(100))
+   traf := buildBox("traf",
+      buildBox("tfhd", []byte{0, 0, 0, 0}, u32(1)),
+      buildBox("trun", []byte{0, 0, 0, 0}, u32(1)),
+      piff,
+   )
+   var box TrafBox
+   if err := box.Parse(traf); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   senc := box.Senc
+   if senc == nil {
+      t.Fatal("PIFF senc not parsed")
+   }
+   if senc.AlgorithmID != 1 || senc.IVSize != 16 || senc.KID != kid {
+      t.Errorf("unexpected override fields %d %d %x", senc.AlgorithmID, senc.IVSize, senc.KID)
+   }
+   if len(senc.Samples) != 1 || !bytes.Equal(senc.Samples[0].IV, iv) {
+      t.Fatalf("unexpected samples %+v", senc.Samples)
+   }
+   if subsamples := senc.Samples[0].Subsamples; len(subsamples) != 1 ||
+      subsamples[0] != (SubsampleInfo{5, 100}) {
+      t.Errorf("unexpected subsamples %+v", subsamples)
+   }
+
+   other := buildBox("uuid", make([]byte, 16))
+   if err := box.Parse(buildBox("traf", other)); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+}
@@ -0,0 +1,83 @@
+package sofia
+
+import (
+   "bytes"
+   "errors"
+)
+
+// --- EMSG (Event Message) ---
+
+// EmsgBox is a DASH in-band event, such as an SCTE-35 ad marker. Version 0
+// times the event by PresentationTimeDelta from the earliest presentation
+// time of the segment, version 1 by the absolute PresentationTime, both in
+// Timescale units.
+type EmsgBox struct {
+   Header                BoxHeader
+   Version               byte
+   Flags                 [3]byte
+   SchemeIDURI           string
+   Value                 string
+   Timescale             uint32
+   PresentationTimeDelta uint32 // version 0
+   PresentationTime      uint64 // version 1
+   EventDuration         uint32 // 0xFFFFFFFF if unknown
+   ID                    uint32
+   MessageData           []byte
+}
+
+func (b *EmsgBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 12 {
+      return errors.New("emsg box too short")
+   }
+   p := parser{data: data[:b.Header.Size], offset: 8}
+   versionAndFlags := p.Bytes(4)
+   b.Version = versionAndFlags[0]
+   copy(b.Flags[:], versionAndFlags[1:])
+
+   var err error
+   switch b.Version {
+   case 0:
+      if b.SchemeIDURI, err = emsgString(&p); err != nil {
+         return err
+      }
+      if b.Value, err = emsgString(&p); err != nil {
+         return err
+      }
+      b.Timescale = p.Uint32()
+      b.PresentationTimeDelta = p.Uint32()
+      b.EventDuration = p.Uint32()
+      b.ID = p.Uint32()
+   case 1:
+      b.Timescale = p.Uint32()
+      b.PresentationTime = p.Uint64()
+      b.EventDuration = p.Uint32()
+      b.ID = p.Uint32()
+      if b.SchemeIDURI, err = emsgString(&p); err != nil {
+         return err
+      }
+      if b.Value, err = emsgString(&p); err != nil {
+         return err
+      }
+   default:
+      return errors.New("unsupported emsg version")
+   }
+   if err := p.Err(); err != nil {
+      return err
+   }
+   b.MessageData = p.data[p.offset:]
+   return nil
+}
+
+// emsgString reads a null-terminated string of emsg.
+func emsgString(p *parser) (string, error) {
+   end := bytes.IndexByte(p.data[p.offset:], 0)
+   if end < 0 {
+      return "", errors.New("emsg string is not null-terminated")
+   }
+   value := string(p.Bytes(end))
+   p.offset++
+   return value, nil
+}
@@ -0,0 +1,52 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+func TestEmsgBox_Parse(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   scheme, message := []byte("urn:scte:scte35:2013:bin\x00"), []byte{0xFC, 0x30, 0x11}
+
+   v0 := buildBox("emsg", []byte{0, 0, 0, 0}, scheme, []byte("1\x00"),
+      u32(90000), u32(180000), u32(0xFFFFFFFF), u32(7), message)
+   v1 := buildBox("emsg", []byte{1, 0, 0, 0}, u32(90000), u64(1<<33), u32(450000), u32(8),
+      scheme, []byte("\x00"), message)
+   boxes, err := Parse(append(v0, v1...))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if len(boxes) != 2 || boxes[0].Emsg == nil || boxes[1].Emsg == nil {
+      t.Fatalf("expected 2 emsg boxes, got %+v", boxes)
+   }
+   if !bytes.Equal(boxes[0].Encode(), v0) {
+      t.Error("emsg should encode as parsed")
+   }
+
+   emsg := boxes[0].Emsg
+   if emsg.SchemeIDURI != "urn:scte:scte35:2013:bin" || emsg.Value != "1" || emsg.Timescale != 90000 ||
+      emsg.PresentationTimeDelta != 180000 || emsg.EventDuration != 0xFFFFFFFF || emsg.ID != 7 {
+      t.Errorf("emsg v0: unexpected %+v", emsg)
+   }
+   if !bytes.Equal(emsg.MessageData, message) {
+      t.Errorf("emsg v0: message data %x", emsg.MessageData)
+   }
+   emsg = boxes[1].Emsg
+   if emsg.SchemeIDURI != "urn:scte:scte35:2013:bin" || emsg.Value != "" || emsg.PresentationTime != 1<<33 ||
+      emsg.EventDuration != 450000 || emsg.ID != 8 {
+      t.Errorf("emsg v1: unexpected %+v", emsg)
+   }
+   if !bytes.Equal(emsg.MessageData, message) {
+      t.Errorf("emsg v1: message data %x", emsg.MessageData)
+   }
+
+   if err := new(EmsgBox).Parse(buildBox("emsg", []byte{0, 0, 0, 0}, []byte("urn:unterminated"))); err == nil {
+      t.Error("expected error for an unterminated scheme_id_uri")
+   }
+   if err := new(EmsgBox).Parse(buildBox("emsg", []byte{1, 0, 0, 0}, u32(90000))); err == nil {
+      t.Error("expected error for truncated v1 timing fields")
+   }
+}
@@ -0,0 +1,182 @@
+package sofia
+
+import (
+   "bytes"
+   "errors"
+   "slices"
+)
+
+// File is a parsed MP4 file, either a progressive file, a fragmented file
+// with its init segment, or a bare media segment. It is the starting point
+// for callers that do not want to navigate boxes themselves.
+type File struct {
+   Boxes      []Box
+   Moov       *MoovBox // nil for a bare media segment
+   Fragmented bool
+   Encrypted  bool
+   data       []byte
+}
+
+// Open parses data and classifies it as progressive or fragmented, and as
+// encrypted or clear.
+func Open(data []byte) (*File, error) {
+   boxes, err := Parse(data)
+   if err != nil {
+      return nil, err
+   }
+   f := &File{Boxes: boxes, data: data}
+   f.Moov, _ = FindMoov(boxes)
+   for _, box := range boxes {
+      if box.Moof == nil {
+         continue
+      }
+      f.Fragmented = true
+      for _, traf := range box.Moof.Trafs {
+         if traf.encrypted() {
+            f.Encrypted = true
+         }
+      }
+   }
+   if f.Moov == nil {
+      if !f.Fragmented {
+         return nil, errors.New("no moov or moof found")
+      }
+      return f, nil
+   }
+   if _, ok := findChild(f.Moov.RawChildren, "mvex"); ok {
+      f.Fragmented = true
+   }
+   for _, trak := range f.Moov.Trak {
+      if tenc, ok := trak.Tenc(); ok && tenc.DefaultIsProtected == 1 {
+         f.Encrypted = true
+      }
+   }
+   return f, nil
+}
+
+// Tracks describes every track of the moov. It is empty for a bare media
+// segment.
+func (f *File) Tracks() []TrackSummary {
+   if f.Moov == nil {
+      return nil
+   }
+   summaries := make([]TrackSummary, 0, len(f.Moov.Trak))
+   for _, trak := range f.Moov.Trak {
+      summaries = append(summaries, trak.Summary())
+   }
+   return summaries
+}
+
+// Pssh returns every pssh box of the file, from the moov, the top level and
+// each moof, in file order.
+func (f *File) Pssh() []*PsshBox {
+   var pssh []*PsshBox
+   for _, box := range f.Boxes {
+      switch {
+      case box.Moov != nil:
+         pssh = append(pssh, box.Moov.Pssh...)
+      case box.Moof != nil:
+         pssh = append(pssh, box.Moof.Pssh...)
+      case box.Pssh != nil:
+         pssh = append(pssh, box.Pssh)
+      }
+   }
+   return pssh
+}
+
+// Segments returns the media segments of a fragmented file, each made of
+// the boxes leading up to a moof (styp, sidx, emsg, prft), the moof and its
+// mdat. It is empty for progressive files.
+func (f *File) Segments() [][]byte {
+   var segments [][]byte
+   start, offset := -1, 0
+   inMoof := false
+   for _, box := range childBoxes(f.data) {
+      switch string(box[4:8]) {
+      case "styp", "sidx", "emsg", "prft":
+         if start < 0 {
+            start = offset
+         }
+      case "moof":
+         if start < 0 {
+            start = offset
+         }
+         inMoof = true
+      case "mdat":
+         if inMoof {
+            segments = append(segments, f.data[start:offset+len(box)])
+            start, inMoof = -1, false
+         }
+      default:
+         if !inMoof {
+            start = -1
+         }
+      }
+      offset += len(box)
+   }
+   return segments
+}
+
+// Decrypt returns a decrypted copy of the file. For fragmented files every
+// moof/mdat pair is decrypted as by ClearSegment, and the moov is rewritten
+// with its sample entries unprotected and its pssh boxes removed. For
+// progressive files, and moovs without fragments, the samples are
+// decrypted in place; the moov is left unchanged, since rewriting it would
+// move the chunk offsets. Only the cenc and cbcs schemes can be decrypted;
+// a file with a track protected by any other scheme is an error rather
+// than ciphertext labelled as clear.
+func (f *File) Decrypt(keys KeyProvider) ([]byte, error) {
+   d := &Decrypter{Keys: keys, Init: f.Moov}
+   if f.Moov != nil {
+      for _, trak := range f.Moov.Trak {
+         if prot, ok := trakProtection(trak); ok {
+            if err := checkScheme(prot.scheme); err != nil {
+               return nil, err
+            }
+         }
+      }
+   }
+   // A moov with mvex but no fragments keeps its samples in the sample
+   // tables, which only the progressive path decrypts.
+   hasMoof := slices.ContainsFunc(f.Boxes, func(box Box) bool { return box.Moof != nil })
+   if !f.Fragmented || (!hasMoof && f.Moov != nil) {
+      out := bytes.Clone(f.data)
+      reader := bytes.NewReader(f.data)
+      for _, trak := range f.Moov.Trak {
+         samples, err := d.trackSamples(reader, trak)
+         if err != nil {
+            return nil, err
+         }
+         for _, sample := range samples {
+            end := sample.Offset + uint64(sample.Size)
+            if end > uint64(len(out)) {
+               return nil, errors.New("sample extends past end of file")
+            }
+            if sample.block != nil {
+               if err := d.decryptProtected(out[sample.Offset:end], sample.info, sample.block, sample.prot); err != nil {
+                  return nil, overrunSample(err, sample.index)
+               }
+            }
+         }
+      }
+      return out, nil
+   }
+
+   // the moov is rewritten with the fragments, so that absolute tfhd base
+   // data offsets follow it
+   return d.clearSegment(f.data, func(box []byte) ([]byte, error) {
+      var moov MoovBox
+      if err := moov.Parse(box); err != nil {
+         return nil, err
+      }
+      for _, trak := range moov.Trak {
+         if stsd, ok := trak.Stsd(); ok {
+            if err := stsd.UnprotectAll(); err != nil {
+               return nil, err
+            }
+         }
+      }
+      moov.RemovePssh()
+      return moov.Encode(), nil
+   })
+}
@@ -0,0 +1,132 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "slices"
+   "testing"
+)
+
+func TestOpen_Fragmented(t *testing.T) {
+   clear := [][]byte{[]byte("first sample"), []byte("second sample")}
+   segment := buildEncryptedSegment(t, clear)
+   data := slices.Concat(buildInitSegment(true), segment, segment)
+
+   f, err := Open(data)
+   if err != nil {
+      t.Fatalf("Open failed: %v", err)
+   }
+   if !f.Fragmented || !f.Encrypted {
+      t.Errorf("expected fragmented encrypted file, got %v %v", f.Fragmented, f.Encrypted)
+   }
+   if tracks := f.Tracks(); len(tracks) != 1 || tracks[0].CodecString != "avc1.64001f" {
+      t.Errorf("unexpected tracks %+v", tracks)
+   }
+   segments := f.Segments()
+   if len(segments) != 2 || !bytes.Equal(segments[0], segment) || !bytes.Equal(segments[1], segment) {
+      t.Fatalf("expected 2 segments, got %d", len(segments))
+   }
+
+   out, err := f.Decrypt(KeyMap{testKID: testKey})
+   if err != nil {
+      t.Fatalf("Decrypt failed: %v", err)
+   }
+   decrypted, err := Open(out)
+   if err != nil {
+      t.Fatalf("Open of decrypted file failed: %v", err)
+   }
+   if decrypted.Encrypted {
+      t.Error("decrypted file is still marked encrypted")
+   }
+   if codec := decrypted.Tracks()[0].CodecString; codec != "avc1.64001f" {
+      t.Errorf("expected avc1.64001f after decryption, got %q", codec)
+   }
+   media := bytes.Join(clear, nil)
+   for i, segment := range decrypted.Segments() {
+      if !bytes.HasSuffix(segment, media) {
+         t.Errorf("segment %d was not decrypted", i)
+      }
+   }
+}
+
+func TestSegmentHasInit(t *testing.T) {
+   segment := buildEncryptedSegment(t, [][]byte{[]byte("sample")})
+   selfInitializing := slices.Concat(buildInitSegment(true), segment)
+   if !SegmentHasInit(selfInitializing) {
+      t.Error("expected in-band init")
+   }
+   if SegmentHasInit(segment) {
+      t.Error("unexpected in-band init")
+   }
+   tracks, err := Tracks(selfInitializing)
+   if err != nil || len(tracks) != 1 || tracks[0].KID != testKID {
+      t.Errorf("unexpected tracks %+v %v", tracks, err)
+   }
+}
+
+func TestOpen_NoMovie(t *testing.T) {
+   if _, err := Open(buildBox("free", []byte("nothing"))); err == nil {
+      t.Error("expected error for data without moov or moof")
+   }
+}
+
+func TestFile_DecryptCBCS(t *testing.T) {
+   init, segment, err := BuildTestContent(TestContentOptions{Scheme: "cbcs", KID: testKID, Key: testKey})
+   if err != nil {
+      t.Fatal(err)
+   }
+   f, err := Open(slices.Concat(init, segment))
+   if err != nil {
+      t.Fatalf("Open failed: %v", err)
+   }
+   out, err := f.Decrypt(KeyMap{testKID: testKey})
+   if err != nil {
+      t.Fatalf("Decrypt failed: %v", err)
+   }
+   decrypted, err := Open(out)
+   if err != nil {
+      t.Fatalf("Open of decrypted file failed: %v", err)
+   }
+   if decrypted.Encrypted {
+      t.Error("decrypted file is still marked encrypted")
+   }
+   if media := bytes.Join(testContentSamples, nil); !bytes.HasSuffix(out, media) {
+      t.Error("cbcs samples were not decrypted")
+   }
+}
+
+func TestFile_DecryptAbsoluteBase(t *testing.T) {
+   init, segment, err := BuildTestContent(TestContentOptions{Scheme: "cenc", KID: testKID, Key: testKey})
+   if err != nil {
+      t.Fatal(err)
+   }
+   // Replace the 16-byte tfhd after moof(8) mfhd(16) traf(8) with one
+   // holding a base data offset into the file. The trun data offset is
+   // left as is, so the base absorbs the 8 bytes the moof grows by.
+   tfhd := buildBox("tfhd", []byte{0, 0, 0, 0x01}, binary.BigEndian.AppendUint32(nil, 1),
+      binary.BigEndian.AppendUint64(nil, uint64(len(init)+8)))
+   segment = slices.Concat(segment[:32], tfhd, segment[48:])
+   binary.BigEndian.PutUint32(segment, binary.BigEndian.Uint32(segment)+8)
+   binary.BigEndian.PutUint32(segment[24:], binary.BigEndian.Uint32(segment[24:])+8)
+
+   f, err := Open(slices.Concat(init, segment))
+   if err != nil {
+      t.Fatalf("Open failed: %v", err)
+   }
+   out, err := f.Decrypt(KeyMap{testKID: testKey})
+   if err != nil {
+      t.Fatalf("Decrypt failed: %v", err)
+   }
+   samples, err := ExtractSamples(out)
+   if err != nil {
+      t.Fatalf("ExtractSamples failed: %v", err)
+   }
+   if len(samples) != len(testContentSamples) {
+      t.Fatalf("expected %d samples, got %d", len(testContentSamples), len(samples))
+   }
+   for i, sample := range samples {
+      if !bytes.Equal(sample.Data, testContentSamples[i]) {
+         t.Errorf("sample %d: expected %q, got %q", i, testContentSamples[i], sample.Data)
+      }
+   }
+}
@@ -1,25 +1,40 @@
 package sofia
 
-import "errors"
+import (
+   "errors"
+   "io"
+   "math"
+   "slices"
+   "strconv"
+)
 
 // --- MOOF ---
 type MoofBox struct {
-   Header      BoxHeader
+   Header BoxHeader
+   Mfhd   *MfhdBox
+   // Traf is the first of Trafs, the track fragment of single-track
+   // segments.
    Traf        *TrafBox
+   Trafs       []*TrafBox
    Pssh        []*PsshBox
    RawChildren [][]byte
 }
 
 func (b *MoofBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *MoofBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
+   opts = opts.session()
 
-   payload := data[8:b.Header.Size]
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -32,12 +47,21 @@ func (b *MoofBox) Parse(data []byte) error {
 
       content := payload[offset : offset+boxSize]
       switch string(header.Type[:]) {
+      case "mfhd":
+         var mfhd MfhdBox
+         if err := mfhd.Parse(content); err != nil {
+            return err
+         }
+         b.Mfhd = &mfhd
       case "traf":
          var traf TrafBox
-         if err := traf.Parse(content); err != nil {
+         if err := traf.parse(content, opts); err != nil {
             return err
          }
-         b.Traf = &traf
+         if b.Traf == nil {
+            b.Traf = &traf
+         }
+         b.Trafs = append(b.Trafs, &traf)
       case "pssh":
          var pssh PsshBox
          if err := pssh.Parse(content); err != nil {
@@ -52,26 +76,204 @@ func (b *MoofBox) Parse(data []byte) error {
    return nil
 }
 
+// --- MFHD ---
+type MfhdBox struct {
+   Header         BoxHeader
+   Version        byte
+   Flags          uint32
+   SequenceNumber uint32
+}
+
+func (b *MfhdBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 {
+      return errors.New("mfhd box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.SequenceNumber = p.Uint32()
+   return nil
+}
+
 // --- TRAF ---
 type TrafBox struct {
    Header      BoxHeader
    Tfhd        *TfhdBox
+   Tfdt        *TfdtBox
    Trun        []*TrunBox
    Senc        *SencBox
    Tenc        *TencBox
+   Saiz        *SaizBox
+   Saio        *SaioBox
+   Subs        *SubsBox
+   Sbgp        []*SbgpBox
+   Sgpd        []*SgpdBox
    RawChildren [][]byte
+   // sencData is the senc box, parsed into Senc with the IV size
+   // sencIVSize. Without a seig sample group or tenc in the traf that size
+   // is a guess, so when the init segment gives another the box is parsed
+   // again, and Senc is nil if the guess does not parse.
+   sencData   []byte
+   sencIVSize int
+}
+
+// SampleGroups returns the sbgp/sgpd pair for a grouping type such as
+// "seig" or "roll".
+func (b *TrafBox) SampleGroups(groupingType string) (*SbgpBox, *SgpdBox, bool) {
+   return findSampleGroup(b.Sbgp, b.Sgpd, groupingType)
+}
+
+// KID returns the key ID protecting the fragment samples, taken from the
+// first 'seig' sample group entry or failing that from a 'tenc' box.
+func (b *TrafBox) KID() ([16]byte, bool) {
+   kids := b.KIDs()
+   if len(kids) == 0 {
+      return [16]byte{}, false
+   }
+   return kids[0], true
+}
+
+// KIDs returns every key ID referenced by the fragment, from all protected
+// 'seig' sample group entries and the 'tenc' box.
+func (b *TrafBox) KIDs() [][16]byte {
+   var kids [][16]byte
+   add := func(kid [16]byte) {
+      if !slices.Contains(kids, kid) {
+         kids = append(kids, kid)
+      }
+   }
+   if _, sgpd, ok := b.SampleGroups("seig"); ok && sgpd != nil {
+      for _, data := range sgpd.Entries {
+         var entry SeigEntry
+         if entry.Parse(data) == nil && entry.IsProtected == 1 {
+            add(entry.KID)
+         }
+      }
+   }
+   if b.Tenc != nil && b.Tenc.DefaultIsProtected == 1 {
+      add(b.Tenc.DefaultKID)
+   }
+   return kids
+}
+
+// perSampleIVSize returns the per-sample IV size of the fragment from the
+// first protected 'seig' sample group entry or failing that from a 'tenc'
+// box.
+func (b *TrafBox) perSampleIVSize() (int, bool) {
+   if _, sgpd, ok := b.SampleGroups("seig"); ok && sgpd != nil {
+      for _, data := range sgpd.Entries {
+         var entry SeigEntry
+         if entry.Parse(data) == nil && entry.IsProtected == 1 {
+            return int(entry.PerSampleIVSize), true
+         }
+      }
+   }
+   if b.Tenc != nil && b.Tenc.DefaultIsProtected == 1 {
+      return int(b.Tenc.DefaultPerSampleIVSize), true
+   }
+   return 0, false
+}
+
+// trex returns the trex of the track of the fragment in mvex, which may be
+// nil.
+func (b *TrafBox) trex(mvex *MvexBox) (*TrexBox, bool) {
+   if mvex == nil || b.Tfhd == nil {
+      return nil, false
+   }
+   return mvex.TrackDefaults(b.Tfhd.TrackID)
+}
+
+// sampleSizes resolves the size of every sample in the fragment. When a
+// trun omits per-sample sizes they come from the tfhd default or failing
+// that from the trex of the track in mvex, which may be nil; it is an
+// error if neither gives one.
+func (b *TrafBox) sampleSizes(mvex *MvexBox) ([]uint32, error) {
+   var defSize uint32
+   known := true
+   if b.Tfhd != nil && b.Tfhd.Flags&0x000010 != 0 {
+      defSize = b.Tfhd.DefaultSampleSize
+   } else if trex, ok := b.trex(mvex); ok {
+      defSize = trex.DefaultSampleSize
+   } else {
+      known = false
+   }
+   var sizes []uint32
+   for _, trun := range b.Trun {
+      if trun.Flags&0x000200 == 0 && len(trun.Samples) > 0 && !known {
+         return nil, errors.New("no sample size in trun, tfhd or trex")
+      }
+      sizes = append(sizes, trun.SampleSizes(defSize)...)
+   }
+   return sizes, nil
+}
+
+// sampleTimings resolves the duration and sync flag of every sample in the
+// fragment. Durations and flags a trun omits come from the tfhd defaults or
+// failing those from the trex of the track in mvex, which may be nil; it is
+// an error if no duration is given. Samples are treated as sync samples
+// when no flags are signalled.
+func (b *TrafBox) sampleTimings(mvex *MvexBox) ([]FragmentSample, error) {
+   var defDuration, defFlags uint32
+   durationKnown := true
+   trex, hasTrex := b.trex(mvex)
+   switch {
+   case b.Tfhd != nil && b.Tfhd.Flags&0x000008 != 0:
+      defDuration = b.Tfhd.DefaultSampleDuration
+   case hasTrex:
+      defDuration = trex.DefaultSampleDuration
+   default:
+      durationKnown = false
+   }
+   switch {
+   case b.Tfhd != nil && b.Tfhd.Flags&0x000020 != 0:
+      defFlags = b.Tfhd.DefaultSampleFlags
+   case hasTrex:
+      defFlags = trex.DefaultSampleFlags
+   }
+   var samples []FragmentSample
+   for _, trun := range b.Trun {
+      if trun.Flags&0x000100 == 0 && len(trun.Samples) > 0 && !durationKnown {
+         return nil, errors.New("no sample duration in trun, tfhd or trex")
+      }
+      for i, sample := range trun.Samples {
+         duration := defDuration
+         if trun.Flags&0x000100 != 0 {
+            duration = sample.Duration
+         }
+         flags := defFlags
+         if i == 0 && trun.Flags&0x000004 != 0 {
+            flags = trun.FirstSampleFlags
+         }
+         if trun.Flags&0x000400 != 0 {
+            flags = sample.Flags
+         }
+         // sample_is_non_sync_sample
+         samples = append(samples, FragmentSample{duration, flags&0x00010000 == 0})
+      }
+   }
+   return samples, nil
 }
 
 func (b *TrafBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *TrafBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
+   opts = opts.session()
 
-   payload := data[8:b.Header.Size]
+   var sencErr error
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -90,32 +292,140 @@ func (b *TrafBox) Parse(data []byte) error {
             return err
          }
          b.Tfhd = &tfhd
+      case "tfdt":
+         var tfdt TfdtBox
+         if err := tfdt.Parse(content); err != nil {
+            return err
+         }
+         b.Tfdt = &tfdt
       case "trun":
          var trun TrunBox
-         if err := trun.Parse(content); err != nil {
+         if err := trun.parse(content, opts); err != nil {
             return err
          }
          b.Trun = append(b.Trun, &trun)
       case "senc":
+         // the IV size may come from a later seig sample group
+         b.sencData = content
+      case "uuid":
+         if header.UserType != piffSencUUID {
+            b.RawChildren = append(b.RawChildren, content)
+            break
+         }
          var senc SencBox
-         if err := senc.Parse(content); err != nil {
-            return err
+         if err := senc.parsePIFF(content, opts); err != nil {
+            // the trun sample count may not be known yet
+            if !senc.lastTruncated {
+               return err
+            }
+            sencErr = err
          }
          b.Senc = &senc
       case "tenc":
          var tenc TencBox
-         if err := tenc.Parse(content); err != nil {
+         if err := tenc.parse(content, opts); err != nil {
             return err
          }
          b.Tenc = &tenc
+      case "saiz":
+         var saiz SaizBox
+         if err := saiz.Parse(content); err != nil {
+            return err
+         }
+         b.Saiz = &saiz
+      case "saio":
+         var saio SaioBox
+         if err := saio.Parse(content); err != nil {
+            return err
+         }
+         b.Saio = &saio
+      case "subs":
+         var subs SubsBox
+         if err := subs.Parse(content); err != nil {
+            return err
+         }
+         b.Subs = &subs
+      case "sbgp":
+         var sbgp SbgpBox
+         if err := sbgp.Parse(content); err != nil {
+            return err
+         }
+         b.Sbgp = append(b.Sbgp, &sbgp)
+      case "sgpd":
+         var sgpd SgpdBox
+         if err := sgpd.Parse(content); err != nil {
+            return err
+         }
+         b.Sgpd = append(b.Sgpd, &sgpd)
       default:
          b.RawChildren = append(b.RawChildren, content)
       }
       offset += boxSize
    }
+   if sencErr != nil {
+      if err := b.repairSenc(b.Senc, sencErr, opts); err != nil {
+         return err
+      }
+   }
+   if b.sencData != nil {
+      ivSize, known := b.perSampleIVSize()
+      if !known {
+         ivSize = 8
+      }
+      b.sencIVSize = ivSize
+      senc, err := b.parseSenc(ivSize, opts)
+      if err != nil && known {
+         return err
+      }
+      // otherwise the IV size is left to the tenc of the init segment, and
+      // sencWithIVSize reports the error once it is known
+      b.Senc = senc
+   }
    return nil
 }
 
+// parseSenc parses the senc box of the traf with the given per-sample IV
+// size.
+func (b *TrafBox) parseSenc(ivSize int, opts *ParseOptions) (*SencBox, error) {
+   var senc SencBox
+   if err := senc.parseWithIVSize(b.sencData, ivSize, opts); err != nil {
+      if err := b.repairSenc(&senc, err, opts); err != nil {
+         return nil, err
+      }
+   }
+   return &senc, nil
+}
+
+// repairSenc drops the truncated final entry of a senc that failed to
+// parse with err if it is the one sample too many of a known packager bug,
+// unless opts is strict. It returns err if senc cannot be repaired.
+func (b *TrafBox) repairSenc(senc *SencBox, err error, opts *ParseOptions) error {
+   var sampleCount uint32
+   for _, trun := range b.Trun {
+      sampleCount += trun.SampleCount
+   }
+   if opts.strict() || !senc.RepairAgainstTrun(sampleCount) {
+      return err
+   }
+   opts.warn("senc declares one more sample than trun; dropped truncated entry")
+   return nil
+}
+
+// encrypted reports whether the traf carries sample encryption info, even
+// if its senc still awaits the IV size of the init segment.
+func (b *TrafBox) encrypted() bool {
+   return b.Senc != nil || b.sencData != nil
+}
+
+// sencWithIVSize returns the senc of the traf parsed with the per-sample
+// IV size ivSize, parsing it again if Senc was parsed with another.
+func (b *TrafBox) sencWithIVSize(ivSize int, opts *ParseOptions) (*SencBox, error) {
+   if b.sencData == nil || (b.Senc != nil && ivSize == b.sencIVSize) {
+      return b.Senc, nil
+   }
+   return b.parseSenc(ivSize, opts)
+}
+
 // --- TFHD ---
 type TfhdBox struct {
    Header                 BoxHeader
@@ -173,6 +483,241 @@ func (b *TfhdBox) Parse(data []byte) error {
    return nil
 }
 
+// DefaultBaseIsMoof reports the default-base-is-moof flag: without an
+// explicit base data offset, trun data offsets are relative to the start
+// of the moof rather than to the end of the previous track fragment's data.
+func (b *TfhdBox) DefaultBaseIsMoof() bool {
+   return b.Flags&0x020000 != 0
+}
+
+// --- TFDT ---
+type TfdtBox struct {
+   Header              BoxHeader
+   Version             byte
+   Flags               uint32
+   BaseMediaDecodeTime uint64
+}
+
+func (b *TfdtBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 {
+      return errors.New("tfdt too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   if b.Version == 1 {
+      if len(data) < 20 {
+         return errors.New("tfdt v1 too short")
+      }
+      b.BaseMediaDecodeTime = p.Uint64()
+   } else {
+      b.BaseMediaDecodeTime = uint64(p.Uint32())
+   }
+   return nil
+}
+
+// --- SAIZ ---
+
+// SaizBox gives the size of the auxiliary information of each sample,
+// either as DefaultSampleInfoSize for every sample or, when that is 0, from
+// the per-sample SampleInfoSizes table.
+type SaizBox struct {
+   Header                BoxHeader
+   Version               byte
+   Flags                 uint32
+   AuxInfoType           [4]byte // Present if Flags&1
+   AuxInfoTypeParameter  uint32  // Present if Flags&1
+   DefaultSampleInfoSize byte
+   SampleCount           uint32
+   SampleInfoSizes       []byte // Present if DefaultSampleInfoSize=0
+}
+
+func (b *SaizBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   p := parser{data: data, offset: 8}
+   if len(data) < p.offset+4 {
+      return errors.New("saiz box too short for version/flags")
+   }
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   if b.Flags&0x000001 != 0 {
+      if len(data) < p.offset+8 {
+         return errors.New("saiz box too short for aux info type")
+      }
+      copy(b.AuxInfoType[:], p.Bytes(4))
+      b.AuxInfoTypeParameter = p.Uint32()
+   }
+   if len(data) < p.offset+5 {
+      return errors.New("saiz box too short for sample count")
+   }
+   b.DefaultSampleInfoSize = p.Byte()
+   b.SampleCount = p.Uint32()
+   if b.DefaultSampleInfoSize == 0 {
+      if uint64(len(data)-p.offset) < uint64(b.SampleCount) {
+         return errors.New("saiz box too short for declared samples")
+      }
+      b.SampleInfoSizes = p.Bytes(int(b.SampleCount))
+   }
+   return nil
+}
+
+func (b *SaizBox) Encode() []byte {
+   size := 17
+   if b.Flags&0x000001 != 0 {
+      size += 8
+   }
+   if b.DefaultSampleInfoSize == 0 {
+      size += len(b.SampleInfoSizes)
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   if b.Flags&0x000001 != 0 {
+      w.PutBytes(b.AuxInfoType[:])
+      w.PutUint32(b.AuxInfoTypeParameter)
+   }
+   w.PutByte(b.DefaultSampleInfoSize)
+   w.PutUint32(b.SampleCount)
+   if b.DefaultSampleInfoSize == 0 {
+      w.PutBytes(b.SampleInfoSizes)
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'s', 'a', 'i', 'z'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *SaizBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// SampleInfoSize returns the aux info size of the sample at index i.
+func (b *SaizBox) SampleInfoSize(i int) int {
+   if b.DefaultSampleInfoSize != 0 {
+      return int(b.DefaultSampleInfoSize)
+   }
+   if i < len(b.SampleInfoSizes) {
+      return int(b.SampleInfoSizes[i])
+   }
+   return 0
+}
+
+// --- SAIO ---
+
+// SaioBox locates sample auxiliary information. In a traf it usually holds
+// a single offset, to aux info stored contiguously for every sample of the
+// fragment; otherwise it holds one offset per chunk (per trun).
+type SaioBox struct {
+   Header               BoxHeader
+   Version              byte
+   Flags                uint32
+   AuxInfoType          [4]byte // Present if Flags&1
+   AuxInfoTypeParameter uint32  // Present if Flags&1
+   Offsets              []uint64
+}
+
+func (b *SaioBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   p := parser{data: data, offset: 8}
+   if len(data) < p.offset+4 {
+      return errors.New("saio box too short for version/flags")
+   }
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   if b.Flags&0x000001 != 0 {
+      if len(data) < p.offset+8 {
+         return errors.New("saio box too short for aux info type")
+      }
+      copy(b.AuxInfoType[:], p.Bytes(4))
+      b.AuxInfoTypeParameter = p.Uint32()
+   }
+   if len(data) < p.offset+4 {
+      return errors.New("saio box too short for entry count")
+   }
+   entryCount := p.Uint32()
+   offsetSize := 4
+   if b.Version == 1 {
+      offsetSize = 8
+   }
+   if uint64(len(data)-p.offset) < uint64(entryCount)*uint64(offsetSize) {
+      return errors.New("saio box too short for declared entries")
+   }
+   b.Offsets = make([]uint64, entryCount)
+   for i := range b.Offsets {
+      if b.Version == 1 {
+         b.Offsets[i] = p.Uint64()
+      } else {
+         b.Offsets[i] = uint64(p.Uint32())
+      }
+   }
+   return nil
+}
+
+func (b *SaioBox) Encode() []byte {
+   offsetSize := 4
+   if b.Version == 1 {
+      offsetSize = 8
+   }
+   size := 16 + len(b.Offsets)*offsetSize
+   if b.Flags&0x000001 != 0 {
+      size += 8
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   if b.Flags&0x000001 != 0 {
+      w.PutBytes(b.AuxInfoType[:])
+      w.PutUint32(b.AuxInfoTypeParameter)
+   }
+   w.PutUint32(uint32(len(b.Offsets)))
+   for _, offset := range b.Offsets {
+      if b.Version == 1 {
+         w.PutUint64(offset)
+      } else {
+         w.PutUint32(uint32(offset))
+      }
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'s', 'a', 'i', 'o'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *SaioBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// SampleInfoOffset returns the offset of the aux info of the sample at
+// index i, for a saio holding a single offset to the aux info of every
+// sample, laid out back to back with the sizes given by saiz. It returns
+// false if saio holds any other number of offsets or i is out of range.
+func (b *SaioBox) SampleInfoOffset(saiz *SaizBox, i int) (uint64, bool) {
+   if len(b.Offsets) != 1 || i < 0 || i >= int(saiz.SampleCount) {
+      return 0, false
+   }
+   offset := b.Offsets[0]
+   for j := 0; j < i; j++ {
+      offset += uint64(saiz.SampleInfoSize(j))
+   }
+   return offset, true
+}
+
 // --- TRUN ---
 type SampleInfo struct {
    Size                  uint32
@@ -181,8 +726,14 @@ type SampleInfo struct {
    CompositionTimeOffset int32
 }
 
+// maxFieldlessSamples bounds the samples without fields that the trun and
+// senc boxes of one parse may declare together, since the box sizes do
+// not bound them.
+const maxFieldlessSamples = 1 << 22
+
 type TrunBox struct {
    Header           BoxHeader
+   Version          byte
    Flags            uint32
    SampleCount      uint32
    DataOffset       int32
@@ -191,6 +742,10 @@ type TrunBox struct {
 }
 
 func (b *TrunBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *TrunBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
@@ -200,6 +755,7 @@ func (b *TrunBox) Parse(data []byte) error {
 
    p := parser{data: data, offset: 8}
    flags := p.Uint32()
+   b.Version = byte(flags >> 24)
    b.Flags = flags & 0x00FFFFFF
    b.SampleCount = p.Uint32()
 
@@ -232,6 +788,9 @@ func (b *TrunBox) Parse(data []byte) error {
    if len(data)-p.offset < int(b.SampleCount)*sampleEntrySize {
       return errors.New("trun box too short for declared samples")
    }
+   if sampleEntrySize == 0 && !opts.takeFieldless(b.SampleCount) {
+      return errors.New("trun sample_count too large for samples without fields")
+   }
 
    b.Samples = make([]SampleInfo, b.SampleCount)
    for i := uint32(0); i < b.SampleCount; i++ {
@@ -245,8 +804,324 @@ func (b *TrunBox) Parse(data []byte) error {
          b.Samples[i].Flags = p.Uint32()
       }
       if b.Flags&0x000800 != 0 {
-         b.Samples[i].CompositionTimeOffset = p.Int32()
+         // signed in version 1, unsigned in version 0
+         offset := p.Uint32()
+         if b.Version == 0 && offset > math.MaxInt32 {
+            if opts.strict() {
+               return errors.New("trun v0 composition offset overflows int32")
+            }
+            opts.warn("clamping trun v0 composition offset " + strconv.FormatUint(uint64(offset), 10))
+            offset = math.MaxInt32
+         }
+         b.Samples[i].CompositionTimeOffset = int32(offset)
+      }
+   }
+   return nil
+}
+
+// SampleSizes returns the size of every sample of the run, using
+// defaultSize, usually the tfhd default, when the run omits sizes. The
+// samples follow one another in the mdat from the data offset.
+func (b *TrunBox) SampleSizes(defaultSize uint32) []uint32 {
+   sizes := make([]uint32, len(b.Samples))
+   for i, sample := range b.Samples {
+      if b.Flags&0x000200 != 0 {
+         sizes[i] = sample.Size
+      } else {
+         sizes[i] = defaultSize
       }
    }
+   return sizes
+}
+
+// --- MFRA ---
+type MfraBox struct {
+   Header      BoxHeader
+   Tfra        []*TfraBox
+   RawChildren [][]byte
+}
+
+func (b *MfraBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+
+   payload := data[b.Header.HeaderSize:b.Header.Size]
+   offset := 0
+   for offset < len(payload) {
+      var header BoxHeader
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
+         break
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(payload) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(payload) {
+         return errors.New("invalid child box size")
+      }
+
+      content := payload[offset : offset+boxSize]
+      switch string(header.Type[:]) {
+      case "tfra":
+         var tfra TfraBox
+         if err := tfra.Parse(content); err != nil {
+            return err
+         }
+         b.Tfra = append(b.Tfra, &tfra)
+      default:
+         b.RawChildren = append(b.RawChildren, content)
+      }
+      offset += boxSize
+   }
    return nil
 }
+
+// --- TFRA ---
+type TfraEntry struct {
+   Time         uint64
+   MoofOffset   uint64
+   TrafNumber   uint32
+   TrunNumber   uint32
+   SampleNumber uint32
+}
+
+type TfraBox struct {
+   Header                BoxHeader
+   Version               byte
+   Flags                 uint32
+   TrackID               uint32
+   LengthSizeOfTrafNum   byte // field width minus one
+   LengthSizeOfTrunNum   byte // field width minus one
+   LengthSizeOfSampleNum byte // field width minus one
+   Entries               []TfraEntry
+}
+
+func (b *TfraBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 24 { // 8 header + 4 version/flags + 4 track_ID + 4 sizes + 4 count
+      return errors.New("tfra box too short")
+   }
+
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.TrackID = p.Uint32()
+
+   sizes := p.Uint32() // reserved(26) + three 2-bit length fields
+   b.LengthSizeOfTrafNum = byte(sizes>>4) & 0x03
+   b.LengthSizeOfTrunNum = byte(sizes>>2) & 0x03
+   b.LengthSizeOfSampleNum = byte(sizes) & 0x03
+   entryCount := p.Uint32()
+
+   trafSize := int(b.LengthSizeOfTrafNum) + 1
+   trunSize := int(b.LengthSizeOfTrunNum) + 1
+   sampleSize := int(b.LengthSizeOfSampleNum) + 1
+   entrySize := 8 + trafSize + trunSize + sampleSize
+   if b.Version == 1 {
+      entrySize += 8
+   }
+   if uint64(len(data)-p.offset) < uint64(entryCount)*uint64(entrySize) {
+      return errors.New("tfra box too short for declared entries")
+   }
+
+   b.Entries = make([]TfraEntry, entryCount)
+   for i := range b.Entries {
+      if b.Version == 1 {
+         b.Entries[i].Time = p.Uint64()
+         b.Entries[i].MoofOffset = p.Uint64()
+      } else {
+         b.Entries[i].Time = uint64(p.Uint32())
+         b.Entries[i].MoofOffset = uint64(p.Uint32())
+      }
+      b.Entries[i].TrafNumber = p.UintN(trafSize)
+      b.Entries[i].TrunNumber = p.UintN(trunSize)
+      b.Entries[i].SampleNumber = p.UintN(sampleSize)
+   }
+   return nil
+}
+
+// --- SEEKING ---
+
+// FragmentSample is the timing of one sample of a fragment.
+type FragmentSample struct {
+   Duration uint32
+   IsSync   bool
+}
+
+// FragmentInfo is the timeline of one fragment, in media timescale units.
+type FragmentInfo struct {
+   BaseMediaDecodeTime uint64
+   Samples             []FragmentSample
+}
+
+// Duration returns the sum of the sample durations of the fragment.
+func (f *FragmentInfo) Duration() uint64 {
+   var duration uint64
+   for _, sample := range f.Samples {
+      duration += uint64(sample.Duration)
+   }
+   return duration
+}
+
+// FragmentIndex builds the timeline of the fragments of a track in the
+// given media segments, in order; moofs without a traf of the track are
+// skipped. Sample durations the fragments leave to trex are taken from the
+// mvex of a moov among the segments, such as an init segment passed first.
+func FragmentIndex(segments [][]byte, trackID uint32) ([]FragmentInfo, error) {
+   var index []FragmentInfo
+   var mvex *MvexBox
+   for _, segment := range segments {
+      boxes, err := Parse(segment)
+      if err != nil {
+         return nil, err
+      }
+      for _, box := range boxes {
+         if box.Moov != nil {
+            mvex = box.Moov.Mvex
+         }
+         if box.Moof == nil {
+            continue
+         }
+         traf, ok := box.Moof.trackFragment(trackID, 0)
+         if !ok {
+            continue
+         }
+         if traf.Tfdt == nil {
+            return nil, errors.New("traf has no tfdt")
+         }
+         samples, err := traf.sampleTimings(mvex)
+         if err != nil {
+            return nil, err
+         }
+         index = append(index, FragmentInfo{
+            BaseMediaDecodeTime: traf.Tfdt.BaseMediaDecodeTime,
+            Samples:             samples,
+         })
+      }
+   }
+   return index, nil
+}
+
+// MfraFragmentIndex builds the timeline of the fragments of a track that
+// the tfra of a fragmented file lists, in order. file is the whole file,
+// since tfra gives the moof offsets from its start, and its moov supplies
+// the trex defaults. A fragment without a tfdt is timed by its first tfra
+// entry, less the durations of the samples before that entry.
+func MfraFragmentIndex(file []byte, trackID uint32) ([]FragmentInfo, error) {
+   boxes, err := Parse(file)
+   if err != nil {
+      return nil, err
+   }
+   var mvex *MvexBox
+   if moov, ok := FindMoov(boxes); ok {
+      mvex = moov.Mvex
+   }
+   var tfra *TfraBox
+   for _, box := range boxes {
+      if box.Mfra == nil {
+         continue
+      }
+      for _, candidate := range box.Mfra.Tfra {
+         if candidate.TrackID == trackID {
+            tfra = candidate
+         }
+      }
+   }
+   if tfra == nil {
+      return nil, errors.New("no tfra for track " + strconv.FormatUint(uint64(trackID), 10))
+   }
+   var index []FragmentInfo
+   for i, entry := range tfra.Entries {
+      if i > 0 && entry.MoofOffset == tfra.Entries[i-1].MoofOffset {
+         continue
+      }
+      var header BoxHeader
+      if entry.MoofOffset >= uint64(len(file)) || header.Parse(file[entry.MoofOffset:]) != nil ||
+         string(header.Type[:]) != "moof" || header.Size > uint64(len(file))-entry.MoofOffset {
+         return nil, errors.New("tfra moof offset does not point to a moof")
+      }
+      var moof MoofBox
+      if err := moof.Parse(file[entry.MoofOffset : entry.MoofOffset+header.Size]); err != nil {
+         return nil, err
+      }
+      traf, ok := moof.trackFragment(trackID, entry.TrafNumber)
+      if !ok {
+         return nil, errors.New("tfra entry points to a moof without the track")
+      }
+      samples, err := traf.sampleTimings(mvex)
+      if err != nil {
+         return nil, err
+      }
+      info := FragmentInfo{Samples: samples}
+      if traf.Tfdt != nil {
+         info.BaseMediaDecodeTime = traf.Tfdt.BaseMediaDecodeTime
+      } else {
+         // trun_number and sample_number count from 1
+         before := int(entry.SampleNumber) - 1
+         for _, trun := range traf.Trun[:min(max(int(entry.TrunNumber)-1, 0), len(traf.Trun))] {
+            before += len(trun.Samples)
+         }
+         info.BaseMediaDecodeTime = entry.Time
+         for _, sample := range samples[:min(max(before, 0), len(samples))] {
+            info.BaseMediaDecodeTime -= uint64(sample.Duration)
+         }
+      }
+      index = append(index, info)
+   }
+   return index, nil
+}
+
+// trackFragment returns the traf of trackID, preferring the one at the
+// 1-based trafNumber of a tfra entry.
+func (b *MoofBox) trackFragment(trackID, trafNumber uint32) (*TrafBox, bool) {
+   if trafNumber >= 1 && int(trafNumber) <= len(b.Trafs) {
+      if traf := b.Trafs[trafNumber-1]; traf.Tfhd != nil && traf.Tfhd.TrackID == trackID {
+         return traf, true
+      }
+   }
+   for _, traf := range b.Trafs {
+      if traf.Tfhd != nil && traf.Tfhd.TrackID == trackID {
+         return traf, true
+      }
+   }
+   return nil, false
+}
+
+// SeekToTime returns the fragment and sample index of the nearest sync
+// sample at or before media time t. It returns an error if t lies outside
+// the index or no sync sample precedes it.
+func SeekToTime(index []FragmentInfo, t uint64) (int, int, error) {
+   fragment, sample := -1, -1
+   for i := range index {
+      start := index[i].BaseMediaDecodeTime
+      if t < start || t >= start+index[i].Duration() {
+         continue
+      }
+      for j, s := range index[i].Samples {
+         if t < start+uint64(s.Duration) {
+            fragment, sample = i, j
+            break
+         }
+         start += uint64(s.Duration)
+      }
+      break
+   }
+   if fragment < 0 {
+      return 0, 0, errors.New("time out of range")
+   }
+   for ; fragment >= 0; fragment-- {
+      for ; sample >= 0; sample-- {
+         if index[fragment].Samples[sample].IsSync {
+            return fragment, sample, nil
+         }
+      }
+      if fragment > 0 {
+         sample = len(index[fragment-1].Samples) - 1
+      }
+   }
+   return 0, 0, errors.New("no sync sample before time")
+}
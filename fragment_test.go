@@ -0,0 +1,436 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "math"
+   "slices"
+   "strings"
+   "testing"
+)
+
+// buildTfra assembles a 'tfra' box with a single entry. The traf, trun and
+// sample numbers are written using the given field widths (1-4 bytes).
+func buildTfra(version byte, trafSize, trunSize, sampleSize int, entry TfraEntry) []byte {
+   putN := func(buffer []byte, n int, val uint32) []byte {
+      for i := n - 1; i >= 0; i-- {
+         buffer = append(buffer, byte(val>>(8*i)))
+      }
+      return buffer
+   }
+   buffer := make([]byte, 8)
+   buffer = append(buffer, version, 0, 0, 0)
+   buffer = binary.BigEndian.AppendUint32(buffer, 1) // track_ID
+   sizes := uint32(trafSize-1)<<4 | uint32(trunSize-1)<<2 | uint32(sampleSize-1)
+   buffer = binary.BigEndian.AppendUint32(buffer, sizes)
+   buffer = binary.BigEndian.AppendUint32(buffer, 1) // number_of_entry
+   if version == 1 {
+      buffer = binary.BigEndian.AppendUint64(buffer, entry.Time)
+      buffer = binary.BigEndian.AppendUint64(buffer, entry.MoofOffset)
+   } else {
+      buffer = binary.BigEndian.AppendUint32(buffer, uint32(entry.Time))
+      buffer = binary.BigEndian.AppendUint32(buffer, uint32(entry.MoofOffset))
+   }
+   buffer = putN(buffer, trafSize, entry.TrafNumber)
+   buffer = putN(buffer, trunSize, entry.TrunNumber)
+   buffer = putN(buffer, sampleSize, entry.SampleNumber)
+   binary.BigEndian.PutUint32(buffer, uint32(len(buffer)))
+   copy(buffer[4:8], "tfra")
+   return buffer
+}
+
+func TestTfraBox_Parsing(t *testing.T) {
+   tests := []struct {
+      name                           string
+      version                        byte
+      trafSize, trunSize, sampleSize int
+      entry                          TfraEntry
+   }{
+      {"v0 1-byte fields", 0, 1, 1, 1, TfraEntry{
+         Time: 90000, MoofOffset: 1234, TrafNumber: 1, TrunNumber: 2, SampleNumber: 0xFF,
+      }},
+      {"v1 4-byte fields", 1, 4, 4, 4, TfraEntry{
+         Time: 0x1_0000_0000, MoofOffset: 0x2_0000_0000,
+         TrafNumber: 0x01020304, TrunNumber: 0xFFFFFFFF, SampleNumber: 0x0A0B0C0D,
+      }},
+      {"v1 mixed fields", 1, 1, 2, 3, TfraEntry{
+         Time: 42, MoofOffset: 7, TrafNumber: 9, TrunNumber: 0x0102, SampleNumber: 0x010203,
+      }},
+   }
+   for _, test := range tests {
+      t.Run(test.name, func(t *testing.T) {
+         data := buildTfra(test.version, test.trafSize, test.trunSize, test.sampleSize, test.entry)
+         var tfra TfraBox
+         if err := tfra.Parse(data); err != nil {
+            t.Fatalf("Parse failed: %v", err)
+         }
+         if len(tfra.Entries) != 1 {
+            t.Fatalf("expected 1 entry, got %d", len(tfra.Entries))
+         }
+         if tfra.Entries[0] != test.entry {
+            t.Errorf("entry mismatch\n  Expected: %+v\n  Got:      %+v", test.entry, tfra.Entries[0])
+         }
+      })
+   }
+
+   // A box declaring more entries than it holds must be rejected.
+   data := buildTfra(0, 4, 4, 4, TfraEntry{})
+   binary.BigEndian.PutUint32(data[20:24], 2)
+   var tfra TfraBox
+   if err := tfra.Parse(data); err == nil {
+      t.Error("expected error for truncated tfra entries")
+   }
+}
+
+func TestSeekToTime(t *testing.T) {
+   sync := FragmentSample{Duration: 10, IsSync: true}
+   delta := FragmentSample{Duration: 10}
+   index := []FragmentInfo{
+      {BaseMediaDecodeTime: 100, Samples: []FragmentSample{sync, delta, delta}},
+      {BaseMediaDecodeTime: 130, Samples: []FragmentSample{delta, sync, delta}},
+   }
+   tests := []struct {
+      time             uint64
+      fragment, sample int
+   }{
+      {100, 0, 0},
+      {125, 0, 0},
+      {135, 0, 0}, // the first sample of the second fragment is not sync
+      {145, 1, 1},
+      {159, 1, 1},
+   }
+   for _, test := range tests {
+      fragment, sample, err := SeekToTime(index, test.time)
+      if err != nil {
+         t.Errorf("time %d: %v", test.time, err)
+         continue
+      }
+      if fragment != test.fragment || sample != test.sample {
+         t.Errorf("time %d: expected %d/%d, got %d/%d",
+            test.time, test.fragment, test.sample, fragment, sample)
+      }
+   }
+   for _, time := range []uint64{99, 160} {
+      if _, _, err := SeekToTime(index, time); err == nil {
+         t.Errorf("time %d: expected out of range error", time)
+      }
+   }
+}
+
+func TestFragmentIndex(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // tfhd with default-sample-duration and default-sample-flags (non-sync)
+   tfhd := buildBox("tfhd", []byte{0, 0, 0, 0x28}, u32(1), u32(1000), u32(0x00010000))
+   tfdt := buildBox("tfdt", []byte{1, 0, 0, 0}, binary.BigEndian.AppendUint64(nil, 1<<33))
+   // first-sample-flags-present marks the first sample as sync
+   trun := buildBox("trun", []byte{0, 0, 0, 0x04}, u32(2), u32(0x02000000))
+   other := buildBox("traf", buildBox("tfhd", []byte{0, 0, 0, 0}, u32(2)))
+   moof := buildBox("moof", other, buildBox("traf", tfhd, tfdt, trun))
+
+   index, err := FragmentIndex([][]byte{moof}, 1)
+   if err != nil {
+      t.Fatalf("FragmentIndex failed: %v", err)
+   }
+   if len(index) != 1 || index[0].BaseMediaDecodeTime != 1<<33 {
+      t.Fatalf("unexpected index %+v", index)
+   }
+   expected := []FragmentSample{{1000, true}, {1000, false}}
+   if !slices.Equal(index[0].Samples, expected) {
+      t.Errorf("expected samples %+v, got %+v", expected, index[0].Samples)
+   }
+   if index, err := FragmentIndex([][]byte{moof}, 3); err != nil || len(index) != 0 {
+      t.Errorf("expected an empty index for another track, got %+v %v", index, err)
+   }
+}
+
+func TestFragmentIndex_Trex(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   init := buildInitSegment(false)
+   binary.BigEndian.PutUint32(init[bytes.Index(init, []byte("trex"))+16:], 1000) // default_sample_duration
+   // neither the tfhd nor the trun gives sample durations
+   moof := func(tfdt ...[]byte) []byte {
+      children := [][]byte{buildBox("tfhd", []byte{0, 0, 0, 0}, u32(1))}
+      children = append(children, tfdt...)
+      return buildBox("moof", buildBox("traf", append(children, buildBox("trun", []byte{0, 0, 0, 0}, u32(3)))...))
+   }
+   first := moof(buildBox("tfdt", []byte{0, 0, 0, 0}, u32(0)))
+
+   index, err := FragmentIndex([][]byte{init, first}, 1)
+   if err != nil {
+      t.Fatalf("FragmentIndex failed: %v", err)
+   }
+   if len(index) != 1 || index[0].Duration() != 3000 {
+      t.Fatalf("unexpected index %+v", index)
+   }
+   if fragment, sample, err := SeekToTime(index, 2500); err != nil || fragment != 0 || sample != 2 {
+      t.Errorf("expected 0/2, got %d/%d %v", fragment, sample, err)
+   }
+   if _, err := FragmentIndex([][]byte{first}, 1); err == nil {
+      t.Error("expected error without the trex durations")
+   }
+
+   // mfra lists both moofs; the second has no tfdt, so its tfra time,
+   // that of its second sample, places it.
+   second := moof()
+   mdat := buildBox("mdat", []byte("samples"))
+   file := slices.Concat(init, first, mdat, second, mdat)
+   entry := func(time, offset uint32, sample byte) []byte {
+      return append(u32(time), append(u32(offset), 1, 1, sample)...)
+   }
+   tfra := buildBox("tfra", []byte{0, 0, 0, 0}, u32(1), u32(0), u32(2),
+      entry(0, uint32(len(init)), 1),
+      entry(5000, uint32(len(init)+len(first)+len(mdat)), 2))
+   file = append(file, buildBox("mfra", tfra)...)
+
+   index, err = MfraFragmentIndex(file, 1)
+   if err != nil {
+      t.Fatalf("MfraFragmentIndex failed: %v", err)
+   }
+   if len(index) != 2 || index[0].BaseMediaDecodeTime != 0 || index[1].BaseMediaDecodeTime != 4000 {
+      t.Fatalf("unexpected index %+v", index)
+   }
+   if _, err := MfraFragmentIndex(file, 2); err == nil {
+      t.Error("expected error for a track without tfra")
+   }
+}
+
+func TestFindMoof(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   traf := func(trackID uint32) []byte {
+      return buildBox("traf",
+         buildBox("tfhd", []byte{0, 0, 0, 0}, u32(trackID)),
+         buildBox("tfdt", []byte{1, 0, 0, 0}, u32(0), u32(900)),
+         buildBox("trun", []byte{0, 0, 0, 0}, u32(0)),
+      )
+   }
+   moof := buildBox("moof", buildBox("mfhd", []byte{0, 0, 0, 0}, u32(7)), traf(1), traf(2))
+   boxes, err := Parse(append(buildBox("styp", []byte("msdh"), u32(0)), moof...))
+   if err != nil {
+      t.Fatal(err)
+   }
+   box, ok := FindMoof(boxes)
+   if !ok {
+      t.Fatal("'moof' box not found")
+   }
+   if box.Mfhd == nil || box.Mfhd.SequenceNumber != 7 {
+      t.Errorf("unexpected mfhd %+v", box.Mfhd)
+   }
+   if len(box.Trafs) != 2 || box.Traf != box.Trafs[0] || box.Trafs[1].Tfhd.TrackID != 2 {
+      t.Fatalf("unexpected trafs %+v", box.Trafs)
+   }
+   if box.Trafs[1].Tfdt.BaseMediaDecodeTime != 900 || len(box.Trafs[1].Trun) != 1 {
+      t.Errorf("nested boxes not reachable: %+v", box.Trafs[1])
+   }
+   if _, ok := FindMoof(boxes[:1]); ok {
+      t.Error("unexpected moof")
+   }
+   if err := new(MfhdBox).Parse(buildBox("mfhd", []byte{0, 0, 0, 0})); err == nil {
+      t.Error("expected error for short mfhd")
+   }
+}
+
+func TestTrunBox_SampleSizes(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   samples := []string{"first", "second sample", "3rd"}
+   // version 1: data offset, sizes and signed composition offsets
+   body := append(u32(uint32(len(samples))), u32(0)...)
+   for _, sample := range samples {
+      body = append(body, u32(uint32(len(sample)))...)
+      body = append(body, u32(0xFFFFFFFE)...) // -2
+   }
+   var trun TrunBox
+   if err := trun.Parse(buildBox("trun", []byte{1, 0, 0x0A, 0x01}, body)); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   mdat := []byte(strings.Join(samples, ""))
+   for i, size := range trun.SampleSizes(0) {
+      if got := string(mdat[:size]); got != samples[i] {
+         t.Errorf("sample %d: expected %q, got %q", i, samples[i], got)
+      }
+      mdat = mdat[size:]
+   }
+   if trun.Samples[0].CompositionTimeOffset != -2 {
+      t.Errorf("expected signed offset -2, got %d", trun.Samples[0].CompositionTimeOffset)
+   }
+   if sizes := (&TrunBox{Samples: make([]SampleInfo, 2)}).SampleSizes(7); !slices.Equal(sizes, []uint32{7, 7}) {
+      t.Errorf("expected default sizes, got %v", sizes)
+   }
+
+   // version 0 offsets are unsigned
+   v0 := buildBox("trun", []byte{0, 0, 0x08, 0}, u32(1), u32(0xFFFFFFFE))
+   if err := trun.Parse(v0); err != nil || trun.Samples[0].CompositionTimeOffset != math.MaxInt32 {
+      t.Errorf("expected clamped v0 offset, got %d %v", trun.Samples[0].CompositionTimeOffset, err)
+   }
+   if err := trun.parse(v0, &ParseOptions{Strict: true}); err == nil {
+      t.Error("expected strict error for v0 offset overflow")
+   }
+}
+
+func TestTrafBox_FieldlessSampleBudget(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // runs without per-sample fields, each within the bound on its own
+   trun := buildBox("trun", []byte{0, 0, 0, 0}, u32(maxFieldlessSamples/2))
+   var traf TrafBox
+   if err := traf.Parse(buildBox("traf", trun, trun)); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if err := traf.Parse(buildBox("traf", trun, trun, trun)); err == nil {
+      t.Error("expected error once the runs exceed the budget together")
+   }
+   moof := buildBox("moof", buildBox("traf", trun), buildBox("traf", trun, trun))
+   if _, err := Parse(moof); err == nil {
+      t.Error("expected error once the trafs of a moof exceed the budget together")
+   }
+}
+
+func TestTfhdBox_DefaultSampleSize(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   // every optional field, default-base-is-moof and a default size of 4
+   tfhd := buildBox("tfhd", []byte{0, 0x02, 0, 0x3B}, u32(1), u64(100), u32(1), u32(1000), u32(4), u32(0x00010000))
+   var box TfhdBox
+   if err := box.Parse(tfhd); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   expected := TfhdBox{Header: box.Header, Flags: 0x02003B, TrackID: 1, BaseDataOffset: 100,
+      SampleDescriptionIndex: 1, DefaultSampleDuration: 1000, DefaultSampleSize: 4, DefaultSampleFlags: 0x00010000}
+   if box != expected || !box.DefaultBaseIsMoof() {
+      t.Errorf("unexpected tfhd\n  Expected: %+v\n  Got:      %+v", expected, box)
+   }
+   if err := box.Parse(tfhd[:len(tfhd)-4]); err == nil {
+      t.Error("expected error for truncated tfhd")
+   }
+
+   // The trun omits sample sizes, so they come from the tfhd default.
+   moof := buildBox("moof", buildBox("traf",
+      buildBox("tfhd", []byte{0, 0x02, 0, 0x10}, u32(1), u32(4)),
+      buildBox("trun", []byte{0, 0, 0, 0}, u32(3)),
+   ))
+   segment := append(moof, buildBox("mdat", []byte("aaaabbbbcccc"))...)
+   samples, err := ExtractSamples(segment)
+   if err != nil {
+      t.Fatalf("ExtractSamples failed: %v", err)
+   }
+   if len(samples) != 3 || string(samples[1].Data) != "bbbb" {
+      t.Errorf("unexpected samples %+v", samples)
+   }
+}
+
+func TestTfdtBox_Parse(t *testing.T) {
+   tests := []struct {
+      name     string
+      data     []byte
+      expected uint64
+      wantErr  bool
+   }{
+      {"version 0", buildBox("tfdt", []byte{0, 0, 0, 0}, []byte{0xFF, 0xFF, 0xFF, 0xFF}), 0xFFFFFFFF, false},
+      {"version 1", buildBox("tfdt", []byte{1, 0, 0, 0}, binary.BigEndian.AppendUint64(nil, 1<<40)), 1 << 40, false},
+      {"version 1 with 32-bit time", buildBox("tfdt", []byte{1, 0, 0, 0}, []byte{0, 0, 0, 1}), 0, true},
+      {"no time", buildBox("tfdt", []byte{0, 0, 0, 0}), 0, true},
+   }
+   for _, test := range tests {
+      var box TfdtBox
+      err := box.Parse(test.data)
+      if (err != nil) != test.wantErr {
+         t.Errorf("%s: unexpected error %v", test.name, err)
+         continue
+      }
+      if box.BaseMediaDecodeTime != test.expected {
+         t.Errorf("%s: expected %d, got %d", test.name, test.expected, box.BaseMediaDecodeTime)
+      }
+   }
+}
+
+func TestSaioBox_Parse(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   tests := []struct {
+      name     string
+      data     []byte
+      auxType  string
+      expected []uint64
+      wantErr  bool
+   }{
+      {"version 0", buildBox("saio", []byte{0, 0, 0, 0}, u32(2), u32(100), u32(200)), "", []uint64{100, 200}, false},
+      {"version 1", buildBox("saio", []byte{1, 0, 0, 0}, u32(1), binary.BigEndian.AppendUint64(nil, 1<<33)), "", []uint64{1 << 33}, false},
+      {"aux info type", buildBox("saio", []byte{0, 0, 0, 1}, []byte("cenc"), u32(0), u32(1), u32(64)), "cenc", []uint64{64}, false},
+      {"short entries", buildBox("saio", []byte{1, 0, 0, 0}, u32(1), u32(64)), "", nil, true},
+      {"huge entry count", buildBox("saio", []byte{0, 0, 0, 0}, u32(math.MaxUint32)), "", nil, true},
+   }
+   for _, test := range tests {
+      var box SaioBox
+      err := box.Parse(test.data)
+      if (err != nil) != test.wantErr {
+         t.Errorf("%s: unexpected error %v", test.name, err)
+         continue
+      }
+      if test.wantErr {
+         continue
+      }
+      if test.auxType != "" && string(box.AuxInfoType[:]) != test.auxType {
+         t.Errorf("%s: expected aux info type %q, got %q", test.name, test.auxType, box.AuxInfoType[:])
+      }
+      if !slices.Equal(box.Offsets, test.expected) {
+         t.Errorf("%s: expected offsets %v, got %v", test.name, test.expected, box.Offsets)
+      }
+   }
+}
+
+func TestSaioBox_SampleInfoOffset(t *testing.T) {
+   saiz := &SaizBox{SampleCount: 3, SampleInfoSizes: []byte{8, 16, 8}}
+   saio := &SaioBox{Offsets: []uint64{100}}
+   for i, expected := range []uint64{100, 108, 124} {
+      offset, ok := saio.SampleInfoOffset(saiz, i)
+      if !ok || offset != expected {
+         t.Errorf("sample %d: expected offset %d, got %d (ok=%v)", i, expected, offset, ok)
+      }
+   }
+   if _, ok := saio.SampleInfoOffset(saiz, 3); ok {
+      t.Error("expected false for a sample past the saiz count")
+   }
+   saio.Offsets = append(saio.Offsets, 200)
+   if _, ok := saio.SampleInfoOffset(saiz, 0); ok {
+      t.Error("expected false for a saio with one offset per chunk")
+   }
+}
+
+func TestSaizBox_Parse(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   tests := []struct {
+      name     string
+      data     []byte
+      auxType  string
+      expected []int
+      wantErr  bool
+   }{
+      {"default size", buildBox("saiz", []byte{0, 0, 0, 0}, []byte{16}, u32(3)), "", []int{16, 16, 16}, false},
+      {"per-sample sizes", buildBox("saiz", []byte{0, 0, 0, 0}, []byte{0}, u32(3), []byte{8, 16, 22}), "", []int{8, 16, 22}, false},
+      {"aux info type", buildBox("saiz", []byte{0, 0, 0, 1}, []byte("cenc"), u32(0), []byte{8}, u32(2)), "cenc", []int{8, 8}, false},
+      {"short table", buildBox("saiz", []byte{0, 0, 0, 0}, []byte{0}, u32(3), []byte{8, 16}), "", nil, true},
+      {"short aux info type", buildBox("saiz", []byte{0, 0, 0, 1}, []byte("cenc")), "", nil, true},
+   }
+   for _, test := range tests {
+      var box SaizBox
+      err := box.Parse(test.data)
+      if (err != nil) != test.wantErr {
+         t.Errorf("%s: unexpected error %v", test.name, err)
+         continue
+      }
+      if test.wantErr {
+         continue
+      }
+      if test.auxType != "" && string(box.AuxInfoType[:]) != test.auxType {
+         t.Errorf("%s: expected aux info type %q, got %q", test.name, test.auxType, box.AuxInfoType[:])
+      }
+      if int(box.SampleCount) != len(test.expected) {
+         t.Fatalf("%s: expected %d samples, got %d", test.name, len(test.expected), box.SampleCount)
+      }
+      if box.DefaultSampleInfoSize != 0 && box.SampleInfoSizes != nil {
+         t.Errorf("%s: expected no per-sample table with a default size", test.name)
+      }
+      for i, size := range test.expected {
+         if got := box.SampleInfoSize(i); got != size {
+            t.Errorf("%s sample %d: expected size %d, got %d", test.name, i, size, got)
+         }
+      }
+   }
+}
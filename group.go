@@ -0,0 +1,322 @@
+package sofia
+
+import (
+   "errors"
+   "io"
+)
+
+// findSampleGroup returns the sbgp/sgpd pair for a grouping type. Either
+// box may be nil, for example when an sgpd in the init segment is
+// referenced from a fragment.
+func findSampleGroup(sbgps []*SbgpBox, sgpds []*SgpdBox, groupingType string) (*SbgpBox, *SgpdBox, bool) {
+   var sbgp *SbgpBox
+   var sgpd *SgpdBox
+   for _, box := range sbgps {
+      if string(box.GroupingType[:]) == groupingType {
+         sbgp = box
+         break
+      }
+   }
+   for _, box := range sgpds {
+      if string(box.GroupingType[:]) == groupingType {
+         sgpd = box
+         break
+      }
+   }
+   return sbgp, sgpd, sbgp != nil || sgpd != nil
+}
+
+// --- SBGP ---
+type SbgpEntry struct {
+   SampleCount           uint32
+   GroupDescriptionIndex uint32
+}
+
+type SbgpBox struct {
+   Header                BoxHeader
+   Version               byte
+   Flags                 uint32
+   GroupingType          [4]byte
+   GroupingTypeParameter uint32 // Present if Version=1
+   Entries               []SbgpEntry
+}
+
+func (b *SbgpBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 20 { // 8 header + 4 version/flags + 4 grouping_type + 4 count
+      return errors.New("sbgp box too short")
+   }
+
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   copy(b.GroupingType[:], p.Bytes(4))
+   if b.Version == 1 {
+      if len(data) < p.offset+8 {
+         return errors.New("sbgp v1 box too short")
+      }
+      b.GroupingTypeParameter = p.Uint32()
+   }
+   entryCount := p.Uint32()
+   if uint64(len(data)-p.offset) < uint64(entryCount)*8 {
+      return errors.New("sbgp box too short for declared entries")
+   }
+
+   b.Entries = make([]SbgpEntry, entryCount)
+   for i := range b.Entries {
+      b.Entries[i].SampleCount = p.Uint32()
+      b.Entries[i].GroupDescriptionIndex = p.Uint32()
+   }
+   return nil
+}
+
+func (b *SbgpBox) Encode() []byte {
+   size := 20 + len(b.Entries)*8
+   if b.Version == 1 {
+      size += 4
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   w.PutBytes(b.GroupingType[:])
+   if b.Version == 1 {
+      w.PutUint32(b.GroupingTypeParameter)
+   }
+   w.PutUint32(uint32(len(b.Entries)))
+   for _, entry := range b.Entries {
+      w.PutUint32(entry.SampleCount)
+      w.PutUint32(entry.GroupDescriptionIndex)
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'s', 'b', 'g', 'p'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *SbgpBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// --- SGPD ---
+type SgpdBox struct {
+   Header                        BoxHeader
+   Version                       byte
+   Flags                         uint32
+   GroupingType                  [4]byte
+   DefaultLength                 uint32 // Present if Version>=1
+   DefaultSampleDescriptionIndex uint32 // Present if Version>=2
+   Entries                       [][]byte
+   // RawEntries holds entry_count and the entries of a version 0 box whose
+   // grouping type has no known entry length, leaving Entries empty.
+   RawEntries []byte
+}
+
+func (b *SgpdBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 20 { // 8 header + 4 version/flags + 4 grouping_type + 4 count
+      return errors.New("sgpd box too short")
+   }
+
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   copy(b.GroupingType[:], p.Bytes(4))
+   if b.Version >= 1 {
+      if len(data) < p.offset+8 {
+         return errors.New("sgpd v1 box too short")
+      }
+      b.DefaultLength = p.Uint32()
+   }
+   if b.Version >= 2 {
+      if len(data) < p.offset+8 {
+         return errors.New("sgpd v2 box too short")
+      }
+      b.DefaultSampleDescriptionIndex = p.Uint32()
+   }
+
+   // Version 0 carries no length, so it has to be inferred from the type.
+   length := b.DefaultLength
+   if b.Version == 0 {
+      switch string(b.GroupingType[:]) {
+      case "roll", "prol":
+         length = 2
+      case "rap ":
+         length = 1
+      case "seig":
+         length = 20
+      default:
+         b.RawEntries = data[p.offset:]
+         return nil
+      }
+   }
+   entryCount := p.Uint32()
+
+   // Bound entry_count by the remaining data before allocating, counting
+   // at least a byte per entry or its description_length field.
+   minSize := max(uint64(length), 1)
+   if b.Version >= 1 && b.DefaultLength == 0 {
+      minSize = 4
+   }
+   if uint64(entryCount)*minSize > uint64(len(data)-p.offset) {
+      return errors.New("sgpd entry_count exceeds box size")
+   }
+   b.Entries = make([][]byte, entryCount)
+   for i := range b.Entries {
+      entryLength := length
+      if b.Version >= 1 && b.DefaultLength == 0 {
+         if len(data) < p.offset+4 {
+            return errors.New("sgpd truncated while reading description length")
+         }
+         entryLength = p.Uint32()
+      }
+      if uint64(len(data)-p.offset) < uint64(entryLength) {
+         return errors.New("sgpd truncated while reading entry")
+      }
+      b.Entries[i] = p.Bytes(int(entryLength))
+   }
+   return nil
+}
+
+func (b *SgpdBox) Encode() []byte {
+   lengths := b.Version >= 1 && b.DefaultLength == 0
+   size := 16 + len(b.RawEntries)
+   if b.Version >= 1 {
+      size += 4
+   }
+   if b.Version >= 2 {
+      size += 4
+   }
+   if b.RawEntries == nil {
+      size += 4
+      for _, entry := range b.Entries {
+         size += len(entry)
+         if lengths {
+            size += 4
+         }
+      }
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   w.PutBytes(b.GroupingType[:])
+   if b.Version >= 1 {
+      w.PutUint32(b.DefaultLength)
+   }
+   if b.Version >= 2 {
+      w.PutUint32(b.DefaultSampleDescriptionIndex)
+   }
+   if b.RawEntries != nil {
+      w.PutBytes(b.RawEntries)
+   } else {
+      w.PutUint32(uint32(len(b.Entries)))
+      for _, entry := range b.Entries {
+         if lengths {
+            w.PutUint32(uint32(len(entry)))
+         }
+         w.PutBytes(entry)
+      }
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'s', 'g', 'p', 'd'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *SgpdBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// --- SEIG (CENC Sample Encryption Information Group Entry) ---
+type SeigEntry struct {
+   CryptByteBlock  byte
+   SkipByteBlock   byte
+   IsProtected     byte
+   PerSampleIVSize byte
+   KID             [16]byte
+   ConstantIVSize  byte   // Present if IsProtected=1 and PerSampleIVSize=0
+   ConstantIV      []byte // Present if IsProtected=1 and PerSampleIVSize=0
+}
+
+func (e *SeigEntry) Parse(data []byte) error {
+   if len(data) < 20 {
+      return errors.New("seig entry too short")
+   }
+   p := parser{data: data}
+   _ = p.Byte() // reserved
+   pattern := p.Byte()
+   e.CryptByteBlock = pattern >> 4
+   e.SkipByteBlock = pattern & 0x0F
+   e.IsProtected = p.Byte()
+   e.PerSampleIVSize = p.Byte()
+   copy(e.KID[:], p.Bytes(16))
+   if e.IsProtected == 1 && e.PerSampleIVSize == 0 {
+      if len(data) < p.offset+1 {
+         return errors.New("seig entry truncated before constant IV size")
+      }
+      e.ConstantIVSize = p.Byte()
+      if len(data) < p.offset+int(e.ConstantIVSize) {
+         return errors.New("seig entry truncated, not enough data for constant IV")
+      }
+      e.ConstantIV = p.Bytes(int(e.ConstantIVSize))
+   }
+   return nil
+}
+
+// --- ROLL (Roll Recovery Entry) ---
+type RollEntry struct {
+   RollDistance int16
+}
+
+func (e *RollEntry) Parse(data []byte) error {
+   if len(data) < 2 {
+      return errors.New("roll entry too short")
+   }
+   p := parser{data: data}
+   e.RollDistance = int16(p.Uint16())
+   return nil
+}
+
+// --- ALST (Alternative Startup Entry) ---
+type AlstOutputCount struct {
+   NumOutputSamples uint16
+   NumTotalSamples  uint16
+}
+
+type AlstEntry struct {
+   RollCount         uint16
+   FirstOutputSample uint16
+   SampleOffsets     []uint32
+   OutputCounts      []AlstOutputCount // optional, fills the rest of the entry
+}
+
+func (e *AlstEntry) Parse(data []byte) error {
+   if len(data) < 4 {
+      return errors.New("alst entry too short")
+   }
+   p := parser{data: data}
+   e.RollCount = p.Uint16()
+   e.FirstOutputSample = p.Uint16()
+   if len(data)-p.offset < int(e.RollCount)*4 {
+      return errors.New("alst entry too short for sample offsets")
+   }
+   e.SampleOffsets = make([]uint32, e.RollCount)
+   for i := range e.SampleOffsets {
+      e.SampleOffsets[i] = p.Uint32()
+   }
+   for len(data)-p.offset >= 4 {
+      e.OutputCounts = append(e.OutputCounts, AlstOutputCount{p.Uint16(), p.Uint16()})
+   }
+   return nil
+}
@@ -0,0 +1,90 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+func TestTrafBox_SampleGroups(t *testing.T) {
+   kid := [16]byte{0x3c, 0x18, 0x63, 0x99, 0x5f, 0x93, 0xb8, 0x2b, 0xce, 0x88, 0xba, 0xce, 0x3a, 0x1a, 0xa6, 0x7a}
+   seig := append([]byte{0, 0x19, 1, 8}, kid[:]...)
+
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   fullBox := []byte{1, 0, 0, 0} // version 1, no flags
+   traf := buildBox("traf",
+      buildBox("sbgp", []byte{0, 0, 0, 0}, []byte("seig"), u32(1), u32(3), u32(1)),
+      buildBox("sgpd", fullBox, []byte("seig"), u32(20), u32(1), seig),
+      buildBox("sbgp", []byte{0, 0, 0, 0}, []byte("roll"), u32(1), u32(3), u32(1)),
+      buildBox("sgpd", fullBox, []byte("roll"), u32(2), u32(1), []byte{0xFF, 0xFF}),
+   )
+
+   var box TrafBox
+   if err := box.Parse(traf); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+
+   sbgp, sgpd, ok := box.SampleGroups("seig")
+   if !ok || sbgp == nil || sgpd == nil {
+      t.Fatal("'seig' sample group not found")
+   }
+   if len(sbgp.Entries) != 1 || sbgp.Entries[0].SampleCount != 3 {
+      t.Errorf("unexpected seig sbgp entries: %+v", sbgp.Entries)
+   }
+   var entry SeigEntry
+   if err := entry.Parse(sgpd.Entries[0]); err != nil {
+      t.Fatalf("seig entry Parse failed: %v", err)
+   }
+   if entry.CryptByteBlock != 1 || entry.SkipByteBlock != 9 || entry.PerSampleIVSize != 8 {
+      t.Errorf("unexpected seig entry: %+v", entry)
+   }
+   if !bytes.Equal(entry.KID[:], kid[:]) {
+      t.Errorf("seig KID mismatch: %x", entry.KID)
+   }
+
+   _, sgpd, ok = box.SampleGroups("roll")
+   if !ok || sgpd == nil {
+      t.Fatal("'roll' sample group not found")
+   }
+   var roll RollEntry
+   if err := roll.Parse(sgpd.Entries[0]); err != nil {
+      t.Fatalf("roll entry Parse failed: %v", err)
+   }
+   if roll.RollDistance != -1 {
+      t.Errorf("expected roll distance -1, got %d", roll.RollDistance)
+   }
+
+   if _, _, ok := box.SampleGroups("rap "); ok {
+      t.Error("unexpected 'rap ' sample group")
+   }
+}
+
+func TestAlstEntry_Parse(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // alst entries have no fixed length, so version 1 signals each length.
+   entry := append([]byte{0, 2, 0, 1}, u32(100)...)
+   entry = append(entry, u32(250)...)
+   entry = append(entry, 0, 3, 0, 5)
+   sgpd := buildBox("sgpd", []byte{1, 0, 0, 0}, []byte("alst"), u32(0), u32(1), u32(uint32(len(entry))), entry)
+
+   var box SgpdBox
+   if err := box.Parse(sgpd); err != nil {
+      t.Fatalf("sgpd Parse failed: %v", err)
+   }
+   var alst AlstEntry
+   if err := alst.Parse(box.Entries[0]); err != nil {
+      t.Fatalf("alst Parse failed: %v", err)
+   }
+   if alst.RollCount != 2 || alst.FirstOutputSample != 1 {
+      t.Errorf("unexpected alst header %+v", alst)
+   }
+   if len(alst.SampleOffsets) != 2 || alst.SampleOffsets[0] != 100 || alst.SampleOffsets[1] != 250 {
+      t.Errorf("unexpected sample offsets %v", alst.SampleOffsets)
+   }
+   if len(alst.OutputCounts) != 1 || alst.OutputCounts[0] != (AlstOutputCount{3, 5}) {
+      t.Errorf("unexpected output counts %+v", alst.OutputCounts)
+   }
+   if err := alst.Parse([]byte{0, 2, 0, 1, 0}); err == nil {
+      t.Error("expected error for truncated sample offsets")
+   }
+}
@@ -2,7 +2,14 @@ package sofia
 
 import (
    "bytes"
+   "encoding/binary"
+   "encoding/hex"
    "errors"
+   "io"
+   "math"
+   "strconv"
+   "time"
+   "unicode/utf16"
 )
 
 // --- MOOV ---
@@ -11,38 +18,34 @@ type MoovBox struct {
    Mvhd        *MvhdBox
    Trak        []*TrakBox
    Pssh        []*PsshBox
+   // Mvex is parsed from the mvex box, which stays in RawChildren and is
+   // encoded from there, so changes to Mvex are not encoded.
+   Mvex        *MvexBox
    RawChildren [][]byte
+   opts        *ParseOptions // for the warnings of Copyright and Ratings
 }
 
 // IsAudio checks the handler type within the first track to determine if it's audio.
 func (b *MoovBox) IsAudio() bool {
-   if len(b.Trak) > 0 {
-      trak := b.Trak[0]
-      if trak.Mdia != nil {
-         for _, child := range trak.Mdia.RawChildren {
-            // Check if the raw box is an 'hdlr' box.
-            // The handler_type is at offset 16 of the box content.
-            if len(child) >= 20 && string(child[4:8]) == "hdlr" {
-               handlerType := string(child[16:20])
-               // Handler type for audio is 'soun'
-               return handlerType == "soun"
-            }
-         }
-      }
-   }
-   return false
+   // Handler type for audio is 'soun'
+   return len(b.Trak) > 0 && b.Trak[0].HandlerType() == "soun"
 }
 
 func (b *MoovBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *MoovBox) parse(data []byte, opts *ParseOptions) error {
+   b.opts = opts
    if err := b.Header.Parse(data); err != nil {
       return err
    }
 
-   payload := data[8:b.Header.Size]
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -63,7 +66,7 @@ func (b *MoovBox) Parse(data []byte) error {
          b.Mvhd = &mvhd
       case "trak":
          var trak TrakBox
-         if err := trak.Parse(content); err != nil {
+         if err := trak.parse(content, opts); err != nil {
             return err
          }
          b.Trak = append(b.Trak, &trak)
@@ -73,6 +76,13 @@ func (b *MoovBox) Parse(data []byte) error {
             return err
          }
          b.Pssh = append(b.Pssh, &pssh)
+      case "mvex":
+         var mvex MvexBox
+         if err := mvex.Parse(content); err != nil {
+            return err
+         }
+         b.Mvex = &mvex
+         b.RawChildren = append(b.RawChildren, content)
       default:
          b.RawChildren = append(b.RawChildren, content)
       }
@@ -93,16 +103,22 @@ func (b *MoovBox) Encode() []byte {
    for _, raw := range b.RawChildren {
       buffer = append(buffer, raw...)
    }
-   b.Header.Size = uint32(len(buffer))
+   b.Header.Size = uint64(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *MoovBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 func (b *MoovBox) RemovePssh() {
    b.Pssh = nil
 }
 
 func (b *MoovBox) RemoveMvex() {
+   b.Mvex = nil
    var kept [][]byte
    for _, child := range b.RawChildren {
       if len(child) >= 8 && string(child[4:8]) == "mvex" {
@@ -113,6 +129,128 @@ func (b *MoovBox) RemoveMvex() {
    b.RawChildren = kept
 }
 
+// MovieTimescale returns the timescale from 'mvhd', or 0 if it is missing.
+// Only the movie duration and edit list segment durations use it; sample
+// timing uses the per-track TrakBox.MediaTimescale.
+func (b *MoovBox) MovieTimescale() uint32 {
+   if b.Mvhd == nil {
+      return 0
+   }
+   return b.Mvhd.Timescale
+}
+
+// Track returns the track with the given track_ID.
+func (b *MoovBox) Track(trackID uint32) (*TrakBox, bool) {
+   for _, trak := range b.Trak {
+      if trak.TrackID() == trackID {
+         return trak, true
+      }
+   }
+   return nil, false
+}
+
+// TrackByHandler returns the first track with the given handler type, such
+// as "vide" or "soun".
+func (b *MoovBox) TrackByHandler(handlerType string) (*TrakBox, bool) {
+   for _, trak := range b.Trak {
+      if trak.HandlerType() == handlerType {
+         return trak, true
+      }
+   }
+   return nil, false
+}
+
+// VideoTrack returns the first video track.
+func (b *MoovBox) VideoTrack() (*TrakBox, bool) {
+   return b.TrackByHandler("vide")
+}
+
+// AudioTrack returns the first audio track.
+func (b *MoovBox) AudioTrack() (*TrakBox, bool) {
+   return b.TrackByHandler("soun")
+}
+
+// CipherMode describes how the samples of a track are encrypted, derived
+// from its protection scheme: "AES-CTR" for cenc, "AES-CBC" for cbc1, and
+// the same followed by the crypt:skip block pattern of the tenc, such as
+// "AES-CBC 1:9", for the pattern schemes cens and cbcs.
+func (b *MoovBox) CipherMode(trackID uint32) (string, error) {
+   trak, ok := b.Track(trackID)
+   if !ok {
+      return "", errors.New("track not found")
+   }
+   scheme, ok := trak.Scheme()
+   if !ok {
+      return "", errors.New("track is not encrypted")
+   }
+   var mode string
+   switch scheme {
+   case "cenc", "cens":
+      mode = "AES-CTR"
+   case "cbc1", "cbcs":
+      mode = "AES-CBC"
+   default:
+      return "", errors.New("unknown protection scheme " + scheme)
+   }
+   if scheme == "cenc" || scheme == "cbc1" {
+      return mode, nil
+   }
+   tenc, ok := trak.Tenc()
+   if !ok {
+      return "", errors.New("pattern scheme " + scheme + " without tenc")
+   }
+   crypt := strconv.Itoa(int(tenc.DefaultCryptByteBlock))
+   skip := strconv.Itoa(int(tenc.DefaultSkipByteBlock))
+   return mode + " " + crypt + ":" + skip, nil
+}
+
+// CheckSchemeConsistency reports encrypted tracks of an init segment whose
+// protection scheme or key ID differs from the first encrypted track, such
+// as cenc video with cbcs audio. The report is advisory: separate keys per
+// track are legitimate, but often a single key was intended. A segment that
+// does not parse is reported as a single error.
+func CheckSchemeConsistency(initSegment []byte) []error {
+   boxes, err := Parse(initSegment)
+   if err != nil {
+      return []error{err}
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      return []error{errors.New("no moov found")}
+   }
+   var problems []error
+   var first *TrakBox
+   var firstScheme string
+   var firstKID [16]byte
+   for _, trak := range moov.Trak {
+      scheme, ok := trak.Scheme()
+      if !ok {
+         continue
+      }
+      var kid [16]byte
+      if tenc, ok := trak.Tenc(); ok {
+         kid = tenc.DefaultKID
+      }
+      if first == nil {
+         first, firstScheme, firstKID = trak, scheme, kid
+         continue
+      }
+      track := "track " + strconv.FormatUint(uint64(trak.TrackID()), 10)
+      firstTrack := "track " + strconv.FormatUint(uint64(first.TrackID()), 10)
+      if scheme != firstScheme {
+         problems = append(problems, errors.New(
+            track+" uses scheme "+scheme+" but "+firstTrack+" uses "+firstScheme,
+         ))
+      }
+      if kid != firstKID {
+         problems = append(problems, errors.New(
+            track+" uses KID "+hex.EncodeToString(kid[:])+" but "+firstTrack+" uses "+hex.EncodeToString(firstKID[:]),
+         ))
+      }
+   }
+   return problems
+}
+
 func (b *MoovBox) FindPssh(systemID []byte) (*PsshBox, bool) {
    for _, pssh := range b.Pssh {
       if bytes.Equal(pssh.SystemID[:], systemID) {
@@ -122,6 +260,342 @@ func (b *MoovBox) FindPssh(systemID []byte) (*PsshBox, bool) {
    return nil, false
 }
 
+// udtaChildren returns the children of the moov 'udta' box.
+func (b *MoovBox) udtaChildren() [][]byte {
+   udta, ok := findChild(b.RawChildren, "udta")
+   if !ok {
+      return nil
+   }
+   return childBoxes(udta[8:])
+}
+
+// Copyright returns every 'cprt' box of the moov 'udta'. Malformed boxes
+// are skipped, with a warning to the ParseOptions the moov was parsed with.
+func (b *MoovBox) Copyright() []CprtBox {
+   var notices []CprtBox
+   for _, child := range b.udtaChildren() {
+      if string(child[4:8]) != "cprt" {
+         continue
+      }
+      var cprt CprtBox
+      if err := cprt.Parse(child); err != nil {
+         b.opts.warn("skipping cprt: " + err.Error())
+         continue
+      }
+      notices = append(notices, cprt)
+   }
+   return notices
+}
+
+// Ratings returns every 'rtng' box of the moov 'udta'. Malformed boxes are
+// skipped as by Copyright.
+func (b *MoovBox) Ratings() []RtngBox {
+   var ratings []RtngBox
+   for _, child := range b.udtaChildren() {
+      if string(child[4:8]) != "rtng" {
+         continue
+      }
+      var rtng RtngBox
+      if err := rtng.Parse(child); err != nil {
+         b.opts.warn("skipping rtng: " + err.Error())
+         continue
+      }
+      ratings = append(ratings, rtng)
+   }
+   return ratings
+}
+
+// udtaString decodes a null-terminated user data string, which is UTF-16
+// if it starts with a byte order mark and UTF-8 otherwise.
+func udtaString(data []byte) string {
+   if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+      units := make([]uint16, 0, len(data)/2)
+      for i := 2; i+1 < len(data); i += 2 {
+         unit := binary.BigEndian.Uint16(data[i:])
+         if unit == 0 {
+            break
+         }
+         units = append(units, unit)
+      }
+      return string(utf16.Decode(units))
+   }
+   return cString(data)
+}
+
+// --- CPRT ---
+type CprtBox struct {
+   Header   BoxHeader
+   Version  byte
+   Flags    uint32
+   Language [2]byte
+   Notice   string
+}
+
+func (b *CprtBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 14 || int(b.Header.Size) > len(data) {
+      return errors.New("cprt box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   copy(b.Language[:], p.Bytes(2))
+   b.Notice = udtaString(data[p.offset:b.Header.Size])
+   return nil
+}
+
+// LanguageCode returns the ISO 639-2/T language of the notice.
+func (b *CprtBox) LanguageCode() string {
+   return languageCode(b.Language)
+}
+
+// --- RTNG ---
+// RtngBox is the 3GPP content rating box, e.g. entity "MPAA" with criteria
+// "PG13".
+type RtngBox struct {
+   Header   BoxHeader
+   Version  byte
+   Flags    uint32
+   Entity   [4]byte
+   Criteria [4]byte
+   Language [2]byte
+   Info     string
+}
+
+func (b *RtngBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 22 || int(b.Header.Size) > len(data) {
+      return errors.New("rtng box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   copy(b.Entity[:], p.Bytes(4))
+   copy(b.Criteria[:], p.Bytes(4))
+   copy(b.Language[:], p.Bytes(2))
+   b.Info = udtaString(data[p.offset:b.Header.Size])
+   return nil
+}
+
+// LanguageCode returns the ISO 639-2/T language of the rating info.
+func (b *RtngBox) LanguageCode() string {
+   return languageCode(b.Language)
+}
+
+// TrackSummary describes a track of an init segment.
+type TrackSummary struct {
+   TrackID     uint32
+   HandlerType string
+   CodecString string
+   Timescale   uint32
+   Encrypted   bool
+   KID         [16]byte
+   Language    string
+}
+
+// Tracks parses an init segment and summarizes each of its tracks.
+func Tracks(initSegment []byte) ([]TrackSummary, error) {
+   boxes, err := Parse(initSegment)
+   if err != nil {
+      return nil, err
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      return nil, errors.New("no moov found")
+   }
+   summaries := make([]TrackSummary, 0, len(moov.Trak))
+   for _, trak := range moov.Trak {
+      summaries = append(summaries, trak.Summary())
+   }
+   return summaries, nil
+}
+
+// VideoParameterSets returns the codec string, parameter sets and NAL unit
+// length size of the first video track. For avcC the sets are the SPS
+// followed by the PPS; for hvcC they are the NAL units of every array in
+// order.
+func VideoParameterSets(initSegment []byte) (string, [][]byte, int, error) {
+   boxes, err := Parse(initSegment)
+   if err != nil {
+      return "", nil, 0, err
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      return "", nil, 0, errors.New("no moov found")
+   }
+   for _, trak := range moov.Trak {
+      if trak.HandlerType() != "vide" {
+         continue
+      }
+      format, children, ok := trak.sampleEntry()
+      if !ok {
+         return "", nil, 0, errors.New("video track has no sample entry")
+      }
+      codec := CodecString(format, children)
+      if data, ok := findChild(children, "avcC"); ok {
+         var avcC AvcCBox
+         if err := avcC.Parse(data); err != nil {
+            return "", nil, 0, err
+         }
+         sets := append(append([][]byte{}, avcC.SPS...), avcC.PPS...)
+         return codec, sets, avcC.NALLengthSize(), nil
+      }
+      if data, ok := findChild(children, "hvcC"); ok {
+         var hvcC HvcCBox
+         if err := hvcC.Parse(data); err != nil {
+            return "", nil, 0, err
+         }
+         var sets [][]byte
+         for _, array := range hvcC.Arrays {
+            sets = append(sets, array.NALUnits...)
+         }
+         return codec, sets, hvcC.NALLengthSize(), nil
+      }
+      return "", nil, 0, errors.New("video track has no avcC or hvcC")
+   }
+   return "", nil, 0, errors.New("no video track found")
+}
+
+// mp4Epoch is the start of the seconds counted by creation and
+// modification times.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// mp4Time converts seconds since 1904-01-01 UTC to a time.Time. Values
+// beyond what time.Time can represent are clamped.
+func mp4Time(seconds uint64) time.Time {
+   return time.Unix(mp4Epoch.Unix()+int64(min(seconds, math.MaxInt64/2)), 0).UTC()
+}
+
+// --- MVEX ---
+type MvexBox struct {
+   Header      BoxHeader
+   Mehd        *MehdBox
+   Trex        []*TrexBox
+   RawChildren [][]byte
+}
+
+func (b *MvexBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+
+   payload := data[b.Header.HeaderSize:b.Header.Size]
+   offset := 0
+   for offset < len(payload) {
+      var header BoxHeader
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
+         break
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(payload) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(payload) {
+         return errors.New("invalid child box size")
+      }
+
+      content := payload[offset : offset+boxSize]
+      switch string(header.Type[:]) {
+      case "mehd":
+         var mehd MehdBox
+         if err := mehd.Parse(content); err != nil {
+            return err
+         }
+         b.Mehd = &mehd
+      case "trex":
+         var trex TrexBox
+         if err := trex.Parse(content); err != nil {
+            return err
+         }
+         b.Trex = append(b.Trex, &trex)
+      default:
+         b.RawChildren = append(b.RawChildren, content)
+      }
+      offset += boxSize
+   }
+   return nil
+}
+
+// TrackDefaults returns the trex of the given track_ID.
+func (b *MvexBox) TrackDefaults(trackID uint32) (*TrexBox, bool) {
+   for _, trex := range b.Trex {
+      if trex.TrackID == trackID {
+         return trex, true
+      }
+   }
+   return nil, false
+}
+
+// --- MEHD ---
+type MehdBox struct {
+   Header           BoxHeader
+   Version          byte
+   Flags            [3]byte
+   FragmentDuration uint64 // in the movie timescale
+}
+
+func (b *MehdBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 { // 8 header + 4 version/flags + 4 v0 duration
+      return errors.New("mehd box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Bytes(4)
+   b.Version = versionAndFlags[0]
+   copy(b.Flags[:], versionAndFlags[1:])
+   if b.Version == 1 {
+      if len(data) < 20 {
+         return errors.New("mehd v1 too short")
+      }
+      b.FragmentDuration = p.Uint64()
+   } else {
+      b.FragmentDuration = uint64(p.Uint32())
+   }
+   return nil
+}
+
+// --- TREX ---
+
+// TrexBox holds the sample defaults of a track's fragments, used where
+// tfhd and trun leave a value out.
+type TrexBox struct {
+   Header                        BoxHeader
+   Version                       byte
+   Flags                         [3]byte
+   TrackID                       uint32
+   DefaultSampleDescriptionIndex uint32
+   DefaultSampleDuration         uint32
+   DefaultSampleSize             uint32
+   DefaultSampleFlags            uint32
+}
+
+func (b *TrexBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 32 { // 8 header + 4 version/flags + 5 fields
+      return errors.New("trex box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Bytes(4)
+   b.Version = versionAndFlags[0]
+   copy(b.Flags[:], versionAndFlags[1:])
+   b.TrackID = p.Uint32()
+   b.DefaultSampleDescriptionIndex = p.Uint32()
+   b.DefaultSampleDuration = p.Uint32()
+   b.DefaultSampleSize = p.Uint32()
+   b.DefaultSampleFlags = p.Uint32()
+   return nil
+}
+
 // --- MVHD ---
 type MvhdBox struct {
    Header           BoxHeader
@@ -169,6 +643,48 @@ func (b *MvhdBox) Parse(data []byte) error {
    return nil
 }
 
+// mvhdRemainingSize is the size of the fields after duration, kept in
+// RemainingData: rate(4), volume(2), reserved(10), matrix(36),
+// pre_defined(24) and next_track_ID(4). The accessors below read them in
+// place, so Encode still round-trips them.
+const mvhdRemainingSize = 80
+
+// Rate returns the preferred playback rate as 16.16 fixed point, 0x00010000
+// for normal speed, or 0 if the field is missing.
+func (b *MvhdBox) Rate() uint32 {
+   if len(b.RemainingData) < mvhdRemainingSize {
+      return 0
+   }
+   return binary.BigEndian.Uint32(b.RemainingData[0:4])
+}
+
+// Volume returns the preferred volume as 8.8 fixed point, 0x0100 for full
+// volume, or 0 if the field is missing.
+func (b *MvhdBox) Volume() uint16 {
+   if len(b.RemainingData) < mvhdRemainingSize {
+      return 0
+   }
+   return binary.BigEndian.Uint16(b.RemainingData[4:6])
+}
+
+// NextTrackID returns the next_track_ID field, or 0 if it is missing.
+func (b *MvhdBox) NextTrackID() uint32 {
+   if len(b.RemainingData) < mvhdRemainingSize {
+      return 0
+   }
+   return binary.BigEndian.Uint32(b.RemainingData[76:80])
+}
+
+// Created returns CreationTime as a time.Time.
+func (b *MvhdBox) Created() time.Time {
+   return mp4Time(b.CreationTime)
+}
+
+// Modified returns ModificationTime as a time.Time.
+func (b *MvhdBox) Modified() time.Time {
+   return mp4Time(b.ModificationTime)
+}
+
 func (b *MvhdBox) SetDuration(duration uint64) {
    b.Duration = duration
    if b.Duration > 0xFFFFFFFF {
@@ -205,6 +721,11 @@ func (b *MvhdBox) Encode() []byte {
    }
 
    w.PutBytes(b.RemainingData)
-   b.Header.Size = totalSize
+   b.Header.Size = uint64(totalSize)
    return buffer
 }
+
+// WriteTo writes the encoded box to w.
+func (b *MvhdBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
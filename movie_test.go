@@ -0,0 +1,442 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "slices"
+   "testing"
+   "time"
+)
+
+// buildInitSegment returns an ftyp+moov init segment with a single H.264
+// video track. If encrypted is true the sample entry is 'encv' protected
+// with the 'cenc' scheme and testKID. Any tables replace the empty sample
+// tables that follow stsd.
+func buildInitSegment(encrypted bool, tables ...[]byte) []byte {
+   u16 := func(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   fullBox := []byte{0, 0, 0, 0}
+
+   mvhd := buildBox("mvhd", fullBox, u32(0), u32(0), u32(1000), u32(0), make([]byte, 76), u32(2))
+   tkhd := buildBox("tkhd", []byte{0, 0, 0, 3}, u32(0), u32(0), u32(1), u32(0), u32(0),
+      make([]byte, 16), make([]byte, 36), u32(1280<<16), u32(720<<16))
+   mdhd := buildBox("mdhd", fullBox, u32(0), u32(0), u32(90000), u32(0), []byte{0x15, 0xC7}, u16(0))
+   hdlr := buildBox("hdlr", fullBox, u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+
+   // configurationVersion, profile, compatibility, level, lengthSizeMinusOne,
+   // then one SPS and one PPS
+   avcC := buildBox("avcC", []byte{1, 0x64, 0x00, 0x1f, 0xFF},
+      []byte{0xE1, 0, 4, 0x67, 0x64, 0x00, 0x1f}, []byte{1, 0, 2, 0x68, 0xEE})
+   entry := make([]byte, 78)
+   binary.BigEndian.PutUint16(entry[6:], 1) // data_reference_index
+   binary.BigEndian.PutUint16(entry[24:], 1280)
+   binary.BigEndian.PutUint16(entry[26:], 720)
+   var sampleEntry []byte
+   if encrypted {
+      tenc := buildBox("tenc", fullBox, []byte{0, 0, 1, 8}, testKID[:])
+      sinf := buildBox("sinf",
+         buildBox("frma", []byte("avc1")),
+         buildBox("schm", fullBox, []byte("cenc"), u32(0x00010000)),
+         buildBox("schi", tenc),
+      )
+      sampleEntry = buildBox("encv", entry, avcC, sinf)
+   } else {
+      sampleEntry = buildBox("avc1", entry, avcC)
+   }
+   stsd := buildBox("stsd", fullBox, u32(1), sampleEntry)
+   if len(tables) == 0 {
+      tables = [][]byte{
+         buildBox("stts", fullBox, u32(0)),
+         buildBox("stsc", fullBox, u32(0)),
+         buildBox("stsz", fullBox, u32(0), u32(0)),
+         buildBox("stco", fullBox, u32(0)),
+      }
+   }
+   stbl := buildBox("stbl", append([][]byte{stsd}, tables...)...)
+   mdia := buildBox("mdia", mdhd, hdlr, buildBox("minf", stbl))
+   trex := buildBox("trex", fullBox, u32(1), u32(1), u32(0), u32(0), u32(0))
+   moov := buildBox("moov", mvhd, buildBox("trak", tkhd, mdia), buildBox("mvex", trex))
+   ftyp := buildBox("ftyp", []byte("iso6"), u32(0), []byte("iso6dash"))
+   return append(ftyp, moov...)
+}
+
+func TestTracks(t *testing.T) {
+   tracks, err := Tracks(buildInitSegment(true))
+   if err != nil {
+      t.Fatalf("Tracks failed: %v", err)
+   }
+   if len(tracks) != 1 {
+      t.Fatalf("expected 1 track, got %d", len(tracks))
+   }
+   expected := TrackSummary{
+      TrackID:     1,
+      HandlerType: "vide",
+      CodecString: "avc1.64001f",
+      Timescale:   90000,
+      Encrypted:   true,
+      KID:         testKID,
+      Language:    "eng",
+   }
+   if tracks[0] != expected {
+      t.Errorf("summary mismatch\n  Expected: %+v\n  Got:      %+v", expected, tracks[0])
+   }
+
+   tracks, err = Tracks(buildInitSegment(false))
+   if err != nil {
+      t.Fatalf("Tracks failed: %v", err)
+   }
+   if tracks[0].Encrypted || tracks[0].CodecString != "avc1.64001f" {
+      t.Errorf("unexpected clear track summary: %+v", tracks[0])
+   }
+}
+
+func TestTracks_DisabledTrack(t *testing.T) {
+   init := buildInitSegment(true)
+   // clear track_enabled, track_in_movie and track_in_preview in tkhd
+   tkhd := bytes.Index(init, []byte("tkhd"))
+   init[tkhd+7] = 0
+   tracks, err := Tracks(init)
+   if err != nil {
+      t.Fatalf("Tracks failed: %v", err)
+   }
+   if len(tracks) != 1 || !tracks[0].Encrypted || tracks[0].KID != testKID {
+      t.Errorf("expected KID %x for disabled track, got %+v", testKID, tracks)
+   }
+}
+
+func TestMoovBox_TrackByHandler(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   moov, _ := FindMoov(boxes)
+   // a second, audio track
+   audio := &TrakBox{Tkhd: &TkhdBox{TrackID: 2}, Mdia: &MdiaBox{Hdlr: &HdlrBox{HandlerType: [4]byte{'s', 'o', 'u', 'n'}}}}
+   moov.Trak = append(moov.Trak, audio)
+
+   if trak, ok := moov.VideoTrack(); !ok || trak.TrackID() != 1 {
+      t.Errorf("expected video track 1, got %v", ok)
+   }
+   if trak, ok := moov.AudioTrack(); !ok || trak != audio {
+      t.Errorf("expected the audio track, got %v", ok)
+   }
+   if _, ok := moov.TrackByHandler("text"); ok {
+      t.Error("expected no text track")
+   }
+}
+
+func TestMvexBox_Parse(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   moov, _ := FindMoov(boxes)
+   if moov.Mvex == nil || len(moov.Mvex.Trex) != 1 || moov.Mvex.Mehd != nil {
+      t.Fatalf("unexpected mvex %+v", moov.Mvex)
+   }
+   if _, ok := findChild(moov.RawChildren, "mvex"); !ok {
+      t.Error("mvex should stay in RawChildren")
+   }
+
+   trex := func(trackID, duration uint32) []byte {
+      return buildBox("trex", []byte{0, 0, 0, 0}, u32(trackID), u32(1), u32(duration), u32(100), u32(0x00010000))
+   }
+   mvex := buildBox("mvex", buildBox("mehd", []byte{1, 0, 0, 0}, u64(1<<34)), trex(1, 3000), trex(2, 1024))
+   var box MvexBox
+   if err := box.Parse(mvex); err != nil {
+      t.Fatalf("mvex Parse failed: %v", err)
+   }
+   if box.Mehd == nil || box.Mehd.FragmentDuration != 1<<34 {
+      t.Errorf("unexpected mehd %+v", box.Mehd)
+   }
+   defaults, ok := box.TrackDefaults(2)
+   if !ok || defaults.DefaultSampleDuration != 1024 || defaults.DefaultSampleSize != 100 ||
+      defaults.DefaultSampleDescriptionIndex != 1 || defaults.DefaultSampleFlags != 0x00010000 {
+      t.Errorf("unexpected trex %+v", defaults)
+   }
+   if _, ok := box.TrackDefaults(3); ok {
+      t.Error("expected no trex for track 3")
+   }
+
+   var mehd MehdBox
+   if err := mehd.Parse(buildBox("mehd", []byte{0, 0, 0, 0}, u32(9000))); err != nil || mehd.FragmentDuration != 9000 {
+      t.Errorf("mehd v0: unexpected %d (%v)", mehd.FragmentDuration, err)
+   }
+}
+
+func TestMoovBox_CipherMode(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(true))
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      t.Fatal("'moov' box not found")
+   }
+   mode, err := moov.CipherMode(1)
+   if err != nil {
+      t.Fatalf("CipherMode failed: %v", err)
+   }
+   if mode != "AES-CTR" {
+      t.Errorf("expected %q, got %q", "AES-CTR", mode)
+   }
+   if _, err := moov.CipherMode(2); err == nil {
+      t.Error("expected error for unknown track")
+   }
+
+   init, _, err := BuildTestContent(TestContentOptions{Scheme: "cbcs", KID: testKID, Key: testKey})
+   if err != nil {
+      t.Fatal(err)
+   }
+   file, err := Open(init)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if mode, err := file.Moov.CipherMode(1); err != nil || mode != "AES-CBC 1:9" {
+      t.Errorf("expected %q, got %q %v", "AES-CBC 1:9", mode, err)
+   }
+}
+
+func TestCheckSchemeConsistency(t *testing.T) {
+   if problems := CheckSchemeConsistency(buildInitSegment(true)); len(problems) != 0 {
+      t.Errorf("expected no problems for a single track, got %v", problems)
+   }
+   // A second track protected with cbcs under another key.
+   video := buildInitSegment(true)
+   audio := bytes.Clone(video)
+   schm := bytes.Index(audio, []byte("cenc"))
+   copy(audio[schm:], "cbcs")
+   tenc := bytes.Index(audio, []byte("tenc"))
+   audio[tenc+12] ^= 0xFF // first KID byte
+   moov := buildTwoTrackMoov(video, audio, true)
+   ftyp, _ := findChild(childBoxes(video), "ftyp")
+   problems := CheckSchemeConsistency(append(bytes.Clone(ftyp), moov...))
+   if len(problems) != 2 {
+      t.Fatalf("expected scheme and KID problems, got %v", problems)
+   }
+   if problems[0].Error() != "track 2 uses scheme cbcs but track 1 uses cenc" {
+      t.Errorf("unexpected scheme problem %q", problems[0])
+   }
+}
+
+func TestVideoParameterSets(t *testing.T) {
+   for _, encrypted := range []bool{false, true} {
+      codec, sets, lengthSize, err := VideoParameterSets(buildInitSegment(encrypted))
+      if err != nil {
+         t.Fatalf("VideoParameterSets failed: %v", err)
+      }
+      if codec != "avc1.64001f" || lengthSize != 4 {
+         t.Errorf("encrypted=%v: unexpected codec %q, length size %d", encrypted, codec, lengthSize)
+      }
+      expected := [][]byte{{0x67, 0x64, 0x00, 0x1f}, {0x68, 0xEE}}
+      if len(sets) != len(expected) {
+         t.Fatalf("expected %d parameter sets, got %d", len(expected), len(sets))
+      }
+      for i := range expected {
+         if !bytes.Equal(sets[i], expected[i]) {
+            t.Errorf("parameter set %d: expected %x, got %x", i, expected[i], sets[i])
+         }
+      }
+   }
+}
+
+func TestTimescales(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      t.Fatal("'moov' box not found")
+   }
+   if timescale := moov.MovieTimescale(); timescale != 1000 {
+      t.Errorf("expected movie timescale 1000, got %d", timescale)
+   }
+   trak, ok := moov.Track(1)
+   if !ok {
+      t.Fatal("track 1 not found")
+   }
+   if timescale := trak.MediaTimescale(); timescale != 90000 {
+      t.Errorf("expected media timescale 90000, got %d", timescale)
+   }
+   if seconds := trak.MediaToSeconds(135000); seconds != 1.5 {
+      t.Errorf("expected 1.5 seconds, got %v", seconds)
+   }
+}
+
+func TestTrakBox_EncryptionGranularity(t *testing.T) {
+   trak := func(encrypted bool) *TrakBox {
+      boxes, err := Parse(buildInitSegment(encrypted))
+      if err != nil {
+         t.Fatal(err)
+      }
+      moov, _ := FindMoov(boxes)
+      return moov.Trak[0]
+   }
+   segment := buildEncryptedSegment(t, [][]byte{[]byte("sample")})
+   if granularity := trak(true).EncryptionGranularity(segment); granularity != "full-sample" {
+      t.Errorf("expected full-sample, got %q", granularity)
+   }
+   if granularity := trak(false).EncryptionGranularity(segment); granularity != "clear" {
+      t.Errorf("expected clear, got %q", granularity)
+   }
+
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // 8 byte IV, subsample count and one subsample entry, after the traf
+   // of another track
+   subsample := buildBox("moof",
+      buildBox("traf", buildBox("tfhd", []byte{0, 0, 0, 0}, u32(2))),
+      buildBox("traf",
+         buildBox("tfhd", []byte{0, 0, 0, 0}, u32(1)),
+         buildBox("saiz", []byte{0, 0, 0, 0}, []byte{16}, u32(1)),
+      ),
+   )
+   if granularity := trak(true).EncryptionGranularity(subsample); granularity != "subsample" {
+      t.Errorf("expected subsample, got %q", granularity)
+   }
+}
+
+func TestTrakBox_PresentationOrder(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov, _ := FindMoov(boxes)
+   trak := moov.Trak[0]
+
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   tfhd := buildBox("tfhd", []byte{0, 0, 0, 0x08}, u32(1), u32(10)) // default duration 10
+   // I P B B: decode 0 10 20 30, present 10 40 20 30
+   trun := buildBox("trun", []byte{1, 0, 0x08, 0}, u32(4), u32(10), u32(30), u32(0), u32(0))
+   // the samples of another track come first
+   other := buildBox("traf", buildBox("tfhd", []byte{0, 0, 0, 0x08}, u32(2), u32(10)),
+      buildBox("trun", []byte{0, 0, 0, 0}, u32(3)))
+   segment := buildBox("moof", other, buildBox("traf", tfhd, trun))
+   order, err := trak.PresentationOrder(segment)
+   if err != nil {
+      t.Fatalf("PresentationOrder failed: %v", err)
+   }
+   if expected := []int{0, 2, 3, 1}; !slices.Equal(order, expected) {
+      t.Errorf("expected order %v, got %v", expected, order)
+   }
+
+   negative := buildBox("trun", []byte{1, 0, 0x08, 0}, u32(2), u32(0), u32(0xFFFFFFF6))
+   plain := buildBox("trun", []byte{0, 0, 0, 0}, u32(1))
+   segment = buildBox("moof", buildBox("traf", tfhd, negative, plain))
+   if _, err := trak.PresentationOrder(segment); err == nil {
+      t.Error("expected error for missing composition offsets")
+   }
+}
+
+func TestMvhdBox_Parse(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   moov, _ := FindMoov(boxes)
+   if moov.Mvhd == nil || moov.MovieTimescale() != 1000 || moov.Mvhd.NextTrackID() != 2 {
+      t.Errorf("unexpected mvhd %+v", moov.Mvhd)
+   }
+
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   rest := append(u32(0x00010000), 0x01, 0)
+   rest = append(rest, make([]byte, 70)...)
+   rest = append(rest, u32(5)...)
+   var mvhd MvhdBox
+   data := buildBox("mvhd", []byte{1, 0, 0, 0}, u64(1), u64(2), u32(600), u64(1<<33), rest)
+   if err := mvhd.Parse(data); err != nil {
+      t.Fatalf("mvhd v1 Parse failed: %v", err)
+   }
+   if mvhd.Timescale != 600 || mvhd.Duration != 1<<33 || mvhd.ModificationTime != 2 {
+      t.Errorf("mvhd v1: unexpected %+v", mvhd)
+   }
+   if mvhd.Rate() != 0x00010000 || mvhd.Volume() != 0x0100 || mvhd.NextTrackID() != 5 {
+      t.Errorf("mvhd v1: unexpected rate %x volume %x next track %d", mvhd.Rate(), mvhd.Volume(), mvhd.NextTrackID())
+   }
+   if !bytes.Equal(mvhd.Encode(), data) {
+      t.Error("mvhd v1 does not round-trip")
+   }
+}
+
+func TestCreationTimes(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   // 2020-01-01 fits in 32 bits, 2050-01-01 is past 2040 and needs v1
+   const v0Seconds = 3660681600
+   const v1Seconds = 4607452800
+   v0Time := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+   v1Time := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+
+   var mvhd MvhdBox
+   data := buildBox("mvhd", []byte{0, 0, 0, 0}, u32(v0Seconds), u32(v0Seconds), u32(1000), u32(0))
+   if err := mvhd.Parse(data); err != nil {
+      t.Fatalf("mvhd Parse failed: %v", err)
+   }
+   if !mvhd.Created().Equal(v0Time) || !mvhd.Modified().Equal(v0Time) {
+      t.Errorf("mvhd v0: expected %v, got %v %v", v0Time, mvhd.Created(), mvhd.Modified())
+   }
+
+   var tkhd TkhdBox
+   data = buildBox("tkhd", []byte{1, 0, 0, 3}, u64(v1Seconds), u64(v0Seconds), u32(1), u32(0), u64(0), make([]byte, 60))
+   if err := tkhd.Parse(data); err != nil {
+      t.Fatalf("tkhd Parse failed: %v", err)
+   }
+   if !tkhd.Created().Equal(v1Time) || !tkhd.Modified().Equal(v0Time) || tkhd.TrackID != 1 {
+      t.Errorf("tkhd v1: unexpected %v %v track %d", tkhd.Created(), tkhd.Modified(), tkhd.TrackID)
+   }
+
+   var mdhd MdhdBox
+   data = buildBox("mdhd", []byte{1, 0, 0, 0}, u64(v1Seconds), u64(v1Seconds), u32(90000), u64(0), u32(0))
+   if err := mdhd.Parse(data); err != nil {
+      t.Fatalf("mdhd Parse failed: %v", err)
+   }
+   if !mdhd.Created().Equal(v1Time) || !mdhd.Modified().Equal(v1Time) {
+      t.Errorf("mdhd v1: expected %v, got %v %v", v1Time, mdhd.Created(), mdhd.Modified())
+   }
+
+   if epoch := (&MdhdBox{}).Created(); !epoch.Equal(mp4Epoch) {
+      t.Errorf("expected zero time to be the 1904 epoch, got %v", epoch)
+   }
+   if (&MdhdBox{CreationTime: ^uint64(0)}).Created().Before(v1Time) {
+      t.Error("expected huge creation time to clamp into the future")
+   }
+}
+
+func TestMoovBox_Copyright(t *testing.T) {
+   fullBox := []byte{0, 0, 0, 0}
+   eng := []byte{0x15, 0xC7}
+   notice := []byte{0xFE, 0xFF, 0, 'O', 0, 'p', 0, 'e', 0, 'n', 0, 0}
+   udta := buildBox("udta",
+      buildBox("cprt", fullBox, eng, []byte("2026 Example\x00")),
+      buildBox("cprt", fullBox, eng, notice),
+      buildBox("cprt", fullBox),
+      buildBox("rtng", fullBox, []byte("MPAA"), []byte("PG13"), eng, []byte("mild peril\x00")),
+   )
+   var warnings int
+   opts := &ParseOptions{Warn: func(string) { warnings++ }}
+   var moov MoovBox
+   if err := moov.parse(buildBox("moov", udta), opts); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   notices := moov.Copyright()
+   if len(notices) != 2 || warnings != 1 {
+      t.Fatalf("expected 2 notices and 1 warning, got %d and %d", len(notices), warnings)
+   }
+   if notices[0].Notice != "2026 Example" || notices[0].LanguageCode() != "eng" {
+      t.Errorf("unexpected UTF-8 notice %q %q", notices[0].Notice, notices[0].LanguageCode())
+   }
+   if notices[1].Notice != "Open" {
+      t.Errorf("unexpected UTF-16 notice %q", notices[1].Notice)
+   }
+   ratings := moov.Ratings()
+   if len(ratings) != 1 {
+      t.Fatalf("expected 1 rating, got %d", len(ratings))
+   }
+   rating := ratings[0]
+   if string(rating.Entity[:]) != "MPAA" || string(rating.Criteria[:]) != "PG13" || rating.Info != "mild peril" {
+      t.Errorf("unexpected rating %+v", rating)
+   }
+}
@@ -0,0 +1,167 @@
+package sofia
+
+import (
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/xml"
+   "errors"
+   "slices"
+   "strings"
+   "unicode/utf16"
+)
+
+// --- PLAYREADY OBJECT ---
+
+// PlayReadySystemID is the pssh system ID of PlayReady,
+// 9a04f079-9840-4286-ab92-e65be0885f95.
+var PlayReadySystemID = [16]byte{
+   0x9a, 0x04, 0xf0, 0x79, 0x98, 0x40, 0x42, 0x86,
+   0xab, 0x92, 0xe6, 0x5b, 0xe0, 0x88, 0x5f, 0x95,
+}
+
+// PlayReadyRecord is one record of a PlayReady Object. Type 1 holds the
+// WRMHEADER XML as UTF-16LE.
+type PlayReadyRecord struct {
+   Type  uint16
+   Value []byte
+}
+
+// PlayReadyObject is the data of a PlayReady pssh box.
+type PlayReadyObject struct {
+   Records []PlayReadyRecord
+}
+
+// ParsePlayReadyObject parses a PlayReady Object, whose fields are
+// little-endian unlike the rest of the file.
+func ParsePlayReadyObject(data []byte) (*PlayReadyObject, error) {
+   if len(data) < 6 {
+      return nil, errors.New("PlayReady object too short")
+   }
+   length := binary.LittleEndian.Uint32(data)
+   if uint64(length) > uint64(len(data)) {
+      return nil, errors.New("PlayReady object length exceeds data")
+   }
+   if length < 6 {
+      return nil, errors.New("PlayReady object length too small")
+   }
+   count := int(binary.LittleEndian.Uint16(data[4:]))
+   data = data[6:length]
+   var object PlayReadyObject
+   for i := 0; i < count; i++ {
+      if len(data) < 4 {
+         return nil, errors.New("PlayReady object truncated while reading record")
+      }
+      recordType := binary.LittleEndian.Uint16(data)
+      size := int(binary.LittleEndian.Uint16(data[2:]))
+      if len(data) < 4+size {
+         return nil, errors.New("PlayReady record extends past object")
+      }
+      object.Records = append(object.Records, PlayReadyRecord{recordType, data[4 : 4+size]})
+      data = data[4+size:]
+   }
+   return &object, nil
+}
+
+// Header returns the WRMHEADER XML of the first rights management record.
+func (o *PlayReadyObject) Header() (string, bool) {
+   for _, record := range o.Records {
+      if record.Type != 1 {
+         continue
+      }
+      units := make([]uint16, len(record.Value)/2)
+      for i := range units {
+         units[i] = binary.LittleEndian.Uint16(record.Value[i*2:])
+      }
+      return string(utf16.Decode(units)), true
+   }
+   return "", false
+}
+
+// KIDs returns the key IDs declared by the WRMHEADER in CENC byte order.
+// Both the single <KID> of version 4.0 and 4.1 headers and the <KIDS> list
+// of version 4.2 and 4.3 headers are read.
+func (o *PlayReadyObject) KIDs() [][16]byte {
+   header, ok := o.Header()
+   if !ok {
+      return nil
+   }
+   var kids [][16]byte
+   add := func(value string) {
+      if kid, err := PlayReadyKIDToCenc(strings.TrimSpace(value)); err == nil {
+         if !slices.Contains(kids, kid) {
+            kids = append(kids, kid)
+         }
+      }
+   }
+   decoder := xml.NewDecoder(strings.NewReader(header))
+   for {
+      token, err := decoder.Token()
+      if err != nil {
+         break
+      }
+      start, ok := token.(xml.StartElement)
+      if !ok || start.Name.Local != "KID" {
+         continue
+      }
+      value := ""
+      for _, attr := range start.Attr {
+         if attr.Name.Local == "VALUE" {
+            value = attr.Value
+         }
+      }
+      if value == "" {
+         // version 4.0 holds the KID as the element text
+         var text string
+         if decoder.DecodeElement(&text, &start) == nil {
+            value = text
+         }
+      }
+      add(value)
+   }
+   return kids
+}
+
+// PlayReadyKIDs returns the key IDs of a PlayReady pssh box in CENC byte
+// order, to be matched against tenc.DefaultKID. It returns an error for any
+// other system ID.
+func (b *PsshBox) PlayReadyKIDs() ([][16]byte, error) {
+   if b.SystemID != PlayReadySystemID {
+      return nil, errors.New("pssh system ID is not PlayReady")
+   }
+   object, err := ParsePlayReadyObject(b.Data)
+   if err != nil {
+      return nil, err
+   }
+   return object.KIDs(), nil
+}
+
+// PlayReadyKIDToCenc converts a base64 PlayReady KID, a GUID whose first
+// three fields are little-endian, to the big-endian byte order of
+// tenc.DefaultKID.
+func PlayReadyKIDToCenc(b64 string) ([16]byte, error) {
+   var kid [16]byte
+   data, err := base64.StdEncoding.DecodeString(b64)
+   if err != nil {
+      return kid, err
+   }
+   if len(data) != 16 {
+      return kid, errors.New("PlayReady KID is not 16 bytes")
+   }
+   copy(kid[:], data)
+   swapGUID(&kid)
+   return kid, nil
+}
+
+// CencKIDToPlayReady is the inverse of PlayReadyKIDToCenc.
+func CencKIDToPlayReady(kid [16]byte) string {
+   swapGUID(&kid)
+   return base64.StdEncoding.EncodeToString(kid[:])
+}
+
+// swapGUID converts between the mixed-endian GUID layout and CENC byte
+// order by reversing the first three fields.
+func swapGUID(kid *[16]byte) {
+   slices.Reverse(kid[0:4])
+   slices.Reverse(kid[4:6])
+   slices.Reverse(kid[6:8])
+}
@@ -0,0 +1,101 @@
+package sofia
+
+import (
+   "encoding/hex"
+   "encoding/binary"
+   "testing"
+   "unicode/utf16"
+)
+
+// buildPlayReadyObject wraps a WRMHEADER in a PlayReady Object with a
+// single rights management record.
+func buildPlayReadyObject(header string) []byte {
+   var value []byte
+   for _, unit := range utf16.Encode([]rune(header)) {
+      value = binary.LittleEndian.AppendUint16(value, unit)
+   }
+   data := binary.LittleEndian.AppendUint32(nil, uint32(10+len(value)))
+   data = binary.LittleEndian.AppendUint16(data, 1)
+   data = binary.LittleEndian.AppendUint16(data, 1)
+   data = binary.LittleEndian.AppendUint16(data, uint16(len(value)))
+   return append(data, value...)
+}
+
+func TestPlayReadyObject_KIDs(t *testing.T) {
+   first := [16]byte{0x3c, 0x18, 0x63, 0x99, 0x5f, 0x93, 0xb8, 0x2b, 0xce, 0x88, 0xba, 0xce, 0x3a, 0x1a, 0xa6, 0x7a}
+   second := [16]byte{0x10, 0x77, 0xef, 0xec, 0xc0, 0xb2, 0x4d, 0x02, 0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b}
+   encode := CencKIDToPlayReady
+   header := `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.3.0.0">` +
+      `<DATA><PROTECTINFO><KIDS>` +
+      `<KID ALGID="AESCTR" VALUE="` + encode(first) + `"></KID>` +
+      `<KID ALGID="AESCTR" VALUE="` + encode(second) + `"></KID>` +
+      `</KIDS></PROTECTINFO><LA_URL>https://example.com/rightsmanager.asmx</LA_URL></DATA></WRMHEADER>`
+
+   object, err := ParsePlayReadyObject(buildPlayReadyObject(header))
+   if err != nil {
+      t.Fatalf("ParsePlayReadyObject failed: %v", err)
+   }
+   if decoded, ok := object.Header(); !ok || decoded != header {
+      t.Fatalf("header mismatch: %q", decoded)
+   }
+   kids := object.KIDs()
+   if len(kids) != 2 || kids[0] != first || kids[1] != second {
+      t.Errorf("unexpected KIDs %x", kids)
+   }
+
+   // version 4.0 carries a single KID as element text
+   legacy := `<WRMHEADER version="4.0.0.0"><DATA><KID>` + encode(first) + `</KID></DATA></WRMHEADER>`
+   object, err = ParsePlayReadyObject(buildPlayReadyObject(legacy))
+   if err != nil {
+      t.Fatalf("ParsePlayReadyObject failed: %v", err)
+   }
+   if kids := object.KIDs(); len(kids) != 1 || kids[0] != first {
+      t.Errorf("unexpected v4.0 KIDs %x", kids)
+   }
+
+   if _, err := ParsePlayReadyObject([]byte{0xFF, 0, 0, 0, 1, 0}); err == nil {
+      t.Error("expected error for length past end of data")
+   }
+   if _, err := ParsePlayReadyObject([]byte{2, 0, 0, 0, 0, 0}); err == nil {
+      t.Error("expected error for length shorter than the object header")
+   }
+}
+
+func TestPlayReadyKIDToCenc(t *testing.T) {
+   // GUID {9A04F079-9840-4286-AB92-E65BE0885F95} as PlayReady stores it
+   const playReady = "efAEmkCYhkKrkuZb4IhflQ=="
+   const cenc = "9a04f07998404286ab92e65be0885f95"
+   kid, err := PlayReadyKIDToCenc(playReady)
+   if err != nil {
+      t.Fatalf("PlayReadyKIDToCenc failed: %v", err)
+   }
+   if got := hex.EncodeToString(kid[:]); got != cenc {
+      t.Errorf("expected %s, got %s", cenc, got)
+   }
+   if got := CencKIDToPlayReady(kid); got != playReady {
+      t.Errorf("expected %s, got %s", playReady, got)
+   }
+   if _, err := PlayReadyKIDToCenc("AAAA"); err == nil {
+      t.Error("expected error for short KID")
+   }
+   if _, err := PlayReadyKIDToCenc("not base64!"); err == nil {
+      t.Error("expected error for invalid base64")
+   }
+}
+
+func TestPsshBox_PlayReadyKIDs(t *testing.T) {
+   // KID {9A04F079-9840-4286-AB92-E65BE0885F95} in its GUID byte order
+   header := `<WRMHEADER version="4.0.0.0"><DATA><KID>efAEmkCYhkKrkuZb4IhflQ==</KID></DATA></WRMHEADER>`
+   pssh := &PsshBox{SystemID: PlayReadySystemID, Data: buildPlayReadyObject(header)}
+   kids, err := pssh.PlayReadyKIDs()
+   if err != nil {
+      t.Fatalf("PlayReadyKIDs failed: %v", err)
+   }
+   if len(kids) != 1 || hex.EncodeToString(kids[0][:]) != "9a04f07998404286ab92e65be0885f95" {
+      t.Errorf("unexpected KIDs %x", kids)
+   }
+   pssh.SystemID = WidevineSystemID
+   if _, err := pssh.PlayReadyKIDs(); err == nil {
+      t.Error("expected error for a non-PlayReady system ID")
+   }
+}
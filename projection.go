@@ -0,0 +1,160 @@
+package sofia
+
+import "errors"
+
+// Projection describes the spherical video metadata of a visual sample
+// entry, from the 'sv3d' box of the Spherical Video V2 specification. The
+// boxes stay in the raw children of the sample entry, so they survive
+// re-encoding unchanged.
+type Projection struct {
+   MetadataSource string // from 'svhd'
+   Type           string // "equirectangular", "cubemap" or "mesh"
+   Pose           PrhdBox
+   Equi           *EquiBox // set for equirectangular projections
+   Cbmp           *CbmpBox // set for cubemap projections
+}
+
+// ParseProjection reads the 'sv3d' box among the children of a visual
+// sample entry. It returns false if there is none.
+func ParseProjection(children [][]byte) (*Projection, bool, error) {
+   sv3d, ok := findChild(children, "sv3d")
+   if !ok {
+      return nil, false, nil
+   }
+   var projection Projection
+   sv3dChildren := childBoxes(sv3d[8:])
+   // svhd is a full box holding a null-terminated string
+   if svhd, ok := findChild(sv3dChildren, "svhd"); ok && len(svhd) >= 12 {
+      projection.MetadataSource = cString(svhd[12:])
+   }
+   proj, ok := findChild(sv3dChildren, "proj")
+   if !ok {
+      return nil, true, errors.New("sv3d without proj")
+   }
+   projChildren := childBoxes(proj[8:])
+   if prhd, ok := findChild(projChildren, "prhd"); ok {
+      if err := projection.Pose.Parse(prhd); err != nil {
+         return nil, true, err
+      }
+   }
+   if data, ok := findChild(projChildren, "equi"); ok {
+      var equi EquiBox
+      if err := equi.Parse(data); err != nil {
+         return nil, true, err
+      }
+      projection.Type, projection.Equi = "equirectangular", &equi
+   } else if data, ok := findChild(projChildren, "cbmp"); ok {
+      var cbmp CbmpBox
+      if err := cbmp.Parse(data); err != nil {
+         return nil, true, err
+      }
+      projection.Type, projection.Cbmp = "cubemap", &cbmp
+   } else if _, ok := findChild(projChildren, "mshp"); ok {
+      projection.Type = "mesh"
+   } else {
+      return nil, true, errors.New("proj without a projection box")
+   }
+   return &projection, true, nil
+}
+
+// Projection returns the spherical video metadata of the first sample
+// entry of the track.
+func (b *TrakBox) Projection() (*Projection, bool, error) {
+   _, children, ok := b.sampleEntry()
+   if !ok {
+      return nil, false, nil
+   }
+   return ParseProjection(children)
+}
+
+// --- PRHD ---
+// PrhdBox is the projection header, the orientation of the sphere in
+// degrees as 16.16 fixed point.
+type PrhdBox struct {
+   Header  BoxHeader
+   Version byte
+   Flags   uint32
+   Yaw     int32
+   Pitch   int32
+   Roll    int32
+}
+
+func (b *PrhdBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 24 {
+      return errors.New("prhd box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.Yaw = p.Int32()
+   b.Pitch = p.Int32()
+   b.Roll = p.Int32()
+   return nil
+}
+
+// Degrees returns the yaw, pitch and roll in degrees.
+func (b *PrhdBox) Degrees() (yaw, pitch, roll float64) {
+   return float64(b.Yaw) / 65536, float64(b.Pitch) / 65536, float64(b.Roll) / 65536
+}
+
+// --- EQUI ---
+// EquiBox holds the equirectangular projection bounds, the fraction of the
+// frame cropped from each edge as 0.32 fixed point.
+type EquiBox struct {
+   Header       BoxHeader
+   Version      byte
+   Flags        uint32
+   BoundsTop    uint32
+   BoundsBottom uint32
+   BoundsLeft   uint32
+   BoundsRight  uint32
+}
+
+func (b *EquiBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 28 {
+      return errors.New("equi box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.BoundsTop = p.Uint32()
+   b.BoundsBottom = p.Uint32()
+   b.BoundsLeft = p.Uint32()
+   b.BoundsRight = p.Uint32()
+   return nil
+}
+
+// --- CBMP ---
+// CbmpBox holds the cubemap projection layout and the padding in pixels
+// around each face.
+type CbmpBox struct {
+   Header  BoxHeader
+   Version byte
+   Flags   uint32
+   Layout  uint32
+   Padding uint32
+}
+
+func (b *CbmpBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 20 {
+      return errors.New("cbmp box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.Layout = p.Uint32()
+   b.Padding = p.Uint32()
+   return nil
+}
@@ -0,0 +1,44 @@
+package sofia
+
+import (
+   "encoding/binary"
+   "testing"
+)
+
+func TestParseProjection(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   fullBox := []byte{0, 0, 0, 0}
+   sv3d := buildBox("sv3d",
+      buildBox("svhd", fullBox, []byte("Spherical Metadata Tool\x00")),
+      buildBox("proj",
+         buildBox("prhd", fullBox, u32(90<<16), u32(0xFFFF0000), u32(0)),
+         buildBox("equi", fullBox, u32(0), u32(0), u32(1<<30), u32(1<<30)),
+      ),
+   )
+   avcC := buildBox("avcC", []byte{1, 0x64, 0x00, 0x1f, 0xFF})
+   projection, ok, err := ParseProjection([][]byte{avcC, sv3d})
+   if err != nil || !ok {
+      t.Fatalf("ParseProjection failed: %v %v", ok, err)
+   }
+   if projection.Type != "equirectangular" || projection.MetadataSource != "Spherical Metadata Tool" {
+      t.Errorf("unexpected projection %+v", projection)
+   }
+   if yaw, pitch, roll := projection.Pose.Degrees(); yaw != 90 || pitch != -1 || roll != 0 {
+      t.Errorf("unexpected pose %v %v %v", yaw, pitch, roll)
+   }
+   if projection.Equi.BoundsLeft != 1<<30 {
+      t.Errorf("unexpected equi bounds %+v", projection.Equi)
+   }
+
+   cubemap := buildBox("sv3d", buildBox("proj", buildBox("cbmp", fullBox, u32(0), u32(4))))
+   projection, _, err = ParseProjection([][]byte{cubemap})
+   if err != nil || projection.Type != "cubemap" || projection.Cbmp.Padding != 4 {
+      t.Errorf("unexpected cubemap projection %+v %v", projection, err)
+   }
+   if _, ok, _ := ParseProjection([][]byte{avcC}); ok {
+      t.Error("expected no projection without sv3d")
+   }
+   if _, _, err := ParseProjection([][]byte{buildBox("sv3d")}); err == nil {
+      t.Error("expected error for sv3d without proj")
+   }
+}
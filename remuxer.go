@@ -4,6 +4,7 @@ import (
    "encoding/binary"
    "errors"
    "io"
+   "slices"
    "strconv"
    "strings"
 )
@@ -74,15 +75,21 @@ func (r *Remuxer) AddSegment(segmentData []byte) error {
    if err != nil {
       return remuxError("parsing segment", r.segmentCount, err)
    }
+   offsets := boxOffsets(segmentData)
    var pendingMoof *MoofBox
+   var moofStart uint64
    for i, box := range boxes {
+      if i >= len(offsets) {
+         break
+      }
       if box.Moof != nil {
-         pendingMoof = box.Moof
+         pendingMoof, moofStart = box.Moof, offsets[i]
          continue
       }
       if box.Mdat != nil {
          if pendingMoof != nil {
-            if err := r.processFragment(pendingMoof, box.Mdat); err != nil {
+            payloadStart := offsets[i] + uint64(box.Mdat.Header.HeaderSize)
+            if err := r.processFragment(pendingMoof, box.Mdat, moofStart, payloadStart); err != nil {
                return remuxError("processing fragment at box index", i, err)
             }
             pendingMoof = nil
@@ -92,27 +99,33 @@ func (r *Remuxer) AddSegment(segmentData []byte) error {
    return nil
 }
 
-func (r *Remuxer) processFragment(moof *MoofBox, mdat *MdatBox) error {
-   traf := moof.Traf
-   if traf == nil {
+// processFragment appends the samples of the remuxed track, the first trak
+// of the moov, from a moof/mdat pair, with moofStart and payloadStart as in
+// fragmentLayout.
+func (r *Remuxer) processFragment(moof *MoofBox, mdat *MdatBox, moofStart, payloadStart uint64) error {
+   trackID := r.Moov.Trak[0].TrackID()
+   index := slices.IndexFunc(moof.Trafs, func(traf *TrafBox) bool {
+      return traf.Tfhd != nil && traf.Tfhd.TrackID == trackID
+   })
+   if index < 0 {
       return nil
    }
-   tfhd := traf.Tfhd
-   if tfhd == nil {
-      return nil
+   traf := moof.Trafs[index]
+   fragment, err := fragmentSamples(moof, mdat, moofStart, payloadStart, r.Moov, nil)
+   if err != nil {
+      return err
    }
-   senc := traf.Senc
-   sencIndex := 0
+   samples := fragment[index]
+   tfhd := traf.Tfhd
    var newSamples []RemuxSample
+   var payload []byte
    defDur := tfhd.DefaultSampleDuration
-   defSize := tfhd.DefaultSampleSize
    defFlags := tfhd.DefaultSampleFlags
-   mdatOffset := 0
    for _, trun := range traf.Trun {
       for i, sample := range trun.Samples {
          remuxSample := RemuxSample{
             Duration:              defDur,
-            Size:                  defSize,
+            Size:                  uint32(len(samples[0].Data)),
             IsSync:                true,
             CompositionTimeOffset: 0,
          }
@@ -126,9 +139,6 @@ func (r *Remuxer) processFragment(moof *MoofBox, mdat *MdatBox) error {
          if (trun.Flags & 0x000100) != 0 {
             remuxSample.Duration = sample.Duration
          }
-         if (trun.Flags & 0x000200) != 0 {
-            remuxSample.Size = sample.Size
-         }
          if (trun.Flags & 0x000800) != 0 {
             remuxSample.CompositionTimeOffset = sample.CompositionTimeOffset
          }
@@ -137,21 +147,12 @@ func (r *Remuxer) processFragment(moof *MoofBox, mdat *MdatBox) error {
          } else {
             remuxSample.IsSync = true
          }
-         originalSize := int(remuxSample.Size)
-         if mdatOffset+originalSize > len(mdat.Payload) {
-            return errors.New("mdat payload too short for samples")
-         }
-         sampleData := mdat.Payload[mdatOffset : mdatOffset+originalSize]
-         var encInfo *SampleEncryptionInfo
-         if senc != nil && sencIndex < len(senc.Samples) {
-            encInfo = &senc.Samples[sencIndex]
-            sencIndex++
-         }
          if r.OnSample != nil {
-            r.OnSample(sampleData, encInfo)
+            r.OnSample(samples[0].Data, samples[0].Encryption)
          }
          newSamples = append(newSamples, remuxSample)
-         mdatOffset += originalSize
+         payload = append(payload, samples[0].Data...)
+         samples = samples[1:]
       }
    }
 
@@ -160,7 +161,7 @@ func (r *Remuxer) processFragment(moof *MoofBox, mdat *MdatBox) error {
    }
    currentPos, _ := r.Writer.Seek(0, io.SeekCurrent)
    r.chunkOffsets = append(r.chunkOffsets, uint64(currentPos))
-   if _, err := r.Writer.Write(mdat.Payload); err != nil {
+   if _, err := r.Writer.Write(payload); err != nil {
       return err
    }
    r.samples = append(r.samples, newSamples...)
@@ -212,7 +213,10 @@ func (r *Remuxer) Finish() error {
    }
    r.Moov.RemoveMvex()
    trak.RemoveEdts()
-   stbl.RawChildren = nil // Clear existing table boxes
+   // Clear existing table boxes, which describe the fragments' samples
+   stbl.RawChildren = nil
+   stbl.Saiz, stbl.Saio, stbl.Subs, stbl.Padb, stbl.Stdp = nil, nil, nil, nil, nil
+   stbl.Sbgp, stbl.Sgpd = nil, nil
    if stbl.Stsd == nil {
       return errors.New("missing stsd")
    }
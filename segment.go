@@ -0,0 +1,961 @@
+package sofia
+
+import (
+   "bytes"
+   "cmp"
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/sha256"
+   "encoding/binary"
+   "encoding/hex"
+   "errors"
+   "io"
+   "math"
+   "slices"
+)
+
+// Sample is a media sample of a fragment together with its encryption
+// info, which is nil for clear samples.
+type Sample struct {
+   TrackID    uint32
+   Data       []byte
+   Encryption *SampleEncryptionInfo
+}
+
+// sampleRange is where a sample lies in the mdat payload of its fragment.
+type sampleRange struct {
+   offset, size uint64
+}
+
+// fragmentLayout locates the samples of every traf of moof in the mdat
+// payload of payloadSize bytes that follows it, following the tfhd bases
+// and trun data offsets the way splitMoof does. moofStart and payloadStart
+// are the positions of the moof and of the payload in the data the offsets
+// refer to. A trun without a data offset continues the data of the traf
+// before it, or for the first traf starts the payload. mvex, which may be
+// nil, supplies the trex sample size defaults.
+func fragmentLayout(moof *MoofBox, mvex *MvexBox, moofStart, payloadStart, payloadSize uint64) ([][]sampleRange, error) {
+   layout := make([][]sampleRange, len(moof.Trafs))
+   previousEnd := payloadStart
+   for i, traf := range moof.Trafs {
+      base := moofStart
+      switch {
+      case traf.Tfhd != nil && traf.Tfhd.Flags&0x000001 != 0:
+         base = traf.Tfhd.BaseDataOffset
+      case traf.Tfhd != nil && !traf.Tfhd.DefaultBaseIsMoof() && i > 0:
+         base = previousEnd
+      }
+      position := previousEnd
+      if traf.Tfhd != nil && traf.Tfhd.Flags&0x000001 != 0 {
+         position = base
+      }
+      sizes, err := traf.sampleSizes(mvex)
+      if err != nil {
+         return nil, err
+      }
+      for _, trun := range traf.Trun {
+         if trun.Flags&0x000001 != 0 {
+            position = base + uint64(int64(trun.DataOffset))
+         }
+         count := min(len(trun.Samples), len(sizes))
+         for _, size := range sizes[:count] {
+            if position < payloadStart || position+uint64(size) > payloadStart+payloadSize {
+               return nil, errors.New("mdat payload too short for samples")
+            }
+            layout[i] = append(layout[i], sampleRange{position - payloadStart, uint64(size)})
+            position += uint64(size)
+         }
+         sizes = sizes[count:]
+      }
+      previousEnd = position
+   }
+   return layout, nil
+}
+
+// fragmentSamples slices the samples of every traf of a moof out of the
+// payload of the mdat after it, with moofStart and payloadStart as in
+// fragmentLayout. moov, which may be nil, is the init segment of the
+// fragment. The samples of each traf are returned in its own slice.
+func fragmentSamples(moof *MoofBox, mdat *MdatBox, moofStart, payloadStart uint64, moov *MoovBox, opts *ParseOptions) ([][]Sample, error) {
+   layout, err := fragmentLayout(moof, moovMvex(moov), moofStart, payloadStart, uint64(len(mdat.Payload)))
+   if err != nil {
+      return nil, err
+   }
+   samples := make([][]Sample, len(moof.Trafs))
+   for i, traf := range moof.Trafs {
+      var trackID uint32
+      if traf.Tfhd != nil {
+         trackID = traf.Tfhd.TrackID
+      }
+      senc, err := trafSenc(traf, moov, opts)
+      if err != nil {
+         return nil, err
+      }
+      samples[i] = make([]Sample, 0, len(layout[i]))
+      for j, r := range layout[i] {
+         sample := Sample{TrackID: trackID, Data: mdat.Payload[r.offset : r.offset+r.size]}
+         if senc != nil && j < len(senc.Samples) {
+            sample.Encryption = &senc.Samples[j]
+         }
+         samples[i] = append(samples[i], sample)
+      }
+   }
+   return samples, nil
+}
+
+// moovMvex returns the mvex of moov, or nil if moov is nil.
+func moovMvex(moov *MoovBox) *MvexBox {
+   if moov == nil {
+      return nil
+   }
+   return moov.Mvex
+}
+
+// trafSenc returns the senc of traf parsed with the per-sample IV size of
+// its protection, which may come from the tenc of its track in moov.
+func trafSenc(traf *TrafBox, moov *MoovBox, opts *ParseOptions) (*SencBox, error) {
+   if prot, ok := trafProtection(traf, moov); ok {
+      return traf.sencWithIVSize(prot.ivSize, opts)
+   }
+   return traf.Senc, nil
+}
+
+// decryptFragment decrypts the samples of a moof/mdat pair in place, with
+// moofStart and payloadStart as in fragmentLayout. The decrypted mdat
+// payload is written to out if it is not nil.
+func (d *Decrypter) decryptFragment(moof *MoofBox, mdat *MdatBox, moofStart, payloadStart uint64, moov *MoovBox, out io.Writer) error {
+   samples, err := fragmentSamples(moof, mdat, moofStart, payloadStart, moov, d.parseOptions())
+   if err != nil {
+      return err
+   }
+   for i, traf := range moof.Trafs {
+      if !trafEncrypted(traf, moov) {
+         continue
+      }
+      block, prot, err := d.fragmentCipher(traf, moov)
+      if err != nil {
+         return err
+      }
+      for j, sample := range samples[i] {
+         if err := d.decryptProtected(sample.Data, sample.Encryption, block, prot); err != nil {
+            return overrunSample(err, j)
+         }
+      }
+   }
+   if out != nil {
+      if _, err := out.Write(mdat.Payload); err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
+// protection is how the samples of a track fragment are encrypted.
+type protection struct {
+   scheme         string
+   kid            [16]byte
+   ivSize         int
+   constantIV     []byte
+   cryptByteBlock byte
+   skipByteBlock  byte
+}
+
+// trafProtection resolves the protection of a traf from its first
+// protected seig sample group entry, failing that from a tenc in the traf
+// and failing that from the tenc of its track in moov, which may be nil.
+// The scheme is that of protectionScheme. It returns false if nothing
+// signals protection.
+func trafProtection(traf *TrafBox, moov *MoovBox) (protection, bool) {
+   var trak *TrakBox
+   if moov != nil && traf.Tfhd != nil {
+      trak, _ = moov.Track(traf.Tfhd.TrackID)
+   }
+   prot, ok := seigProtection(traf)
+   if !ok {
+      tenc := traf.Tenc
+      if tenc == nil && trak != nil {
+         tenc, _ = trak.Tenc()
+      }
+      if tenc == nil || tenc.DefaultIsProtected != 1 {
+         return protection{}, false
+      }
+      prot = tencProtection(tenc)
+   }
+   prot.scheme = protectionScheme(trak, prot)
+   return prot, true
+}
+
+// trakProtection returns the protection of a track from its tenc, or false
+// if the track is not protected.
+func trakProtection(trak *TrakBox) (protection, bool) {
+   tenc, ok := trak.Tenc()
+   if !ok || tenc.DefaultIsProtected != 1 {
+      return protection{}, false
+   }
+   prot := tencProtection(tenc)
+   prot.scheme = protectionScheme(trak, prot)
+   return prot, true
+}
+
+// tencProtection returns the default protection of a tenc, leaving the
+// scheme empty.
+func tencProtection(tenc *TencBox) protection {
+   return protection{
+      kid:            tenc.DefaultKID,
+      ivSize:         int(tenc.DefaultPerSampleIVSize),
+      constantIV:     tenc.DefaultConstantIV,
+      cryptByteBlock: tenc.DefaultCryptByteBlock,
+      skipByteBlock:  tenc.DefaultSkipByteBlock,
+   }
+}
+
+// protectionScheme returns the schm scheme of trak, which may be nil, or
+// without one cbcs if prot has a pattern or constant IV and cenc otherwise.
+func protectionScheme(trak *TrakBox, prot protection) string {
+   if trak != nil {
+      if scheme, ok := trak.Scheme(); ok {
+         return scheme
+      }
+   }
+   if prot.cryptByteBlock != 0 || len(prot.constantIV) > 0 {
+      return "cbcs"
+   }
+   return "cenc"
+}
+
+// seigProtection returns the protection of the first protected seig
+// sample group entry of traf, leaving the scheme empty.
+func seigProtection(traf *TrafBox) (protection, bool) {
+   if _, sgpd, ok := traf.SampleGroups("seig"); ok && sgpd != nil {
+      for _, data := range sgpd.Entries {
+         var entry SeigEntry
+         if entry.Parse(data) == nil && entry.IsProtected == 1 {
+            return protection{
+               kid:            entry.KID,
+               ivSize:         int(entry.PerSampleIVSize),
+               constantIV:     entry.ConstantIV,
+               cryptByteBlock: entry.CryptByteBlock,
+               skipByteBlock:  entry.SkipByteBlock,
+            }, true
+         }
+      }
+   }
+   return protection{}, false
+}
+
+// trafEncrypted reports whether the samples of traf are encrypted: it
+// carries sample encryption info, or its protection, which may come from
+// the tenc of its track in moov, says so. Samples with a constant IV need
+// no senc.
+func trafEncrypted(traf *TrafBox, moov *MoovBox) bool {
+   if traf.encrypted() {
+      return true
+   }
+   _, ok := trafProtection(traf, moov)
+   return ok
+}
+
+// trafKIDs returns the key IDs of traf.KIDs or, failing those, the key ID
+// of its track in moov, which may be nil.
+func trafKIDs(traf *TrafBox, moov *MoovBox) [][16]byte {
+   if kids := traf.KIDs(); len(kids) > 0 {
+      return kids
+   }
+   if prot, ok := trafProtection(traf, moov); ok {
+      return [][16]byte{prot.kid}
+   }
+   return nil
+}
+
+// fragmentCipher returns the protection of an encrypted traf and the
+// cipher for its key ID. It fails for schemes decryptProtected cannot
+// decrypt.
+func (d *Decrypter) fragmentCipher(traf *TrafBox, moov *MoovBox) (cipher.Block, protection, error) {
+   prot, ok := trafProtection(traf, moov)
+   if !ok {
+      return nil, prot, errors.New("no key ID for encrypted fragment")
+   }
+   if err := checkScheme(prot.scheme); err != nil {
+      return nil, prot, err
+   }
+   block, err := d.keyCipher(prot.kid)
+   return block, prot, err
+}
+
+// checkScheme returns an error for protection schemes other than cenc and
+// cbcs, whose samples the package cannot decrypt.
+func checkScheme(scheme string) error {
+   switch scheme {
+   case "cenc", "cbcs":
+      return nil
+   }
+   return errors.New("unsupported protection scheme " + scheme)
+}
+
+// decryptProtected decrypts a sample in place with the scheme of prot,
+// using its constant IV for samples that carry no IV of their own.
+func (d *Decrypter) decryptProtected(sample []byte, info *SampleEncryptionInfo, block cipher.Block, prot protection) error {
+   if (info == nil || len(info.IV) == 0) && len(prot.constantIV) > 0 {
+      constant := SampleEncryptionInfo{IV: prot.constantIV}
+      if info != nil {
+         constant.Subsamples = info.Subsamples
+      }
+      info = &constant
+   }
+   if prot.scheme == "cbcs" {
+      return d.DecryptSampleCBCS(sample, info, block, prot.cryptByteBlock, prot.skipByteBlock)
+   }
+   return d.DecryptSample(sample, info, block)
+}
+
+// keyCipher returns the cipher for the key of kid.
+func (d *Decrypter) keyCipher(kid [16]byte) (cipher.Block, error) {
+   key, ok := d.Keys.Key(kid)
+   if !ok {
+      return nil, errors.New("no key for KID " + hex.EncodeToString(kid[:]))
+   }
+   return aes.NewCipher(key)
+}
+
+// moov returns the moov of the content being decrypted: the first of boxes
+// or failing that d.Init.
+func (d *Decrypter) moov(boxes []Box) *MoovBox {
+   if moov, ok := FindMoov(boxes); ok {
+      return moov
+   }
+   return d.Init
+}
+
+// StreamDecrypt decrypts the mdat payload of a fragment as it is read,
+// writing each sample to out as soon as it is decrypted, along with the
+// mdat bytes between and after the samples. Only one sample is held in
+// memory at a time, so it suits fragments too large to buffer. The mdat is
+// taken to follow the moof with an 8-byte header.
+func StreamDecrypt(moof *MoofBox, mdat io.Reader, keys KeyProvider, out io.Writer) error {
+   return (&Decrypter{Keys: keys}).StreamDecrypt(moof, mdat, out)
+}
+
+// StreamDecrypt is the package StreamDecrypt with the keys and options of d.
+func (d *Decrypter) StreamDecrypt(moof *MoofBox, mdat io.Reader, out io.Writer) error {
+   type streamSample struct {
+      sampleRange
+      index int
+      info  *SampleEncryptionInfo
+      block cipher.Block
+      prot  protection
+   }
+   layout, err := fragmentLayout(moof, moovMvex(d.Init), 0, moof.Header.Size+8, math.MaxInt64)
+   if err != nil {
+      return err
+   }
+   var samples []streamSample
+   for i, traf := range moof.Trafs {
+      var block cipher.Block
+      var prot protection
+      var senc *SencBox
+      if trafEncrypted(traf, d.Init) {
+         if block, prot, err = d.fragmentCipher(traf, d.Init); err != nil {
+            return err
+         }
+         if senc, err = trafSenc(traf, d.Init, d.parseOptions()); err != nil {
+            return err
+         }
+      }
+      for j, r := range layout[i] {
+         sample := streamSample{sampleRange: r, index: j, block: block, prot: prot}
+         if senc != nil && j < len(senc.Samples) {
+            sample.info = &senc.Samples[j]
+         }
+         samples = append(samples, sample)
+      }
+   }
+   slices.SortStableFunc(samples, func(a, b streamSample) int {
+      return cmp.Compare(a.offset, b.offset)
+   })
+   var position uint64
+   var buffer []byte
+   for _, sample := range samples {
+      if sample.offset < position {
+         return remuxError("overlapping sample", sample.index, errors.New("samples overlap in mdat"))
+      }
+      if _, err := io.CopyN(out, mdat, int64(sample.offset-position)); err != nil {
+         return err
+      }
+      if cap(buffer) < int(sample.size) {
+         buffer = make([]byte, sample.size)
+      }
+      data := buffer[:sample.size]
+      if _, err := io.ReadFull(mdat, data); err != nil {
+         return remuxError("reading sample", sample.index, err)
+      }
+      if sample.block != nil {
+         if err := d.decryptProtected(data, sample.info, sample.block, sample.prot); err != nil {
+            return overrunSample(err, sample.index)
+         }
+      }
+      if _, err := out.Write(data); err != nil {
+         return err
+      }
+      position = sample.offset + sample.size
+   }
+   _, err = io.Copy(out, mdat)
+   return err
+}
+
+// boxOffsets returns the offset in data of each complete top-level box, in
+// the order Parse returns them.
+func boxOffsets(data []byte) []uint64 {
+   var offsets []uint64
+   var offset uint64
+   for _, box := range childBoxes(data) {
+      offsets = append(offsets, offset)
+      offset += uint64(len(box))
+   }
+   return offsets
+}
+
+// decryptSegment decrypts every fragment of a media segment in place.
+func (d *Decrypter) decryptSegment(segment []byte, out io.Writer) error {
+   boxes, err := d.parseOptions().Parse(segment)
+   if err != nil {
+      return err
+   }
+   moov := d.moov(boxes)
+   offsets := boxOffsets(segment)
+   var pendingMoof *MoofBox
+   var moofStart uint64
+   for i, box := range boxes {
+      if box.Moof != nil && i < len(offsets) {
+         pendingMoof, moofStart = box.Moof, offsets[i]
+         continue
+      }
+      if box.Mdat != nil {
+         if pendingMoof == nil || i >= len(offsets) {
+            if out != nil {
+               if _, err := out.Write(box.Mdat.Payload); err != nil {
+                  return err
+               }
+            }
+            continue
+         }
+         payloadStart := offsets[i] + uint64(box.Mdat.Header.HeaderSize)
+         if err := d.decryptFragment(pendingMoof, box.Mdat, moofStart, payloadStart, moov, out); err != nil {
+            return remuxError("decrypting fragment at box index", i, err)
+         }
+         pendingMoof = nil
+      }
+   }
+   return nil
+}
+
+// DecryptSegment returns a copy of a media segment with the samples of
+// every encrypted fragment decrypted. The box structure is left unchanged.
+func DecryptSegment(segment []byte, keys KeyProvider) ([]byte, error) {
+   return (&Decrypter{Keys: keys}).DecryptSegment(segment)
+}
+
+// DecryptSegment is the package DecryptSegment with the keys and options
+// of d.
+func (d *Decrypter) DecryptSegment(segment []byte) ([]byte, error) {
+   out := bytes.Clone(segment)
+   if err := d.decryptSegment(out, nil); err != nil {
+      return nil, err
+   }
+   return out, nil
+}
+
+// DecryptSegmentWithChecksum is like DecryptSegment but also returns the
+// SHA-256 of the decrypted mdat payloads, hashed as each sample is
+// decrypted, so the output can be checked against a reference digest.
+func DecryptSegmentWithChecksum(segment []byte, keys KeyProvider) ([]byte, [32]byte, error) {
+   return (&Decrypter{Keys: keys}).DecryptSegmentWithChecksum(segment)
+}
+
+// DecryptSegmentWithChecksum is the package DecryptSegmentWithChecksum with
+// the keys and options of d.
+func (d *Decrypter) DecryptSegmentWithChecksum(segment []byte) ([]byte, [32]byte, error) {
+   var sum [32]byte
+   out := bytes.Clone(segment)
+   hash := sha256.New()
+   if err := d.decryptSegment(out, hash); err != nil {
+      return nil, sum, err
+   }
+   copy(sum[:], hash.Sum(nil))
+   return out, sum, nil
+}
+
+// ExtractSamples returns the samples of every fragment in a segment along
+// with their encryption info, without decrypting them, so they can be
+// handed to an external decryptor. The sample data aliases segment.
+func ExtractSamples(segment []byte) ([]Sample, error) {
+   boxes, err := Parse(segment)
+   if err != nil {
+      return nil, err
+   }
+   moov, _ := FindMoov(boxes)
+   offsets := boxOffsets(segment)
+   var samples []Sample
+   var pendingMoof *MoofBox
+   var moofStart uint64
+   for i, box := range boxes {
+      if i >= len(offsets) {
+         break
+      }
+      if box.Moof != nil {
+         pendingMoof, moofStart = box.Moof, offsets[i]
+         continue
+      }
+      if box.Mdat != nil && pendingMoof != nil {
+         payloadStart := offsets[i] + uint64(box.Mdat.Header.HeaderSize)
+         fragment, err := fragmentSamples(pendingMoof, box.Mdat, moofStart, payloadStart, moov, nil)
+         if err != nil {
+            return nil, remuxError("extracting fragment at box index", i, err)
+         }
+         for _, trafSamples := range fragment {
+            samples = append(samples, trafSamples...)
+         }
+         pendingMoof = nil
+      }
+   }
+   return samples, nil
+}
+
+// EncryptionOverhead sums the sizes, headers included, of the encryption
+// metadata boxes of a segment: senc (or the PIFF uuid equivalent), saiz and
+// saio of every traf, and pssh at the top level or in a moof or moov.
+func EncryptionOverhead(segment []byte) (sencBytes, saizBytes, saioBytes, psshBytes uint64, err error) {
+   if _, err := Parse(segment); err != nil {
+      return 0, 0, 0, 0, err
+   }
+   var walk func(boxes [][]byte)
+   walk = func(boxes [][]byte) {
+      for _, box := range boxes {
+         size := uint64(len(box))
+         switch string(box[4:8]) {
+         case "moof", "moov", "traf":
+            walk(childBoxes(box[8:]))
+         case "senc":
+            sencBytes += size
+         case "uuid":
+            if len(box) >= 24 && [16]byte(box[8:24]) == piffSencUUID {
+               sencBytes += size
+            }
+         case "saiz":
+            saizBytes += size
+         case "saio":
+            saioBytes += size
+         case "pssh":
+            psshBytes += size
+         }
+      }
+   }
+   walk(childBoxes(segment))
+   return sencBytes, saizBytes, saioBytes, psshBytes, nil
+}
+
+// CanDecrypt reports whether keys holds a key for every key ID referenced
+// by the encrypted fragments of a segment, and lists the key IDs that are
+// missing. A fragment that is encrypted but does not signal its key ID also
+// makes the segment undecryptable. Fragments that leave the key ID to the
+// init segment need the segment to carry its moov, or see
+// Decrypter.CanDecrypt.
+func CanDecrypt(segment []byte, keys KeyProvider) (bool, [][16]byte) {
+   return (&Decrypter{Keys: keys}).CanDecrypt(segment)
+}
+
+// CanDecrypt is the package CanDecrypt with the keys of d, taking key IDs
+// the fragments leave out from the tenc of their track in d.Init.
+func (d *Decrypter) CanDecrypt(segment []byte) (bool, [][16]byte) {
+   boxes, err := Parse(segment)
+   if err != nil {
+      return false, nil
+   }
+   moov := d.moov(boxes)
+   ok := true
+   var missing [][16]byte
+   for _, box := range boxes {
+      if box.Moof == nil {
+         continue
+      }
+      for _, traf := range box.Moof.Trafs {
+         if !traf.encrypted() {
+            continue
+         }
+         kids := trafKIDs(traf, moov)
+         if len(kids) == 0 {
+            ok = false
+         }
+         for _, kid := range kids {
+            if _, found := d.Keys.Key(kid); found || slices.Contains(missing, kid) {
+               continue
+            }
+            missing = append(missing, kid)
+         }
+      }
+   }
+   return ok && len(missing) == 0, missing
+}
+
+// IVCollision records a per-sample IV that is used more than once.
+type IVCollision struct {
+   IV            []byte
+   FirstSegment  int
+   FirstSample   int
+   SecondSegment int
+   SecondSample  int
+}
+
+// CheckIVReuse scans the senc boxes of a track across segments and reports
+// every IV that repeats an earlier one. With CTR schemes a reused IV leaks
+// the XOR of the plaintexts, so any collision is a packaging bug. Sample
+// indices count from the start of each segment. init, the moov of the init
+// segment, gives the IV size of segments that leave it to the tenc; it may
+// be nil if they carry it in seig sample groups.
+func CheckIVReuse(init *MoovBox, segments [][]byte, trackID uint32) []IVCollision {
+   type position struct {
+      segment, sample int
+   }
+   seen := map[string]position{}
+   var collisions []IVCollision
+   for i, segment := range segments {
+      boxes, err := Parse(segment)
+      if err != nil {
+         continue
+      }
+      sample := 0
+      for _, box := range boxes {
+         if box.Moof == nil {
+            continue
+         }
+         for _, traf := range box.Moof.Trafs {
+            if traf.Tfhd == nil || traf.Tfhd.TrackID != trackID {
+               continue
+            }
+            senc, err := trafSenc(traf, init, nil)
+            if err != nil || senc == nil {
+               continue
+            }
+            for _, info := range senc.Samples {
+               if len(info.IV) > 0 {
+                  if first, ok := seen[string(info.IV)]; ok {
+                     collisions = append(collisions, IVCollision{
+                        IV:            info.IV,
+                        FirstSegment:  first.segment,
+                        FirstSample:   first.sample,
+                        SecondSegment: i,
+                        SecondSample:  sample,
+                     })
+                  } else {
+                     seen[string(info.IV)] = position{i, sample}
+                  }
+               }
+               sample++
+            }
+         }
+      }
+   }
+   return collisions
+}
+
+// clearTraf returns a copy of a traf without its encryption boxes.
+func clearTraf(traf []byte) []byte {
+   out := make([]byte, 8, len(traf))
+   for _, child := range childBoxes(traf[8:]) {
+      switch string(child[4:8]) {
+      case "senc", "saiz", "saio":
+         continue
+      case "sbgp", "sgpd":
+         if len(child) >= 16 && string(child[12:16]) == "seig" {
+            continue
+         }
+      }
+      out = append(out, child...)
+   }
+   binary.BigEndian.PutUint32(out, uint32(len(out)))
+   copy(out[4:8], traf[4:8])
+   return out
+}
+
+// shiftTraf moves the data offsets of a traf earlier after bytes were
+// removed: moofRemoved from its moof and segmentRemoved from the segment
+// before it. An explicit tfhd base data offset moves with the data, so the
+// trun offsets relative to it stay put; otherwise trun offsets relative to
+// the moof shrink by the bytes removed from the moof.
+func shiftTraf(traf []byte, first bool, moofRemoved, segmentRemoved int) {
+   children := childBoxes(traf[8:])
+   baseIsMoof := first
+   for _, child := range children {
+      if string(child[4:8]) != "tfhd" || len(child) < 16 {
+         continue
+      }
+      flags := binary.BigEndian.Uint32(child[8:]) & 0x00FFFFFF
+      if flags&0x000001 != 0 && len(child) >= 24 { // base-data-offset-present
+         base := binary.BigEndian.Uint64(child[16:])
+         binary.BigEndian.PutUint64(child[16:], base-uint64(moofRemoved+segmentRemoved))
+         return
+      }
+      if flags&0x020000 != 0 { // default-base-is-moof
+         baseIsMoof = true
+      }
+   }
+   if !baseIsMoof {
+      return
+   }
+   for _, child := range children {
+      if string(child[4:8]) != "trun" || len(child) < 20 || child[11]&0x01 == 0 {
+         continue
+      }
+      offset := int32(binary.BigEndian.Uint32(child[16:]))
+      binary.BigEndian.PutUint32(child[16:], uint32(offset-int32(moofRemoved)))
+   }
+}
+
+// ClearSegment decrypts a media segment and removes the encryption boxes
+// (senc, saiz, saio, seig sample groups and pssh) from every moof, fixing up
+// box sizes, tfhd base data offsets and trun data offsets for the bytes
+// removed, so the result plays as clear content.
+func ClearSegment(segment []byte, keys KeyProvider) ([]byte, error) {
+   return (&Decrypter{Keys: keys}).ClearSegment(segment)
+}
+
+// ClearSegment is the package ClearSegment with the keys and options of d.
+func (d *Decrypter) ClearSegment(segment []byte) ([]byte, error) {
+   return d.clearSegment(segment, nil)
+}
+
+// clearSegment is ClearSegment, with every moov replaced by rewriteMoov
+// unless it is nil. The bytes a new moov saves count towards the offsets
+// of the fragments after it like those removed from a moof.
+func (d *Decrypter) clearSegment(segment []byte, rewriteMoov func(moov []byte) ([]byte, error)) ([]byte, error) {
+   decrypted, err := d.DecryptSegment(segment)
+   if err != nil {
+      return nil, err
+   }
+   out := make([]byte, 0, len(decrypted))
+   segmentRemoved := 0
+   for _, box := range childBoxes(decrypted) {
+      if string(box[4:8]) == "moov" && rewriteMoov != nil {
+         moov, err := rewriteMoov(box)
+         if err != nil {
+            return nil, err
+         }
+         out = append(out, moov...)
+         segmentRemoved += len(box) - len(moov)
+         continue
+      }
+      if string(box[4:8]) != "moof" {
+         out = append(out, box...)
+         continue
+      }
+      var children, trafs [][]byte
+      for _, child := range childBoxes(box[8:]) {
+         switch string(child[4:8]) {
+         case "pssh":
+         case "traf":
+            traf := clearTraf(child)
+            children = append(children, traf)
+            trafs = append(trafs, traf)
+         default:
+            children = append(children, child)
+         }
+      }
+      moofSize := 8
+      for _, child := range children {
+         moofSize += len(child)
+      }
+      // Every byte removed from the moof moves the mdat data earlier.
+      moofRemoved := len(box) - moofSize
+      for i, traf := range trafs {
+         shiftTraf(traf, i == 0, moofRemoved, segmentRemoved)
+      }
+      moof := make([]byte, 8, moofSize)
+      for _, child := range children {
+         moof = append(moof, child...)
+      }
+      binary.BigEndian.PutUint32(moof, uint32(len(moof)))
+      copy(moof[4:8], "moof")
+      out = append(out, moof...)
+      segmentRemoved += moofRemoved
+   }
+   return out, nil
+}
+
+// SegmentHasInit reports whether a media segment carries its own
+// initialization, a moov ahead of its first moof, as some low-latency
+// setups send instead of a separate init segment. Open and Tracks read
+// such a moov like any other.
+func SegmentHasInit(segment []byte) bool {
+   for _, box := range childBoxes(segment) {
+      switch string(box[4:8]) {
+      case "moov":
+         return true
+      case "moof":
+         return false
+      }
+   }
+   return false
+}
+
+// SplitChunks splits a CMAF segment into its moof+mdat chunks. Boxes before
+// a moof, such as styp, emsg or prft, belong to its chunk. If the segment
+// starts with a styp, a copy is prepended to every later chunk so that each
+// can be delivered on its own.
+func SplitChunks(segment []byte) ([][]byte, error) {
+   var chunks [][]byte
+   var styp []byte
+   start, offset := 0, 0
+   inChunk := false
+   for offset < len(segment) {
+      var header BoxHeader
+      if err := header.Parse(segment[offset:]); err != nil {
+         return nil, err
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(segment) - offset
+      }
+      if boxSize < 8 {
+         return nil, errors.New("invalid box size")
+      }
+      if offset+boxSize > len(segment) {
+         return nil, ErrSizeMismatch
+      }
+      switch string(header.Type[:]) {
+      case "styp":
+         if offset == 0 {
+            styp = segment[:boxSize]
+         }
+      case "moof":
+         if inChunk {
+            return nil, errors.New("moof is not followed by mdat")
+         }
+         inChunk = true
+      case "mdat":
+         if inChunk {
+            chunk := segment[start : offset+boxSize]
+            if len(chunks) > 0 && styp != nil && string(chunk[4:8]) != "styp" {
+               chunk = append(bytes.Clone(styp), chunk...)
+            }
+            chunks = append(chunks, chunk)
+            start = offset + boxSize
+            inChunk = false
+         }
+      }
+      offset += boxSize
+   }
+   if inChunk {
+      return nil, errors.New("moof is not followed by mdat")
+   }
+   if start < len(segment) {
+      return nil, errors.New("boxes after the last chunk")
+   }
+   return chunks, nil
+}
+
+// fileSample is a sample of a progressive file with the cipher of its
+// track, which is nil for clear tracks.
+type fileSample struct {
+   SampleLocation
+   index int // within the track
+   info  *SampleEncryptionInfo
+   block cipher.Block
+   prot  protection
+}
+
+// overrunSample records the sample index in a *SubsampleOverrunError.
+func overrunSample(err error, index int) error {
+   var overrun *SubsampleOverrunError
+   if errors.As(err, &overrun) {
+      overrun.Sample = index
+   }
+   return err
+}
+
+// trackSamples locates the samples of a progressive track and, if it is
+// protected, reads their auxiliary information from r.
+func (d *Decrypter) trackSamples(r io.ReaderAt, trak *TrakBox) ([]fileSample, error) {
+   if trak.Mdia == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil {
+      return nil, nil
+   }
+   stbl := trak.Mdia.Minf.Stbl
+   index, chunkCounts, err := stbl.sampleIndex()
+   if err != nil {
+      return nil, err
+   }
+   var block cipher.Block
+   var infos []SampleEncryptionInfo
+   prot, protected := trakProtection(trak)
+   if protected {
+      if err := checkScheme(prot.scheme); err != nil {
+         return nil, err
+      }
+      block, err = d.keyCipher(prot.kid)
+      if err != nil {
+         return nil, err
+      }
+      switch {
+      case stbl.Saiz != nil && stbl.Saio != nil:
+         infos, err = ParseSampleAuxInfoAt(r, stbl.Saiz, stbl.Saio, 0, prot.ivSize, chunkCounts)
+         if err != nil {
+            return nil, err
+         }
+      case len(prot.constantIV) == 0:
+         return nil, errors.New("protected track has no saiz/saio")
+      }
+   }
+   samples := make([]fileSample, len(index))
+   for i, location := range index {
+      samples[i] = fileSample{SampleLocation: location, index: i, block: block, prot: prot}
+      if block != nil && i < len(infos) {
+         samples[i].info = &infos[i]
+      }
+   }
+   return samples, nil
+}
+
+// DecryptFile decrypts a progressive (non-fragmented) file held in r, which
+// holds size bytes. The moov is found wherever it is, and the samples of
+// every track are read from r at the offsets given by the sample tables,
+// decrypted if their track is protected and written to w in file order.
+// Only one sample is held in memory at a time.
+func DecryptFile(r io.ReaderAt, size int64, w io.Writer, keys KeyProvider) error {
+   return (&Decrypter{Keys: keys}).DecryptFile(r, size, w)
+}
+
+// DecryptFile is the package DecryptFile with the keys and options of d.
+func (d *Decrypter) DecryptFile(r io.ReaderAt, size int64, w io.Writer) error {
+   moov, err := FindMoovInReader(r, size)
+   if err != nil {
+      return err
+   }
+   var samples []fileSample
+   for _, trak := range moov.Trak {
+      track, err := d.trackSamples(r, trak)
+      if err != nil {
+         return err
+      }
+      samples = append(samples, track...)
+   }
+   slices.SortStableFunc(samples, func(a, b fileSample) int {
+      return cmp.Compare(a.Offset, b.Offset)
+   })
+   var buffer []byte
+   for _, sample := range samples {
+      if sample.Offset+uint64(sample.Size) > uint64(size) {
+         return errors.New("sample extends past end of file")
+      }
+      buffer = slices.Grow(buffer[:0], int(sample.Size))[:sample.Size]
+      if n, err := r.ReadAt(buffer, int64(sample.Offset)); n < len(buffer) {
+         return err
+      }
+      if sample.block != nil {
+         if err := d.decryptProtected(buffer, sample.info, sample.block, sample.prot); err != nil {
+            return overrunSample(err, sample.index)
+         }
+      }
+      if _, err := w.Write(buffer); err != nil {
+         return err
+      }
+   }
+   return nil
+}
@@ -0,0 +1,504 @@
+package sofia
+
+import (
+   "bytes"
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/sha256"
+   "encoding/binary"
+   "io"
+   "slices"
+   "testing"
+)
+
+var (
+   testKID = [16]byte{0x3c, 0x18, 0x63, 0x99, 0x5f, 0x93, 0xb8, 0x2b, 0xce, 0x88, 0xba, 0xce, 0x3a, 0x1a, 0xa6, 0x7a}
+   testKey = []byte("0123456789abcdef")
+)
+
+// buildEncryptedSegment returns a moof+mdat pair holding the given samples
+// encrypted with full-sample AES-CTR, one 8-byte IV per sample, with the
+// key ID signalled by a 'seig' sample group.
+func buildEncryptedSegment(t *testing.T, samples [][]byte) []byte {
+   t.Helper()
+   return buildSegment(t, samples, 8, true)
+}
+
+// buildSegment is buildEncryptedSegment with ivSize byte IVs, leaving the
+// key ID and IV size to the init segment unless seig is set.
+func buildSegment(t *testing.T, samples [][]byte, ivSize int, seig bool) []byte {
+   t.Helper()
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+   trun := []byte{0, 0, 0x02, 0x01} // sample-size-present, data-offset-present
+   trun = append(trun, u32(uint32(len(samples)))...)
+   trun = append(trun, u32(0)...) // data_offset, patched below
+   senc := []byte{0, 0, 0, 0}
+   senc = append(senc, u32(uint32(len(samples)))...)
+   var payload []byte
+   for i, sample := range samples {
+      trun = append(trun, u32(uint32(len(sample)))...)
+      iv := make([]byte, 16)
+      iv[7] = byte(i + 1)
+      senc = append(senc, iv[:ivSize]...)
+      encrypted := make([]byte, len(sample))
+      cipher.NewCTR(block, iv).XORKeyStream(encrypted, sample)
+      payload = append(payload, encrypted...)
+   }
+   children := [][]byte{
+      buildBox("tfhd", []byte{0, 0, 0, 0}, u32(1)),
+      buildBox("trun", trun),
+      buildBox("senc", senc),
+   }
+   if seig {
+      entry := append([]byte{0, 0, 1, byte(ivSize)}, testKID[:]...)
+      children = append(children, buildBox("sgpd", []byte{1, 0, 0, 0}, []byte("seig"), u32(20), u32(1), entry))
+   }
+   moof := buildBox("moof", buildBox("traf", children...))
+   // moof(8) traf(8) tfhd(16) trun(8) version/flags(4) sample_count(4)
+   binary.BigEndian.PutUint32(moof[48:], uint32(len(moof)+8))
+   return append(moof, buildBox("mdat", payload)...)
+}
+
+func TestDecryptSegmentWithChecksum(t *testing.T) {
+   samples := [][]byte{
+      []byte("first sample payload"),
+      []byte("the second sample is somewhat longer than one block"),
+      []byte("third"),
+   }
+   segment := buildEncryptedSegment(t, samples)
+   original := bytes.Clone(segment)
+
+   out, sum, err := DecryptSegmentWithChecksum(segment, KeyMap{testKID: testKey})
+   if err != nil {
+      t.Fatalf("DecryptSegmentWithChecksum failed: %v", err)
+   }
+   if !bytes.Equal(segment, original) {
+      t.Error("input segment was modified")
+   }
+   clear := bytes.Join(samples, nil)
+   if !bytes.HasSuffix(out, clear) {
+      t.Errorf("decrypted mdat mismatch\n  Expected: %q\n  Got:      %q", clear, out[len(out)-len(clear):])
+   }
+   if sum != sha256.Sum256(clear) {
+      t.Errorf("checksum mismatch: %x", sum)
+   }
+
+   if _, _, err := DecryptSegmentWithChecksum(segment, KeyMap{}); err == nil {
+      t.Error("expected error for missing key")
+   }
+}
+
+func TestStreamDecrypt(t *testing.T) {
+   samples := [][]byte{[]byte("first streamed sample"), []byte("second")}
+   boxes, err := Parse(buildEncryptedSegment(t, samples))
+   if err != nil {
+      t.Fatal(err)
+   }
+   mdat := append(bytes.Clone(boxes[1].Mdat.Payload), "trailer"...)
+   var out bytes.Buffer
+   err = StreamDecrypt(boxes[0].Moof, bytes.NewReader(mdat), KeyMap{testKID: testKey}, &out)
+   if err != nil {
+      t.Fatalf("StreamDecrypt failed: %v", err)
+   }
+   if expected := string(bytes.Join(samples, nil)) + "trailer"; out.String() != expected {
+      t.Errorf("expected %q, got %q", expected, out.String())
+   }
+   short := bytes.NewReader(mdat[:len(samples[0])+1])
+   if err := StreamDecrypt(boxes[0].Moof, short, KeyMap{testKID: testKey}, io.Discard); err == nil {
+      t.Error("expected error for short mdat")
+   }
+
+   // a protected sample senc does not cover has no IV to decrypt with
+   boxes[0].Moof.Traf.Senc.Samples = boxes[0].Moof.Traf.Senc.Samples[:1]
+   err = StreamDecrypt(boxes[0].Moof, bytes.NewReader(mdat), KeyMap{testKID: testKey}, io.Discard)
+   if err != ErrMissingIV {
+      t.Errorf("expected ErrMissingIV, got %v", err)
+   }
+}
+
+func TestEncryptionOverhead(t *testing.T) {
+   pssh := buildBox("pssh", []byte{0, 0, 0, 0}, make([]byte, 16), []byte{0, 0, 0, 0})
+   segment := append(pssh, buildEncryptedSegment(t, [][]byte{[]byte("a"), []byte("b")})...)
+   senc, saiz, saio, psshSize, err := EncryptionOverhead(segment)
+   if err != nil {
+      t.Fatalf("EncryptionOverhead failed: %v", err)
+   }
+   // senc holds a full box header, sample count and two 8 byte IVs
+   if senc != 8+4+4+16 || saiz != 0 || saio != 0 || psshSize != uint64(len(pssh)) {
+      t.Errorf("unexpected overhead senc=%d saiz=%d saio=%d pssh=%d", senc, saiz, saio, psshSize)
+   }
+   if _, _, _, _, err := EncryptionOverhead(segment[:len(segment)-1]); err == nil {
+      t.Error("expected error for truncated segment")
+   }
+}
+
+func TestCanDecrypt(t *testing.T) {
+   segment := buildEncryptedSegment(t, [][]byte{[]byte("sample")})
+   ok, missing := CanDecrypt(segment, KeyMap{testKID: testKey})
+   if !ok || len(missing) != 0 {
+      t.Errorf("expected decryptable segment, got %v %x", ok, missing)
+   }
+   ok, missing = CanDecrypt(segment, KeyMap{})
+   if ok || len(missing) != 1 || missing[0] != testKID {
+      t.Errorf("expected missing %x, got %v %x", testKID, ok, missing)
+   }
+}
+
+func TestDecryptSegment_MultiTrack(t *testing.T) {
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   tracks := [][][]byte{
+      {[]byte("video sample one"), []byte("video sample two")},
+      {[]byte("audio")},
+   }
+   seig := append([]byte{0, 0, 1, 8}, testKID[:]...)
+   build := func(dataOffset uint32) ([]byte, []byte) {
+      var trafs, payload []byte
+      for i, samples := range tracks {
+         trun := append([]byte{0, 0, 0x02, 0x01}, u32(uint32(len(samples)))...)
+         trun = append(trun, u32(dataOffset+uint32(len(payload)))...)
+         senc := append([]byte{0, 0, 0, 0}, u32(uint32(len(samples)))...)
+         for j, sample := range samples {
+            trun = append(trun, u32(uint32(len(sample)))...)
+            iv := make([]byte, 16)
+            iv[0], iv[7] = byte(i+1), byte(j+1)
+            senc = append(senc, iv[:8]...)
+            encrypted := make([]byte, len(sample))
+            cipher.NewCTR(block, iv).XORKeyStream(encrypted, sample)
+            payload = append(payload, encrypted...)
+         }
+         trafs = append(trafs, buildBox("traf",
+            buildBox("tfhd", []byte{0, 2, 0, 0}, u32(uint32(i+1))), // default-base-is-moof
+            buildBox("trun", trun),
+            buildBox("senc", senc),
+            buildBox("sgpd", []byte{1, 0, 0, 0}, []byte("seig"), u32(20), u32(1), seig),
+         )...)
+      }
+      return buildBox("moof", trafs), payload
+   }
+   moof, _ := build(0)
+   moof, payload := build(uint32(len(moof) + 8))
+   segment := append(moof, buildBox("mdat", payload)...)
+   clear := slices.Concat(slices.Concat(tracks[0]...), slices.Concat(tracks[1]...))
+
+   out, err := DecryptSegment(segment, KeyMap{testKID: testKey})
+   if err != nil {
+      t.Fatalf("DecryptSegment failed: %v", err)
+   }
+   if !bytes.HasSuffix(out, clear) {
+      t.Errorf("decrypted mdat mismatch: %q", out[len(out)-len(clear):])
+   }
+
+   boxes, err := Parse(segment)
+   if err != nil {
+      t.Fatal(err)
+   }
+   var streamed bytes.Buffer
+   if err := StreamDecrypt(boxes[0].Moof, bytes.NewReader(payload), KeyMap{testKID: testKey}, &streamed); err != nil {
+      t.Fatalf("StreamDecrypt failed: %v", err)
+   }
+   if !bytes.Equal(streamed.Bytes(), clear) {
+      t.Errorf("streamed mdat mismatch: %q", streamed.Bytes())
+   }
+}
+
+func TestDecrypter_Init(t *testing.T) {
+   samples := [][]byte{[]byte("keyed by the init segment"), []byte("second")}
+   init := buildInitSegment(true)
+   // give the tenc 16 byte IVs, which the senc alone cannot tell from 8
+   tenc := bytes.Index(init, []byte("tenc"))
+   init[tenc+11] = 16
+   segment := buildSegment(t, samples, 16, false)
+   boxes, err := Parse(init)
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov, _ := FindMoov(boxes)
+   keys := KeyMap{testKID: testKey}
+   clear := bytes.Join(samples, nil)
+
+   if _, err := DecryptSegment(segment, keys); err == nil {
+      t.Error("expected error without the init segment")
+   }
+   d := &Decrypter{Keys: keys, Init: moov}
+   out, err := d.DecryptSegment(segment)
+   if err != nil {
+      t.Fatalf("DecryptSegment failed: %v", err)
+   }
+   if !bytes.HasSuffix(out, clear) {
+      t.Errorf("decrypted mdat mismatch: %q", out[len(out)-len(clear):])
+   }
+   if ok, missing := (&Decrypter{Keys: KeyMap{}, Init: moov}).CanDecrypt(segment); ok || len(missing) != 1 || missing[0] != testKID {
+      t.Errorf("expected missing %x, got %v %x", testKID, ok, missing)
+   }
+
+   f, err := Open(append(init, segment...))
+   if err != nil {
+      t.Fatalf("Open failed: %v", err)
+   }
+   if !f.Encrypted {
+      t.Error("expected encrypted file")
+   }
+   decrypted, err := f.Decrypt(keys)
+   if err != nil {
+      t.Fatalf("Decrypt failed: %v", err)
+   }
+   if !bytes.HasSuffix(decrypted, clear) {
+      t.Error("file was not decrypted")
+   }
+}
+
+func TestExtractSamples(t *testing.T) {
+   clear := [][]byte{[]byte("first sample"), []byte("second")}
+   segment := buildEncryptedSegment(t, clear)
+   samples, err := ExtractSamples(segment)
+   if err != nil {
+      t.Fatalf("ExtractSamples failed: %v", err)
+   }
+   if len(samples) != len(clear) {
+      t.Fatalf("expected %d samples, got %d", len(clear), len(samples))
+   }
+   for i, sample := range samples {
+      if sample.TrackID != 1 || sample.Encryption == nil {
+         t.Errorf("sample %d: unexpected %+v", i, sample)
+      }
+      if len(sample.Data) != len(clear[i]) || bytes.Equal(sample.Data, clear[i]) {
+         t.Errorf("sample %d: expected encrypted data of length %d", i, len(clear[i]))
+      }
+   }
+}
+
+func TestCheckIVReuse(t *testing.T) {
+   // buildEncryptedSegment numbers IVs from 1 in every segment, so the
+   // second segment repeats the IVs of the first.
+   first := buildEncryptedSegment(t, [][]byte{[]byte("a"), []byte("b")})
+   second := buildEncryptedSegment(t, [][]byte{[]byte("c")})
+   collisions := CheckIVReuse(nil, [][]byte{first, second}, 1)
+   if len(collisions) != 1 {
+      t.Fatalf("expected 1 collision, got %d", len(collisions))
+   }
+   collision := collisions[0]
+   if collision.FirstSegment != 0 || collision.FirstSample != 0 ||
+      collision.SecondSegment != 1 || collision.SecondSample != 0 {
+      t.Errorf("unexpected collision %+v", collision)
+   }
+   if collisions := CheckIVReuse(nil, [][]byte{first}, 1); len(collisions) != 0 {
+      t.Errorf("expected no collisions, got %+v", collisions)
+   }
+   if collisions := CheckIVReuse(nil, [][]byte{first, second}, 2); len(collisions) != 0 {
+      t.Errorf("expected no collisions for other track, got %+v", collisions)
+   }
+
+   // Read as 8 bytes, the zero second halves of these 16 byte IVs would
+   // collide; the tenc of the init segment gives the real size.
+   init := buildInitSegment(true)
+   init[bytes.Index(init, []byte("tenc"))+11] = 16
+   boxes, err := Parse(init)
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov, _ := FindMoov(boxes)
+   long := buildSegment(t, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}, 16, false)
+   if collisions := CheckIVReuse(moov, [][]byte{long}, 1); len(collisions) != 0 {
+      t.Errorf("expected no collisions for 16 byte IVs, got %+v", collisions)
+   }
+}
+
+func TestClearSegment(t *testing.T) {
+   clear := [][]byte{[]byte("first sample"), []byte("second sample")}
+   segment := buildEncryptedSegment(t, clear)
+   out, err := ClearSegment(segment, KeyMap{testKID: testKey})
+   if err != nil {
+      t.Fatalf("ClearSegment failed: %v", err)
+   }
+   boxes, err := Parse(out)
+   if err != nil {
+      t.Fatalf("Parse of clear segment failed: %v", err)
+   }
+   if len(boxes) != 2 || boxes[0].Moof == nil || boxes[1].Mdat == nil {
+      t.Fatalf("unexpected box structure: %+v", boxes)
+   }
+   traf := boxes[0].Moof.Traf
+   if traf.Senc != nil || len(traf.Sgpd) != 0 {
+      t.Error("encryption boxes were not removed")
+   }
+   // The data offset must still point at the first byte of mdat data.
+   dataOffset := int(traf.Trun[0].DataOffset)
+   if dataOffset != int(boxes[0].Moof.Header.Size)+8 {
+      t.Errorf("data offset %d does not point past moof of size %d", dataOffset, boxes[0].Moof.Header.Size)
+   }
+   if !bytes.Equal(out[dataOffset:], bytes.Join(clear, nil)) {
+      t.Errorf("clear mdat mismatch: %q", out[dataOffset:])
+   }
+}
+
+func TestShiftTraf_BaseDataOffset(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   traf := buildBox("traf",
+      buildBox("tfhd", []byte{0, 0, 0, 0x01}, u32(1), u64(1000)),
+      buildBox("trun", []byte{0, 0, 0, 0x01}, u32(0), u32(500)),
+   )
+   shiftTraf(traf, true, 40, 60)
+   var box TrafBox
+   if err := box.Parse(traf); err != nil {
+      t.Fatal(err)
+   }
+   if box.Tfhd.BaseDataOffset != 900 {
+      t.Errorf("expected base data offset 900, got %d", box.Tfhd.BaseDataOffset)
+   }
+   if box.Trun[0].DataOffset != 500 {
+      t.Errorf("expected unchanged data offset 500, got %d", box.Trun[0].DataOffset)
+   }
+}
+
+func TestSplitChunks(t *testing.T) {
+   styp := buildBox("styp", []byte("msdh"), []byte{0, 0, 0, 0}, []byte("msdhmsix"))
+   first := buildEncryptedSegment(t, [][]byte{[]byte("first chunk")})
+   second := buildEncryptedSegment(t, [][]byte{[]byte("second chunk")})
+   segment := slices.Concat(styp, first, second)
+
+   chunks, err := SplitChunks(segment)
+   if err != nil {
+      t.Fatalf("SplitChunks failed: %v", err)
+   }
+   if len(chunks) != 2 {
+      t.Fatalf("expected 2 chunks, got %d", len(chunks))
+   }
+   for i, expected := range [][]byte{slices.Concat(styp, first), slices.Concat(styp, second)} {
+      if !bytes.Equal(chunks[i], expected) {
+         t.Errorf("chunk %d mismatch\n  Expected: %x\n  Got:      %x", i, expected, chunks[i])
+      }
+   }
+
+   if _, err := SplitChunks(first[:len(first)-1]); err != ErrSizeMismatch {
+      t.Errorf("expected ErrSizeMismatch for truncated segment, got %v", err)
+   }
+   moof := first[:binary.BigEndian.Uint32(first)]
+   if _, err := SplitChunks(moof); err == nil {
+      t.Error("expected error for moof without mdat")
+   }
+}
+
+func TestDecryptFile(t *testing.T) {
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   fullBox := []byte{0, 0, 0, 0}
+   clear := [][]byte{[]byte("first progressive sample"), []byte("second")}
+
+   // The mdat holds the 8 byte IVs followed by the encrypted samples.
+   var auxInfo, media []byte
+   for i, sample := range clear {
+      iv := make([]byte, 16)
+      iv[7] = byte(i + 1)
+      auxInfo = append(auxInfo, iv[:8]...)
+      encrypted := make([]byte, len(sample))
+      cipher.NewCTR(block, iv).XORKeyStream(encrypted, sample)
+      media = append(media, encrypted...)
+   }
+   build := func(dataOffset uint32) []byte {
+      init := buildInitSegment(true,
+         buildBox("stts", fullBox, u32(0)),
+         buildBox("stsc", fullBox, u32(1), u32(1), u32(2), u32(1)),
+         buildBox("stsz", fullBox, u32(0), u32(2), u32(uint32(len(clear[0]))), u32(uint32(len(clear[1])))),
+         buildBox("stco", fullBox, u32(1), u32(dataOffset+uint32(len(auxInfo)))),
+         buildBox("saiz", fullBox, []byte{8}, u32(2)),
+         buildBox("saio", fullBox, u32(1), u32(dataOffset)),
+      )
+      return append(init, buildBox("mdat", auxInfo, media)...)
+   }
+   // The table sizes do not depend on the offsets, so measure then rebuild.
+   file := build(0)
+   file = build(uint32(len(file) - len(auxInfo) - len(media)))
+
+   var out bytes.Buffer
+   err = DecryptFile(bytes.NewReader(file), int64(len(file)), &out, KeyMap{testKID: testKey})
+   if err != nil {
+      t.Fatalf("DecryptFile failed: %v", err)
+   }
+   if expected := bytes.Join(clear, nil); !bytes.Equal(out.Bytes(), expected) {
+      t.Errorf("decrypted samples mismatch\n  Expected: %q\n  Got:      %q", expected, out.Bytes())
+   }
+   if err := DecryptFile(bytes.NewReader(file), int64(len(file)), &out, KeyMap{}); err == nil {
+      t.Error("expected error for missing key")
+   }
+}
+
+func TestDecryptFile_Schemes(t *testing.T) {
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   fullBox := []byte{0, 0, 0, 0}
+   clear := [][]byte{[]byte("first progressive cbcs sample"), []byte("second sample, two blocks long!!")}
+
+   // The mdat holds the 16 byte IVs followed by the samples, whose whole
+   // blocks are encrypted with AES-CBC.
+   var auxInfo, media []byte
+   for i, sample := range clear {
+      iv := bytes.Repeat([]byte{byte(i + 1)}, 16)
+      auxInfo = append(auxInfo, iv...)
+      encrypted := bytes.Clone(sample)
+      whole := len(sample) / 16 * 16
+      cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted[:whole], encrypted[:whole])
+      media = append(media, encrypted...)
+   }
+   build := func(scheme string, dataOffset uint32) []byte {
+      init := buildInitSegment(true,
+         buildBox("stts", fullBox, u32(0)),
+         buildBox("stsc", fullBox, u32(1), u32(1), u32(2), u32(1)),
+         buildBox("stsz", fullBox, u32(0), u32(2), u32(uint32(len(clear[0]))), u32(uint32(len(clear[1])))),
+         buildBox("stco", fullBox, u32(1), u32(dataOffset+uint32(len(auxInfo)))),
+         buildBox("saiz", fullBox, []byte{16}, u32(2)),
+         buildBox("saio", fullBox, u32(1), u32(dataOffset)),
+      )
+      init[bytes.Index(init, []byte("tenc"))+11] = 16
+      copy(init[bytes.Index(init, []byte("cenc")):], scheme)
+      return append(init, buildBox("mdat", auxInfo, media)...)
+   }
+   file := build("cbcs", 0)
+   file = build("cbcs", uint32(len(file)-len(auxInfo)-len(media)))
+   keys := KeyMap{testKID: testKey}
+   expected := bytes.Join(clear, nil)
+
+   var out bytes.Buffer
+   if err := DecryptFile(bytes.NewReader(file), int64(len(file)), &out, keys); err != nil {
+      t.Fatalf("DecryptFile failed: %v", err)
+   }
+   if !bytes.Equal(out.Bytes(), expected) {
+      t.Errorf("decrypted samples mismatch\n  Expected: %q\n  Got:      %q", expected, out.Bytes())
+   }
+   f, err := Open(file)
+   if err != nil {
+      t.Fatalf("Open failed: %v", err)
+   }
+   decrypted, err := f.Decrypt(keys)
+   if err != nil {
+      t.Fatalf("File.Decrypt failed: %v", err)
+   }
+   if !bytes.HasSuffix(decrypted, expected) {
+      t.Error("File.Decrypt did not decrypt the cbcs samples")
+   }
+
+   cens := build("cens", uint32(len(file)-len(auxInfo)-len(media)))
+   if err := DecryptFile(bytes.NewReader(cens), int64(len(cens)), io.Discard, keys); err == nil {
+      t.Error("expected error for the cens scheme")
+   }
+   if f, err := Open(cens); err != nil {
+      t.Fatalf("Open failed: %v", err)
+   } else if _, err := f.Decrypt(keys); err == nil {
+      t.Error("expected File.Decrypt error for the cens scheme")
+   }
+}
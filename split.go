@@ -0,0 +1,403 @@
+package sofia
+
+import (
+   "encoding/binary"
+   "errors"
+   "math"
+   "strconv"
+)
+
+// SplitTracks separates a multi-track file into one file per track ID. A
+// fragmented file becomes an init segment with a single trak and trex
+// followed by the moof/mdat pairs of that track, with each traf moved into
+// its own moof and its samples into their own mdat. A progressive file
+// becomes a single-track moov followed by an mdat holding the chunks of
+// that track.
+//
+// Indexes covering every track (sidx, ssix, mfra) are dropped, as are prft
+// boxes of other tracks. Progressive tracks with sample auxiliary
+// information are not supported, since their saio offsets point into the
+// shared mdat.
+func SplitTracks(data []byte) (map[uint32][]byte, error) {
+   boxes := childBoxes(data)
+   size := 0
+   for _, box := range boxes {
+      size += len(box)
+   }
+   if size != len(data) {
+      return nil, ErrSizeMismatch
+   }
+   moov, ok := findChild(boxes, "moov")
+   if !ok {
+      return nil, errors.New("no moov found")
+   }
+   var movie MoovBox
+   if err := movie.Parse(moov); err != nil {
+      return nil, err
+   }
+   if len(movie.Trak) == 0 {
+      return nil, errors.New("no trak found")
+   }
+   if _, ok := findChild(movie.RawChildren, "mvex"); ok {
+      return splitFragmented(data, boxes, movie.Trak, movie.Mvex)
+   }
+   return splitProgressive(data, boxes, movie.Trak)
+}
+
+// containerBox returns a box of the given type holding children.
+func containerBox(boxType string, children [][]byte) []byte {
+   size := 8
+   for _, child := range children {
+      size += len(child)
+   }
+   box := make([]byte, 8, size)
+   for _, child := range children {
+      box = append(box, child...)
+   }
+   binary.BigEndian.PutUint32(box, uint32(len(box)))
+   copy(box[4:8], boxType)
+   return box
+}
+
+// splitMoov returns a moov holding only the trak and trex of trackID.
+func splitMoov(moov []byte, trackID uint32) ([]byte, error) {
+   var children [][]byte
+   for _, child := range childBoxes(moov[8:]) {
+      switch string(child[4:8]) {
+      case "trak":
+         var trak TrakBox
+         if err := trak.Parse(child); err != nil {
+            return nil, err
+         }
+         if trak.TrackID() != trackID {
+            continue
+         }
+      case "mvex":
+         var kept [][]byte
+         for _, grandchild := range childBoxes(child[8:]) {
+            // track_ID follows the full box header
+            if string(grandchild[4:8]) == "trex" && len(grandchild) >= 16 &&
+               binary.BigEndian.Uint32(grandchild[12:]) != trackID {
+               continue
+            }
+            kept = append(kept, grandchild)
+         }
+         child = containerBox("mvex", kept)
+      }
+      children = append(children, child)
+   }
+   return containerBox("moov", children), nil
+}
+
+func splitFragmented(data []byte, boxes [][]byte, traks []*TrakBox, mvex *MvexBox) (map[uint32][]byte, error) {
+   out := make(map[uint32][]byte, len(traks))
+   offset := 0
+   for _, box := range boxes {
+      switch string(box[4:8]) {
+      case "moov":
+         for _, trak := range traks {
+            moov, err := splitMoov(box, trak.TrackID())
+            if err != nil {
+               return nil, err
+            }
+            out[trak.TrackID()] = append(out[trak.TrackID()], moov...)
+         }
+      case "moof":
+         if err := splitMoof(data, offset, box, mvex, out); err != nil {
+            return nil, err
+         }
+      case "mdat", "sidx", "ssix", "mfra":
+         // samples are copied along with their moof
+      case "prft":
+         // reference_track_ID follows the full box header
+         if len(box) >= 16 {
+            trackID := binary.BigEndian.Uint32(box[12:])
+            if _, ok := out[trackID]; ok {
+               out[trackID] = append(out[trackID], box...)
+            }
+         }
+      default:
+         for _, trak := range traks {
+            out[trak.TrackID()] = append(out[trak.TrackID()], box...)
+         }
+      }
+      offset += len(box)
+   }
+   return out, nil
+}
+
+// dataRun is the byte range of the samples of one trun in the input.
+type dataRun struct {
+   start, size uint64
+}
+
+// splitMoof appends a moof/mdat pair for every traf of the moof at
+// moofStart to the output of its track. mvex supplies the trex sample size
+// defaults.
+func splitMoof(data []byte, moofStart int, moof []byte, mvex *MvexBox, out map[uint32][]byte) error {
+   children := childBoxes(moof[8:])
+   var previousEnd uint64
+   first := true
+   for i, child := range children {
+      if string(child[4:8]) != "traf" {
+         continue
+      }
+      var traf TrafBox
+      if err := traf.Parse(child); err != nil {
+         return err
+      }
+      if traf.Tfhd == nil {
+         return errors.New("traf without tfhd")
+      }
+      // The data of a traf without an explicit base follows the data of
+      // the traf before it.
+      base := uint64(moofStart)
+      switch {
+      case traf.Tfhd.Flags&0x000001 != 0:
+         base = traf.Tfhd.BaseDataOffset
+      case !traf.Tfhd.DefaultBaseIsMoof() && !first:
+         base = previousEnd
+      }
+      first = false
+
+      sizes, err := traf.sampleSizes(mvex)
+      if err != nil {
+         return err
+      }
+      runs := make([]dataRun, 0, len(traf.Trun))
+      position := base
+      for _, trun := range traf.Trun {
+         if trun.Flags&0x000001 != 0 {
+            position = base + uint64(int64(trun.DataOffset))
+         }
+         var size uint64
+         for _, sampleSize := range sizes[:len(trun.Samples)] {
+            size += uint64(sampleSize)
+         }
+         sizes = sizes[len(trun.Samples):]
+         if position+size > uint64(len(data)) {
+            return errors.New("trun data extends past end of file")
+         }
+         runs = append(runs, dataRun{position, size})
+         position += size
+      }
+      previousEnd = position
+
+      trackID := traf.Tfhd.TrackID
+      if _, ok := out[trackID]; !ok {
+         return errors.New("traf for unknown track " + strconv.FormatUint(uint64(trackID), 10))
+      }
+      trafStart := uint64(moofStart) + 8
+      for _, sibling := range children[:i] {
+         trafStart += uint64(len(sibling))
+      }
+      fragment, err := splitTraf(data, children, i, trafStart, base, runs, uint64(len(out[trackID])))
+      if err != nil {
+         return err
+      }
+      out[trackID] = append(out[trackID], fragment...)
+   }
+   return nil
+}
+
+// splitTraf returns a moof holding the moof children other than trafs and
+// the traf at index, followed by an mdat with its runs. The tfhd base data
+// offset, trun data offsets and saio offsets are rewritten for a moof
+// starting at moofStart in the output.
+func splitTraf(data []byte, children [][]byte, index int, trafStart, base uint64, runs []dataRun, moofStart uint64) ([]byte, error) {
+   var kept [][]byte
+   var newTrafStart uint64
+   moofSize := uint64(8)
+   for i, child := range children {
+      if i == index {
+         newTrafStart = moofStart + moofSize
+      } else if string(child[4:8]) == "traf" {
+         continue
+      }
+      kept = append(kept, child)
+      moofSize += uint64(len(child))
+   }
+   moof := containerBox("moof", kept)
+   traf := moof[newTrafStart-moofStart:][:len(children[index])]
+   dataStart := moofStart + moofSize + 8
+
+   // Every offset of the new traf is relative to the new moof.
+   runIndex := 0
+   var runOffset uint64
+   for _, child := range childBoxes(traf[8:]) {
+      switch string(child[4:8]) {
+      case "tfhd":
+         if child[11]&0x01 != 0 && len(child) >= 24 { // base-data-offset-present
+            binary.BigEndian.PutUint64(child[16:], moofStart)
+         }
+      case "trun":
+         if child[11]&0x01 != 0 && len(child) >= 20 { // data-offset-present
+            offset := dataStart + runOffset - moofStart
+            if offset > math.MaxInt32 {
+               return nil, errors.New("trun data offset overflows")
+            }
+            binary.BigEndian.PutUint32(child[16:], uint32(offset))
+         } else if runIndex == 0 {
+            return nil, errors.New("first trun without data offset")
+         }
+         if runIndex < len(runs) {
+            runOffset += runs[runIndex].size
+         }
+         runIndex++
+      case "saio":
+         if err := splitSaio(child, trafStart, base, uint64(len(traf)), newTrafStart, moofStart); err != nil {
+            return nil, err
+         }
+      }
+   }
+
+   mdat := make([]byte, 8, 8+runOffset)
+   for _, run := range runs {
+      mdat = append(mdat, data[run.start:run.start+run.size]...)
+   }
+   if uint64(len(mdat)) > math.MaxUint32 {
+      return nil, errors.New("mdat too large")
+   }
+   binary.BigEndian.PutUint32(mdat, uint32(len(mdat)))
+   copy(mdat[4:8], "mdat")
+   return append(moof, mdat...), nil
+}
+
+// splitSaio rewrites saio offsets that point into the traf, as they do
+// when the aux info is the payload of a senc box, for the traf moving to
+// newTrafStart and the base moving to newBase.
+func splitSaio(saio []byte, trafStart, base, trafSize, newTrafStart, newBase uint64) error {
+   if len(saio) < 16 {
+      return errors.New("saio too short")
+   }
+   version := saio[8]
+   offset := 12
+   if saio[11]&0x01 != 0 { // aux_info_type present
+      offset += 8
+   }
+   if len(saio) < offset+4 {
+      return errors.New("saio too short")
+   }
+   count := int(binary.BigEndian.Uint32(saio[offset:]))
+   offset += 4
+   width := 4
+   if version == 1 {
+      width = 8
+   }
+   if (len(saio)-offset)/width < count {
+      return errors.New("saio box too short for declared entries")
+   }
+   for i := 0; i < count; i++ {
+      entry := saio[offset+i*width:]
+      var old uint64
+      if version == 1 {
+         old = binary.BigEndian.Uint64(entry)
+      } else {
+         old = uint64(binary.BigEndian.Uint32(entry))
+      }
+      absolute := base + old
+      if absolute < trafStart || absolute >= trafStart+trafSize {
+         return errors.New("sample auxiliary information outside the traf is not supported")
+      }
+      moved := newTrafStart + (absolute - trafStart) - newBase
+      if version == 1 {
+         binary.BigEndian.PutUint64(entry, moved)
+      } else {
+         binary.BigEndian.PutUint32(entry, uint32(moved))
+      }
+   }
+   return nil
+}
+
+// findPath returns the descendant of box reached by following boxTypes.
+func findPath(box []byte, boxTypes ...string) ([]byte, bool) {
+   for _, boxType := range boxTypes {
+      child, ok := findChild(childBoxes(box[8:]), boxType)
+      if !ok {
+         return nil, false
+      }
+      box = child
+   }
+   return box, true
+}
+
+func splitProgressive(data []byte, boxes [][]byte, traks []*TrakBox) (map[uint32][]byte, error) {
+   out := make(map[uint32][]byte, len(traks))
+   for _, trak := range traks {
+      trackID := trak.TrackID()
+      if trak.Mdia == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil {
+         return nil, errors.New("trak without stbl")
+      }
+      stbl := trak.Mdia.Minf.Stbl
+      if stbl.Saio != nil {
+         return nil, errors.New("splitting progressive tracks with saio is not supported")
+      }
+      locations, chunkCounts, err := stbl.sampleIndex()
+      if err != nil {
+         return nil, err
+      }
+      chunks := make([]dataRun, 0, len(chunkCounts))
+      sample := 0
+      for _, count := range chunkCounts {
+         var chunk dataRun
+         if count > 0 {
+            chunk.start = locations[sample].Offset
+         }
+         for _, location := range locations[sample : sample+int(count)] {
+            chunk.size += uint64(location.Size)
+         }
+         if chunk.start+chunk.size > uint64(len(data)) {
+            return nil, errors.New("chunk extends past end of file")
+         }
+         chunks = append(chunks, chunk)
+         sample += int(count)
+      }
+
+      var file []byte
+      moovStart := -1
+      for _, box := range boxes {
+         switch string(box[4:8]) {
+         case "mdat", "free", "skip":
+            continue
+         case "moov":
+            moov, err := splitMoov(box, trackID)
+            if err != nil {
+               return nil, err
+            }
+            moovStart = len(file)
+            box = moov
+         }
+         file = append(file, box...)
+      }
+      // The offsets are rewritten in place once the mdat position is known.
+      chunkOffsets, ok := findPath(file[moovStart:], "trak", "mdia", "minf", "stbl", "co64")
+      if !ok {
+         chunkOffsets, ok = findPath(file[moovStart:], "trak", "mdia", "minf", "stbl", "stco")
+      }
+      if !ok {
+         return nil, errors.New("missing stco or co64")
+      }
+
+      offset := uint64(len(file)) + 8
+      mdat := make([]byte, 8)
+      for i, chunk := range chunks {
+         if string(chunkOffsets[4:8]) == "co64" {
+            binary.BigEndian.PutUint64(chunkOffsets[16+8*i:], offset)
+         } else {
+            if offset > math.MaxUint32 {
+               return nil, errors.New("chunk offset overflows stco")
+            }
+            binary.BigEndian.PutUint32(chunkOffsets[16+4*i:], uint32(offset))
+         }
+         mdat = append(mdat, data[chunk.start:chunk.start+chunk.size]...)
+         offset += chunk.size
+      }
+      if uint64(len(mdat)) > math.MaxUint32 {
+         return nil, errors.New("mdat too large")
+      }
+      binary.BigEndian.PutUint32(mdat, uint32(len(mdat)))
+      copy(mdat[4:8], "mdat")
+      out[trackID] = append(file, mdat...)
+   }
+   return out, nil
+}
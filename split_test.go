@@ -0,0 +1,187 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+// buildTwoTrackMoov returns a moov holding the traks of two single-track
+// init segments, the second renumbered as track 2, with a trex per track if
+// fragmented is true.
+func buildTwoTrackMoov(first, second []byte, fragmented bool) []byte {
+   trak := func(init []byte) [][]byte {
+      moov, _ := findChild(childBoxes(init), "moov")
+      children := childBoxes(moov[8:])
+      return children[:2] // mvhd and trak
+   }
+   one, two := trak(first), trak(second)
+   two[1] = bytes.Clone(two[1])
+   binary.BigEndian.PutUint32(two[1][8+20:], 2) // tkhd track_ID
+   children := [][]byte{one[0], one[1], two[1]}
+   if fragmented {
+      u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+      trex := func(trackID uint32) []byte {
+         return buildBox("trex", []byte{0, 0, 0, 0}, u32(trackID), u32(1), u32(0), u32(0), u32(0))
+      }
+      children = append(children, buildBox("mvex", trex(1), trex(2)))
+   }
+   return buildBox("moov", children...)
+}
+
+func TestSplitTracks_Fragmented(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   init := buildInitSegment(false)
+   moov := buildTwoTrackMoov(init, init, true)
+   traf := func(trackID uint32, sizes ...uint32) []byte {
+      trun := append([]byte{0, 0, 0x02, 0x01}, u32(uint32(len(sizes)))...)
+      trun = append(trun, u32(0)...) // data_offset, patched below
+      for _, size := range sizes {
+         trun = append(trun, u32(size)...)
+      }
+      return buildBox("traf", buildBox("tfhd", []byte{0, 0x02, 0, 0}, u32(trackID)), buildBox("trun", trun))
+   }
+   first, second := traf(1, 3), traf(2, 2, 2)
+   moof := buildBox("moof", buildBox("mfhd", []byte{0, 0, 0, 0}, u32(1)), first, second)
+   // moof(8) mfhd(16) traf(8) tfhd(16) trun(8) version/flags(4) count(4)
+   binary.BigEndian.PutUint32(moof[64:], uint32(len(moof)+8))
+   binary.BigEndian.PutUint32(moof[64+len(first):], uint32(len(moof)+8+3))
+   ftyp, _ := findChild(childBoxes(init), "ftyp")
+   file := bytes.Join([][]byte{ftyp, moov, moof, buildBox("mdat", []byte("aaabbcc"))}, nil)
+
+   tracks, err := SplitTracks(file)
+   if err != nil {
+      t.Fatalf("SplitTracks failed: %v", err)
+   }
+   if len(tracks) != 2 {
+      t.Fatalf("expected 2 tracks, got %d", len(tracks))
+   }
+   for trackID, expected := range map[uint32]string{1: "aaa", 2: "bbcc"} {
+      boxes, err := Parse(tracks[trackID])
+      if err != nil {
+         t.Fatalf("track %d: Parse failed: %v", trackID, err)
+      }
+      if len(boxes) != 4 || boxes[1].Moov == nil || boxes[2].Moof == nil || boxes[3].Mdat == nil {
+         t.Fatalf("track %d: unexpected box structure %+v", trackID, boxes)
+      }
+      if len(boxes[1].Moov.Trak) != 1 || boxes[1].Moov.Trak[0].TrackID() != trackID {
+         t.Errorf("track %d: moov should hold only its own trak", trackID)
+      }
+      mvex, _ := findChild(boxes[1].Moov.RawChildren, "mvex")
+      if len(childBoxes(mvex[8:])) != 1 {
+         t.Errorf("track %d: mvex should hold only its own trex", trackID)
+      }
+      moof := boxes[2].Moof
+      if moof.Traf.Tfhd.TrackID != trackID {
+         t.Errorf("track %d: unexpected traf for track %d", trackID, moof.Traf.Tfhd.TrackID)
+      }
+      if offset := int(moof.Traf.Trun[0].DataOffset); offset != int(moof.Header.Size)+8 {
+         t.Errorf("track %d: data offset %d does not point past moof", trackID, offset)
+      }
+      if payload := string(boxes[3].Mdat.Payload); payload != expected {
+         t.Errorf("track %d: expected mdat %q, got %q", trackID, expected, payload)
+      }
+   }
+}
+
+func TestSplitTracks_TrexDefaults(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   init := buildInitSegment(false)
+   ftyp, _ := findChild(childBoxes(init), "ftyp")
+   // the truns carry no sample sizes, leaving them to trex
+   traf := func(trackID, count uint32) []byte {
+      trun := append([]byte{0, 0, 0, 0x01}, u32(count)...)
+      trun = append(trun, u32(0)...) // data_offset, patched below
+      return buildBox("traf", buildBox("tfhd", []byte{0, 0x02, 0, 0}, u32(trackID)), buildBox("trun", trun))
+   }
+   first, second := traf(1, 1), traf(2, 2)
+   moof := buildBox("moof", buildBox("mfhd", []byte{0, 0, 0, 0}, u32(1)), first, second)
+   binary.BigEndian.PutUint32(moof[64:], uint32(len(moof)+8))
+   binary.BigEndian.PutUint32(moof[64+len(first):], uint32(len(moof)+8+3))
+   file := func(trex ...[]byte) []byte {
+      children := childBoxes(buildTwoTrackMoov(init, init, false)[8:])
+      moov := buildBox("moov", append(children, buildBox("mvex", trex...))...)
+      return bytes.Join([][]byte{ftyp, moov, moof, buildBox("mdat", []byte("aaabbcc"))}, nil)
+   }
+   trex := func(trackID, size uint32) []byte {
+      return buildBox("trex", []byte{0, 0, 0, 0}, u32(trackID), u32(1), u32(1000), u32(size), u32(0))
+   }
+
+   tracks, err := SplitTracks(file(trex(1, 3), trex(2, 2)))
+   if err != nil {
+      t.Fatalf("SplitTracks failed: %v", err)
+   }
+   for trackID, expected := range map[uint32]string{1: "aaa", 2: "bbcc"} {
+      boxes, err := Parse(tracks[trackID])
+      if err != nil {
+         t.Fatalf("track %d: Parse failed: %v", trackID, err)
+      }
+      if len(boxes) != 4 || boxes[3].Mdat == nil || string(boxes[3].Mdat.Payload) != expected {
+         t.Errorf("track %d: expected mdat %q, got %+v", trackID, expected, boxes)
+      }
+   }
+
+   if _, err := SplitTracks(file(trex(1, 3))); err == nil {
+      t.Error("expected error for a sample size given by neither tfhd nor trex")
+   }
+}
+
+func TestSplitTracks_Progressive(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   fullBox := []byte{0, 0, 0, 0}
+   tables := func(offsets []uint32, sizes ...uint32) []byte {
+      stsz := append(u32(0), u32(uint32(len(sizes)))...)
+      for _, size := range sizes {
+         stsz = append(stsz, u32(size)...)
+      }
+      stco := u32(uint32(len(offsets)))
+      for _, offset := range offsets {
+         stco = append(stco, u32(offset)...)
+      }
+      return buildInitSegment(false,
+         buildBox("stts", fullBox, u32(0)),
+         buildBox("stsc", fullBox, u32(1), u32(1), u32(1), u32(1)),
+         buildBox("stsz", fullBox, stsz),
+         buildBox("stco", fullBox, stco),
+      )
+   }
+   // The media is interleaved as aaa, xx, bbb.
+   build := func(mdatStart uint32) []byte {
+      first := tables([]uint32{mdatStart + 8, mdatStart + 13}, 3, 3)
+      second := tables([]uint32{mdatStart + 11}, 2)
+      ftyp, _ := findChild(childBoxes(first), "ftyp")
+      moov := buildTwoTrackMoov(first, second, false)
+      return bytes.Join([][]byte{ftyp, moov, buildBox("mdat", []byte("aaaxxbbb"))}, nil)
+   }
+   file := build(0)
+   file = build(uint32(len(file) - 16))
+
+   tracks, err := SplitTracks(file)
+   if err != nil {
+      t.Fatalf("SplitTracks failed: %v", err)
+   }
+   for trackID, expected := range map[uint32][]string{1: {"aaa", "bbb"}, 2: {"xx"}} {
+      boxes, err := Parse(tracks[trackID])
+      if err != nil {
+         t.Fatalf("track %d: Parse failed: %v", trackID, err)
+      }
+      moov, ok := FindMoov(boxes)
+      if !ok || len(moov.Trak) != 1 {
+         t.Fatalf("track %d: expected a single-track moov", trackID)
+      }
+      index, err := moov.Trak[0].Mdia.Minf.Stbl.SampleIndex()
+      if err != nil {
+         t.Fatalf("track %d: SampleIndex failed: %v", trackID, err)
+      }
+      if len(index) != len(expected) {
+         t.Fatalf("track %d: expected %d samples, got %d", trackID, len(expected), len(index))
+      }
+      out := tracks[trackID]
+      for i, location := range index {
+         sample := string(out[location.Offset : location.Offset+uint64(location.Size)])
+         if sample != expected[i] {
+            t.Errorf("track %d sample %d: expected %q, got %q", trackID, i, expected[i], sample)
+         }
+      }
+   }
+}
@@ -2,25 +2,43 @@ package sofia
 
 import (
    "errors"
+   "io"
 )
 
 // --- STBL ---
 type StblBox struct {
    Header      BoxHeader
    Stsd        *StsdBox
+   Saiz        *SaizBox
+   Saio        *SaioBox
+   Subs        *SubsBox
+   Padb        *PadbBox
+   Stdp        *StdpBox
+   Sbgp        []*SbgpBox
+   Sgpd        []*SgpdBox
    RawChildren [][]byte
 }
 
+// SampleGroups returns the sbgp/sgpd pair for a grouping type such as
+// "seig" or "roll".
+func (b *StblBox) SampleGroups(groupingType string) (*SbgpBox, *SgpdBox, bool) {
+   return findSampleGroup(b.Sbgp, b.Sgpd, groupingType)
+}
+
 func (b *StblBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *StblBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
 
-   payload := data[8:b.Header.Size]
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -35,10 +53,52 @@ func (b *StblBox) Parse(data []byte) error {
       switch string(header.Type[:]) {
       case "stsd":
          var stsd StsdBox
-         if err := stsd.Parse(content); err != nil {
+         if err := stsd.parse(content, opts); err != nil {
             return err
          }
          b.Stsd = &stsd
+      case "saiz":
+         var saiz SaizBox
+         if err := saiz.Parse(content); err != nil {
+            return err
+         }
+         b.Saiz = &saiz
+      case "saio":
+         var saio SaioBox
+         if err := saio.Parse(content); err != nil {
+            return err
+         }
+         b.Saio = &saio
+      case "subs":
+         var subs SubsBox
+         if err := subs.Parse(content); err != nil {
+            return err
+         }
+         b.Subs = &subs
+      case "padb":
+         var padb PadbBox
+         if err := padb.Parse(content); err != nil {
+            return err
+         }
+         b.Padb = &padb
+      case "stdp":
+         var stdp StdpBox
+         if err := stdp.Parse(content); err != nil {
+            return err
+         }
+         b.Stdp = &stdp
+      case "sbgp":
+         var sbgp SbgpBox
+         if err := sbgp.Parse(content); err != nil {
+            return err
+         }
+         b.Sbgp = append(b.Sbgp, &sbgp)
+      case "sgpd":
+         var sgpd SgpdBox
+         if err := sgpd.Parse(content); err != nil {
+            return err
+         }
+         b.Sgpd = append(b.Sgpd, &sgpd)
       default:
          b.RawChildren = append(b.RawChildren, content)
       }
@@ -55,11 +115,327 @@ func (b *StblBox) Encode() []byte {
    for _, child := range b.RawChildren {
       buffer = append(buffer, child...)
    }
-   b.Header.Size = uint32(len(buffer))
+   if b.Padb != nil {
+      buffer = append(buffer, b.Padb.Encode()...)
+   }
+   if b.Stdp != nil {
+      buffer = append(buffer, b.Stdp.Encode()...)
+   }
+   if b.Subs != nil {
+      buffer = append(buffer, b.Subs.Encode()...)
+   }
+   for _, sbgp := range b.Sbgp {
+      buffer = append(buffer, sbgp.Encode()...)
+   }
+   for _, sgpd := range b.Sgpd {
+      buffer = append(buffer, sgpd.Encode()...)
+   }
+   if b.Saiz != nil {
+      buffer = append(buffer, b.Saiz.Encode()...)
+   }
+   if b.Saio != nil {
+      buffer = append(buffer, b.Saio.Encode()...)
+   }
+   b.Header.Size = uint64(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *StblBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// SampleLocation is the position of a sample in the file.
+type SampleLocation struct {
+   Offset uint64
+   Size   uint32
+}
+
+// SampleIndex computes the file offset and size of every sample from the
+// stsz, stsc and stco/co64 tables.
+func (b *StblBox) SampleIndex() ([]SampleLocation, error) {
+   index, _, err := b.sampleIndex()
+   return index, err
+}
+
+// sampleIndex is SampleIndex that also returns the number of samples in
+// each chunk.
+func (b *StblBox) sampleIndex() ([]SampleLocation, []uint32, error) {
+   var stsz StszBox
+   data, ok := findChild(b.RawChildren, "stsz")
+   if !ok {
+      return nil, nil, errors.New("missing stsz")
+   }
+   if err := stsz.Parse(data); err != nil {
+      return nil, nil, err
+   }
+   var stsc StscBox
+   data, ok = findChild(b.RawChildren, "stsc")
+   if !ok {
+      return nil, nil, errors.New("missing stsc")
+   }
+   if err := stsc.Parse(data); err != nil {
+      return nil, nil, err
+   }
+   var chunkOffsets []uint64
+   if data, ok := findChild(b.RawChildren, "co64"); ok {
+      var co64 Co64Box
+      if err := co64.Parse(data); err != nil {
+         return nil, nil, err
+      }
+      chunkOffsets = co64.Offsets
+   } else if data, ok := findChild(b.RawChildren, "stco"); ok {
+      var stco StcoBox
+      if err := stco.Parse(data); err != nil {
+         return nil, nil, err
+      }
+      for _, offset := range stco.Offsets {
+         chunkOffsets = append(chunkOffsets, uint64(offset))
+      }
+   } else {
+      return nil, nil, errors.New("missing stco or co64")
+   }
+
+   sampleCount := int(stsz.SampleCount)
+   index := make([]SampleLocation, 0, min(sampleCount, 1<<16))
+   chunkCounts := make([]uint32, 0, len(chunkOffsets))
+   entry := 0
+   for chunk, offset := range chunkOffsets {
+      // stsc runs apply from their first_chunk (one-based) onwards
+      for entry+1 < len(stsc.Entries) && int(stsc.Entries[entry+1].FirstChunk) <= chunk+1 {
+         entry++
+      }
+      if len(stsc.Entries) == 0 {
+         break
+      }
+      var count uint32
+      for ; count < stsc.Entries[entry].SamplesPerChunk && len(index) < sampleCount; count++ {
+         size := stsz.Size(len(index))
+         index = append(index, SampleLocation{offset, size})
+         offset += uint64(size)
+      }
+      chunkCounts = append(chunkCounts, count)
+   }
+   if len(index) < sampleCount {
+      return nil, nil, errors.New("chunk tables cover fewer samples than stsz")
+   }
+   return index, chunkCounts, nil
+}
+
+// --- SUBS ---
+type SubsSubsample struct {
+   SubsampleSize           uint32
+   SubsamplePriority       byte
+   Discardable             byte
+   CodecSpecificParameters uint32
+}
+
+type SubsEntry struct {
+   SampleDelta uint32
+   Subsamples  []SubsSubsample
+}
+
+type SubsBox struct {
+   Header  BoxHeader
+   Version byte
+   Flags   uint32
+   Entries []SubsEntry
+}
+
+func (b *SubsBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 { // 8 header + 4 version/flags + 4 count
+      return errors.New("subs box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   entryCount := p.Uint32()
+   subsampleSize := 8 // size(2) + priority(1) + discardable(1) + params(4)
+   if b.Version == 1 {
+      subsampleSize = 10
+   }
+   if uint64(len(data)-p.offset) < uint64(entryCount)*6 {
+      return errors.New("subs box too short for declared entries")
+   }
+
+   b.Entries = make([]SubsEntry, entryCount)
+   for i := range b.Entries {
+      if len(data) < p.offset+6 {
+         return errors.New("subs truncated while reading entry")
+      }
+      b.Entries[i].SampleDelta = p.Uint32()
+      subsampleCount := int(p.Uint16())
+      if len(data)-p.offset < subsampleCount*subsampleSize {
+         return errors.New("subs truncated while reading subsamples")
+      }
+      b.Entries[i].Subsamples = make([]SubsSubsample, subsampleCount)
+      for j := range b.Entries[i].Subsamples {
+         subsample := &b.Entries[i].Subsamples[j]
+         if b.Version == 1 {
+            subsample.SubsampleSize = p.Uint32()
+         } else {
+            subsample.SubsampleSize = uint32(p.Uint16())
+         }
+         subsample.SubsamplePriority = p.Byte()
+         subsample.Discardable = p.Byte()
+         subsample.CodecSpecificParameters = p.Uint32()
+      }
+   }
+   return nil
+}
+
+func (b *SubsBox) Encode() []byte {
+   subsampleSize := 8
+   if b.Version == 1 {
+      subsampleSize = 10
+   }
+   size := 16
+   for _, entry := range b.Entries {
+      size += 6 + len(entry.Subsamples)*subsampleSize
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   w.PutUint32(uint32(len(b.Entries)))
+   for _, entry := range b.Entries {
+      w.PutUint32(entry.SampleDelta)
+      w.PutUint16(uint16(len(entry.Subsamples)))
+      for _, subsample := range entry.Subsamples {
+         if b.Version == 1 {
+            w.PutUint32(subsample.SubsampleSize)
+         } else {
+            w.PutUint16(uint16(subsample.SubsampleSize))
+         }
+         w.PutByte(subsample.SubsamplePriority)
+         w.PutByte(subsample.Discardable)
+         w.PutUint32(subsample.CodecSpecificParameters)
+      }
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'s', 'u', 'b', 's'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *SubsBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// --- PADB ---
+type PadbBox struct {
+   Header      BoxHeader
+   Version     byte
+   Flags       uint32
+   SampleCount uint32
+   Entries     []byte // two samples per byte, as stored
+}
+
+func (b *PadbBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 {
+      return errors.New("padb box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.SampleCount = p.Uint32()
+   size := (uint64(b.SampleCount) + 1) / 2
+   if uint64(len(data)-p.offset) < size {
+      return errors.New("padb box too short for declared samples")
+   }
+   b.Entries = p.Bytes(int(size))
+   return nil
+}
+
+// Pad returns the number of padding bits of sample i (zero-based).
+func (b *PadbBox) Pad(i int) byte {
+   if i < 0 || i/2 >= len(b.Entries) {
+      return 0
+   }
+   if i%2 == 0 {
+      return b.Entries[i/2] >> 4 & 0x07
+   }
+   return b.Entries[i/2] & 0x07
+}
+
+func (b *PadbBox) Encode() []byte {
+   size := 16 + len(b.Entries)
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   w.PutUint32(b.SampleCount)
+   w.PutBytes(b.Entries)
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'p', 'a', 'd', 'b'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *PadbBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// --- STDP ---
+type StdpBox struct {
+   Header     BoxHeader
+   Version    byte
+   Flags      uint32
+   Priorities []uint16 // one per sample, the count comes from the box size
+}
+
+func (b *StdpBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 12 {
+      return errors.New("stdp box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.Priorities = make([]uint16, (len(data)-p.offset)/2)
+   for i := range b.Priorities {
+      b.Priorities[i] = p.Uint16()
+   }
+   return nil
+}
+
+func (b *StdpBox) Encode() []byte {
+   size := 12 + len(b.Priorities)*2
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   for _, priority := range b.Priorities {
+      w.PutUint16(priority)
+   }
+
+   b.Header.Size = uint64(size)
+   b.Header.Type = [4]byte{'s', 't', 'd', 'p'}
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *StdpBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 // --- STTS ---
 type SttsEntry struct {
    SampleCount    uint32
@@ -83,12 +459,17 @@ func (b *SttsBox) Encode() []byte {
       w.PutUint32(entry.SampleDuration)
    }
 
-   b.Header.Size = uint32(size)
+   b.Header.Size = uint64(size)
    b.Header.Type = [4]byte{'s', 't', 't', 's'}
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *SttsBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 func buildStts(samples []RemuxSample) []byte {
    if len(samples) == 0 {
       return nil
@@ -118,27 +499,88 @@ type CttsEntry struct {
 
 type CttsBox struct {
    Header  BoxHeader
+   Version byte
    Entries []CttsEntry
 }
 
+func (b *CttsBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 {
+      return errors.New("ctts box too short")
+   }
+   p := parser{data: data, offset: 8}
+   b.Version = byte(p.Uint32() >> 24)
+   entryCount := p.Uint32()
+   if uint64(len(data)-p.offset) < uint64(entryCount)*8 {
+      return errors.New("ctts box too short for declared entries")
+   }
+   b.Entries = make([]CttsEntry, entryCount)
+   for i := range b.Entries {
+      b.Entries[i].SampleCount = p.Uint32()
+      b.Entries[i].SampleOffset = p.Int32()
+   }
+   return nil
+}
+
+// SampleOffset returns the offset of entry i, unsigned for version 0 and
+// signed for version 1.
+func (b *CttsBox) SampleOffset(i int) int64 {
+   if b.Version == 0 {
+      return int64(uint32(b.Entries[i].SampleOffset))
+   }
+   return int64(b.Entries[i].SampleOffset)
+}
+
+// MinOffset returns the smallest composition offset, which is negative when
+// version 1 offsets reorder frames ahead of their decode time.
+func (b *CttsBox) MinOffset() int64 {
+   if len(b.Entries) == 0 {
+      return 0
+   }
+   minOffset := b.SampleOffset(0)
+   for i := range b.Entries {
+      minOffset = min(minOffset, b.SampleOffset(i))
+   }
+   return minOffset
+}
+
 func (b *CttsBox) Encode() []byte {
    size := 16 + len(b.Entries)*8
    buffer := make([]byte, size)
    w := writer{buf: buffer}
-   w.offset = 8   // Skip header
-   w.PutUint32(0) // Version 0, Flags 0
+   w.offset = 8 // Skip header
+   w.PutUint32(uint32(b.Version) << 24)
    w.PutUint32(uint32(len(b.Entries)))
    for _, entry := range b.Entries {
       w.PutUint32(entry.SampleCount)
       w.PutUint32(uint32(entry.SampleOffset))
    }
 
-   b.Header.Size = uint32(size)
+   b.Header.Size = uint64(size)
    b.Header.Type = [4]byte{'c', 't', 't', 's'}
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *CttsBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// PresentationTime returns decodeTime plus a composition offset, less
+// shift, clamped at zero. shift is usually the edit list media_time or,
+// when offsets can be negative, the cslg compositionToDTSShift or
+// MinOffset, so that the first frame presents at or after zero.
+func PresentationTime(decodeTime uint64, offset int64, shift int64) uint64 {
+   pts := int64(decodeTime) + offset - shift
+   if pts < 0 {
+      return 0
+   }
+   return uint64(pts)
+}
+
 func buildCtts(samples []RemuxSample) []byte {
    hasCTO := false
    for _, sample := range samples {
@@ -168,6 +610,12 @@ func buildCtts(samples []RemuxSample) []byte {
    }
 
    box := CttsBox{Entries: entries}
+   for _, entry := range entries {
+      if entry.SampleOffset < 0 {
+         box.Version = 1 // signed offsets
+         break
+      }
+   }
    return box.Encode()
 }
 
@@ -179,6 +627,41 @@ type StszBox struct {
    EntrySizes  []uint32
 }
 
+func (b *StszBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 20 {
+      return errors.New("stsz box too short")
+   }
+   p := parser{data: data, offset: 12}
+   b.SampleSize = p.Uint32()
+   b.SampleCount = p.Uint32()
+   if b.SampleSize != 0 {
+      return nil // constant size, no per-sample table
+   }
+   if uint64(len(data)-p.offset) < uint64(b.SampleCount)*4 {
+      return errors.New("stsz box too short for declared samples")
+   }
+   b.EntrySizes = make([]uint32, b.SampleCount)
+   for i := range b.EntrySizes {
+      b.EntrySizes[i] = p.Uint32()
+   }
+   return nil
+}
+
+// Size returns the size of sample i (zero-based), which is the
+// constant SampleSize when it is not zero.
+func (b *StszBox) Size(i int) uint32 {
+   if b.SampleSize != 0 {
+      return b.SampleSize
+   }
+   if i < len(b.EntrySizes) {
+      return b.EntrySizes[i]
+   }
+   return 0
+}
+
 func (b *StszBox) Encode() []byte {
    size := 20 + len(b.EntrySizes)*4
    buffer := make([]byte, size)
@@ -191,12 +674,17 @@ func (b *StszBox) Encode() []byte {
       w.PutUint32(entrySize)
    }
 
-   b.Header.Size = uint32(size)
+   b.Header.Size = uint64(size)
    b.Header.Type = [4]byte{'s', 't', 's', 'z'}
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *StszBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 func buildStsz(samples []RemuxSample) []byte {
    entries := make([]uint32, len(samples))
    for i, sample := range samples {
@@ -218,6 +706,27 @@ type StscBox struct {
    Entries []StscEntry
 }
 
+func (b *StscBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 {
+      return errors.New("stsc box too short")
+   }
+   p := parser{data: data, offset: 12}
+   entryCount := p.Uint32()
+   if uint64(len(data)-p.offset) < uint64(entryCount)*12 {
+      return errors.New("stsc box too short for declared entries")
+   }
+   b.Entries = make([]StscEntry, entryCount)
+   for i := range b.Entries {
+      b.Entries[i].FirstChunk = p.Uint32()
+      b.Entries[i].SamplesPerChunk = p.Uint32()
+      b.Entries[i].SampleDescriptionIndex = p.Uint32()
+   }
+   return nil
+}
+
 func (b *StscBox) Encode() []byte {
    size := 16 + len(b.Entries)*12
    buffer := make([]byte, size)
@@ -231,12 +740,17 @@ func (b *StscBox) Encode() []byte {
       w.PutUint32(entry.SampleDescriptionIndex)
    }
 
-   b.Header.Size = uint32(size)
+   b.Header.Size = uint64(size)
    b.Header.Type = [4]byte{'s', 't', 's', 'c'}
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *StscBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 func buildStsc(counts []uint32) []byte {
    var entries []StscEntry
    chunkIdx := uint32(1)
@@ -261,6 +775,25 @@ type StcoBox struct {
    Offsets []uint32
 }
 
+func (b *StcoBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 {
+      return errors.New("stco box too short")
+   }
+   p := parser{data: data, offset: 12}
+   entryCount := p.Uint32()
+   if uint64(len(data)-p.offset) < uint64(entryCount)*4 {
+      return errors.New("stco box too short for declared entries")
+   }
+   b.Offsets = make([]uint32, entryCount)
+   for i := range b.Offsets {
+      b.Offsets[i] = p.Uint32()
+   }
+   return nil
+}
+
 func (b *StcoBox) Encode() []byte {
    size := 16 + len(b.Offsets)*4
    buffer := make([]byte, size)
@@ -272,18 +805,42 @@ func (b *StcoBox) Encode() []byte {
       w.PutUint32(offset)
    }
 
-   b.Header.Size = uint32(size)
+   b.Header.Size = uint64(size)
    b.Header.Type = [4]byte{'s', 't', 'c', 'o'}
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *StcoBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 // --- CO64 ---
 type Co64Box struct {
    Header  BoxHeader
    Offsets []uint64
 }
 
+func (b *Co64Box) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 {
+      return errors.New("co64 box too short")
+   }
+   p := parser{data: data, offset: 12}
+   entryCount := p.Uint32()
+   if uint64(len(data)-p.offset) < uint64(entryCount)*8 {
+      return errors.New("co64 box too short for declared entries")
+   }
+   b.Offsets = make([]uint64, entryCount)
+   for i := range b.Offsets {
+      b.Offsets[i] = p.Uint64()
+   }
+   return nil
+}
+
 func (b *Co64Box) Encode() []byte {
    size := 16 + len(b.Offsets)*8
    buffer := make([]byte, size)
@@ -295,12 +852,17 @@ func (b *Co64Box) Encode() []byte {
       w.PutUint64(offset)
    }
 
-   b.Header.Size = uint32(size)
+   b.Header.Size = uint64(size)
    b.Header.Type = [4]byte{'c', 'o', '6', '4'}
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *Co64Box) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 // buildChunkOffsetBox decides whether to use stco or co64.
 func buildChunkOffsetBox(offsets []uint64) []byte {
    use64bit := false
@@ -343,12 +905,17 @@ func (b *StssBox) Encode() []byte {
       w.PutUint32(index)
    }
 
-   b.Header.Size = uint32(size)
+   b.Header.Size = uint64(size)
    b.Header.Type = [4]byte{'s', 't', 's', 's'}
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *StssBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 func buildStss(samples []RemuxSample) []byte {
    var indices []uint32
    for i, sample := range samples {
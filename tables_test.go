@@ -0,0 +1,174 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "slices"
+   "testing"
+)
+
+func TestCttsBox_MinOffset(t *testing.T) {
+   samples := []RemuxSample{
+      {CompositionTimeOffset: 1024},
+      {CompositionTimeOffset: -512},
+      {CompositionTimeOffset: -512},
+      {CompositionTimeOffset: 512},
+   }
+   var ctts CttsBox
+   if err := ctts.Parse(buildCtts(samples)); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if ctts.Version != 1 {
+      t.Fatalf("expected version 1 for negative offsets, got %d", ctts.Version)
+   }
+   if minOffset := ctts.MinOffset(); minOffset != -512 {
+      t.Errorf("expected MinOffset -512, got %d", minOffset)
+   }
+
+   // Without a shift the second sample would present before zero.
+   if pts := PresentationTime(0, ctts.SampleOffset(1), 0); pts != 0 {
+      t.Errorf("expected clamped PTS 0, got %d", pts)
+   }
+   if pts := PresentationTime(512, ctts.SampleOffset(1), ctts.MinOffset()); pts != 512 {
+      t.Errorf("expected PTS 512, got %d", pts)
+   }
+
+   // Version 0 offsets are unsigned.
+   ctts.Version = 0
+   ctts.Entries = []CttsEntry{{SampleCount: 1, SampleOffset: -1}}
+   if offset := ctts.SampleOffset(0); offset != 0xFFFFFFFF {
+      t.Errorf("expected unsigned offset, got %d", offset)
+   }
+}
+
+func TestSubsBox_Parsing(t *testing.T) {
+   u16 := func(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   data := buildBox("subs", []byte{1, 0, 0, 0}, u32(2),
+      u32(1), u16(2), u32(70000), []byte{1, 0}, u32(0), u32(12), []byte{0, 1}, u32(7),
+      u32(3), u16(0),
+   )
+   var subs SubsBox
+   if err := subs.Parse(data); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if len(subs.Entries) != 2 || subs.Entries[1].SampleDelta != 3 || len(subs.Entries[1].Subsamples) != 0 {
+      t.Fatalf("unexpected entries: %+v", subs.Entries)
+   }
+   expected := []SubsSubsample{{70000, 1, 0, 0}, {12, 0, 1, 7}}
+   for i, subsample := range subs.Entries[0].Subsamples {
+      if subsample != expected[i] {
+         t.Errorf("subsample %d: expected %+v, got %+v", i, expected[i], subsample)
+      }
+   }
+
+   binary.BigEndian.PutUint16(data[20:], 3)
+   if err := subs.Parse(data); err == nil {
+      t.Error("expected error for truncated subsamples")
+   }
+}
+
+func TestStblBox_SampleIndexConstantSize(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   fullBox := []byte{0, 0, 0, 0}
+   // Five samples of 100 bytes each: two chunks of two, then one of one.
+   var stbl StblBox
+   err := stbl.Parse(buildBox("stbl",
+      buildBox("stsz", fullBox, u32(100), u32(5)),
+      buildBox("stsc", fullBox, u32(2), u32(1), u32(2), u32(1), u32(3), u32(1), u32(1)),
+      buildBox("stco", fullBox, u32(3), u32(1000), u32(5000), u32(9000)),
+   ))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   index, err := stbl.SampleIndex()
+   if err != nil {
+      t.Fatalf("SampleIndex failed: %v", err)
+   }
+   expected := []SampleLocation{
+      {1000, 100}, {1100, 100}, {5000, 100}, {5100, 100}, {9000, 100},
+   }
+   if len(index) != len(expected) {
+      t.Fatalf("expected %d samples, got %d", len(expected), len(index))
+   }
+   for i := range expected {
+      if index[i] != expected[i] {
+         t.Errorf("sample %d: expected %+v, got %+v", i, expected[i], index[i])
+      }
+   }
+}
+
+func TestPadbStdp_RoundTrip(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // three samples padded by 1, 7 and 2 bits
+   padb := buildBox("padb", []byte{0, 0, 0, 0}, u32(3), []byte{0x17, 0x20})
+   stdp := buildBox("stdp", []byte{0, 0, 0, 0}, []byte{0, 1, 0, 2, 0xFF, 0xFF})
+
+   var padbBox PadbBox
+   if err := padbBox.Parse(padb); err != nil {
+      t.Fatalf("padb Parse failed: %v", err)
+   }
+   for i, expected := range []byte{1, 7, 2} {
+      if pad := padbBox.Pad(i); pad != expected {
+         t.Errorf("sample %d: expected pad %d, got %d", i, expected, pad)
+      }
+   }
+   if encoded := padbBox.Encode(); !bytes.Equal(encoded, padb) {
+      t.Errorf("padb round trip mismatch: %x", encoded)
+   }
+
+   var stdpBox StdpBox
+   if err := stdpBox.Parse(stdp); err != nil {
+      t.Fatalf("stdp Parse failed: %v", err)
+   }
+   if !slices.Equal(stdpBox.Priorities, []uint16{1, 2, 0xFFFF}) {
+      t.Errorf("unexpected priorities %v", stdpBox.Priorities)
+   }
+   if encoded := stdpBox.Encode(); !bytes.Equal(encoded, stdp) {
+      t.Errorf("stdp round trip mismatch: %x", encoded)
+   }
+
+   var stbl StblBox
+   if err := stbl.Parse(buildBox("stbl", padb, stdp)); err != nil {
+      t.Fatalf("stbl Parse failed: %v", err)
+   }
+   if encoded := stbl.Encode(); !bytes.Equal(encoded, buildBox("stbl", padb, stdp)) {
+      t.Errorf("stbl dropped padb/stdp on encode: %x", encoded)
+   }
+}
+
+func TestStblBox_EncodeSampleGroups(t *testing.T) {
+   u16 := func(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   seig := append([]byte{0, 0x19, 1, 8}, make([]byte, 16)...)
+   children := [][]byte{
+      buildBox("stsz", []byte{0, 0, 0, 0}, u32(100), u32(3)),
+      buildBox("subs", []byte{0, 0, 0, 0}, u32(1), u32(1), u16(1), u16(40), []byte{0, 0}, u32(0)),
+      buildBox("sbgp", []byte{1, 0, 0, 0}, []byte("seig"), u32(0), u32(1), u32(3), u32(1)),
+      buildBox("sgpd", []byte{1, 0, 0, 0}, []byte("seig"), u32(20), u32(1), seig),
+      buildBox("sgpd", []byte{2, 0, 0, 0}, []byte("roll"), u32(2), u32(1), u32(1), []byte{0xFF, 0xFF}),
+      buildBox("sgpd", []byte{0, 0, 0, 0}, []byte("xyzw"), u32(1), []byte{1, 2, 3}),
+      buildBox("saiz", []byte{0, 0, 0, 1}, []byte("cenc"), u32(0), []byte{0}, u32(3), []byte{8, 16, 8}),
+      buildBox("saio", []byte{1, 0, 0, 0}, u32(1), u64(1<<32)),
+   }
+   data := buildBox("stbl", children...)
+
+   var stbl StblBox
+   if err := stbl.Parse(data); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if len(stbl.Sgpd) != 3 || stbl.Saiz == nil || stbl.Saio == nil || stbl.Subs == nil {
+      t.Fatalf("unexpected stbl %+v", stbl)
+   }
+   if roll := stbl.Sgpd[1]; roll.DefaultLength != 2 || roll.DefaultSampleDescriptionIndex != 1 ||
+      len(roll.Entries) != 1 || !bytes.Equal(roll.Entries[0], []byte{0xFF, 0xFF}) {
+      t.Errorf("unexpected v2 sgpd %+v", roll)
+   }
+   if unknown := stbl.Sgpd[2]; len(unknown.Entries) != 0 || !bytes.Equal(unknown.RawEntries, append(u32(1), 1, 2, 3)) {
+      t.Errorf("v0 sgpd of unknown type should be kept raw, got %+v", unknown)
+   }
+   if encoded := stbl.Encode(); !bytes.Equal(encoded, data) {
+      t.Errorf("stbl round trip mismatch:\n got %x\nwant %x", encoded, data)
+   }
+}
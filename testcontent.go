@@ -0,0 +1,197 @@
+package sofia
+
+import (
+   "crypto/aes"
+   "crypto/cipher"
+   "encoding/binary"
+   "errors"
+)
+
+// TestContentOptions configures BuildTestContent.
+type TestContentOptions struct {
+   // Samples are the clear samples of the segment. If nil, three samples
+   // of 20, 50 and 5 bytes are used.
+   Samples [][]byte
+   // Scheme is the protection scheme, "cenc" or "cbcs", or empty for clear
+   // content.
+   Scheme string
+   KID    [16]byte
+   Key    []byte // 16-byte AES key, used if Scheme is set
+   // SampleGroup also signals the key ID of encrypted content with a seig
+   // sample group in the segment, so the segment can be decrypted without
+   // its init segment. Packagers commonly leave it to the tenc alone.
+   SampleGroup bool
+}
+
+// testContentSamples are the default samples of BuildTestContent.
+var testContentSamples = [][]byte{
+   []byte("first sample payload"),
+   []byte("the second sample is somewhat longer than one block"),
+   []byte("third"),
+}
+
+// BuildTestContent returns a minimal fragmented MP4 made of an init segment
+// with a single H.264 video track and one media segment holding the given
+// samples, so code built on sofia can be tested without binary fixtures.
+// With the cenc scheme each sample is encrypted whole with AES-CTR and an
+// 8-byte IV; with cbcs it is encrypted with a 1:9 pattern and a constant
+// IV. In both cases the key ID is signalled by the init segment's tenc,
+// and also by a seig sample group in the segment if opts.SampleGroup is
+// set. BuildTestContent fails if Scheme is unknown or Key is not a valid
+// AES key.
+func BuildTestContent(opts TestContentOptions) (init []byte, segment []byte, err error) {
+   samples := opts.Samples
+   if samples == nil {
+      samples = testContentSamples
+   }
+   var block cipher.Block
+   switch opts.Scheme {
+   case "":
+   case "cenc", "cbcs":
+      block, err = aes.NewCipher(opts.Key)
+      if err != nil {
+         return nil, nil, err
+      }
+   default:
+      return nil, nil, errors.New("unsupported test content scheme " + opts.Scheme)
+   }
+   return buildTestInit(opts), buildTestSegment(opts, samples, block), nil
+}
+
+// testConstantIV is the constant IV of cbcs test content.
+var testConstantIV = []byte("constant IV 0123")
+
+// encodeFullBox returns a full box with the given version and flags
+// followed by its fields.
+func encodeFullBox(boxType string, version byte, flags uint32, fields ...[]byte) []byte {
+   versionAndFlags := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+   return containerBox(boxType, append([][]byte{versionAndFlags}, fields...))
+}
+
+func buildTestInit(opts TestContentOptions) []byte {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   mvhd := encodeFullBox("mvhd", 0, 0, u32(0), u32(0), u32(1000), u32(0),
+      u32(0x00010000), []byte{1, 0}, make([]byte, 10), identityMatrix(), make([]byte, 24), u32(2))
+   tkhd := encodeFullBox("tkhd", 0, 3, u32(0), u32(0), u32(1), u32(0), u32(0),
+      make([]byte, 16), identityMatrix(), u32(1280<<16), u32(720<<16))
+   // language "und"
+   mdhd := encodeFullBox("mdhd", 0, 0, u32(0), u32(0), u32(90000), u32(0), []byte{0x55, 0xC4, 0, 0})
+   hdlr := encodeFullBox("hdlr", 0, 0, u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+   vmhd := encodeFullBox("vmhd", 0, 1, make([]byte, 8))
+   dinf := containerBox("dinf", [][]byte{encodeFullBox("dref", 0, 0, u32(1), encodeFullBox("url ", 0, 1))})
+
+   // configurationVersion, profile, compatibility, level, lengthSizeMinusOne,
+   // then one SPS and one PPS
+   avcC := containerBox("avcC", [][]byte{{1, 0x64, 0x00, 0x1f, 0xFF},
+      {0xE1, 0, 4, 0x67, 0x64, 0x00, 0x1f}, {1, 0, 2, 0x68, 0xEE}})
+   entry := make([]byte, 78)
+   binary.BigEndian.PutUint16(entry[6:], 1) // data_reference_index
+   binary.BigEndian.PutUint16(entry[24:], 1280)
+   binary.BigEndian.PutUint16(entry[26:], 720)
+   binary.BigEndian.PutUint32(entry[28:], 0x00480000) // 72 dpi
+   binary.BigEndian.PutUint32(entry[32:], 0x00480000)
+   binary.BigEndian.PutUint16(entry[40:], 1) // frame_count
+   binary.BigEndian.PutUint16(entry[74:], 0x0018) // depth
+   binary.BigEndian.PutUint16(entry[76:], 0xFFFF) // pre_defined
+   sampleEntry := containerBox("avc1", [][]byte{entry, avcC})
+   if opts.Scheme != "" {
+      var tenc []byte
+      if opts.Scheme == "cbcs" {
+         tenc = encodeFullBox("tenc", 1, 0, []byte{0, 0x19, 1, 0}, opts.KID[:],
+            []byte{byte(len(testConstantIV))}, testConstantIV)
+      } else {
+         tenc = encodeFullBox("tenc", 0, 0, []byte{0, 0, 1, 8}, opts.KID[:])
+      }
+      sinf := containerBox("sinf", [][]byte{
+         containerBox("frma", [][]byte{[]byte("avc1")}),
+         encodeFullBox("schm", 0, 0, []byte(opts.Scheme), u32(0x00010000)),
+         containerBox("schi", [][]byte{tenc}),
+      })
+      sampleEntry = containerBox("encv", [][]byte{entry, avcC, sinf})
+   }
+   stbl := containerBox("stbl", [][]byte{
+      encodeFullBox("stsd", 0, 0, u32(1), sampleEntry),
+      encodeFullBox("stts", 0, 0, u32(0)),
+      encodeFullBox("stsc", 0, 0, u32(0)),
+      encodeFullBox("stsz", 0, 0, u32(0), u32(0)),
+      encodeFullBox("stco", 0, 0, u32(0)),
+   })
+   minf := containerBox("minf", [][]byte{vmhd, dinf, stbl})
+   mdia := containerBox("mdia", [][]byte{mdhd, hdlr, minf})
+   trex := encodeFullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0))
+   moov := containerBox("moov", [][]byte{
+      mvhd, containerBox("trak", [][]byte{tkhd, mdia}), containerBox("mvex", [][]byte{trex}),
+   })
+   ftyp := containerBox("ftyp", [][]byte{[]byte("iso6"), u32(0), []byte("iso6dash")})
+   return append(ftyp, moov...)
+}
+
+// identityMatrix returns the unity transformation matrix of mvhd and tkhd.
+func identityMatrix() []byte {
+   matrix := make([]byte, 36)
+   binary.BigEndian.PutUint32(matrix, 0x00010000)
+   binary.BigEndian.PutUint32(matrix[16:], 0x00010000)
+   binary.BigEndian.PutUint32(matrix[32:], 0x40000000)
+   return matrix
+}
+
+func buildTestSegment(opts TestContentOptions, samples [][]byte, block cipher.Block) []byte {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   // data_offset and sample_size present
+   trun := append(u32(uint32(len(samples))), u32(0)...)
+   var payload []byte
+   senc := u32(uint32(len(samples)))
+   for i, sample := range samples {
+      trun = append(trun, u32(uint32(len(sample)))...)
+      encrypted := append([]byte(nil), sample...)
+      switch opts.Scheme {
+      case "cenc":
+         iv := make([]byte, 16)
+         binary.BigEndian.PutUint64(iv, uint64(i+1))
+         senc = append(senc, iv[:8]...)
+         cipher.NewCTR(block, iv).XORKeyStream(encrypted, encrypted)
+      case "cbcs":
+         encryptPattern(encrypted, testConstantIV, block, 1, 9)
+      }
+      payload = append(payload, encrypted...)
+   }
+   children := [][]byte{
+      encodeFullBox("tfhd", 0, 0x020000, u32(1)), // default-base-is-moof
+      encodeFullBox("tfdt", 1, 0, make([]byte, 8)),
+      encodeFullBox("trun", 0, 0x000201, trun),
+   }
+   if opts.Scheme != "" {
+      children = append(children, encodeFullBox("senc", 0, 0, senc))
+   }
+   if opts.Scheme != "" && opts.SampleGroup {
+      var seig []byte
+      if opts.Scheme == "cbcs" {
+         seig = append([]byte{0, 0x19, 1, 0}, opts.KID[:]...)
+         seig = append(append(seig, byte(len(testConstantIV))), testConstantIV...)
+      } else {
+         seig = append([]byte{0, 0, 1, 8}, opts.KID[:]...)
+      }
+      children = append(children,
+         encodeFullBox("sbgp", 0, 0, []byte("seig"), u32(1), u32(uint32(len(samples))), u32(1)),
+         encodeFullBox("sgpd", 1, 0, []byte("seig"), u32(uint32(len(seig))), u32(1), seig),
+      )
+   }
+   mfhd := encodeFullBox("mfhd", 0, 0, u32(1))
+   moof := containerBox("moof", [][]byte{mfhd, containerBox("traf", children)})
+   // moof(8) mfhd(16) traf(8) tfhd(16) tfdt(20) trun(8) version/flags(4)
+   // sample_count(4)
+   binary.BigEndian.PutUint32(moof[84:], uint32(len(moof)+8))
+   return append(moof, containerBox("mdat", [][]byte{payload})...)
+}
+
+// encryptPattern is the inverse of decryptPattern.
+func encryptPattern(data, iv []byte, block cipher.Block, cryptByteBlock, skipByteBlock byte) {
+   const blockSize = 16
+   mode := cipher.NewCBCEncrypter(block, iv)
+   crypt := int(cryptByteBlock) * blockSize
+   stride := crypt + int(skipByteBlock)*blockSize
+   for offset := 0; offset+blockSize <= len(data); offset += stride {
+      end := offset + min(crypt, (len(data)-offset)/blockSize*blockSize)
+      mode.CryptBlocks(data[offset:end], data[offset:end])
+   }
+}
@@ -0,0 +1,108 @@
+package sofia
+
+import (
+   "bytes"
+   "crypto/aes"
+   "testing"
+)
+
+func TestBuildTestContent(t *testing.T) {
+   clear := bytes.Join(testContentSamples, nil)
+   for _, scheme := range []string{"", "cenc", "cbcs"} {
+      init, segment, err := BuildTestContent(TestContentOptions{Scheme: scheme, KID: testKID, Key: testKey})
+      if err != nil {
+         t.Fatal(err)
+      }
+      file, err := Open(init)
+      if err != nil {
+         t.Fatalf("%q: Open failed: %v", scheme, err)
+      }
+      if !file.Fragmented || file.Encrypted != (scheme != "") {
+         t.Errorf("%q: unexpected classification %+v", scheme, file)
+      }
+      if got, ok := file.Moov.Trak[0].Scheme(); scheme != "" && (!ok || got != scheme) {
+         t.Errorf("%q: unexpected scheme %q", scheme, got)
+      }
+      boxes, err := Parse(segment)
+      if err != nil {
+         t.Fatalf("%q: Parse failed: %v", scheme, err)
+      }
+      if _, err := (&ParseOptions{Strict: true}).Parse(segment); err != nil {
+         t.Errorf("%q: strict Parse failed: %v", scheme, err)
+      }
+      moof, ok := FindMoof(boxes)
+      if !ok {
+         t.Fatalf("%q: no moof", scheme)
+      }
+      samples, err := ExtractSamples(segment)
+      if err != nil {
+         t.Fatalf("%q: ExtractSamples failed: %v", scheme, err)
+      }
+      if len(samples) != len(testContentSamples) {
+         t.Fatalf("%q: expected %d samples, got %d", scheme, len(testContentSamples), len(samples))
+      }
+      switch scheme {
+      case "":
+         if !bytes.Equal(boxes[1].Mdat.Payload, clear) {
+            t.Errorf("%q: unexpected mdat %q", scheme, boxes[1].Mdat.Payload)
+         }
+      case "cenc":
+         if _, err := DecryptSegment(segment, KeyMap{testKID: testKey}); err == nil {
+            t.Errorf("%q: expected the key ID to be left to the init segment", scheme)
+         }
+         out, err := (&Decrypter{Keys: KeyMap{testKID: testKey}, Init: file.Moov}).DecryptSegment(segment)
+         if err != nil {
+            t.Fatalf("%q: DecryptSegment failed: %v", scheme, err)
+         }
+         if !bytes.HasSuffix(out, clear) {
+            t.Errorf("%q: decrypted mdat mismatch", scheme)
+         }
+      case "cbcs":
+         out, err := (&Decrypter{Keys: KeyMap{testKID: testKey}, Init: file.Moov}).DecryptSegment(segment)
+         if err != nil {
+            t.Fatalf("%q: DecryptSegment failed: %v", scheme, err)
+         }
+         if !bytes.HasSuffix(out, clear) {
+            t.Errorf("%q: decrypted mdat mismatch", scheme)
+         }
+         // the senc carries no IVs, so its IV size is that of the tenc
+         senc, err := trafSenc(moof.Traf, file.Moov, nil)
+         if err != nil {
+            t.Fatalf("%q: senc: %v", scheme, err)
+         }
+         tenc, _ := file.Moov.Trak[0].Tenc()
+         tenc.ApplyConstantIV(senc)
+         block, _ := aes.NewCipher(testKey)
+         for i, sample := range samples {
+            err := DecryptSampleCBCS(sample.Data, &senc.Samples[i], block, tenc.DefaultCryptByteBlock, tenc.DefaultSkipByteBlock)
+            if err != nil {
+               t.Fatalf("%q: DecryptSampleCBCS failed: %v", scheme, err)
+            }
+            if !bytes.Equal(sample.Data, testContentSamples[i]) {
+               t.Errorf("%q sample %d: expected %q, got %q", scheme, i, testContentSamples[i], sample.Data)
+            }
+         }
+      }
+   }
+}
+
+func TestBuildTestContent_Options(t *testing.T) {
+   _, segment, err := BuildTestContent(TestContentOptions{Scheme: "cenc", KID: testKID, Key: testKey, SampleGroup: true})
+   if err != nil {
+      t.Fatal(err)
+   }
+   out, err := DecryptSegment(segment, KeyMap{testKID: testKey})
+   if err != nil {
+      t.Fatalf("DecryptSegment failed: %v", err)
+   }
+   if !bytes.HasSuffix(out, bytes.Join(testContentSamples, nil)) {
+      t.Error("decrypted mdat mismatch")
+   }
+
+   if _, _, err := BuildTestContent(TestContentOptions{Scheme: "cens", KID: testKID, Key: testKey}); err == nil {
+      t.Error("expected error for an unsupported scheme")
+   }
+   if _, _, err := BuildTestContent(TestContentOptions{Scheme: "cenc", KID: testKID, Key: []byte("short")}); err == nil {
+      t.Error("expected error for an invalid key")
+   }
+}
@@ -1,24 +1,46 @@
 package sofia
 
-import "errors"
+import (
+   "cmp"
+   "encoding/binary"
+   "errors"
+   "io"
+   "slices"
+   "strings"
+   "time"
+)
+
+// cString returns the bytes up to the first null terminator.
+func cString(data []byte) string {
+   if i := strings.IndexByte(string(data), 0); i >= 0 {
+      return string(data[:i])
+   }
+   return string(data)
+}
 
 // --- TRAK ---
 type TrakBox struct {
    Header      BoxHeader
+   Tkhd        *TkhdBox
+   Edts        *EdtsBox
    Mdia        *MdiaBox
    RawChildren [][]byte
 }
 
 func (b *TrakBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *TrakBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
 
-   payload := data[8:b.Header.Size]
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -31,9 +53,21 @@ func (b *TrakBox) Parse(data []byte) error {
 
       content := payload[offset : offset+boxSize]
       switch string(header.Type[:]) {
+      case "tkhd":
+         var tkhd TkhdBox
+         if err := tkhd.parse(content, opts); err != nil {
+            return err
+         }
+         b.Tkhd = &tkhd
+      case "edts":
+         var edts EdtsBox
+         if err := edts.Parse(content); err != nil {
+            return err
+         }
+         b.Edts = &edts
       case "mdia":
          var mdia MdiaBox
-         if err := mdia.Parse(content); err != nil {
+         if err := mdia.parse(content, opts); err != nil {
             return err
          }
          b.Mdia = &mdia
@@ -47,18 +81,30 @@ func (b *TrakBox) Parse(data []byte) error {
 
 func (b *TrakBox) Encode() []byte {
    buffer := make([]byte, 8)
+   if b.Tkhd != nil {
+      buffer = append(buffer, b.Tkhd.Encode()...)
+   }
+   if b.Edts != nil {
+      buffer = append(buffer, b.Edts.Encode()...)
+   }
    if b.Mdia != nil {
       buffer = append(buffer, b.Mdia.Encode()...)
    }
    for _, child := range b.RawChildren {
       buffer = append(buffer, child...)
    }
-   b.Header.Size = uint32(len(buffer))
+   b.Header.Size = uint64(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *TrakBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 func (b *TrakBox) RemoveEdts() {
+   b.Edts = nil
    var kept [][]byte
    for _, child := range b.RawChildren {
       if len(child) >= 8 && string(child[4:8]) == "edts" {
@@ -69,24 +115,610 @@ func (b *TrakBox) RemoveEdts() {
    b.RawChildren = kept
 }
 
+// TrackID returns the track_ID from the 'tkhd' box, or 0 if it is missing.
+func (b *TrakBox) TrackID() uint32 {
+   if b.Tkhd == nil {
+      return 0
+   }
+   return b.Tkhd.TrackID
+}
+
+// HandlerType returns the handler_type from the 'hdlr' box, such as "vide"
+// or "soun", or an empty string if it is missing.
+func (b *TrakBox) HandlerType() string {
+   if b.Mdia == nil || b.Mdia.Hdlr == nil {
+      return ""
+   }
+   return string(b.Mdia.Hdlr.HandlerType[:])
+}
+
+// Stsd returns the sample description box of the track.
+func (b *TrakBox) Stsd() (*StsdBox, bool) {
+   if b.Mdia == nil || b.Mdia.Minf == nil || b.Mdia.Minf.Stbl == nil {
+      return nil, false
+   }
+   stsd := b.Mdia.Minf.Stbl.Stsd
+   return stsd, stsd != nil
+}
+
+// Tenc returns the track encryption box of the first protected sample
+// entry. Disabled tracks are not skipped, since packagers may disable a
+// track that is still encrypted and needs a license.
+func (b *TrakBox) Tenc() (*TencBox, bool) {
+   stsd, ok := b.Stsd()
+   if !ok {
+      return nil, false
+   }
+   sinf, _, ok := stsd.Sinf()
+   if !ok || sinf.Schi == nil || sinf.Schi.Tenc == nil {
+      return nil, false
+   }
+   return sinf.Schi.Tenc, true
+}
+
+// Scheme returns the protection scheme type from 'schm', such as "cenc" or
+// "cbcs".
+func (b *TrakBox) Scheme() (string, bool) {
+   stsd, ok := b.Stsd()
+   if !ok {
+      return "", false
+   }
+   sinf, _, ok := stsd.Sinf()
+   if !ok || sinf.Schm == nil {
+      return "", false
+   }
+   return string(sinf.Schm.SchemeType[:]), true
+}
+
+// EncryptionGranularity returns "clear" if the track is not protected, or
+// else "subsample" or "full-sample" according to the auxiliary information
+// of the track in segment, taken from senc flags or, failing that, from
+// saiz sizes larger than the IV. It returns an empty string if segment
+// holds no such information for the track.
+func (b *TrakBox) EncryptionGranularity(segment []byte) string {
+   tenc, ok := b.Tenc()
+   if !ok || tenc.DefaultIsProtected != 1 {
+      return "clear"
+   }
+   boxes, err := Parse(segment)
+   if err != nil {
+      return ""
+   }
+   trackID := b.TrackID()
+   for _, box := range boxes {
+      if box.Moof == nil {
+         continue
+      }
+      for _, traf := range box.Moof.Trafs {
+         if traf.Tfhd == nil || traf.Tfhd.TrackID != trackID {
+            continue
+         }
+         switch {
+         case traf.Senc != nil:
+            if traf.Senc.Flags&0x000002 != 0 {
+               return "subsample"
+            }
+            return "full-sample"
+         case traf.Saiz != nil && traf.Saiz.SampleCount > 0:
+            // subsample entries follow the IV in the aux info
+            if traf.Saiz.SampleInfoSize(0) > int(tenc.DefaultPerSampleIVSize) {
+               return "subsample"
+            }
+            return "full-sample"
+         }
+      }
+   }
+   return ""
+}
+
+// PresentationOrder returns the indices of the samples of the track in
+// segment sorted by presentation time, the decode time plus the trun
+// composition offset. Samples are numbered in decode order across every
+// fragment of the track. Truns without composition offsets present their
+// samples at decode time, which is an error if other truns have negative
+// offsets, since those imply reordering that cannot then be recovered.
+// Durations left to trex are taken from a moov in segment.
+func (b *TrakBox) PresentationOrder(segment []byte) ([]int, error) {
+   boxes, err := Parse(segment)
+   if err != nil {
+      return nil, err
+   }
+   var mvex *MvexBox
+   if moov, ok := FindMoov(boxes); ok {
+      mvex = moov.Mvex
+   }
+   trackID := b.TrackID()
+   var pts []int64
+   var decodeTime uint64
+   missing, negative := false, false
+   for _, box := range boxes {
+      if box.Moof == nil {
+         continue
+      }
+      for _, traf := range box.Moof.Trafs {
+         if traf.Tfhd == nil || traf.Tfhd.TrackID != trackID {
+            continue
+         }
+         if traf.Tfdt != nil {
+            decodeTime = traf.Tfdt.BaseMediaDecodeTime
+         }
+         timings, err := traf.sampleTimings(mvex)
+         if err != nil {
+            return nil, err
+         }
+         for _, trun := range traf.Trun {
+            hasOffsets := trun.Flags&0x000800 != 0
+            if !hasOffsets {
+               missing = true
+            }
+            for _, sample := range trun.Samples {
+               var offset int64
+               if hasOffsets {
+                  offset = int64(sample.CompositionTimeOffset)
+                  negative = negative || offset < 0
+               }
+               pts = append(pts, int64(decodeTime)+offset)
+               decodeTime += uint64(timings[0].Duration)
+               timings = timings[1:]
+            }
+         }
+      }
+   }
+   if missing && negative {
+      return nil, errors.New("composition offsets missing from some truns of a reordered track")
+   }
+   order := make([]int, len(pts))
+   for i := range order {
+      order[i] = i
+   }
+   slices.SortStableFunc(order, func(i, j int) int {
+      return cmp.Compare(pts[i], pts[j])
+   })
+   return order, nil
+}
+
+// sampleEntry returns the format and child boxes of the first sample entry.
+// For encrypted entries the original format is taken from 'frma'.
+func (b *TrakBox) sampleEntry() ([4]byte, [][]byte, bool) {
+   var format [4]byte
+   stsd, ok := b.Stsd()
+   if !ok {
+      return format, nil, false
+   }
+   if len(stsd.EncChildren) > 0 {
+      enc := stsd.EncChildren[0]
+      format = enc.Header.Type
+      if enc.Sinf != nil && enc.Sinf.Frma != nil {
+         format = enc.Sinf.Frma.DataFormat
+      }
+      return format, enc.RawChildren, true
+   }
+   if len(stsd.RawChildren) == 0 || len(stsd.RawChildren[0]) < 8 {
+      return format, nil, false
+   }
+   entry := stsd.RawChildren[0]
+   copy(format[:], entry[4:8])
+   var entrySize int
+   switch b.HandlerType() {
+   case "vide":
+      entrySize = 78
+   case "soun":
+      entrySize = 28
+   }
+   var children [][]byte
+   if entrySize > 0 && len(entry) > 8+entrySize {
+      children = childBoxes(entry[8+entrySize:])
+   }
+   return format, children, true
+}
+
+// CodecString returns the RFC 6381 codec string of the first sample entry.
+func (b *TrakBox) CodecString() string {
+   format, children, ok := b.sampleEntry()
+   if !ok {
+      return ""
+   }
+   return CodecString(format, children)
+}
+
+// MediaTimescale returns the timescale from 'mdhd', or 0 if it is missing.
+// Sample durations in stts and trun, and decode times in tfdt, are all in
+// this timescale. It is usually not the movie timescale from 'mvhd', which
+// is only used for edit lists and the movie duration; see
+// MoovBox.MovieTimescale.
+func (b *TrakBox) MediaTimescale() uint32 {
+   if b.Mdia == nil || b.Mdia.Mdhd == nil {
+      return 0
+   }
+   return b.Mdia.Mdhd.Timescale
+}
+
+// MediaToSeconds converts a time in the media timescale to seconds. It
+// returns 0 if the timescale is unknown.
+func (b *TrakBox) MediaToSeconds(t uint64) float64 {
+   timescale := b.MediaTimescale()
+   if timescale == 0 {
+      return 0
+   }
+   return float64(t) / float64(timescale)
+}
+
+// Summary describes the track without any box navigation.
+func (b *TrakBox) Summary() TrackSummary {
+   summary := TrackSummary{
+      TrackID:     b.TrackID(),
+      HandlerType: b.HandlerType(),
+      CodecString: b.CodecString(),
+      Language:    b.Language(),
+      Timescale:   b.MediaTimescale(),
+   }
+   if tenc, ok := b.Tenc(); ok && tenc.DefaultIsProtected == 1 {
+      summary.Encrypted = true
+      summary.KID = tenc.DefaultKID
+   }
+   return summary
+}
+
+// Language returns the track language, preferring the BCP 47 tag in 'elng'
+// over the packed ISO 639-2/T code in 'mdhd'. It returns "und" if neither is
+// present.
+func (b *TrakBox) Language() string {
+   if b.Mdia == nil {
+      return "und"
+   }
+   for _, child := range b.Mdia.RawChildren {
+      // elng is a full box holding a null-terminated string
+      if len(child) > 12 && string(child[4:8]) == "elng" {
+         if tag := cString(child[12:]); tag != "" {
+            return tag
+         }
+      }
+   }
+   if b.Mdia.Mdhd != nil {
+      return b.Mdia.Mdhd.LanguageCode()
+   }
+   return "und"
+}
+
+// Role returns the value of the first 'kind' box inside 'udta', such as
+// "main" or "forced-subtitle", or an empty string if there is none.
+func (b *TrakBox) Role() string {
+   for _, child := range b.RawChildren {
+      if len(child) < 8 || string(child[4:8]) != "udta" {
+         continue
+      }
+      payload := child[8:]
+      for len(payload) >= 8 {
+         size := int(binary.BigEndian.Uint32(payload))
+         if size < 8 || size > len(payload) {
+            break
+         }
+         // kind is a full box holding schemeURI and value strings
+         if string(payload[4:8]) == "kind" && size > 12 {
+            fields := strings.SplitN(string(payload[12:size]), "\x00", 3)
+            if len(fields) >= 2 && fields[1] != "" {
+               return fields[1]
+            }
+         }
+         payload = payload[size:]
+      }
+   }
+   return ""
+}
+
+// languageNames maps ISO 639-1 and ISO 639-2 (T and B) codes of common
+// languages to their English names.
+var languageNames = map[string]string{
+   "ar": "Arabic", "ara": "Arabic",
+   "bg": "Bulgarian", "bul": "Bulgarian",
+   "ca": "Catalan", "cat": "Catalan",
+   "cs": "Czech", "ces": "Czech", "cze": "Czech",
+   "da": "Danish", "dan": "Danish",
+   "de": "German", "deu": "German", "ger": "German",
+   "el": "Greek", "ell": "Greek", "gre": "Greek",
+   "en": "English", "eng": "English",
+   "es": "Spanish", "spa": "Spanish",
+   "et": "Estonian", "est": "Estonian",
+   "fa": "Persian", "fas": "Persian", "per": "Persian",
+   "fi": "Finnish", "fin": "Finnish",
+   "fr": "French", "fra": "French", "fre": "French",
+   "he": "Hebrew", "heb": "Hebrew",
+   "hi": "Hindi", "hin": "Hindi",
+   "hr": "Croatian", "hrv": "Croatian",
+   "hu": "Hungarian", "hun": "Hungarian",
+   "id": "Indonesian", "ind": "Indonesian",
+   "is": "Icelandic", "isl": "Icelandic", "ice": "Icelandic",
+   "it": "Italian", "ita": "Italian",
+   "ja": "Japanese", "jpn": "Japanese",
+   "ko": "Korean", "kor": "Korean",
+   "lt": "Lithuanian", "lit": "Lithuanian",
+   "lv": "Latvian", "lav": "Latvian",
+   "ms": "Malay", "msa": "Malay", "may": "Malay",
+   "nb": "Norwegian Bokmål", "nob": "Norwegian Bokmål",
+   "nl": "Dutch", "nld": "Dutch", "dut": "Dutch",
+   "no": "Norwegian", "nor": "Norwegian",
+   "pl": "Polish", "pol": "Polish",
+   "pt": "Portuguese", "por": "Portuguese",
+   "ro": "Romanian", "ron": "Romanian", "rum": "Romanian",
+   "ru": "Russian", "rus": "Russian",
+   "sk": "Slovak", "slk": "Slovak", "slo": "Slovak",
+   "sl": "Slovenian", "slv": "Slovenian",
+   "sr": "Serbian", "srp": "Serbian",
+   "sv": "Swedish", "swe": "Swedish",
+   "ta": "Tamil", "tam": "Tamil",
+   "te": "Telugu", "tel": "Telugu",
+   "th": "Thai", "tha": "Thai",
+   "tr": "Turkish", "tur": "Turkish",
+   "uk": "Ukrainian", "ukr": "Ukrainian",
+   "vi": "Vietnamese", "vie": "Vietnamese",
+   "zh": "Chinese", "zho": "Chinese", "chi": "Chinese",
+}
+
+// roleLabels maps DASH role values to the label DisplayName shows. Roles
+// with an empty label, such as "main", add nothing to the name.
+var roleLabels = map[string]string{
+   "main":                           "",
+   "subtitle":                       "",
+   "alternate":                      "alternate",
+   "caption":                        "captions",
+   "commentary":                     "commentary",
+   "description":                    "audio description",
+   "dub":                            "dub",
+   "easyreader":                     "easy reader",
+   "emergency":                      "emergency",
+   "enhanced-audio-intelligibility": "enhanced dialogue",
+   "forced-subtitle":                "forced",
+   "sign":                           "sign language",
+   "supplementary":                  "supplementary",
+}
+
+// referenceLabels maps the tref reference types that describe the role of
+// the referencing track to the label DisplayName shows.
+var referenceLabels = map[string]string{
+   "auxl": "auxiliary",
+   "subt": "subtitles",
+   "thmb": "thumbnails",
+}
+
+// ReferenceTypes returns the reference types of the 'tref' box of the
+// track, such as "subt" or "chap", in order.
+func (b *TrakBox) ReferenceTypes() []string {
+   var types []string
+   for _, child := range b.RawChildren {
+      if len(child) < 8 || string(child[4:8]) != "tref" {
+         continue
+      }
+      for _, reference := range childBoxes(child[8:]) {
+         types = append(types, string(reference[4:8]))
+      }
+   }
+   return types
+}
+
+// DisplayName combines the language and role into a label suitable for a
+// track selection menu, e.g. "English (forced)". The language is named from
+// the primary subtag of its tag, keeping a region subtag as in
+// "Portuguese (BR)", and is "Unknown" if undetermined. The role comes from
+// the udta kind or failing that from a tref reference such as subt.
+func (b *TrakBox) DisplayName() string {
+   tag := b.Language()
+   subtags := strings.Split(tag, "-")
+   name, ok := languageNames[strings.ToLower(subtags[0])]
+   switch {
+   case ok:
+   case tag == "und" || tag == "":
+      name = "Unknown"
+   default:
+      name = tag
+      subtags = subtags[:1]
+   }
+   var details []string
+   for _, subtag := range subtags[1:] {
+      // only two-letter and three-digit region subtags
+      if len(subtag) == 2 || (len(subtag) == 3 && subtag[0] >= '0' && subtag[0] <= '9') {
+         details = append(details, strings.ToUpper(subtag))
+      }
+   }
+   if role := b.Role(); role != "" {
+      label, ok := roleLabels[role]
+      if !ok {
+         label = strings.ReplaceAll(role, "-", " ")
+      }
+      if label != "" {
+         details = append(details, label)
+      }
+   } else {
+      for _, reference := range b.ReferenceTypes() {
+         if label, ok := referenceLabels[reference]; ok {
+            details = append(details, label)
+            break
+         }
+      }
+   }
+   if len(details) > 0 {
+      name += " (" + strings.Join(details, ", ") + ")"
+   }
+   return name
+}
+
+// --- EDTS ---
+type EdtsBox struct {
+   Header      BoxHeader
+   Elst        *ElstBox
+   RawChildren [][]byte
+}
+
+func (b *EdtsBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+
+   payload := data[b.Header.HeaderSize:b.Header.Size]
+   offset := 0
+   for offset < len(payload) {
+      var header BoxHeader
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
+         break
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(payload) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(payload) {
+         return errors.New("invalid child box size")
+      }
+
+      content := payload[offset : offset+boxSize]
+      switch string(header.Type[:]) {
+      case "elst":
+         var elst ElstBox
+         if err := elst.Parse(content); err != nil {
+            return err
+         }
+         b.Elst = &elst
+      default:
+         b.RawChildren = append(b.RawChildren, content)
+      }
+      offset += boxSize
+   }
+   return nil
+}
+
+func (b *EdtsBox) Encode() []byte {
+   buffer := make([]byte, 8)
+   if b.Elst != nil {
+      buffer = append(buffer, b.Elst.Encode()...)
+   }
+   for _, child := range b.RawChildren {
+      buffer = append(buffer, child...)
+   }
+   b.Header.Size = uint64(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *EdtsBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// --- ELST ---
+
+// ElstEntry is one edit. SegmentDuration is in the movie timescale and
+// MediaTime in the media timescale. A MediaTime of -1 is an empty edit,
+// which delays the start of the media by SegmentDuration.
+type ElstEntry struct {
+   SegmentDuration   uint64
+   MediaTime         int64
+   MediaRateInteger  int16
+   MediaRateFraction int16
+}
+
+// IsEmpty reports whether the entry is an empty edit.
+func (e ElstEntry) IsEmpty() bool {
+   return e.MediaTime == -1
+}
+
+type ElstBox struct {
+   Header  BoxHeader
+   Version byte
+   Flags   [3]byte
+   Entries []ElstEntry
+}
+
+func (b *ElstBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 { // 8 header + 4 version/flags + 4 entry_count
+      return errors.New("elst box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Bytes(4)
+   b.Version = versionAndFlags[0]
+   copy(b.Flags[:], versionAndFlags[1:])
+   entryCount := p.Uint32()
+   entrySize := 12
+   if b.Version == 1 {
+      entrySize = 20
+   }
+   if uint64(len(data)-p.offset) < uint64(entryCount)*uint64(entrySize) {
+      return errors.New("elst box too short for declared entries")
+   }
+
+   b.Entries = make([]ElstEntry, entryCount)
+   for i := range b.Entries {
+      if b.Version == 1 {
+         b.Entries[i].SegmentDuration = p.Uint64()
+         b.Entries[i].MediaTime = int64(p.Uint64())
+      } else {
+         b.Entries[i].SegmentDuration = uint64(p.Uint32())
+         b.Entries[i].MediaTime = int64(p.Int32())
+      }
+      b.Entries[i].MediaRateInteger = int16(p.Uint16())
+      b.Entries[i].MediaRateFraction = int16(p.Uint16())
+   }
+   return nil
+}
+
+func (b *ElstBox) Encode() []byte {
+   entrySize := 12
+   if b.Version == 1 {
+      entrySize = 20
+   }
+   size := uint32(16 + len(b.Entries)*entrySize)
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+
+   w.PutUint32(size)
+   w.PutBytes(b.Header.Type[:])
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+   w.PutUint32(uint32(len(b.Entries)))
+   for _, entry := range b.Entries {
+      if b.Version == 1 {
+         w.PutUint64(entry.SegmentDuration)
+         w.PutUint64(uint64(entry.MediaTime))
+      } else {
+         w.PutUint32(uint32(entry.SegmentDuration))
+         w.PutUint32(uint32(entry.MediaTime))
+      }
+      w.PutUint16(uint16(entry.MediaRateInteger))
+      w.PutUint16(uint16(entry.MediaRateFraction))
+   }
+
+   b.Header.Size = uint64(size)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *ElstBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 // --- MDIA ---
 type MdiaBox struct {
    Header      BoxHeader
    Mdhd        *MdhdBox
+   Hdlr        *HdlrBox
    Minf        *MinfBox
    RawChildren [][]byte
 }
 
 func (b *MdiaBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *MdiaBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
 
-   payload := data[8:b.Header.Size]
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -105,9 +737,15 @@ func (b *MdiaBox) Parse(data []byte) error {
             return err
          }
          b.Mdhd = &mdhd
+      case "hdlr":
+         var hdlr HdlrBox
+         if err := hdlr.Parse(content); err != nil {
+            return err
+         }
+         b.Hdlr = &hdlr
       case "minf":
          var minf MinfBox
-         if err := minf.Parse(content); err != nil {
+         if err := minf.parse(content, opts); err != nil {
             return err
          }
          b.Minf = &minf
@@ -124,17 +762,256 @@ func (b *MdiaBox) Encode() []byte {
    if b.Mdhd != nil {
       buffer = append(buffer, b.Mdhd.Encode()...)
    }
+   if b.Hdlr != nil {
+      buffer = append(buffer, b.Hdlr.Encode()...)
+   }
    if b.Minf != nil {
       buffer = append(buffer, b.Minf.Encode()...)
    }
    for _, child := range b.RawChildren {
       buffer = append(buffer, child...)
    }
-   b.Header.Size = uint32(len(buffer))
+   b.Header.Size = uint64(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *MdiaBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// --- HDLR ---
+type HdlrBox struct {
+   Header      BoxHeader
+   Version     byte
+   Flags       [3]byte
+   HandlerType [4]byte // such as vide, soun, text, subt or sbtl
+   Name        string
+}
+
+func (b *HdlrBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 32 { // 8 header + 4 version/flags + 20 fixed fields
+      return errors.New("hdlr box too short")
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Bytes(4)
+   b.Version = versionAndFlags[0]
+   copy(b.Flags[:], versionAndFlags[1:])
+   _ = p.Uint32() // pre_defined
+   copy(b.HandlerType[:], p.Bytes(4))
+   p.offset += 12 // reserved
+   b.Name = handlerName(data[p.offset:b.Header.Size])
+   return nil
+}
+
+// handlerName decodes the name of hdlr. ISO files store a null-terminated
+// string, while QuickTime files store a counted string that may or may not
+// also be null-terminated.
+func handlerName(name []byte) string {
+   if len(name) > 1 {
+      count := int(name[0])
+      if count == len(name)-1 || count == len(name)-2 && name[len(name)-1] == 0 {
+         return string(name[1 : 1+count])
+      }
+   }
+   return cString(name)
+}
+
+// Encode writes the name null-terminated, even if it was parsed from a
+// QuickTime counted string.
+func (b *HdlrBox) Encode() []byte {
+   size := uint32(32 + len(b.Name) + 1)
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+
+   w.PutUint32(size)
+   w.PutBytes(b.Header.Type[:])
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+   w.PutUint32(0) // pre_defined
+   w.PutBytes(b.HandlerType[:])
+   w.PutBytes(make([]byte, 12)) // reserved
+   w.PutBytes([]byte(b.Name))
+
+   b.Header.Size = uint64(size)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *HdlrBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// --- TKHD ---
+type TkhdBox struct {
+   Header           BoxHeader
+   Version          byte
+   Flags            [3]byte
+   CreationTime     uint64
+   ModificationTime uint64
+   TrackID          uint32
+   Duration         uint64
+   RemainingData    []byte
+}
+
+func (b *TkhdBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *TkhdBox) parse(data []byte, opts *ParseOptions) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 12 {
+      return errors.New("tkhd box too small")
+   }
+
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Bytes(4)
+   b.Version = versionAndFlags[0]
+   copy(b.Flags[:], versionAndFlags[1:])
+
+   if b.Version == 1 {
+      if len(data) < 44 { // 8 header + 4 version/flags + 32 v1 body
+         return errors.New("tkhd v1 too short")
+      }
+      b.CreationTime = p.Uint64()
+      b.ModificationTime = p.Uint64()
+      b.TrackID = p.Uint32()
+      if err := opts.checkReserved(p.Bytes(4)); err != nil {
+         return err
+      }
+      b.Duration = p.Uint64()
+   } else { // Version 0
+      if len(data) < 32 { // 8 header + 4 version/flags + 20 v0 body
+         return errors.New("tkhd v0 too short")
+      }
+      b.CreationTime = uint64(p.Uint32())
+      b.ModificationTime = uint64(p.Uint32())
+      b.TrackID = p.Uint32()
+      if err := opts.checkReserved(p.Bytes(4)); err != nil {
+         return err
+      }
+      b.Duration = uint64(p.Uint32())
+   }
+
+   b.RemainingData = data[p.offset:b.Header.Size]
+   return b.checkReserved(opts)
+}
+
+// checkReserved validates the reserved fields kept in RemainingData in
+// strict mode.
+func (b *TkhdBox) checkReserved(opts *ParseOptions) error {
+   if len(b.RemainingData) < tkhdRemainingSize {
+      return nil
+   }
+   if err := opts.checkReserved(b.RemainingData[0:8]); err != nil {
+      return err
+   }
+   return opts.checkReserved(b.RemainingData[14:16])
+}
+
+// tkhdRemainingSize is the size of the fields after duration, kept in
+// RemainingData: reserved(8), layer(2), alternate_group(2), volume(2),
+// reserved(2), matrix(36), width(4) and height(4).
+const tkhdRemainingSize = 60
+
+// Layer returns the front-to-back ordering of the track, lower in front.
+func (b *TkhdBox) Layer() int16 {
+   if len(b.RemainingData) < tkhdRemainingSize {
+      return 0
+   }
+   return int16(binary.BigEndian.Uint16(b.RemainingData[8:10]))
+}
+
+// AlternateGroup returns the group of tracks this one is an alternative
+// to, or 0 if it has none.
+func (b *TkhdBox) AlternateGroup() int16 {
+   if len(b.RemainingData) < tkhdRemainingSize {
+      return 0
+   }
+   return int16(binary.BigEndian.Uint16(b.RemainingData[10:12]))
+}
+
+// Volume returns the track volume as 8.8 fixed point, 0x0100 for a full
+// volume audio track and 0 otherwise.
+func (b *TkhdBox) Volume() uint16 {
+   if len(b.RemainingData) < tkhdRemainingSize {
+      return 0
+   }
+   return binary.BigEndian.Uint16(b.RemainingData[12:14])
+}
+
+// Width returns the visual presentation width as 16.16 fixed point.
+func (b *TkhdBox) Width() uint32 {
+   if len(b.RemainingData) < tkhdRemainingSize {
+      return 0
+   }
+   return binary.BigEndian.Uint32(b.RemainingData[52:56])
+}
+
+// Height returns the visual presentation height as 16.16 fixed point.
+func (b *TkhdBox) Height() uint32 {
+   if len(b.RemainingData) < tkhdRemainingSize {
+      return 0
+   }
+   return binary.BigEndian.Uint32(b.RemainingData[56:60])
+}
+
+func (b *TkhdBox) Encode() []byte {
+   var bodySize int
+   if b.Version == 1 {
+      bodySize = 36 // 8+8+4+4+8 + 4 for ver/flags
+   } else {
+      bodySize = 24 // 4+4+4+4+4 + 4 for ver/flags
+   }
+   totalSize := uint32(8 + bodySize + len(b.RemainingData))
+   buffer := make([]byte, totalSize)
+
+   w := writer{buf: buffer}
+   w.PutUint32(totalSize)
+   w.PutBytes(b.Header.Type[:])
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+
+   if b.Version == 1 {
+      w.PutUint64(b.CreationTime)
+      w.PutUint64(b.ModificationTime)
+      w.PutUint32(b.TrackID)
+      w.PutUint32(0) // reserved
+      w.PutUint64(b.Duration)
+   } else {
+      w.PutUint32(uint32(b.CreationTime))
+      w.PutUint32(uint32(b.ModificationTime))
+      w.PutUint32(b.TrackID)
+      w.PutUint32(0) // reserved
+      w.PutUint32(uint32(b.Duration))
+   }
+
+   w.PutBytes(b.RemainingData)
+   b.Header.Size = uint64(totalSize)
+   return buffer
+}
+
+// WriteTo writes the encoded box to w.
+func (b *TkhdBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
+// Created returns CreationTime as a time.Time.
+func (b *TkhdBox) Created() time.Time {
+   return mp4Time(b.CreationTime)
+}
+
+// Modified returns ModificationTime as a time.Time.
+func (b *TkhdBox) Modified() time.Time {
+   return mp4Time(b.ModificationTime)
+}
+
 // --- MDHD ---
 type MdhdBox struct {
    Header           BoxHeader
@@ -187,6 +1064,37 @@ func (b *MdhdBox) Parse(data []byte) error {
    return nil
 }
 
+// LanguageCode decodes the packed ISO 639-2/T language, three 5-bit
+// characters offset from 0x60, into a string such as "eng".
+func (b *MdhdBox) LanguageCode() string {
+   return languageCode(b.Language)
+}
+
+// languageCode unpacks an ISO 639-2/T code stored as three 5-bit letters,
+// returning "und" if it is unset.
+func languageCode(language [2]byte) string {
+   packed := binary.BigEndian.Uint16(language[:]) & 0x7FFF
+   if packed == 0 {
+      return "und"
+   }
+   code := []byte{
+      byte(packed>>10&0x1F) + 0x60,
+      byte(packed>>5&0x1F) + 0x60,
+      byte(packed&0x1F) + 0x60,
+   }
+   return string(code)
+}
+
+// Created returns CreationTime as a time.Time.
+func (b *MdhdBox) Created() time.Time {
+   return mp4Time(b.CreationTime)
+}
+
+// Modified returns ModificationTime as a time.Time.
+func (b *MdhdBox) Modified() time.Time {
+   return mp4Time(b.ModificationTime)
+}
+
 func (b *MdhdBox) SetDuration(duration uint64) {
    b.Duration = duration
    if b.Duration > 0xFFFFFFFF {
@@ -224,10 +1132,15 @@ func (b *MdhdBox) Encode() []byte {
    w.PutBytes(b.Language[:])
    w.PutBytes(b.Quality[:])
 
-   b.Header.Size = size
+   b.Header.Size = uint64(size)
    return buffer
 }
 
+// WriteTo writes the encoded box to w.
+func (b *MdhdBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
+
 // --- MINF ---
 type MinfBox struct {
    Header      BoxHeader
@@ -236,15 +1149,19 @@ type MinfBox struct {
 }
 
 func (b *MinfBox) Parse(data []byte) error {
+   return b.parse(data, nil)
+}
+
+func (b *MinfBox) parse(data []byte, opts *ParseOptions) error {
    if err := b.Header.Parse(data); err != nil {
       return err
    }
 
-   payload := data[8:b.Header.Size]
+   payload := data[b.Header.HeaderSize:b.Header.Size]
    offset := 0
    for offset < len(payload) {
       var header BoxHeader
-      if err := header.Parse(payload[offset:]); err != nil {
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
          break
       }
       boxSize := int(header.Size)
@@ -259,7 +1176,7 @@ func (b *MinfBox) Parse(data []byte) error {
       switch string(header.Type[:]) {
       case "stbl":
          var stbl StblBox
-         if err := stbl.Parse(content); err != nil {
+         if err := stbl.parse(content, opts); err != nil {
             return err
          }
          b.Stbl = &stbl
@@ -279,7 +1196,12 @@ func (b *MinfBox) Encode() []byte {
    for _, child := range b.RawChildren {
       buffer = append(buffer, child...)
    }
-   b.Header.Size = uint32(len(buffer))
+   b.Header.Size = uint64(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
+
+// WriteTo writes the encoded box to w.
+func (b *MinfBox) WriteTo(w io.Writer) (int64, error) {
+   return writeEncoded(w, b.Encode())
+}
@@ -0,0 +1,308 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+// buildBox wraps a payload in a box header of the given type.
+func buildBox(boxType string, payload ...[]byte) []byte {
+   buffer := make([]byte, 8)
+   for _, part := range payload {
+      buffer = append(buffer, part...)
+   }
+   binary.BigEndian.PutUint32(buffer, uint32(len(buffer)))
+   copy(buffer[4:8], boxType)
+   return buffer
+}
+
+func TestTrakBox_DisplayName(t *testing.T) {
+   // "eng" packed as three 5-bit characters offset from 0x60
+   mdhd := &MdhdBox{Language: [2]byte{0x15, 0xC7}}
+   trak := TrakBox{Mdia: &MdiaBox{Mdhd: mdhd}}
+   if name := trak.DisplayName(); name != "English" {
+      t.Errorf("expected %q, got %q", "English", name)
+   }
+
+   kind := func(role string) []byte {
+      return buildBox("udta", buildBox("kind", []byte{0, 0, 0, 0}, []byte("urn:mpeg:dash:role:2011\x00"+role+"\x00")))
+   }
+   trak.RawChildren = [][]byte{kind("forced-subtitle")}
+   if name := trak.DisplayName(); name != "English (forced)" {
+      t.Errorf("expected %q, got %q", "English (forced)", name)
+   }
+   elng := buildBox("elng", []byte{0, 0, 0, 0}, []byte("pt-BR\x00"))
+   trak.Mdia.RawChildren = append(trak.Mdia.RawChildren, elng)
+   if name := trak.DisplayName(); name != "Portuguese (BR, forced)" {
+      t.Errorf("expected %q, got %q", "Portuguese (BR, forced)", name)
+   }
+   trak.RawChildren = [][]byte{kind("main")}
+   if name := trak.DisplayName(); name != "Portuguese (BR)" {
+      t.Errorf("expected %q, got %q", "Portuguese (BR)", name)
+   }
+
+   // without a kind the role comes from tref
+   tref := buildBox("tref", buildBox("subt", []byte{0, 0, 0, 1}))
+   trak = TrakBox{Mdia: &MdiaBox{Mdhd: mdhd}, RawChildren: [][]byte{tref}}
+   if types := trak.ReferenceTypes(); len(types) != 1 || types[0] != "subt" {
+      t.Errorf("unexpected reference types %q", types)
+   }
+   if name := trak.DisplayName(); name != "English (subtitles)" {
+      t.Errorf("expected %q, got %q", "English (subtitles)", name)
+   }
+
+   var empty TrakBox
+   if name := empty.DisplayName(); name != "Unknown" {
+      t.Errorf("expected %q, got %q", "Unknown", name)
+   }
+   unnamed := TrakBox{Mdia: &MdiaBox{RawChildren: [][]byte{buildBox("elng", []byte{0, 0, 0, 0}, []byte("tlh-Latn\x00"))}}}
+   if name := unnamed.DisplayName(); name != "tlh-Latn" {
+      t.Errorf("expected %q, got %q", "tlh-Latn", name)
+   }
+}
+
+func TestMdhdBox_Parse(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   moov, _ := FindMoov(boxes)
+   trak := moov.Trak[0]
+   if trak.MediaTimescale() != 90000 || trak.Mdia.Mdhd.LanguageCode() != "eng" {
+      t.Errorf("unexpected mdhd %+v", trak.Mdia.Mdhd)
+   }
+
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   // "fra" packed as three 5-bit characters
+   data := buildBox("mdhd", []byte{1, 0, 0, 0}, u64(1), u64(2), u32(48000), u64(1<<36), []byte{0x1A, 0x41, 0, 0})
+   var mdhd MdhdBox
+   if err := mdhd.Parse(data); err != nil {
+      t.Fatalf("mdhd v1 Parse failed: %v", err)
+   }
+   if mdhd.Timescale != 48000 || mdhd.Duration != 1<<36 || mdhd.LanguageCode() != "fra" {
+      t.Errorf("mdhd v1: unexpected %+v (%q)", mdhd, mdhd.LanguageCode())
+   }
+   if !bytes.Equal(mdhd.Encode(), data) {
+      t.Error("mdhd v1 does not round-trip")
+   }
+}
+
+func TestHdlrBox_Parse(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   moov, _ := FindMoov(boxes)
+   hdlr := moov.Trak[0].Mdia.Hdlr
+   if hdlr == nil || string(hdlr.HandlerType[:]) != "vide" || hdlr.Name != "VideoHandler" {
+      t.Fatalf("unexpected hdlr %+v", hdlr)
+   }
+   if moov.Trak[0].HandlerType() != "vide" {
+      t.Errorf("expected handler type vide, got %q", moov.Trak[0].HandlerType())
+   }
+   if !bytes.Equal(hdlr.Encode(), buildBox("hdlr", make([]byte, 8), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))) {
+      t.Error("hdlr does not round-trip")
+   }
+
+   for _, name := range [][]byte{
+      []byte("\x0cSoundHandler"),     // QuickTime counted string
+      []byte("\x0cSoundHandler\x00"), // counted and null-terminated
+      []byte("SoundHandler\x00\x00"), // null-terminated with padding
+   } {
+      data := buildBox("hdlr", make([]byte, 8), []byte("soun"), make([]byte, 12), name)
+      var box HdlrBox
+      if err := box.Parse(data); err != nil {
+         t.Fatalf("Parse failed: %v", err)
+      }
+      if box.Name != "SoundHandler" {
+         t.Errorf("%q: expected name %q, got %q", name, "SoundHandler", box.Name)
+      }
+   }
+}
+
+func TestTkhdBox_Parse(t *testing.T) {
+   boxes, err := Parse(buildInitSegment(false))
+   if err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   moov, _ := FindMoov(boxes)
+   tkhd := moov.Trak[0].Tkhd
+   if tkhd == nil || tkhd.TrackID != 1 || tkhd.Width() != 1280<<16 || tkhd.Height() != 720<<16 {
+      t.Fatalf("unexpected tkhd %+v", tkhd)
+   }
+
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   // layer -1, alternate_group 1, full volume
+   rest := append(make([]byte, 8), 0xFF, 0xFF, 0, 1, 1, 0, 0, 0)
+   rest = append(append(rest, make([]byte, 36)...), make([]byte, 8)...)
+   data := buildBox("tkhd", []byte{1, 0, 0, 1}, u64(1), u64(2), u32(3), u32(0), u64(1<<40), rest)
+   trak := buildBox("trak", data)
+   var box TrakBox
+   if err := box.Parse(trak); err != nil {
+      t.Fatalf("trak Parse failed: %v", err)
+   }
+   tkhd = box.Tkhd
+   if box.TrackID() != 3 || tkhd.Duration != 1<<40 || len(box.RawChildren) != 0 {
+      t.Errorf("tkhd v1: unexpected %+v", tkhd)
+   }
+   if tkhd.Layer() != -1 || tkhd.AlternateGroup() != 1 || tkhd.Volume() != 0x0100 {
+      t.Errorf("tkhd v1: unexpected layer %d group %d volume %x", tkhd.Layer(), tkhd.AlternateGroup(), tkhd.Volume())
+   }
+   if encoded := box.Encode(); !bytes.Equal(encoded, trak) {
+      t.Errorf("trak does not round-trip\n  Expected: %x\n  Got:      %x", trak, encoded)
+   }
+
+   strict := &ParseOptions{Strict: true}
+   if err := new(TrakBox).parse(trak, strict); err != nil {
+      t.Errorf("strict Parse failed: %v", err)
+   }
+   // the reserved word after track_ID, then the one after volume
+   for _, offset := range []int{32, 58} {
+      corrupt := bytes.Clone(data)
+      corrupt[offset] = 1
+      if err := new(TkhdBox).Parse(corrupt); err != nil {
+         t.Errorf("offset %d: lenient Parse failed: %v", offset, err)
+      }
+      if err := new(TrakBox).parse(buildBox("trak", corrupt), strict); err != ErrNonZeroReserved {
+         t.Errorf("offset %d: expected ErrNonZeroReserved, got %v", offset, err)
+      }
+   }
+}
+
+func TestElstBox_Parse(t *testing.T) {
+   u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+   u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+   rate := []byte{0, 1, 0, 0}
+   // an empty edit of 100 then the media from time 2000
+   elst := buildBox("elst", []byte{0, 0, 0, 0}, u32(2), u32(100), u32(0xFFFFFFFF), rate, u32(5000), u32(2000), rate)
+   tkhd := buildBox("tkhd", []byte{0, 0, 0, 3}, u32(0), u32(0), u32(1), u32(0), u32(0), make([]byte, 60))
+   trak := buildBox("trak", tkhd, buildBox("edts", elst))
+   var box TrakBox
+   if err := box.Parse(trak); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if box.Edts == nil || box.Edts.Elst == nil || len(box.Edts.Elst.Entries) != 2 {
+      t.Fatal("expected an edit list of 2 entries")
+   }
+   entries := box.Edts.Elst.Entries
+   if !entries[0].IsEmpty() || entries[0].SegmentDuration != 100 || entries[0].MediaRateInteger != 1 {
+      t.Errorf("unexpected empty edit %+v", entries[0])
+   }
+   if entries[1].IsEmpty() || entries[1].MediaTime != 2000 || entries[1].SegmentDuration != 5000 {
+      t.Errorf("unexpected edit %+v", entries[1])
+   }
+   if encoded := box.Encode(); !bytes.Equal(encoded, trak) {
+      t.Errorf("trak does not round-trip\n  Expected: %x\n  Got:      %x", trak, encoded)
+   }
+   box.RemoveEdts()
+   if box.Edts != nil || len(box.Encode()) != 8+len(tkhd) {
+      t.Error("RemoveEdts should drop the edit list")
+   }
+
+   elst = buildBox("elst", []byte{1, 0, 0, 0}, u32(1), u64(1<<33), u64(0xFFFFFFFFFFFFFFFF), rate)
+   var v1 ElstBox
+   if err := v1.Parse(elst); err != nil {
+      t.Fatalf("elst v1 Parse failed: %v", err)
+   }
+   if len(v1.Entries) != 1 || !v1.Entries[0].IsEmpty() || v1.Entries[0].SegmentDuration != 1<<33 {
+      t.Errorf("elst v1: unexpected %+v", v1.Entries)
+   }
+   if !bytes.Equal(v1.Encode(), elst) {
+      t.Error("elst v1 does not round-trip")
+   }
+   if err := new(ElstBox).Parse(buildBox("elst", []byte{0, 0, 0, 0}, u32(3), u32(1))); err == nil {
+      t.Error("expected error for truncated entries")
+   }
+}
+
+func TestStsdBox_EntryTypes(t *testing.T) {
+   entry := make([]byte, 78)
+   stsd := buildBox("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 2},
+      buildBox("encv", entry),
+      buildBox("avc1", entry),
+   )
+   var box StsdBox
+   if err := box.Parse(stsd); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if count := box.EntryCount(); count != 2 {
+      t.Errorf("expected entry count 2, got %d", count)
+   }
+   types := box.EntryTypes()
+   if len(types) != 2 || string(types[0][:]) != "encv" || string(types[1][:]) != "avc1" {
+      t.Errorf("unexpected entry types %q", types)
+   }
+}
+
+func TestStsdBox_Entries(t *testing.T) {
+   encv, ok := FindFirstBoxByType(buildInitSegment(true), "encv")
+   if !ok {
+      t.Fatal("encv not found")
+   }
+   audio := make([]byte, 28)
+   binary.BigEndian.PutUint16(audio[6:], 1)  // data_reference_index
+   binary.BigEndian.PutUint16(audio[16:], 2) // channelcount
+   binary.BigEndian.PutUint16(audio[18:], 16)
+   binary.BigEndian.PutUint32(audio[24:], 48000<<16)
+   stsd := buildBox("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 3},
+      encv, buildBox("mp4a", audio), buildBox("wvtt", make([]byte, 8)))
+   var box StsdBox
+   if err := box.Parse(stsd); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   if len(box.Entries) != 3 {
+      t.Fatalf("expected 3 entries, got %d", len(box.Entries))
+   }
+   video := box.Entries[0].Visual
+   if video == nil || video.Width != 1280 || video.Height != 720 || video.DataReferenceIndex != 1 {
+      t.Fatalf("unexpected visual entry %+v", video)
+   }
+   if format := box.Entries[0].Format(); video.Sinf == nil || string(format[:]) != "avc1" {
+      t.Error("expected the encv entry to carry its sinf")
+   }
+   if video.AvcC == nil || len(video.RawChildren) != 0 {
+      t.Errorf("expected a parsed avcC and no raw children, got %d", len(video.RawChildren))
+   }
+   sound := box.Entries[1].Audio
+   if sound == nil || sound.ChannelCount != 2 || sound.SampleSize != 16 || sound.Rate() != 48000 {
+      t.Errorf("unexpected audio entry %+v", sound)
+   }
+   if entry := box.Entries[2]; entry.Visual != nil || entry.Audio != nil || string(entry.Type[:]) != "wvtt" {
+      t.Errorf("expected a raw wvtt entry, got %+v", entry)
+   }
+
+   sinf, header, ok := box.Sinf()
+   if !ok || sinf != video.Sinf || header != &video.Header {
+      t.Error("Sinf should delegate to the encv entry")
+   }
+   if err := box.UnprotectAll(); err != nil {
+      t.Fatal(err)
+   }
+   if _, _, ok = box.Sinf(); ok || string(box.Entries[0].Type[:]) != "avc1" {
+      t.Error("UnprotectAll should clear the sinf of the parsed entry")
+   }
+}
+
+func TestTrakBox_CodecStringEncryptedAudio(t *testing.T) {
+   // ES_Descriptor > DecoderConfigDescriptor (AAC) > DecoderSpecificInfo
+   // holding an AAC-LC AudioSpecificConfig
+   decoderConfig := append([]byte{0x40, 0x15}, make([]byte, 11)...)
+   decoderConfig = append(decoderConfig, 0x05, 2, 0x12, 0x10)
+   esDescriptor := append([]byte{0, 1, 0, 0x04, byte(len(decoderConfig))}, decoderConfig...)
+   esds := buildBox("esds", []byte{0, 0, 0, 0}, []byte{0x03, byte(len(esDescriptor))}, esDescriptor)
+   sinf := buildBox("sinf", buildBox("frma", []byte("mp4a")))
+   stsd := buildBox("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1},
+      buildBox("enca", make([]byte, 28), esds, sinf),
+   )
+   var stsdBox StsdBox
+   if err := stsdBox.Parse(stsd); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   trak := TrakBox{Mdia: &MdiaBox{Minf: &MinfBox{Stbl: &StblBox{Stsd: &stsdBox}}}}
+   if codec := trak.CodecString(); codec != "mp4a.40.2" {
+      t.Errorf("expected %q, got %q", "mp4a.40.2", codec)
+   }
+}
@@ -0,0 +1,189 @@
+package sofia
+
+import "errors"
+
+// --- WVTT (WebVTT Sample Entry) ---
+type WvttBox struct {
+   Header      BoxHeader
+   EntryHeader []byte // reserved(6) + data_reference_index(2)
+   VttC        *VttCBox
+   Vlab        *VlabBox
+   RawChildren [][]byte
+}
+
+func (b *WvttBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   if len(data) < 16 {
+      return errors.New("wvtt box too short")
+   }
+   b.EntryHeader = data[8:16]
+
+   payload := data[b.Header.HeaderSize+8:b.Header.Size]
+   offset := 0
+   for offset < len(payload) {
+      var header BoxHeader
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
+         break
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(payload) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(payload) {
+         return errors.New("invalid child box size")
+      }
+
+      content := payload[offset : offset+boxSize]
+      switch string(header.Type[:]) {
+      case "vttC":
+         var vttC VttCBox
+         if err := vttC.Parse(content); err != nil {
+            return err
+         }
+         b.VttC = &vttC
+      case "vlab":
+         var vlab VlabBox
+         if err := vlab.Parse(content); err != nil {
+            return err
+         }
+         b.Vlab = &vlab
+      default:
+         b.RawChildren = append(b.RawChildren, content)
+      }
+      offset += boxSize
+   }
+   return nil
+}
+
+// Wvtt returns the first WebVTT sample entry of the sample description.
+func (b *StsdBox) Wvtt() (*WvttBox, bool) {
+   entry, ok := findChild(b.RawChildren, "wvtt")
+   if !ok {
+      return nil, false
+   }
+   var wvtt WvttBox
+   if err := wvtt.Parse(entry); err != nil {
+      return nil, false
+   }
+   return &wvtt, true
+}
+
+// --- VTTC (WebVTT Configuration) ---
+type VttCBox struct {
+   Header BoxHeader
+   Config string // the WebVTT file header, e.g. "WEBVTT"
+}
+
+func (b *VttCBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   b.Config = string(data[b.Header.HeaderSize:b.Header.Size])
+   return nil
+}
+
+// --- VLAB (WebVTT Source Label) ---
+type VlabBox struct {
+   Header BoxHeader
+   Label  string
+}
+
+func (b *VlabBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+   b.Label = string(data[b.Header.HeaderSize:b.Header.Size])
+   return nil
+}
+
+// --- VTTC (WebVTT Cue) ---
+
+// VttcBox is a cue carried in a WebVTT sample. The strings are empty when
+// the corresponding child box is absent.
+type VttcBox struct {
+   Header      BoxHeader
+   SourceID    uint32 // Present if HasSourceID
+   HasSourceID bool
+   CurrentTime string // ctim
+   CueID       string // iden
+   Settings    string // sttg
+   Payload     string // payl, the cue text
+   RawChildren [][]byte
+}
+
+func (b *VttcBox) Parse(data []byte) error {
+   if err := b.Header.Parse(data); err != nil {
+      return err
+   }
+
+   payload := data[b.Header.HeaderSize:b.Header.Size]
+   offset := 0
+   for offset < len(payload) {
+      var header BoxHeader
+      if err := header.Parse(payload[offset:]); err != nil && err != ErrSizeMismatch {
+         break
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(payload) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(payload) {
+         return errors.New("invalid child box size")
+      }
+
+      content := payload[offset : offset+boxSize]
+      text := string(content[8:])
+      switch string(header.Type[:]) {
+      case "vsid":
+         if len(content) < 12 {
+            return errors.New("vsid box too short")
+         }
+         p := parser{data: content, offset: 8}
+         b.SourceID = p.Uint32()
+         b.HasSourceID = true
+      case "ctim":
+         b.CurrentTime = text
+      case "iden":
+         b.CueID = text
+      case "sttg":
+         b.Settings = text
+      case "payl":
+         b.Payload = text
+      default:
+         b.RawChildren = append(b.RawChildren, content)
+      }
+      offset += boxSize
+   }
+   return nil
+}
+
+// ParseWebVTTSample returns the cues of a WebVTT sample. A sample holding
+// only an empty cue box ('vtte') yields no cues.
+func ParseWebVTTSample(sample []byte) ([]VttcBox, error) {
+   var cues []VttcBox
+   offset := 0
+   for offset < len(sample) {
+      var header BoxHeader
+      if err := header.Parse(sample[offset:]); err != nil {
+         return nil, err
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(sample) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(sample) {
+         return nil, errors.New("invalid child box size")
+      }
+      if string(header.Type[:]) == "vttc" {
+         var cue VttcBox
+         if err := cue.Parse(sample[offset : offset+boxSize]); err != nil {
+            return nil, err
+         }
+         cues = append(cues, cue)
+      }
+      offset += boxSize
+   }
+   return cues, nil
+}
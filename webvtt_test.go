@@ -0,0 +1,56 @@
+package sofia
+
+import "testing"
+
+func TestParseWebVTTSample(t *testing.T) {
+   sample := append(
+      buildBox("vttc",
+         buildBox("iden", []byte("intro")),
+         buildBox("sttg", []byte("line:0 align:start")),
+         buildBox("payl", []byte("Hello,\nworld")),
+      ),
+      buildBox("vttc",
+         buildBox("vsid", []byte{0, 0, 0, 7}),
+         buildBox("payl", []byte("<i>Second cue</i>")),
+      )...,
+   )
+   cues, err := ParseWebVTTSample(sample)
+   if err != nil {
+      t.Fatalf("ParseWebVTTSample failed: %v", err)
+   }
+   if len(cues) != 2 {
+      t.Fatalf("expected 2 cues, got %d", len(cues))
+   }
+   if cues[0].CueID != "intro" || cues[0].Settings != "line:0 align:start" || cues[0].Payload != "Hello,\nworld" {
+      t.Errorf("unexpected first cue: %+v", cues[0])
+   }
+   if !cues[1].HasSourceID || cues[1].SourceID != 7 || cues[1].Payload != "<i>Second cue</i>" {
+      t.Errorf("unexpected second cue: %+v", cues[1])
+   }
+
+   cues, err = ParseWebVTTSample(buildBox("vtte"))
+   if err != nil || len(cues) != 0 {
+      t.Errorf("expected no cues for empty sample, got %v %v", cues, err)
+   }
+}
+
+func TestStsdBox_Wvtt(t *testing.T) {
+   wvtt := buildBox("wvtt", []byte{0, 0, 0, 0, 0, 0, 0, 1},
+      buildBox("vttC", []byte("WEBVTT")),
+      buildBox("vlab", []byte("source")),
+   )
+   var stsd StsdBox
+   if err := stsd.Parse(buildBox("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, wvtt)); err != nil {
+      t.Fatalf("Parse failed: %v", err)
+   }
+   entry, ok := stsd.Wvtt()
+   if !ok {
+      t.Fatal("'wvtt' sample entry not found")
+   }
+   if entry.VttC == nil || entry.VttC.Config != "WEBVTT" {
+      t.Errorf("unexpected vttC: %+v", entry.VttC)
+   }
+   if entry.Vlab == nil || entry.Vlab.Label != "source" {
+      t.Errorf("unexpected vlab: %+v", entry.Vlab)
+   }
+}
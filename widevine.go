@@ -0,0 +1,105 @@
+package sofia
+
+import (
+   "encoding/binary"
+   "errors"
+   "strconv"
+)
+
+// --- WIDEVINE PSSH DATA ---
+
+// WidevineSystemID is the pssh system ID of Widevine,
+// edef8ba9-79d6-4ace-a3c8-27dcd51d21ed.
+var WidevineSystemID = [16]byte{
+   0xed, 0xef, 0x8b, 0xa9, 0x79, 0xd6, 0x4a, 0xce,
+   0xa3, 0xc8, 0x27, 0xdc, 0xd5, 0x1d, 0x21, 0xed,
+}
+
+// WidevinePsshData is the data of a Widevine pssh box, a WidevinePsshData
+// protobuf message. Fields the package does not know are skipped.
+type WidevinePsshData struct {
+   KeyIDs           [][]byte // field 2
+   Provider         string   // field 3
+   ContentID        []byte   // field 4
+   ProtectionScheme [4]byte  // field 9, such as cenc or cbcs
+}
+
+// ParseWidevinePssh decodes the protobuf data of a Widevine pssh box.
+func ParseWidevinePssh(data []byte) (*WidevinePsshData, error) {
+   var message WidevinePsshData
+   for len(data) > 0 {
+      key, n := binary.Uvarint(data)
+      if n <= 0 {
+         return nil, errors.New("widevine pssh data truncated while reading field key")
+      }
+      data = data[n:]
+      field, wireType := key>>3, key&7
+      var value []byte
+      var number uint64
+      switch wireType {
+      case 0: // varint
+         number, n = binary.Uvarint(data)
+         if n <= 0 {
+            return nil, errors.New("widevine pssh data truncated while reading varint")
+         }
+         data = data[n:]
+      case 1: // 64-bit
+         if len(data) < 8 {
+            return nil, errors.New("widevine pssh data truncated while reading fixed64")
+         }
+         data = data[8:]
+      case 2: // length-delimited
+         length, n := binary.Uvarint(data)
+         if n <= 0 || length > uint64(len(data)-n) {
+            return nil, errors.New("widevine pssh data truncated while reading field " + strconv.FormatUint(field, 10))
+         }
+         value = data[n : n+int(length)]
+         data = data[n+int(length):]
+      case 5: // 32-bit
+         if len(data) < 4 {
+            return nil, errors.New("widevine pssh data truncated while reading fixed32")
+         }
+         data = data[4:]
+      default:
+         return nil, errors.New("widevine pssh data has unknown wire type " + strconv.FormatUint(wireType, 10))
+      }
+      switch {
+      case field == 2 && wireType == 2:
+         message.KeyIDs = append(message.KeyIDs, value)
+      case field == 3 && wireType == 2:
+         message.Provider = string(value)
+      case field == 4 && wireType == 2:
+         message.ContentID = value
+      case field == 9 && wireType == 0:
+         binary.BigEndian.PutUint32(message.ProtectionScheme[:], uint32(number))
+      }
+   }
+   return &message, nil
+}
+
+// WidevineData decodes the data of a Widevine pssh box. It returns an
+// error for any other system ID.
+func (b *PsshBox) WidevineData() (*WidevinePsshData, error) {
+   if b.SystemID != WidevineSystemID {
+      return nil, errors.New("pssh system ID is not Widevine")
+   }
+   return ParseWidevinePssh(b.Data)
+}
+
+// WidevineKIDs returns the 16-byte key IDs of a Widevine pssh box, to be
+// matched against tenc.DefaultKID. It returns an error for any other system
+// ID or for key IDs of another length.
+func (b *PsshBox) WidevineKIDs() ([][16]byte, error) {
+   message, err := b.WidevineData()
+   if err != nil {
+      return nil, err
+   }
+   kids := make([][16]byte, 0, len(message.KeyIDs))
+   for _, id := range message.KeyIDs {
+      if len(id) != 16 {
+         return nil, errors.New("widevine key ID is not 16 bytes")
+      }
+      kids = append(kids, [16]byte(id))
+   }
+   return kids, nil
+}
@@ -0,0 +1,53 @@
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+func TestParseWidevinePssh(t *testing.T) {
+   other := [16]byte{0x10, 0x77, 0xef, 0xec, 0xc0, 0xb2, 0x4d, 0x02, 0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b}
+   data := []byte{0x08, 0x01} // algorithm AESCTR
+   data = append(append(data, 0x12, 16), testKID[:]...)
+   data = append(append(data, 0x12, 16), other[:]...)
+   data = append(append(data, 0x1a, 7), "example"...)
+   data = append(append(data, 0x22, 4), "abcd"...)
+   data = append(data, 0x3d, 1, 2, 3, 4) // unknown fixed32 field 7
+   data = binary.AppendUvarint(append(data, 0x48), 0x63626373)
+
+   message, err := ParseWidevinePssh(data)
+   if err != nil {
+      t.Fatalf("ParseWidevinePssh failed: %v", err)
+   }
+   if len(message.KeyIDs) != 2 || !bytes.Equal(message.KeyIDs[0], testKID[:]) || !bytes.Equal(message.KeyIDs[1], other[:]) {
+      t.Errorf("unexpected key IDs %x", message.KeyIDs)
+   }
+   if message.Provider != "example" || string(message.ContentID) != "abcd" || string(message.ProtectionScheme[:]) != "cbcs" {
+      t.Errorf("unexpected message %+v", message)
+   }
+
+   pssh := &PsshBox{SystemID: WidevineSystemID, Data: data}
+   kids, err := pssh.WidevineKIDs()
+   if err != nil {
+      t.Fatalf("WidevineKIDs failed: %v", err)
+   }
+   if len(kids) != 2 || kids[0] != testKID || kids[1] != other {
+      t.Errorf("unexpected KIDs %x", kids)
+   }
+   pssh.SystemID[0] ^= 0xFF
+   if _, err := pssh.WidevineKIDs(); err == nil {
+      t.Error("expected error for a non-Widevine system ID")
+   }
+
+   for _, bad := range [][]byte{
+      {0x12, 16, 1, 2},       // key ID past the end
+      {0x08},                 // missing varint
+      {0x0b},                 // group wire type
+      {0x12, 0xFF, 0xFF, 0x7F}, // huge length
+   } {
+      if _, err := ParseWidevinePssh(bad); err == nil {
+         t.Errorf("%x: expected error", bad)
+      }
+   }
+}